@@ -14,256 +14,484 @@
 -v - "invert" (вместо совпадения, исключать)
 -F - "fixed", точное совпадение со строкой, не паттерн
 -n - "line num", напечатать номер строки
+
+Дополнительно:
+-o - печатать только совпавшие части строк
+-b - печатать смещение строки (с -o - совпадения) в байтах от начала файла
+-H / -h - печатать / не печатать имя файла перед строкой (по умолчанию печатается, если файлов несколько)
+--json - по объекту JSON на строку для каждого совпадения: файл, номер строки, колонки и подгруппы
+Группы строк с контекстом, идущие не подряд, разделяются строкой "--".
+
+Использование: grep [ключи] шаблон [файл...], без файлов читается стандартный ввод
 */
 
 package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"regexp"
-	"sort"
+	"strings"
 )
 
 // keys - структура флагов программы
 type keys struct {
-	after      int
-	before     int
-	context    int
-	count      bool
-	ignoreCase bool
-	invert     bool
-	fixed      bool
-	lineNum    bool
-	rExp       string
+	after        int
+	before       int
+	context      int
+	count        bool
+	ignoreCase   bool
+	invert       bool
+	fixed        bool
+	lineNum      bool
+	onlyMatching bool
+	byteOffset   bool
+	withFilename bool
+	noFilename   bool
+	json         bool
+	rExp         string
+}
+
+// line - строка входных данных
+type line struct {
+	// num - номер строки, начиная с 1
+	num int
+	// offset - смещение начала строки в байтах от начала файла
+	offset int
+	text   string
 }
 
-// readData - функция чтениия файла в срез строк
-func readData(nameOfFile string) []string {
-	var data []string
+// resultLine - строка результата: совпавшая строка или строка контекста
+type resultLine struct {
+	line
+	match bool
+	// matches - совпадения в строке в виде regexp.FindAllStringSubmatchIndex, для -v пусто
+	matches [][]int
+}
+
+// result - результат grep по одному файлу
+type result struct {
+	file  string
+	lines []resultLine
+	// count - число совпавших строк без строк контекста
+	count int
+}
 
-	file, err := os.Open(nameOfFile)
-	defer func(file *os.File) {
-		err := file.Close()
+// stdinName - имя стандартного ввода в выводе
+const stdinName = "(standard input)"
+
+// readData - функция чтения файла в срез строк, "-" - стандартный ввод stdin.
+// Строки сохраняют смещения в байтах, поэтому считываются вместе с переводами строк
+func readData(nameOfFile string, stdin io.Reader) ([]line, error) {
+	in := stdin
+	if nameOfFile != "-" {
+		file, err := os.Open(nameOfFile)
 		if err != nil {
-			log.Fatal("Не могу закрыть файл")
+			return nil, fmt.Errorf("не могу открыть файл %s: %w", nameOfFile, err)
 		}
-	}(file)
+		defer file.Close()
+		in = file
+	}
 
-	if err != nil {
-		log.Fatal("Не могу открыть файл ", nameOfFile)
+	var data []line
+	rd := bufio.NewReader(in)
+	offset := 0
+	for {
+		str, err := rd.ReadString('\n')
+		if str != "" {
+			text := strings.TrimSuffix(strings.TrimSuffix(str, "\n"), "\r")
+			data = append(data, line{num: len(data) + 1, offset: offset, text: text})
+			offset += len(str)
+		}
+		if errors.Is(err, io.EOF) {
+			return data, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("не могу прочитать файл %s: %w", nameOfFile, err)
+		}
 	}
+}
+
+// compile собирает регулярное выражение из шаблона и флагов
+func compile(f keys) (*regexp.Regexp, error) {
+	var (
+		prefix  string
+		postfix string
+	)
 
-	sc := bufio.NewScanner(file)
-	for sc.Scan() {
-		data = append(data, sc.Text())
+	if f.ignoreCase {
+		prefix = "(?i)"
 	}
 
-	return data
+	pattern := f.rExp
+	if f.fixed {
+		pattern = regexp.QuoteMeta(pattern)
+		prefix += "^"
+		postfix += "$"
+	}
+
+	rExp, err := regexp.Compile(prefix + pattern + postfix)
+	if err != nil {
+		return nil, fmt.Errorf("неверное регулярное выражение: %w", err)
+	}
+	return rExp, nil
+}
+
+// contextSize возвращает число строк контекста до и после совпадения: -C задает оба, -A и -B - каждое отдельно
+func contextSize(f keys) (int, int) {
+	return max(f.before, f.context), max(f.after, f.context)
 }
 
-// showResult функция печатает результат вывода grep на экран
-func showResult(res interface{}) {
-	switch result := res.(type) {
-	case []string:
-		for _, str := range result {
-			fmt.Println(str)
+// Решает поставленную задачу: отбирает совпавшие строки и строки контекста вокруг них
+func grep(data []line, f keys) (result, error) {
+	rExp, err := compile(f)
+	if err != nil {
+		return result{}, err
+	}
+	before, after := contextSize(f)
+
+	var res result
+	// last - индекс последней строки, попавшей в результат
+	last := -1
+	// tail - сколько строк контекста после совпадения еще нужно вывести
+	tail := 0
+	for ind, l := range data {
+		var matches [][]int
+		if !f.invert {
+			matches = rExp.FindAllStringSubmatchIndex(l.text, -1)
+		}
+		selected := len(matches) > 0
+		if f.invert {
+			selected = !rExp.MatchString(l.text)
+		}
+
+		if !selected {
+			if tail > 0 {
+				res.lines = append(res.lines, resultLine{line: l})
+				last = ind
+				tail--
+			}
+			continue
 		}
-	case []int:
-		for _, num := range result {
-			fmt.Println(num)
+
+		for k := max(last+1, ind-before); k < ind; k++ {
+			res.lines = append(res.lines, resultLine{line: data[k]})
 		}
-	case int:
-		fmt.Println(result)
+		res.lines = append(res.lines, resultLine{line: l, match: true, matches: matches})
+		res.count++
+		last = ind
+		tail = after
 	}
+
+	return res, nil
 }
 
-// copyToMapByInterval - функция копирует из слайса в мапу данные из заданного интервала в слайсе
-func copyToMapByInterval(m map[int]string, data []string, first int, last int) {
-	for k := first; k < last; k++ {
-		m[k] = data[k]
-	}
+// printer - формат вывода результатов grep
+type printer interface {
+	// print выводит результат по одному файлу
+	print(res result) error
 }
 
-// sortMapKeys - функция возвращает слайс чисел (отсортированных ключей мапы)
-func sortMapKeys(m map[int]string) []int {
-	keys := make([]int, 0, 1)
-	for k := range m {
-		keys = append(keys, k)
+// newPrinter выбирает формат вывода по флагам. files - число входных файлов:
+// имя файла по умолчанию печатается, если их несколько
+func newPrinter(w io.Writer, f keys, files int) printer {
+	withFilename := (files > 1 || f.withFilename) && !f.noFilename
+	before, after := contextSize(f)
+	switch {
+	case f.count:
+		return &countPrinter{w: w, withFilename: withFilename}
+	case f.json:
+		// Для разбора скриптами имя файла в JSON есть всегда, кроме -h
+		return &jsonPrinter{enc: json.NewEncoder(w), withFilename: !f.noFilename, withContext: before+after > 0}
+	default:
+		return &textPrinter{w: w, f: f, withFilename: withFilename, separate: before+after > 0}
 	}
-	sort.Ints(keys)
-	return keys
 }
 
-// GenerateTheResult - функция, на основе промежуточной мапы и ее отсортированных ключей, формирует результат
-func GenerateTheResult(m map[int]string, keys []int) []string {
-	res := make([]string, 0, len(m))
-	for _, key := range keys {
-		res = append(res, m[key])
+// countPrinter печатает число совпавших строк в каждом файле
+type countPrinter struct {
+	w            io.Writer
+	withFilename bool
+}
+
+func (p *countPrinter) print(res result) error {
+	if p.withFilename {
+		_, err := fmt.Fprintf(p.w, "%s:%d\n", res.file, res.count)
+		return err
 	}
+	_, err := fmt.Fprintln(p.w, res.count)
+	return err
+}
 
-	return res
+// textPrinter печатает строки как grep: перед текстом имя файла, номер строки и смещение,
+// отделенные ":" у совпавших строк и "-" у строк контекста
+type textPrinter struct {
+	w            io.Writer
+	f            keys
+	withFilename bool
+	// separate - печатать "--" между группами строк, идущими не подряд. С -o строки контекста
+	// не печатаются, но группы разделяются так же
+	separate bool
+	// printed - напечатана ли хотя бы одна строка: разделитель ставится только между группами
+	printed bool
 }
 
-// keyB для реализации ключа -B
-func keyB(rExp *regexp.Regexp, f keys, data []string) map[int]string {
-	mapBuf := make(map[int]string)
-	for ind, str := range data {
-		if rExp.MatchString(str) && !f.invert || !rExp.MatchString(str) && f.invert {
-			mapBuf[ind] = str
-			if ind-f.before >= 0 {
-				copyToMapByInterval(mapBuf, data, ind-f.before, ind)
-			} else {
-				copyToMapByInterval(mapBuf, data, 0, ind)
-			}
+// prefix формирует начало строки вывода, offset - смещение строки или совпадения
+func (p *textPrinter) prefix(file string, num, offset int, sep string) string {
+	var b strings.Builder
+	if p.withFilename {
+		b.WriteString(file + sep)
+	}
+	if p.f.lineNum {
+		fmt.Fprintf(&b, "%d%s", num, sep)
+	}
+	if p.f.byteOffset {
+		fmt.Fprintf(&b, "%d%s", offset, sep)
+	}
+	return b.String()
+}
+
+// format возвращает строки вывода для строки результата: саму строку или, с -o, ее непустые совпадения
+func (p *textPrinter) format(file string, l resultLine) []string {
+	sep := "-"
+	if l.match {
+		sep = ":"
+	}
+	if !p.f.onlyMatching {
+		return []string{p.prefix(file, l.num, l.offset, sep) + l.text}
+	}
+	var out []string
+	for _, m := range l.matches {
+		// Пустые совпадения, например шаблона "x*", не печатаются
+		if m[0] != m[1] {
+			out = append(out, p.prefix(file, l.num, l.offset+m[0], sep)+l.text[m[0]:m[1]])
 		}
 	}
-	return mapBuf
+	return out
 }
 
-// keyA для реализации ключа -A
-func keyA(rExp *regexp.Regexp, f keys, data []string) map[int]string {
-	mapBuf := make(map[int]string)
-	for ind, str := range data {
-		if rExp.MatchString(str) && !f.invert || !rExp.MatchString(str) && f.invert {
-			mapBuf[ind] = str
-			if ind+f.after < len(data) {
-				copyToMapByInterval(mapBuf, data, ind+1, ind+f.after+1)
-			} else {
-				copyToMapByInterval(mapBuf, data, ind+1, len(data))
+func (p *textPrinter) print(res result) error {
+	// gap - перед строкой есть пропуск. Группы разных файлов тоже разделяются
+	gap := true
+	lastNum := 0
+	for _, l := range res.lines {
+		gap = gap || l.num != lastNum+1
+		lastNum = l.num
+		out := p.format(res.file, l)
+		if len(out) == 0 {
+			continue
+		}
+		if p.separate && p.printed && gap {
+			if _, err := fmt.Fprintln(p.w, "--"); err != nil {
+				return err
+			}
+		}
+		gap, p.printed = false, true
+		for _, s := range out {
+			if _, err := fmt.Fprintln(p.w, s); err != nil {
+				return err
 			}
 		}
 	}
-	return mapBuf
+	return nil
+}
+
+// jsonSubmatch - подгруппа совпадения. Колонки считаются в байтах с 1, конец не включается
+type jsonSubmatch struct {
+	Text        string `json:"text"`
+	StartColumn int    `json:"start_column"`
+	EndColumn   int    `json:"end_column"`
+}
+
+// jsonRecord - объект вывода --json: совпадение (type "match"), строка, выбранная -v (type "line"),
+// или строка контекста (type "context"). Для "line" и "context" поля совпадения не заполняются
+type jsonRecord struct {
+	Type       string `json:"type"`
+	File       string `json:"file,omitempty"`
+	LineNumber int    `json:"line_number"`
+	// ByteOffset - смещение строки в байтах от начала файла
+	ByteOffset  int    `json:"byte_offset"`
+	Line        string `json:"line"`
+	Match       string `json:"match,omitempty"`
+	StartColumn int    `json:"start_column,omitempty"`
+	EndColumn   int    `json:"end_column,omitempty"`
+	// Submatches - подгруппы шаблона по порядку, null - подгруппа не участвовала в совпадении
+	Submatches []*jsonSubmatch `json:"submatches,omitempty"`
+}
+
+// jsonPrinter печатает по объекту JSON на строку для каждого совпадения
+type jsonPrinter struct {
+	enc          *json.Encoder
+	withFilename bool
+	withContext  bool
 }
 
-// keyC для реализации ключа -C
-func keyC(rExp *regexp.Regexp, f keys, data []string) map[int]string {
-	mapBuf := make(map[int]string)
-	for ind, str := range data {
-		if rExp.MatchString(str) && !f.invert || !rExp.MatchString(str) && f.invert {
-			mapBuf[ind] = str
-
-			if ind-f.context >= 0 {
-				copyToMapByInterval(mapBuf, data, ind-f.context, ind)
-			} else {
-				copyToMapByInterval(mapBuf, data, 0, ind)
+func (p *jsonPrinter) print(res result) error {
+	for _, l := range res.lines {
+		rec := jsonRecord{LineNumber: l.num, ByteOffset: l.offset, Line: l.text}
+		if p.withFilename {
+			rec.File = res.file
+		}
+		switch {
+		case !l.match:
+			if !p.withContext {
+				continue
+			}
+			rec.Type = "context"
+		case len(l.matches) == 0:
+			rec.Type = "line"
+		}
+		if rec.Type != "" {
+			if err := p.enc.Encode(rec); err != nil {
+				return err
 			}
+			continue
+		}
 
-			if ind+f.context < len(data) {
-				copyToMapByInterval(mapBuf, data, ind+1, ind+f.context+1)
-			} else {
-				copyToMapByInterval(mapBuf, data, ind+1, len(data))
+		for _, m := range l.matches {
+			// Пустые совпадения не выводятся, как и с -o
+			if m[0] == m[1] {
+				continue
+			}
+			rec.Type = "match"
+			rec.Match = l.text[m[0]:m[1]]
+			rec.StartColumn, rec.EndColumn = m[0]+1, m[1]+1
+			rec.Submatches = nil
+			for k := 2; k < len(m); k += 2 {
+				if m[k] < 0 {
+					rec.Submatches = append(rec.Submatches, nil)
+					continue
+				}
+				rec.Submatches = append(rec.Submatches, &jsonSubmatch{Text: l.text[m[k]:m[k+1]], StartColumn: m[k] + 1, EndColumn: m[k+1] + 1})
+			}
+			if err := p.enc.Encode(rec); err != nil {
+				return err
 			}
 		}
 	}
-
-	return mapBuf
+	return nil
 }
 
-// Реализует простейший grep
-func grepSimple(rExp *regexp.Regexp, f keys, data []string) map[int]string {
-	mapBuf := make(map[int]string)
-	for ind, str := range data {
-		if rExp.MatchString(str) && !f.invert || !rExp.MatchString(str) && f.invert {
-			mapBuf[ind] = str
+// splitShortFlags разбивает сгруппированные короткие флаги, как их понимает grep: "-in" - это "-i -n",
+// а "-C2" - это "-C 2". Флаги разбираются до первого аргумента, не являющегося флагом, или "--"
+func splitShortFlags(args []string) []string {
+	res := make([]string, 0, len(args))
+	for ind := 0; ind < len(args); ind++ {
+		arg := args[ind]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			return append(res, args[ind:]...)
+		}
+		if strings.HasPrefix(arg, "--") || arg == "-json" || len(arg) == 2 {
+			res = append(res, arg)
+			if strings.ContainsAny(arg[1:], "ABC") && len(arg) == 2 && ind+1 < len(args) {
+				ind++
+				res = append(res, args[ind])
+			}
+			continue
+		}
+		for k := 1; k < len(arg); k++ {
+			res = append(res, "-"+arg[k:k+1])
+			if !strings.ContainsRune("ABC", rune(arg[k])) {
+				continue
+			}
+			// Число строк контекста - остаток группы или следующий аргумент
+			if k+1 < len(arg) {
+				res = append(res, arg[k+1:])
+			} else if ind+1 < len(args) {
+				ind++
+				res = append(res, args[ind])
+			}
+			break
 		}
 	}
-
-	return mapBuf
+	return res
 }
 
-// Решает поставленную задачу (выполняетя grep с различными ключами)
-func grep(data []string, f keys) (interface{}, error) {
-	var (
-		prefix  string
-		postfix string
-	)
-
-	if f.ignoreCase {
-		prefix = "(?i)"
+// parseKeys разбирает флаги командной строки, шаблон и список файлов
+func parseKeys(args []string) (keys, []string, error) {
+	var f keys
+	fs := flag.NewFlagSet("grep", flag.ContinueOnError)
+	fs.IntVar(&f.after, "A", 0, "печатать N строк после совпадения")
+	fs.IntVar(&f.before, "B", 0, "печатать N строк до совпадения")
+	fs.IntVar(&f.context, "C", 0, "печатать N строк вокруг совпадения")
+	fs.BoolVar(&f.count, "c", false, "печатать количество совпавших строк")
+	fs.BoolVar(&f.ignoreCase, "i", false, "игнорировать регистр")
+	fs.BoolVar(&f.invert, "v", false, "выбирать несовпавшие строки")
+	fs.BoolVar(&f.fixed, "F", false, "точное совпадение со строкой, не шаблон")
+	fs.BoolVar(&f.lineNum, "n", false, "печатать номер строки")
+	fs.BoolVar(&f.onlyMatching, "o", false, "печатать только совпавшие части строк")
+	fs.BoolVar(&f.byteOffset, "b", false, "печатать смещение в байтах")
+	fs.BoolVar(&f.withFilename, "H", false, "печатать имя файла")
+	fs.BoolVar(&f.noFilename, "h", false, "не печатать имя файла")
+	fs.BoolVar(&f.json, "json", false, "выводить совпадения в JSON")
+	if err := fs.Parse(splitShortFlags(args)); err != nil {
+		return f, nil, err
 	}
-
-	if f.fixed {
-		prefix += "^"
-		postfix += "$"
+	if f.after < 0 || f.before < 0 || f.context < 0 {
+		return f, nil, errors.New("число строк контекста не может быть отрицательным")
+	}
+	if fs.NArg() == 0 {
+		return f, nil, errors.New("шаблон не указан")
+	}
+	f.rExp = fs.Arg(0)
+	files := fs.Args()[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
 	}
+	return f, files, nil
+}
 
-	rExp, err := regexp.Compile(prefix + f.rExp + postfix)
+// run выполняет grep с аргументами args и возвращает код выхода как у grep:
+// 0 - есть совпадения, 1 - нет, 2 - ошибка
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flgs, files, err := parseKeys(args)
 	if err != nil {
-		log.Fatal("Bad regexp")
+		fmt.Fprintln(stderr, err)
+		return 2
 	}
 
-	if f.count {
-		cnt := 0
-		if f.before > 0 {
-			beforeRes := keyB(rExp, f, data)
-			cnt = len(beforeRes)
-		} else if f.after > 0 {
-			afterRes := keyA(rExp, f, data)
-			cnt = len(afterRes)
-		} else if f.context > 0 {
-			contextRes := keyC(rExp, f, data)
-			cnt = len(contextRes)
-		} else {
-			simpleRes := grepSimple(rExp, f, data)
-			cnt = len(simpleRes)
+	out := bufio.NewWriter(stdout)
+	p := newPrinter(out, flgs, len(files))
+	status := 1
+	for _, name := range files {
+		// Cчитывание файла
+		data, err := readData(name, stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 2
+			continue
 		}
-
-		return cnt, nil
-	} else if f.lineNum {
-		var lineNumList []int
-
-		if f.before > 0 {
-			beforeRes := keyB(rExp, f, data)
-			lineNumList = sortMapKeys(beforeRes)
-		} else if f.after > 0 {
-			afterRes := keyA(rExp, f, data)
-			lineNumList = sortMapKeys(afterRes)
-		} else if f.context > 0 {
-			contextRes := keyC(rExp, f, data)
-			lineNumList = sortMapKeys(contextRes)
-		} else {
-			simpleRes := grepSimple(rExp, f, data)
-			lineNumList = sortMapKeys(simpleRes)
+		// Выполнение операции
+		res, err := grep(data, flgs)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
 		}
-
-		return lineNumList, nil
-	} else if f.before > 0 {
-		mapBuf := keyB(rExp, f, data)
-		keys := sortMapKeys(mapBuf)
-		res := GenerateTheResult(mapBuf, keys)
-
-		return res, nil
-	} else if f.after > 0 {
-		mapBuf := keyA(rExp, f, data)
-		keys := sortMapKeys(mapBuf)
-		res := GenerateTheResult(mapBuf, keys)
-
-		return res, nil
-	} else if f.context > 0 {
-		mapBuf := keyC(rExp, f, data)
-		keys := sortMapKeys(mapBuf)
-		res := GenerateTheResult(mapBuf, keys)
-
-		return res, nil
-	} else {
-		mapBuf := grepSimple(rExp, f, data)
-		keys := sortMapKeys(mapBuf)
-		res := GenerateTheResult(mapBuf, keys)
-
-		return res, nil
+		res.file = name
+		if name == "-" {
+			res.file = stdinName
+		}
+		// Вывод результата
+		if err := p.print(res); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		if res.count > 0 && status == 1 {
+			status = 0
+		}
+	}
+	if err := out.Flush(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
 	}
+	return status
 }
 
 func main() {
-	flgs := keys{rExp: "\\.txt"}
-	// Cчитывание файла
-	data := readData("example.txt")
-	// Выполнение операции
-	res, _ := grep(data, flgs)
-	// Вывод результата
-	showResult(res)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// numbers - строки "1".."10" для проверки контекста
+const numbers = "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+
+func TestRun(t *testing.T) {
+	var table = []struct {
+		name     string
+		args     []string
+		input    string
+		expected string
+		code     int
+	}{
+		{"match", []string{"b"}, "abc\ndef\nxbx\n", "abc\nxbx\n", 0},
+		{"no match", []string{"z"}, "abc\ndef\n", "", 1},
+		{"bad regexp", []string{"a("}, "abc\n", "", 2},
+		{"no pattern", nil, "abc\n", "", 2},
+		{"negative context", []string{"-A", "-1", "a"}, "abc\n", "", 2},
+		{"missing file", []string{"a", "/nonexistent/file"}, "", "", 2},
+		{"after", []string{"-A", "1", "^(2|7)$"}, numbers, "2\n3\n--\n7\n8\n", 0},
+		{"before", []string{"-B1", "^(2|7)$"}, numbers, "1\n2\n--\n6\n7\n", 0},
+		{"context merges groups", []string{"-C1", "^(2|4)$"}, numbers, "1\n2\n3\n4\n5\n", 0},
+		{"context with line numbers", []string{"-nC1", "^(2|8)$"}, numbers, "1-1\n2:2\n3-3\n--\n7-7\n8:8\n9-9\n", 0},
+		{"count", []string{"-c", "1"}, numbers, "2\n", 0},
+		{"count inverted", []string{"-cv", "1"}, numbers, "8\n", 0},
+		{"count without matches", []string{"-c", "z"}, numbers, "0\n", 1},
+		{"invert", []string{"-v", "[2-9]"}, numbers, "1\n10\n", 0},
+		{"ignore case", []string{"-i", "abc"}, "ABC\nabd\naBc\n", "ABC\naBc\n", 0},
+		{"fixed whole line", []string{"-F", "a.c"}, "abc\na.c\na.cd\n", "a.c\n", 0},
+		{"line numbers", []string{"-n", "c"}, "abc\ndef\ncc\n", "1:abc\n3:cc\n", 0},
+		{"only matching", []string{"-o", "[0-9]+"}, "a1b22\nxyz\n333\n", "1\n22\n333\n", 0},
+		{"only matching skips empty matches", []string{"-o", "x*"}, "axxb\nab\n", "xx\n", 0},
+		{"only matching with context keeps separators", []string{"-o", "-C1", "^(2|4|9)$"}, numbers, "2\n4\n--\n9\n", 0},
+		{"byte offset", []string{"-b", "c"}, "abc\ndef\ncc\n", "0:abc\n8:cc\n", 0},
+		{"byte offset of matches", []string{"-ob", "c"}, "abc\ndef\ncc\n", "2:c\n8:c\n9:c\n", 0},
+		{"stdin with file name", []string{"-H", "a"}, "abc\n", "(standard input):abc\n", 0},
+	}
+
+	for _, test := range table {
+		var stdout, stderr bytes.Buffer
+		code := run(test.args, strings.NewReader(test.input), &stdout, &stderr)
+		if code != test.code || stdout.String() != test.expected {
+			t.Errorf("%s: run(%q) = %d, %q, expected %d, %q (stderr %q)",
+				test.name, test.args, code, stdout.String(), test.code, test.expected, stderr.String())
+		}
+	}
+}
+
+func TestRunFiles(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.txt"), filepath.Join(dir, "second.txt")
+	if err := os.WriteFile(first, []byte("a1\nb\na2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("c\na3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var table = []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"file names by default", []string{"a", first, second}, first + ":a1\n" + first + ":a2\n" + second + ":a3\n"},
+		{"no file names", []string{"-h", "a", first, second}, "a1\na2\na3\n"},
+		{"count per file", []string{"-c", "a", first, second}, first + ":2\n" + second + ":1\n"},
+		{"groups of different files are separated", []string{"-hB1", "a[13]", first, second}, "a1\n--\nc\na3\n"},
+	}
+	for _, test := range table {
+		var stdout, stderr bytes.Buffer
+		code := run(test.args, strings.NewReader(""), &stdout, &stderr)
+		if code != 0 || stdout.String() != test.expected {
+			t.Errorf("%s: run = %d, %q, expected 0, %q (stderr %q)", test.name, code, stdout.String(), test.expected, stderr.String())
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"--json", "-C1", "x*(é)(z)?"}, strings.NewReader("abc\naxé\nxyz\n"), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("run = %d, stderr %q", code, stderr.String())
+	}
+
+	var got []map[string]interface{}
+	for _, s := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &rec); err != nil {
+			t.Fatalf("invalid JSON %q: %v", s, err)
+		}
+		got = append(got, rec)
+	}
+	expected := []map[string]interface{}{
+		{"type": "context", "file": stdinName, "line_number": 1.0, "byte_offset": 0.0, "line": "abc"},
+		{"type": "match", "file": stdinName, "line_number": 2.0, "byte_offset": 4.0, "line": "axé", "match": "xé",
+			"start_column": 2.0, "end_column": 5.0, "submatches": []interface{}{
+				map[string]interface{}{"text": "é", "start_column": 3.0, "end_column": 5.0}, nil}},
+		{"type": "context", "file": stdinName, "line_number": 3.0, "byte_offset": 9.0, "line": "xyz"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("--json = %v, expected %v", got, expected)
+	}
+}
+
+func TestJSONSkipsEmptyMatches(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"--json", "-h", "x*"}, strings.NewReader("axxb\nab\n"), &stdout, &stderr)
+	expected := `{"type":"match","line_number":1,"byte_offset":0,"line":"axxb","match":"xx","start_column":2,"end_column":4}` + "\n"
+	if code != 0 || stdout.String() != expected {
+		t.Errorf("run = %d, %q, expected 0, %q", code, stdout.String(), expected)
+	}
+}
+
+func TestSplitShortFlags(t *testing.T) {
+	var table = []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-in", "a"}, []string{"-i", "-n", "a"}},
+		{[]string{"-C2", "a"}, []string{"-C", "2", "a"}},
+		{[]string{"-nA", "3", "a"}, []string{"-n", "-A", "3", "a"}},
+		{[]string{"-B", "1", "--json", "a"}, []string{"-B", "1", "--json", "a"}},
+		{[]string{"--", "-in"}, []string{"--", "-in"}},
+	}
+	for _, test := range table {
+		if got := splitShortFlags(test.args); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("splitShortFlags(%q) = %q, expected %q", test.args, got, test.expected)
+		}
+	}
+}
@@ -3,420 +3,10210 @@ HTTP-сервер
 
 Реализовать HTTP-сервер для работы с календарем. В рамках задания необходимо работать строго со стандартной HTTP-библиотекой.
 
-
 В рамках задания необходимо:
 Реализовать вспомогательные функции для сериализации объектов доменной области в JSON.
 Реализовать вспомогательные функции для парсинга и валидации параметров методов /create_event и /update_event.
 Реализовать HTTP обработчики для каждого из методов API, используя вспомогательные функции и объекты доменной области.
 Реализовать middleware для логирования запросов
 
-
-Методы API: 
-POST /create_event 
-POST /update_event 
-POST /delete_event 
-GET /events_for_day 
-GET /events_for_week 
+Методы API:
+POST /create_event
+POST /update_event
+POST /delete_event
+GET /events_for_day
+GET /events_for_week
 GET /events_for_month
 
-
-Параметры передаются в виде www-url-form-encoded (т.е. обычные user_id=3&date=2019-09-09). В GET методах параметры передаются через queryString, 
+Параметры передаются в виде www-url-form-encoded (т.е. обычные user_id=3&date=2019-09-09). В GET методах параметры передаются через queryString,
 в POST через тело запроса.
-В результате каждого запроса должен возвращаться JSON-документ содержащий либо {"result": "..."} в случае успешного выполнения метода, 
+В результате каждого запроса должен возвращаться JSON-документ содержащий либо {"result": "..."} в случае успешного выполнения метода,
 либо {"error": "..."} в случае ошибки бизнес-логики.
 
 В рамках задачи необходимо:
 Реализовать все методы.
 Бизнес логика НЕ должна зависеть от кода HTTP сервера.
-В случае ошибки бизнес-логики сервер должен возвращать HTTP 503. В случае ошибки входных данных (невалидный int например) сервер должен 
-возвращать HTTP 400. В случае остальных ошибок сервер должен возвращать HTTP 500. Web-сервер должен запускаться на порту указанном в конфиге 
+В случае ошибки бизнес-логики сервер должен возвращать HTTP 503. В случае ошибки входных данных (невалидный int например) сервер должен
+возвращать HTTP 400. В случае остальных ошибок сервер должен возвращать HTTP 500. Web-сервер должен запускаться на порту указанном в конфиге
 и выводить в лог каждый обработанный запрос.
 */
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	// База часовых поясов IANA встраивается в бинарник на случай, если ее нет в системе
+	_ "time/tzdata"
 )
 
 type Event struct {
-	UserID      int    `json:"user_id"`
-	ID          int    `json:"id"`
-	Date        Date                        `json:"date"`
+	UserID int `json:"user_id"`
+	// ID назначает сервер при создании события, он уникален в пределах хранилища
+	ID int `json:"id"`
+	// Version увеличивается при каждом изменении события, начинается с 1
+	Version int `json:"version"`
+	// Date - начало события
+	Date Date `json:"date"`
+	// End - окончание события. Если не задано, событие на дату без времени длится сутки,
+	// а событие со временем начала не имеет длительности
+	End Date `json:"end"`
+	// TimeZone - часовой пояс IANA, в котором заданы начало и окончание, по умолчанию UTC
+	TimeZone    string `json:"time_zone"`
 	Title       string `json:"title"`
 	Description string `json:"description"`
+	// Recurrence - правило повторения, nil для разового события
+	Recurrence *Recurrence `json:"recurrence,omitempty"`
+	// RecurrenceID - исходная дата повторения, заполняется только в развернутых повторениях серии
+	RecurrenceID *Date `json:"recurrence_id,omitempty"`
+	// Attendees - приглашенные пользователи. Событие хранится один раз у организатора (UserID)
+	Attendees []Attendee `json:"attendees,omitempty"`
+	// Tags - метки события в нижнем регистре для поиска и фильтрации
+	Tags []string `json:"tags,omitempty"`
+	// Reminders - за сколько до начала каждого повторения напомнить организатору и участникам
+	Reminders []Offset `json:"reminders,omitempty"`
+	// RSVP - ответ пользователя, для которого построена выборка, заполняется только
+	// в событиях, куда он приглашен
+	RSVP string `json:"rsvp,omitempty"`
 }
 
-// ConcreteEvent структура для получения конкретного события
-type ConcreteEvent struct {
-	UserID int `json:"user_id"`
-	ID     int `json:"id"`
+// Ответы участника на приглашение
+const (
+	RSVPNeedsAction = "needs-action"
+	RSVPAccepted    = "accepted"
+	RSVPDeclined    = "declined"
+	RSVPTentative   = "tentative"
+)
+
+// Attendee - участник события и его ответ на приглашение
+type Attendee struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
 }
 
-type EventRepository struct {
-	m map[int][]Event
-	*sync.RWMutex
+// Область применения изменений повторяющегося события
+const (
+	ApplyToAll  = "all"
+	ApplyToThis = "this"
+)
+
+// SeriesTarget указывает, менять всю серию или одно ее повторение
+type SeriesTarget struct {
+	// ApplyTo - "all" (по умолчанию) или "this"
+	ApplyTo string `json:"scope,omitempty"`
+	// OccurrenceDate - исходная дата повторения для ApplyTo == "this"
+	OccurrenceDate *Date `json:"occurrence_date,omitempty"`
 }
 
-type Date struct {
-	date time.Time
+// WriteOptions - необязательные режимы создания и изменения событий
+type WriteOptions struct {
+	// RejectOverlaps запрещает пересечение события с другими событиями пользователя
+	RejectOverlaps bool `json:"reject_overlaps,omitempty"`
+	// ExpectedVersion - версия, которую клиент видел перед изменением, 0 - не проверять
+	ExpectedVersion int `json:"expected_version,omitempty"`
 }
 
-type Logger struct {
-	*log.Logger
+// EventRequest - тело запросов create_event и update_event
+type EventRequest struct {
+	Event
+	SeriesTarget
+	WriteOptions
 }
 
-// Scope - сервер, логер и хранилище
-type Scope struct {
-	srv        *http.ServeMux
-	logger     Logger
-	EventRepository EventRepository
+// ConcreteEvent структура для получения конкретного события
+type ConcreteEvent struct {
+	UserID int `json:"user_id"`
+	ID     int `json:"id"`
+	// ExpectedVersion - версия, которую клиент видел перед удалением, 0 - не проверять
+	ExpectedVersion int `json:"expected_version,omitempty"`
+	SeriesTarget
 }
 
-func CreateScope() *Scope {
-	return &Scope{
-		srv: http.NewServeMux(),
-		logger: Logger{
-			log.New(os.Stdout, "logger: ", log.Lshortfile),
-		},
-		EventRepository: EventRepository{
-			m:       make(map[int][]Event),
-			RWMutex: new(sync.RWMutex),
-		},
-	}
+var (
+	// ErrDuplicateEvent - событие с таким ID у пользователя уже есть
+	ErrDuplicateEvent = errors.New("duplicate event not allowed")
+	// ErrEventNotFound - событие не найдено в хранилище
+	ErrEventNotFound = errors.New("event not found")
+	// ErrUnknownUser - у пользователя нет ни одного события
+	ErrUnknownUser = errors.New("unknown user_id")
+	// ErrOccurrenceNotFound - у серии нет повторения с указанной датой
+	ErrOccurrenceNotFound = errors.New("occurrence not found")
+	// ErrEndBeforeStart - окончание события раньше его начала
+	ErrEndBeforeStart = errors.New("event end is before its start")
+	// ErrOverlap - событие пересекается с другим событием пользователя
+	ErrOverlap = errors.New("event overlaps another event")
+	// ErrNotInvited - пользователь не приглашен на событие
+	ErrNotInvited = errors.New("user is not invited to the event")
+	// ErrVersionConflict - событие изменили после того, как клиент его прочитал
+	ErrVersionConflict = errors.New("version conflict: event was changed by someone else")
+	// ErrNotAcceptable - ни один формат ответа не подходит под заголовок Accept
+	ErrNotAcceptable = errors.New("none of the supported formats is acceptable")
+	// ErrWebhookNotFound - у пользователя нет вебхука с таким ID
+	ErrWebhookNotFound = errors.New("webhook not found")
+)
+
+// TrashedEvent - удаленное событие в корзине пользователя
+type TrashedEvent struct {
+	Event
+	DeletedAt time.Time `json:"deleted_at"`
+	// DeletedBy - пользователь, удаливший событие
+	DeletedBy int `json:"deleted_by"`
 }
 
-// startingServer настраивает роуты и запускает сервер
-func (scope *Scope) startingServer() {
-	scope.srv.HandleFunc("/create_event", scope.CreateEvent)
-	scope.srv.HandleFunc("/update_event", scope.UpdateEvent)
-	scope.srv.HandleFunc("/delete_event", scope.RemoveEvent)
+// Действия журнала аудита
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// AuditEntry - запись журнала изменений события: кто, когда и что изменил
+type AuditEntry struct {
+	EventID int `json:"event_id"`
+	// UserID - владелец события
+	UserID int    `json:"user_id"`
+	Action string `json:"action"`
+	// Actor - пользователь, выполнивший изменение, 0 - сервер
+	Actor int       `json:"actor"`
+	Time  time.Time `json:"time"`
+	// Old и New - событие до и после изменения
+	Old *Event `json:"old,omitempty"`
+	New *Event `json:"new,omitempty"`
+}
 
-	scope.srv.HandleFunc("/events_for_day", scope.DayEvents)
-	scope.srv.HandleFunc("/events_for_week", scope.WeekEvents)
-	scope.srv.HandleFunc("/events_for_month", scope.MonthEvents)
+// EventRepository - хранилище событий. Бизнес-логика работает только через этот интерфейс
+// и не знает, где лежат данные: в памяти или на диске
+type EventRepository interface {
+	// Create сохраняет новое событие с версией 1. Событию без ID назначается следующий ID хранилища
+	Create(event Event) (Event, error)
+	// Update заменяет существующее событие целиком и увеличивает его версию.
+	// Если expectedVersion не 0 и не совпадает с текущей версией, возвращается ErrVersionConflict
+	Update(event Event, expectedVersion int) (Event, error)
+	// Delete удаляет событие пользователя с проверкой cEvent.ExpectedVersion
+	Delete(cEvent ConcreteEvent) error
+	// Get возвращает событие пользователя по идентификатору
+	Get(userID, id int) (Event, error)
+	// UserEvents возвращает копию всех событий пользователя
+	UserEvents(userID int) ([]Event, error)
+	// Invited возвращает копии событий других пользователей, на которые приглашен userID
+	Invited(userID int) ([]Event, error)
+	// Search возвращает события пользователя и события, на которые он приглашен, содержащие в названии
+	// или описании все слова terms и все теги tags. Без terms и tags возвращаются все такие события
+	Search(userID int, terms, tags []string) ([]Event, error)
+	// OverlappingAll возвращает события всех пользователей, пересекающиеся с интервалом [from, to),
+	// и все серии
+	OverlappingAll(from, to time.Time) ([]Event, error)
+	// Overlapping возвращает разовые события пользователя, пересекающиеся с интервалом [from, to),
+	// и все его повторяющиеся события: их повторения разворачивает бизнес-логика
+	Overlapping(userID int, from, to time.Time) ([]Event, error)
+	// PutTrash кладет удаленное событие в корзину его владельца
+	PutTrash(t TrashedEvent) error
+	// Trash возвращает корзину пользователя
+	Trash(userID int) ([]TrashedEvent, error)
+	// ExpiredTrash возвращает события всех корзин, удаленные раньше before
+	ExpiredTrash(before time.Time) ([]TrashedEvent, error)
+	// Restore возвращает событие из корзины с увеличенной версией
+	Restore(userID, id int) (Event, error)
+	// Purge окончательно удаляет событие из корзины
+	Purge(userID, id int) error
+	// AppendHistory дописывает запись в журнал изменений события
+	AppendHistory(entry AuditEntry) error
+	// History возвращает журнал изменений события в порядке записи
+	History(id int) ([]AuditEntry, error)
+	// PutWebhook сохраняет вебхук целиком. Вебхуку без ID назначается следующий ID вебхуков хранилища
+	PutWebhook(h Webhook) (Webhook, error)
+	// DeleteWebhook удаляет вебхук, если его нет, возвращается ErrWebhookNotFound
+	DeleteWebhook(id int) error
+	// Webhooks возвращает все вебхуки в порядке ID
+	Webhooks() ([]Webhook, error)
+	// AppendDeadLetter сохраняет недоставленное изменение, хранятся deadLetterLimit последних
+	AppendDeadLetter(dl DeadLetter) error
+	// DeadLetters возвращает недоставленные изменения, старые идут первыми
+	DeadLetters() ([]DeadLetter, error)
+	// Transaction выполняет fn атомарно: изменения, сделанные через tx, либо применяются все,
+	// либо, если fn вернула ошибку, отменяются все. Другие вызовы хранилища к тем же данным ждут
+	// завершения fn. Хранилище может отменить изменения и вызвать fn повторно, поэтому fn
+	// не должна накапливать состояние между вызовами
+	Transaction(fn func(tx EventRepository) error) error
+	// Stats возвращает число событий пользователей и время ожидания блокировок
+	Stats() (RepositoryStats, error)
+	// Close сбрасывает данные и освобождает ресурсы хранилища
+	Close() error
+}
 
-	log.Fatal(http.ListenAndServe("localhost:"+os.Getenv("SERVERPORT"), scope.srv))
+// intervalIndex - индекс событий одного пользователя по времени. Разовые события отсортированы
+// по началу, поэтому поиск пересечений с интервалом просматривает только события, начавшиеся
+// не раньше чем за maxDuration до него, а не все события пользователя
+type intervalIndex struct {
+	events      []Event
+	series      []Event
+	maxDuration time.Duration
 }
 
-// CreateNewEvent создает новое событие и сохраняет его в хранилище
-func (scope *Scope) CreateNewEvent(event Event) error {
-	scope.EventRepository.RWMutex.Lock()
-	defer scope.EventRepository.RWMutex.Unlock()
-	if scope.checkEvent(event) {
-		return errors.New("duplicate event not allowed")
-	} else {
-		scope.EventRepository.m[event.UserID] = append(scope.EventRepository.m[event.UserID], event)
-	}
-	return nil
+// searchStart возвращает позицию первого разового события, начинающегося не раньше t
+func (idx *intervalIndex) searchStart(t time.Time) int {
+	return sort.Search(len(idx.events), func(i int) bool {
+		return !idx.events[i].Date.date.Before(t)
+	})
 }
 
-func (scope *Scope) CreateEvent(w http.ResponseWriter, r *http.Request) {
-	scope .logger.Println(r.URL)
-	if r.Method != http.MethodPost {
-		sendErr(w, "Not correct method", http.StatusBadRequest)
+// add добавляет событие в индекс
+func (idx *intervalIndex) add(e Event) {
+	if e.Recurrence != nil {
+		idx.series = append(idx.series, e)
 		return
 	}
+	if d := e.duration(); d > idx.maxDuration {
+		idx.maxDuration = d
+	}
+	// Вставка после событий с тем же началом сохраняет порядок добавления
+	pos := sort.Search(len(idx.events), func(i int) bool {
+		return idx.events[i].Date.date.After(e.Date.date)
+	})
+	idx.events = append(idx.events, Event{})
+	copy(idx.events[pos+1:], idx.events[pos:])
+	idx.events[pos] = e
+}
 
-	event, err := parseJSON(r)
-
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusBadRequest)
+// remove удаляет событие из индекса, old - его сохраненная версия. После удаления самого длинного
+// события maxDuration пересчитывается, иначе отсечение при поиске ослабевало бы навсегда
+func (idx *intervalIndex) remove(old Event) {
+	if old.Recurrence != nil {
+		for ind := range idx.series {
+			if idx.series[ind].ID == old.ID {
+				idx.series = append(idx.series[:ind], idx.series[ind+1:]...)
+				return
+			}
+		}
 		return
 	}
-	if err := scope.CreateNewEvent(event); err != nil {
-		sendErr(w, err.Error(), http.StatusBadRequest)
+	for ind := idx.searchStart(old.Date.date); ind < len(idx.events); ind++ {
+		if idx.events[ind].ID == old.ID {
+			idx.events = append(idx.events[:ind], idx.events[ind+1:]...)
+			break
+		}
+	}
+	if old.duration() == idx.maxDuration {
+		idx.maxDuration = 0
+		for _, e := range idx.events {
+			idx.maxDuration = max(idx.maxDuration, e.duration())
+		}
 	}
-	sendRes(w, "Success", []Event{event}, http.StatusCreated)
 }
 
-func (scope  *Scope) UpdateEventFunc(e Event) error {
-	scope .EventRepository.RWMutex.Lock()
-	defer scope .EventRepository.RWMutex.Unlock()
-
-	events := scope .EventRepository.m[e.UserID]
-	for ind := 0; ind < len(events); ind++ {
-		if events[ind].ID == e.ID {
-			events[ind].Title = e.Title
-			events[ind].Description = e.Description
-			events[ind].Date = e.Date
-			return nil
+// query возвращает разовые события, пересекающиеся с [from, to), и все серии
+func (idx *intervalIndex) query(from, to time.Time) []Event {
+	var result []Event
+	for ind := idx.searchStart(from.Add(-idx.maxDuration)); ind < len(idx.events); ind++ {
+		e := idx.events[ind]
+		if !e.Date.date.Before(to) {
+			break
+		}
+		if e.overlaps(from, to) {
+			result = append(result, e)
 		}
 	}
-	return errors.New("event not found")
+	return append(result, idx.series...)
 }
 
-func (scope *Scope) UpdateEvent(w http.ResponseWriter, r *http.Request) {
-	scope.logger.Println(r.URL)
-	if r.Method != http.MethodPost {
-		sendErr(w, "Not correct method", http.StatusBadRequest)
-		return
-	}
-	event, err := parseJSON(r)
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusBadRequest)
-		return
+// tokenize разбивает текст на слова из букв и цифр в нижнем регистре
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// normalizeTags приводит теги к нижнему регистру, убирает пустые и повторяющиеся
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
 	}
-	if ValidEvents(event) {
-		err = scope.UpdateEventFunc(event)
-		if err != nil {
-			sendErr(w, "Event not found", http.StatusInternalServerError)
-		} else {
-			sendRes(w, "Success", []Event{event}, http.StatusOK)
+	res := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			res = append(res, tag)
 		}
-	} else {
-		sendErr(w, "Not valid event", http.StatusBadRequest)
 	}
+	return res
 }
 
-func (scope *Scope) RemoveEventFunc(cEvent ConcreteEvent) error {
-	scope.EventRepository.RWMutex.Lock()
-	defer scope.EventRepository.RWMutex.Unlock()
-
-	events := scope.EventRepository.m[cEvent.UserID]
-	for ind := 0; ind < len(events); ind++ {
-		if events[ind].ID == cEvent.ID {
-			scope.EventRepository.m[cEvent.UserID] = append(scope.EventRepository.m[cEvent.UserID][0:ind], scope.EventRepository.m[cEvent.UserID][ind+1:]...)
-			return nil
+// searchTokens возвращает слова названия и описания события и его измененных повторений
+func (e Event) searchTokens() []string {
+	tokens := append(tokenize(e.Title), tokenize(e.Description)...)
+	if e.Recurrence != nil {
+		for _, o := range e.Recurrence.Overrides {
+			tokens = append(tokens, tokenize(o.Title)...)
+			tokens = append(tokens, tokenize(o.Description)...)
 		}
 	}
-	return errors.New("event not found")
+	return tokens
 }
 
-func (scope *Scope) RemoveEvent(w http.ResponseWriter, r *http.Request) {
-	scope.logger.Println(r.URL)
-	if r.Method != http.MethodPost {
-		sendErr(w, "Not correct method", http.StatusBadRequest)
-		return
+// searchIndex - обратный индекс: слово или тег -> ID событий
+type searchIndex struct {
+	terms map[string]map[int]bool
+	tags  map[string]map[int]bool
+}
+
+// newSearchIndex создает пустой обратный индекс
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		terms: make(map[string]map[int]bool),
+		tags:  make(map[string]map[int]bool),
 	}
+}
 
-	var cEvent ConcreteEvent
-	err := json.NewDecoder(r.Body).Decode(&cEvent)
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusBadRequest)
-		return
+// addTo добавляет id в множество posting[key]
+func addTo(posting map[string]map[int]bool, key string, id int) {
+	if posting[key] == nil {
+		posting[key] = make(map[int]bool)
 	}
+	posting[key][id] = true
+}
 
-	err = scope.RemoveEventFunc(cEvent)
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusInternalServerError)
-		return
+// removeFrom удаляет id из множества posting[key]
+func removeFrom(posting map[string]map[int]bool, key string, id int) {
+	delete(posting[key], id)
+	if len(posting[key]) == 0 {
+		delete(posting, key)
 	}
+}
 
-	sendRes(w, "Success", nil, http.StatusOK)
+// add индексирует событие
+func (idx *searchIndex) add(e Event) {
+	for _, token := range e.searchTokens() {
+		addTo(idx.terms, token, e.ID)
+	}
+	for _, tag := range e.Tags {
+		addTo(idx.tags, tag, e.ID)
+	}
 }
 
-// sendErr отправляет заданную ошибку с заданным кодов статуса
-func sendErr(writer http.ResponseWriter, errorStr string, status int) {
-	response := struct {
-		Error string `json:"error"`
-	}{errorStr}
-	jsonResponse, err := json.Marshal(response)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+// remove убирает событие из индекса
+func (idx *searchIndex) remove(e Event) {
+	for _, token := range e.searchTokens() {
+		removeFrom(idx.terms, token, e.ID)
+	}
+	for _, tag := range e.Tags {
+		removeFrom(idx.tags, tag, e.ID)
 	}
-	writer.WriteHeader(status)
-	writer.Header().Set("Content-Type", "application/json")
-	_, _ = writer.Write(jsonResponse)
 }
 
-// sendRes отправляет результат запроса
-func sendRes(writer http.ResponseWriter, resStr string, events []Event, status int) {
-	response := struct {
-		Result string  `json:"result"`
-		Events []Event `json:"events"`
-	}{resStr, events}
-	responseJson, err := json.Marshal(response)
-	if err != nil {
-		sendErr(writer, err.Error(), http.StatusInternalServerError)
-		return
+// match возвращает ID событий, содержащих все слова terms и все теги tags
+func (idx *searchIndex) match(terms, tags []string) map[int]bool {
+	var sets []map[int]bool
+	for _, term := range terms {
+		sets = append(sets, idx.terms[term])
+	}
+	for _, tag := range tags {
+		sets = append(sets, idx.tags[tag])
+	}
+	// Пересечение начинается с самого короткого множества
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	res := make(map[int]bool)
+	if len(sets) == 0 {
+		return res
 	}
+	for id := range sets[0] {
+		found := true
+		for _, set := range sets[1:] {
+			if !set[id] {
+				found = false
+				break
+			}
+		}
+		if found {
+			res[id] = true
+		}
+	}
+	return res
+}
 
-	writer.WriteHeader(status)
-	writer.Header().Set("Content-Type", "application/json")
-	_, _ = writer.Write(responseJson)
+// timedRWMutex - sync.RWMutex, который измеряет время ожидания блокировки
+type timedRWMutex struct {
+	sync.RWMutex
+	readWait  *Histogram
+	writeWait *Histogram
 }
 
-// checkEvent проверяет содержится ли событие в хранилище
-func (scope *Scope) checkEvent(e Event) bool {
-	for _, v := range scope.EventRepository.m[e.UserID] {
-		if v.ID == e.ID {
-			return true
-		}
+// newTimedRWMutex создает блокировку с пустыми гистограммами ожидания
+func newTimedRWMutex() *timedRWMutex {
+	return &timedRWMutex{readWait: NewHistogram(lockWaitBuckets), writeWait: NewHistogram(lockWaitBuckets)}
+}
+
+// Lock захватывает блокировку на запись и учитывает время ожидания
+func (mu *timedRWMutex) Lock() {
+	start := time.Now()
+	mu.RWMutex.Lock()
+	mu.writeWait.Observe(time.Since(start).Seconds())
+}
+
+// RLock захватывает блокировку на чтение и учитывает время ожидания
+func (mu *timedRWMutex) RLock() {
+	start := time.Now()
+	mu.RWMutex.RLock()
+	mu.readWait.Observe(time.Since(start).Seconds())
+}
+
+// RepositoryStats - сведения о хранилище для метрик
+type RepositoryStats struct {
+	// Events - число событий каждого пользователя
+	Events map[int]int
+	// ReadLockWait и WriteLockWait - время ожидания блокировки хранилища на чтение и на запись
+	ReadLockWait  *Histogram
+	WriteLockWait *Histogram
+}
+
+// webhookData - вебхуки и недоставленные изменения хранилища
+type webhookData struct {
+	hooks map[int]Webhook
+	// lastID - последний выданный ID вебхука, никогда не уменьшается
+	lastID int
+	dead   []DeadLetter
+}
+
+// newWebhookData создает пустые данные вебхуков
+func newWebhookData() *webhookData {
+	return &webhookData{hooks: make(map[int]Webhook)}
+}
+
+// put сохраняет вебхук, вебхуку без ID назначается следующий ID
+func (data *webhookData) put(h Webhook) Webhook {
+	if h.ID == 0 {
+		h.ID = data.lastID + 1
 	}
-	return false
+	data.lastID = max(data.lastID, h.ID)
+	data.hooks[h.ID] = h
+	return h
 }
 
-func ValidEvents(event Event) bool {
-	if event.ID <= 0 || event.UserID <= 0 || event.Title == "" || event.Description == "" {
-		return false
+// delete удаляет вебхук
+func (data *webhookData) delete(id int) error {
+	if _, ok := data.hooks[id]; !ok {
+		return ErrWebhookNotFound
 	}
-	return true
+	delete(data.hooks, id)
+	return nil
 }
 
-func parseJSON(r *http.Request) (Event, error) {
-	var event Event
-	err := json.NewDecoder(r.Body).Decode(&event)
-	if err != nil {
-		return event, errors.New("cannot decode json")
+// list возвращает вебхуки в порядке ID
+func (data *webhookData) list() []Webhook {
+	res := make([]Webhook, 0, len(data.hooks))
+	for _, h := range data.hooks {
+		res = append(res, h)
 	}
-	return event, nil
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
 }
 
-              
-func (d *Date) UnmarshalJSON(input []byte) error {
-	var err error
-	d.date, err = time.Parse(`"2006-01-02"`, string(input))
-	return err
+// bury дописывает недоставленное изменение и отбрасывает самые старые сверх deadLetterLimit
+func (data *webhookData) bury(dl DeadLetter) {
+	data.dead = append(data.dead, dl)
+	if extra := len(data.dead) - deadLetterLimit; extra > 0 {
+		data.dead = append(data.dead[:0:0], data.dead[extra:]...)
+	}
 }
 
-// String для типа Date                       
-func (d Date) String() string {
-	return d.date.String()
+// clone возвращает копию данных для отката
+func (data *webhookData) clone() *webhookData {
+	res := &webhookData{hooks: make(map[int]Webhook, len(data.hooks)), lastID: data.lastID}
+	for id, h := range data.hooks {
+		res.hooks[id] = h
+	}
+	res.dead = append([]DeadLetter(nil), data.dead...)
+	return res
 }
 
-// MarshalJSON для типа Date                       
-func (d *Date) MarshalJSON() ([]byte, error) {
-	dateStr := d.date.Format("2006-01-02")
-	return json.Marshal(dateStr)
+// MemoryRepository - хранилище событий в памяти, данные теряются при перезапуске
+type MemoryRepository struct {
+	m map[int][]Event
+	// index - индекс событий каждого пользователя по времени
+	index map[int]*intervalIndex
+	// owners - владелец каждого события: ID уникальны в пределах хранилища
+	owners map[int]int
+	// invitations - ID событий, на которые приглашен каждый пользователь
+	invitations map[int]map[int]bool
+	// search - обратный индекс слов и тегов
+	search *searchIndex
+	// trash - корзины пользователей: удаленные события по ID
+	trash map[int]map[int]TrashedEvent
+	// history - журнал изменений каждого события
+	history map[int][]AuditEntry
+	// lastID - последний выданный ID, никогда не уменьшается
+	lastID int
+	// webhooks - вебхуки пользователей и недоставленные им изменения
+	webhooks *webhookData
+	*timedRWMutex
 }
 
-func (scope *Scope) DayEventsFunc(userID int, date time.Time) ([]Event, error) {
-	scope.EventRepository.RWMutex.RLock()
-	scope.EventRepository.RWMutex.RUnlock()
+// NewMemoryRepository создает пустое хранилище в памяти
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		m:            make(map[int][]Event),
+		index:        make(map[int]*intervalIndex),
+		owners:       make(map[int]int),
+		invitations:  make(map[int]map[int]bool),
+		search:       newSearchIndex(),
+		trash:        make(map[int]map[int]TrashedEvent),
+		history:      make(map[int][]AuditEntry),
+		webhooks:     newWebhookData(),
+		timedRWMutex: newTimedRWMutex(),
+	}
+}
 
-	var result []Event
+// restore заменяет содержимое хранилища снимком и перестраивает индексы
+func (repo *MemoryRepository) restore(snapshot snapshotData) {
+	repo.Lock()
+	defer repo.Unlock()
 
-	var allUserEvents []Event
-	allUserEvents = scope.EventRepository.m[userID]
-	if allUserEvents == nil {
-		return nil, errors.New("unknown user_id")
+	repo.m = snapshot.Events
+	if repo.m == nil {
+		repo.m = make(map[int][]Event)
 	}
-
-	for _, event := range allUserEvents {
-		if event.Date.date.Year() == date.Year() &&
-			event.Date.date.Month() == date.Month() &&
-			event.Date.date.Day() == date.Day() {
-			result = append(result, event)
+	repo.lastID = snapshot.LastID
+	repo.index = make(map[int]*intervalIndex, len(repo.m))
+	repo.owners = make(map[int]int)
+	repo.invitations = make(map[int]map[int]bool)
+	repo.search = newSearchIndex()
+	for userID, events := range repo.m {
+		repo.index[userID] = &intervalIndex{}
+		for ind := range events {
+			events[ind].localize()
+			e := events[ind]
+			repo.index[userID].add(e)
+			repo.invite(e)
+			repo.search.add(e)
+			repo.owners[e.ID] = userID
+			repo.lastID = max(repo.lastID, e.ID)
 		}
 	}
-	return result, nil
+	repo.trash = make(map[int]map[int]TrashedEvent)
+	for _, t := range snapshot.Trash {
+		t.localize()
+		repo.putTrash(t)
+		repo.lastID = max(repo.lastID, t.ID)
+	}
+	repo.history = snapshot.History
+	if repo.history == nil {
+		repo.history = make(map[int][]AuditEntry)
+	}
+	for _, entries := range repo.history {
+		for ind := range entries {
+			entries[ind].localize()
+		}
+	}
+	repo.webhooks = newWebhookData()
+	repo.webhooks.lastID = snapshot.WebhookLastID
+	for _, h := range snapshot.Webhooks {
+		repo.webhooks.put(h)
+	}
+	for _, dl := range snapshot.DeadLetters {
+		dl.Payload.Event.localize()
+		repo.webhooks.bury(dl)
+	}
 }
 
-func (scope *Scope) DayEvents(w http.ResponseWriter, r *http.Request) {
-	scope.logger.Println(r.URL)
-	if r.Method != http.MethodGet {
-		sendErr(w, "Not correct method", http.StatusBadRequest)
-		return
-	}
+// Create сохраняет новое событие, если в хранилище нет события с таким же ID
+func (repo *MemoryRepository) Create(event Event) (Event, error) {
+	repo.Lock()
+	defer repo.Unlock()
 
-	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
-	date, err := time.Parse("2006-01-02", r.URL.Query().Get("date"))
-	if err != nil {
-		sendErr(w, "Incorrect args", http.StatusBadRequest)
-		return
+	if event.ID == 0 {
+		repo.lastID++
+		event.ID = repo.lastID
+	} else if repo.checkEvent(event) {
+		return event, ErrDuplicateEvent
+	} else if event.ID > repo.lastID {
+		repo.lastID = event.ID
 	}
-	events, err := scope.DayEventsFunc(userID, date)
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusInternalServerError)
-		return
+	event.Version = 1
+	repo.insert(event)
+	return event, nil
+}
+
+// insert добавляет событие в данные и индексы, вызывается под блокировкой
+func (repo *MemoryRepository) insert(event Event) {
+	repo.m[event.UserID] = append(repo.m[event.UserID], event)
+	repo.owners[event.ID] = event.UserID
+	if repo.index[event.UserID] == nil {
+		repo.index[event.UserID] = &intervalIndex{}
 	}
-	sendRes(w, "Success", events, http.StatusOK)
+	repo.index[event.UserID].add(event)
+	repo.invite(event)
+	repo.search.add(event)
 }
 
-func (scope *Scope) WeekEventsFunc(userID int, date time.Time) ([]Event, error) {
-	scope.EventRepository.RWMutex.RLock()
-	scope.EventRepository.RWMutex.RUnlock()
+// PutTrash кладет событие в корзину
+func (repo *MemoryRepository) PutTrash(t TrashedEvent) error {
+	repo.Lock()
+	defer repo.Unlock()
 
-	var result []Event
+	repo.putTrash(t)
+	return nil
+}
 
-	var allUserEvents []Event
-	allUserEvents = scope.EventRepository.m[userID]
-	if allUserEvents == nil {
-		return nil, errors.New("unknown user_id")
+// putTrash кладет событие в корзину, вызывается под блокировкой
+func (repo *MemoryRepository) putTrash(t TrashedEvent) {
+	if repo.trash[t.UserID] == nil {
+		repo.trash[t.UserID] = make(map[int]TrashedEvent)
 	}
+	repo.trash[t.UserID][t.ID] = t
+}
 
-	for _, event := range allUserEvents {
-		difference := date.Sub(event.Date.date)
-		if difference < 0 {
-			difference = -difference
+// Trash возвращает корзину пользователя, последние удаленные события идут первыми
+func (repo *MemoryRepository) Trash(userID int) ([]TrashedEvent, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	res := make([]TrashedEvent, 0, len(repo.trash[userID]))
+	for _, t := range repo.trash[userID] {
+		res = append(res, t)
+	}
+	sortTrash(res)
+	return res, nil
+}
+
+// sortTrash сортирует корзину: последние удаленные события идут первыми
+func sortTrash(trash []TrashedEvent) {
+	sort.Slice(trash, func(i, j int) bool {
+		if !trash[i].DeletedAt.Equal(trash[j].DeletedAt) {
+			return trash[i].DeletedAt.After(trash[j].DeletedAt)
 		}
-		if difference <= time.Duration(7*24)*time.Hour {
-			result = append(result, event)
+		return trash[i].ID > trash[j].ID
+	})
+}
+
+// ExpiredTrash ищет просроченные события во всех корзинах
+func (repo *MemoryRepository) ExpiredTrash(before time.Time) ([]TrashedEvent, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	var res []TrashedEvent
+	for _, trash := range repo.trash {
+		for _, t := range trash {
+			if t.DeletedAt.Before(before) {
+				res = append(res, t)
+			}
 		}
 	}
-	return result, nil
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
 }
 
-func (scope *Scope) WeekEvents(w http.ResponseWriter, r *http.Request) {
-	scope.logger.Println(r.URL)
-	if r.Method != http.MethodGet {
-		sendErr(w, "Not correct method", http.StatusBadRequest)
-		return
+// Restore переносит событие из корзины обратно в события пользователя
+func (repo *MemoryRepository) Restore(userID, id int) (Event, error) {
+	repo.Lock()
+	defer repo.Unlock()
+
+	t, ok := repo.trash[userID][id]
+	if !ok {
+		return Event{}, ErrEventNotFound
+	}
+	if _, ok := repo.owners[id]; ok {
+		return Event{}, ErrDuplicateEvent
 	}
+	repo.dropTrash(userID, id)
+	e := t.Event
+	e.Version++
+	repo.insert(e)
+	return e, nil
+}
 
-	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
-	date, err := time.Parse("2006-01-02", r.URL.Query().Get("date"))
-	if err != nil {
-		sendErr(w, "Incorrect args", http.StatusBadRequest)
-		return
+// Purge удаляет событие из корзины
+func (repo *MemoryRepository) Purge(userID, id int) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	if _, ok := repo.trash[userID][id]; !ok {
+		return ErrEventNotFound
 	}
-	events, err := scope.WeekEventsFunc(userID, date)
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusInternalServerError)
-		return
+	repo.dropTrash(userID, id)
+	return nil
+}
+
+// dropTrash убирает событие из корзины, вызывается под блокировкой
+func (repo *MemoryRepository) dropTrash(userID, id int) {
+	delete(repo.trash[userID], id)
+	if len(repo.trash[userID]) == 0 {
+		delete(repo.trash, userID)
 	}
-	sendRes(w, "Success", events, http.StatusOK)
 }
 
-func (scope *Scope) MonthEventsFunc(userID int, date time.Time) ([]Event, error) {
-	scope.EventRepository.RWMutex.RLock()
-	scope.EventRepository.RWMutex.RUnlock()
+// AppendHistory дописывает запись в журнал изменений события
+func (repo *MemoryRepository) AppendHistory(entry AuditEntry) error {
+	repo.Lock()
+	defer repo.Unlock()
 
-	var result []Event
+	repo.history[entry.EventID] = append(repo.history[entry.EventID], entry)
+	return nil
+}
+
+// PutWebhook сохраняет вебхук
+func (repo *MemoryRepository) PutWebhook(h Webhook) (Webhook, error) {
+	repo.Lock()
+	defer repo.Unlock()
+
+	return repo.webhooks.put(h), nil
+}
+
+// DeleteWebhook удаляет вебхук
+func (repo *MemoryRepository) DeleteWebhook(id int) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	return repo.webhooks.delete(id)
+}
+
+// Webhooks возвращает копии всех вебхуков
+func (repo *MemoryRepository) Webhooks() ([]Webhook, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	return repo.webhooks.list(), nil
+}
+
+// AppendDeadLetter сохраняет недоставленное изменение
+func (repo *MemoryRepository) AppendDeadLetter(dl DeadLetter) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	repo.webhooks.bury(dl)
+	return nil
+}
 
-	var allUserEvents []Event
-	allUserEvents = scope.EventRepository.m[userID]
-	if allUserEvents == nil {
-		return nil, errors.New("unknown user_id")
+// DeadLetters возвращает копию недоставленных изменений
+func (repo *MemoryRepository) DeadLetters() ([]DeadLetter, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	return append([]DeadLetter(nil), repo.webhooks.dead...), nil
+}
+
+// History возвращает копию журнала изменений события
+func (repo *MemoryRepository) History(id int) ([]AuditEntry, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	entries, ok := repo.history[id]
+	if !ok {
+		return nil, ErrEventNotFound
 	}
+	return append([]AuditEntry(nil), entries...), nil
+}
 
-	for _, event := range allUserEvents {
-		if event.Date.date.Year() == date.Year() || event.Date.date.Month() == date.Month() {
-			result = append(result, event)
+// invite добавляет событие в приглашения его участников, вызывается под блокировкой
+func (repo *MemoryRepository) invite(e Event) {
+	for _, a := range e.Attendees {
+		if repo.invitations[a.UserID] == nil {
+			repo.invitations[a.UserID] = make(map[int]bool)
 		}
+		repo.invitations[a.UserID][e.ID] = true
 	}
-	return result, nil
 }
 
-func (scope *Scope) MonthEvents(w http.ResponseWriter, r *http.Request) {
-	scope.logger.Println(r.URL)
-	if r.Method != http.MethodGet {
-		sendErr(w, "Not correct method", http.StatusBadRequest)
-		return
+// uninvite убирает событие из приглашений его участников, вызывается под блокировкой
+func (repo *MemoryRepository) uninvite(e Event) {
+	for _, a := range e.Attendees {
+		delete(repo.invitations[a.UserID], e.ID)
+		if len(repo.invitations[a.UserID]) == 0 {
+			delete(repo.invitations, a.UserID)
+		}
 	}
+}
 
-	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
-	date, err := time.Parse("2006-01-02", r.URL.Query().Get("date"))
-	if err != nil {
-		sendErr(w, "Incorrect args", http.StatusBadRequest)
-		return
-	}
-	events, err := scope.MonthEventsFunc(userID, date)
-	if err != nil {
-		sendErr(w, err.Error(), http.StatusInternalServerError)
-		return
+// versionConflict формирует ошибку несовпадения версий
+func versionConflict(expected, current int) error {
+	return fmt.Errorf("%w (expected version %d, current %d)", ErrVersionConflict, expected, current)
+}
+
+// Update заменяет данные существующего события
+func (repo *MemoryRepository) Update(e Event, expectedVersion int) (Event, error) {
+	repo.Lock()
+	defer repo.Unlock()
+
+	events := repo.m[e.UserID]
+	for ind := 0; ind < len(events); ind++ {
+		if events[ind].ID == e.ID {
+			if expectedVersion != 0 && events[ind].Version != expectedVersion {
+				return e, versionConflict(expectedVersion, events[ind].Version)
+			}
+			e.Version = events[ind].Version + 1
+			repo.index[e.UserID].remove(events[ind])
+			repo.index[e.UserID].add(e)
+			repo.uninvite(events[ind])
+			repo.invite(e)
+			repo.search.remove(events[ind])
+			repo.search.add(e)
+			events[ind] = e
+			return e, nil
+		}
 	}
-	sendRes(w, "Success", events, http.StatusOK)
+	return e, ErrEventNotFound
 }
 
-func main() {
-	scope := CreateScope()
-	scope.startingServer()
+// Delete удаляет событие из среза событий пользователя
+func (repo *MemoryRepository) Delete(cEvent ConcreteEvent) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	events := repo.m[cEvent.UserID]
+	for ind := 0; ind < len(events); ind++ {
+		if events[ind].ID == cEvent.ID {
+			if cEvent.ExpectedVersion != 0 && events[ind].Version != cEvent.ExpectedVersion {
+				return versionConflict(cEvent.ExpectedVersion, events[ind].Version)
+			}
+			repo.index[cEvent.UserID].remove(events[ind])
+			repo.uninvite(events[ind])
+			repo.search.remove(events[ind])
+			delete(repo.owners, cEvent.ID)
+			repo.m[cEvent.UserID] = append(events[0:ind], events[ind+1:]...)
+			return nil
+		}
+	}
+	return ErrEventNotFound
+}
+
+// Get ищет событие пользователя по идентификатору
+func (repo *MemoryRepository) Get(userID, id int) (Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	for _, e := range repo.m[userID] {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return Event{}, ErrEventNotFound
+}
+
+// UserEvents возвращает копию событий пользователя, чтобы вызывающий код не держал блокировку
+func (repo *MemoryRepository) UserEvents(userID int) ([]Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	events, ok := repo.m[userID]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return append([]Event(nil), events...), nil
+}
+
+// Invited ищет события, на которые приглашен пользователь, по индексу приглашений
+func (repo *MemoryRepository) Invited(userID int) ([]Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	var res []Event
+	for id := range repo.invitations[userID] {
+		if e, ok := repo.find(id); ok {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// Search ищет события по обратному индексу
+func (repo *MemoryRepository) Search(userID int, terms, tags []string) ([]Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	var res []Event
+	if len(terms) == 0 && len(tags) == 0 {
+		res = append(res, repo.m[userID]...)
+		for id := range repo.invitations[userID] {
+			if e, ok := repo.find(id); ok {
+				res = append(res, e)
+			}
+		}
+	} else {
+		for id := range repo.search.match(terms, tags) {
+			if repo.owners[id] != userID && !repo.invitations[userID][id] {
+				continue
+			}
+			if e, ok := repo.find(id); ok {
+				res = append(res, e)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// find ищет событие по ID среди событий его владельца, вызывается под блокировкой
+func (repo *MemoryRepository) find(id int) (Event, bool) {
+	owner, ok := repo.owners[id]
+	if !ok {
+		return Event{}, false
+	}
+	for _, e := range repo.m[owner] {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Event{}, false
+}
+
+// Overlapping ищет события пользователя в интервале по индексу
+func (repo *MemoryRepository) Overlapping(userID int, from, to time.Time) ([]Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	idx, ok := repo.index[userID]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return idx.query(from, to), nil
+}
+
+// OverlappingAll ищет события всех пользователей в интервале по индексам
+func (repo *MemoryRepository) OverlappingAll(from, to time.Time) ([]Event, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	var res []Event
+	for _, idx := range repo.index {
+		res = append(res, idx.query(from, to)...)
+	}
+	return res, nil
+}
+
+// Transaction выполняет fn под блокировкой хранилища на запись. tx работает с теми же данными
+// без этой блокировки и запоминает исходные события пользователей, которые меняет, чтобы вернуть их при откате
+func (repo *MemoryRepository) Transaction(fn func(tx EventRepository) error) error {
+	repo.Lock()
+	defer repo.Unlock()
+
+	tx := &memoryTx{
+		MemoryRepository: &MemoryRepository{
+			m:            repo.m,
+			index:        repo.index,
+			owners:       repo.owners,
+			invitations:  repo.invitations,
+			search:       repo.search,
+			trash:        repo.trash,
+			history:      repo.history,
+			lastID:       repo.lastID,
+			webhooks:     repo.webhooks,
+			timedRWMutex: newTimedRWMutex(),
+		},
+		saved:        map[int][]Event{},
+		savedTrash:   map[int]map[int]TrashedEvent{},
+		savedHistory: map[int]int{},
+	}
+	committed := false
+	// Откат выполняется и при панике в fn, чтобы хранилище не осталось в промежуточном состоянии
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	repo.lastID = tx.lastID
+	return nil
+}
+
+// memoryTx - транзакция хранилища в памяти
+type memoryTx struct {
+	*MemoryRepository
+	// saved - события пользователей до первого изменения в транзакции, nil - у пользователя не было событий
+	saved map[int][]Event
+	// savedTrash - корзины тех же пользователей, nil - корзина была пуста
+	savedTrash map[int]map[int]TrashedEvent
+	// savedHistory - длина журнала изменений события до первой записи в транзакции
+	savedHistory map[int]int
+	// savedWebhooks - вебхуки до первого их изменения в транзакции, nil - не менялись
+	savedWebhooks *webhookData
+}
+
+// touch запоминает события и корзину пользователя перед первым изменением
+func (tx *memoryTx) touch(userID int) {
+	if _, ok := tx.saved[userID]; ok {
+		return
+	}
+	var events []Event
+	if stored, ok := tx.m[userID]; ok {
+		events = append([]Event{}, stored...)
+	}
+	tx.saved[userID] = events
+
+	var trash map[int]TrashedEvent
+	if stored, ok := tx.trash[userID]; ok {
+		trash = make(map[int]TrashedEvent, len(stored))
+		for id, t := range stored {
+			trash[id] = t
+		}
+	}
+	tx.savedTrash[userID] = trash
+}
+
+// Create сохраняет событие в транзакции
+func (tx *memoryTx) Create(event Event) (Event, error) {
+	tx.touch(event.UserID)
+	return tx.MemoryRepository.Create(event)
+}
+
+// Update изменяет событие в транзакции
+func (tx *memoryTx) Update(e Event, expectedVersion int) (Event, error) {
+	tx.touch(e.UserID)
+	return tx.MemoryRepository.Update(e, expectedVersion)
+}
+
+// Delete удаляет событие в транзакции
+func (tx *memoryTx) Delete(cEvent ConcreteEvent) error {
+	tx.touch(cEvent.UserID)
+	return tx.MemoryRepository.Delete(cEvent)
+}
+
+// PutTrash кладет событие в корзину в транзакции
+func (tx *memoryTx) PutTrash(t TrashedEvent) error {
+	tx.touch(t.UserID)
+	return tx.MemoryRepository.PutTrash(t)
+}
+
+// Restore возвращает событие из корзины в транзакции
+func (tx *memoryTx) Restore(userID, id int) (Event, error) {
+	tx.touch(userID)
+	return tx.MemoryRepository.Restore(userID, id)
+}
+
+// Purge удаляет событие из корзины в транзакции
+func (tx *memoryTx) Purge(userID, id int) error {
+	tx.touch(userID)
+	return tx.MemoryRepository.Purge(userID, id)
+}
+
+// AppendHistory дописывает журнал изменений в транзакции
+func (tx *memoryTx) AppendHistory(entry AuditEntry) error {
+	if _, ok := tx.savedHistory[entry.EventID]; !ok {
+		tx.savedHistory[entry.EventID] = len(tx.history[entry.EventID])
+	}
+	return tx.MemoryRepository.AppendHistory(entry)
+}
+
+// saveWebhooks запоминает вебхуки перед первым изменением
+func (tx *memoryTx) saveWebhooks() {
+	if tx.savedWebhooks == nil {
+		tx.savedWebhooks = tx.webhooks.clone()
+	}
+}
+
+// PutWebhook сохраняет вебхук в транзакции
+func (tx *memoryTx) PutWebhook(h Webhook) (Webhook, error) {
+	tx.saveWebhooks()
+	return tx.MemoryRepository.PutWebhook(h)
+}
+
+// DeleteWebhook удаляет вебхук в транзакции
+func (tx *memoryTx) DeleteWebhook(id int) error {
+	tx.saveWebhooks()
+	return tx.MemoryRepository.DeleteWebhook(id)
+}
+
+// AppendDeadLetter сохраняет недоставленное изменение в транзакции
+func (tx *memoryTx) AppendDeadLetter(dl DeadLetter) error {
+	tx.saveWebhooks()
+	return tx.MemoryRepository.AppendDeadLetter(dl)
+}
+
+// Transaction внутри транзакции выполняет fn в ней же
+func (tx *memoryTx) Transaction(fn func(tx EventRepository) error) error {
+	return fn(tx)
+}
+
+// rollback возвращает события и корзины измененных пользователей, перестраивает их индексы,
+// отбрасывает записи журнала изменений и возвращает вебхуки
+func (tx *memoryTx) rollback() {
+	if tx.savedWebhooks != nil {
+		*tx.webhooks = *tx.savedWebhooks
+	}
+	for userID, trash := range tx.savedTrash {
+		if trash == nil {
+			delete(tx.trash, userID)
+		} else {
+			tx.trash[userID] = trash
+		}
+	}
+	for id, n := range tx.savedHistory {
+		if n == 0 {
+			delete(tx.history, id)
+		} else {
+			tx.history[id] = tx.history[id][:n]
+		}
+	}
+	for userID, events := range tx.saved {
+		for _, e := range tx.m[userID] {
+			tx.uninvite(e)
+			tx.search.remove(e)
+			delete(tx.owners, e.ID)
+		}
+		if events == nil {
+			delete(tx.m, userID)
+			delete(tx.index, userID)
+			continue
+		}
+		idx := &intervalIndex{}
+		for _, e := range events {
+			idx.add(e)
+			tx.invite(e)
+			tx.search.add(e)
+			tx.owners[e.ID] = userID
+		}
+		tx.m[userID] = events
+		tx.index[userID] = idx
+	}
+}
+
+// Stats возвращает число событий пользователей и гистограммы ожидания блокировки
+func (repo *MemoryRepository) Stats() (RepositoryStats, error) {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	stats := RepositoryStats{
+		Events:        make(map[int]int, len(repo.m)),
+		ReadLockWait:  repo.readWait,
+		WriteLockWait: repo.writeWait,
+	}
+	for userID, events := range repo.m {
+		stats.Events[userID] = len(events)
+	}
+	return stats, nil
+}
+
+// Close для хранилища в памяти ничего не делает
+func (repo *MemoryRepository) Close() error {
+	return nil
+}
+
+// checkEvent проверяет содержится ли событие с таким ID в хранилище, вызывается под блокировкой
+func (repo *MemoryRepository) checkEvent(e Event) bool {
+	_, ok := repo.owners[e.ID]
+	return ok
+}
+
+// errStripeConflict - транзакция не смогла захватить полосу без риска взаимной блокировки
+var errStripeConflict = errors.New("stripe is locked by another transaction")
+
+// stripeIndex возвращает номер полосы для ключа key из n полос
+func stripeIndex(key, n int) int {
+	ind := key % n
+	if ind < 0 {
+		ind += n
+	}
+	return ind
+}
+
+// dateEntry - начало, длительность и ID разового события
+type dateEntry struct {
+	start    time.Time
+	duration time.Duration
+	id       int
+}
+
+// dateIndex - индекс событий пользователя по времени. В отличие от intervalIndex хранит не события,
+// а короткие записи dateEntry, поэтому вставка и удаление сдвигают в несколько раз меньше памяти
+type dateIndex struct {
+	entries []dateEntry
+	// series - ID повторяющихся событий в порядке добавления
+	series      []int
+	maxDuration time.Duration
+}
+
+// searchStart возвращает позицию первой пары с началом не раньше t
+func (idx *dateIndex) searchStart(t time.Time) int {
+	return sort.Search(len(idx.entries), func(i int) bool {
+		return !idx.entries[i].start.Before(t)
+	})
+}
+
+// add добавляет событие в индекс
+func (idx *dateIndex) add(e Event) {
+	if e.Recurrence != nil {
+		idx.series = append(idx.series, e.ID)
+		return
+	}
+	idx.maxDuration = max(idx.maxDuration, e.duration())
+	pos := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].start.After(e.Date.date)
+	})
+	idx.entries = slices.Insert(idx.entries, pos, dateEntry{e.Date.date, e.duration(), e.ID})
+}
+
+// remove удаляет событие из индекса, old - его сохраненная версия. После удаления самого длинного
+// события maxDuration пересчитывается
+func (idx *dateIndex) remove(old Event) {
+	if old.Recurrence != nil {
+		if ind := slices.Index(idx.series, old.ID); ind >= 0 {
+			idx.series = slices.Delete(idx.series, ind, ind+1)
+		}
+		return
+	}
+	for ind := idx.searchStart(old.Date.date); ind < len(idx.entries); ind++ {
+		if idx.entries[ind].id == old.ID {
+			idx.entries = slices.Delete(idx.entries, ind, ind+1)
+			break
+		}
+	}
+	if old.duration() == idx.maxDuration {
+		idx.maxDuration = 0
+		for _, entry := range idx.entries {
+			idx.maxDuration = max(idx.maxDuration, entry.duration)
+		}
+	}
+}
+
+// query возвращает разовые события из events, пересекающиеся с [from, to), и все серии
+func (idx *dateIndex) query(events map[int]Event, from, to time.Time) []Event {
+	var result []Event
+	for ind := idx.searchStart(from.Add(-idx.maxDuration)); ind < len(idx.entries); ind++ {
+		entry := idx.entries[ind]
+		if !entry.start.Before(to) {
+			break
+		}
+		if e := events[entry.id]; e.overlaps(from, to) {
+			result = append(result, e)
+		}
+	}
+	for _, id := range idx.series {
+		result = append(result, events[id])
+	}
+	return result
+}
+
+// userData - события и корзина одного пользователя с индексами по ID и по времени
+type userData struct {
+	// events - индекс по ID
+	events map[int]Event
+	// dates - индекс по времени
+	dates  *dateIndex
+	search *searchIndex
+	trash  map[int]TrashedEvent
+}
+
+// newUserData создает пустые данные пользователя
+func newUserData() *userData {
+	return &userData{
+		events: make(map[int]Event),
+		dates:  &dateIndex{},
+		search: newSearchIndex(),
+		trash:  make(map[int]TrashedEvent),
+	}
+}
+
+// add добавляет событие в индексы пользователя
+func (u *userData) add(e Event) {
+	u.events[e.ID] = e
+	u.dates.add(e)
+	u.search.add(e)
+}
+
+// remove убирает сохраненное событие из индексов пользователя
+func (u *userData) remove(old Event) {
+	delete(u.events, old.ID)
+	u.dates.remove(old)
+	u.search.remove(old)
+}
+
+// list возвращает события пользователя в порядке ID
+func (u *userData) list() []Event {
+	res := make([]Event, 0, len(u.events))
+	for _, e := range u.events {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// eventStripe - полоса пользователей: пользователь попадает в полосу по своему ID
+type eventStripe struct {
+	*timedRWMutex
+	// ind - номер полосы, задает порядок захвата полос
+	ind   int
+	users map[int]*userData
+}
+
+// refStripe - полоса связей между пользователями: владельцы и журналы изменений событий
+// лежат в полосе по ID события, приглашения - в полосе по ID участника.
+// Блокировка полосы связей берется последней и не удерживается при захвате других блокировок
+type refStripe struct {
+	sync.Mutex
+	owners map[int]int
+	// invitations - ID события -> владелец для каждого участника
+	invitations map[int]map[int]int
+	history     map[int][]AuditEntry
+}
+
+// shardedData - данные хранилища, общие для него и его транзакций
+type shardedData struct {
+	stripes []*eventStripe
+	refs    []*refStripe
+	lastID  atomic.Int64
+	// webhooks - вебхуки и недоставленные изменения, защищены webhookMu
+	webhookMu sync.Mutex
+	webhooks  *webhookData
+	// readWait и writeWait - время ожидания блокировок всех полос
+	readWait  *Histogram
+	writeWait *Histogram
+}
+
+// ShardedRepository - хранилище событий в памяти, разбитое на полосы по пользователям: запросы
+// к пользователям разных полос не ждут друг друга. События пользователя проиндексированы по ID
+// и по времени, поэтому поиск события и запросы интервалов не просматривают все события
+type ShardedRepository struct {
+	*shardedData
+	// tx - транзакция, через которую работает хранилище, nil - вне транзакции
+	tx *shardedTx
+}
+
+// NewShardedRepository создает пустое хранилище из n полос
+func NewShardedRepository(n int) *ShardedRepository {
+	data := &shardedData{
+		stripes:   make([]*eventStripe, n),
+		refs:      make([]*refStripe, n),
+		webhooks:  newWebhookData(),
+		readWait:  NewHistogram(lockWaitBuckets),
+		writeWait: NewHistogram(lockWaitBuckets),
+	}
+	for ind := range data.stripes {
+		data.stripes[ind] = &eventStripe{
+			timedRWMutex: &timedRWMutex{readWait: data.readWait, writeWait: data.writeWait},
+			ind:          ind,
+			users:        make(map[int]*userData),
+		}
+		data.refs[ind] = &refStripe{
+			owners:      make(map[int]int),
+			invitations: make(map[int]map[int]int),
+			history:     make(map[int][]AuditEntry),
+		}
+	}
+	return &ShardedRepository{shardedData: data}
+}
+
+// userStripe возвращает полосу пользователя
+func (data *shardedData) userStripe(userID int) *eventStripe {
+	return data.stripes[stripeIndex(userID, len(data.stripes))]
+}
+
+// ref возвращает полосу связей для ID события или участника
+func (data *shardedData) ref(key int) *refStripe {
+	return data.refs[stripeIndex(key, len(data.refs))]
+}
+
+// claim назначает событию id владельца, если у события его еще нет
+func (data *shardedData) claim(id, userID int) bool {
+	ref := data.ref(id)
+	ref.Lock()
+	defer ref.Unlock()
+
+	if _, ok := ref.owners[id]; ok {
+		return false
+	}
+	ref.owners[id] = userID
+	return true
+}
+
+// disown убирает владельца события id
+func (data *shardedData) disown(id int) {
+	ref := data.ref(id)
+	ref.Lock()
+	delete(ref.owners, id)
+	ref.Unlock()
+}
+
+// invite добавляет событие в приглашения его участников
+func (data *shardedData) invite(e Event) {
+	for _, a := range e.Attendees {
+		ref := data.ref(a.UserID)
+		ref.Lock()
+		if ref.invitations[a.UserID] == nil {
+			ref.invitations[a.UserID] = make(map[int]int)
+		}
+		ref.invitations[a.UserID][e.ID] = e.UserID
+		ref.Unlock()
+	}
+}
+
+// uninvite убирает событие из приглашений его участников
+func (data *shardedData) uninvite(e Event) {
+	for _, a := range e.Attendees {
+		ref := data.ref(a.UserID)
+		ref.Lock()
+		delete(ref.invitations[a.UserID], e.ID)
+		if len(ref.invitations[a.UserID]) == 0 {
+			delete(ref.invitations, a.UserID)
+		}
+		ref.Unlock()
+	}
+}
+
+// raiseLastID поднимает последний выданный ID до id
+func (data *shardedData) raiseLastID(id int) {
+	for {
+		last := data.lastID.Load()
+		if int64(id) <= last || data.lastID.CompareAndSwap(last, int64(id)) {
+			return
+		}
+	}
+}
+
+// lock захватывает полосу на чтение или запись и возвращает функцию освобождения.
+// В транзакции полоса захватывается на запись до ее завершения
+func (repo *ShardedRepository) lock(s *eventStripe, write bool) (func(), error) {
+	if repo.tx != nil {
+		return func() {}, repo.tx.acquire(s)
+	}
+	if write {
+		s.Lock()
+		return s.Unlock, nil
+	}
+	s.RLock()
+	return s.RUnlock, nil
+}
+
+// undo запоминает отмену изменения, если хранилище работает в транзакции
+func (repo *ShardedRepository) undo(fn func()) {
+	if repo.tx != nil {
+		repo.tx.undo = append(repo.tx.undo, fn)
+	}
+}
+
+// user возвращает данные пользователя полосы s, создавая их при необходимости.
+// Вызывается под блокировкой полосы на запись
+func (repo *ShardedRepository) user(s *eventStripe, userID int) *userData {
+	u := s.users[userID]
+	if u == nil {
+		u = newUserData()
+		s.users[userID] = u
+		repo.undo(func() { delete(s.users, userID) })
+	}
+	return u
+}
+
+// insert добавляет событие в данные пользователя и приглашения участников
+func (repo *ShardedRepository) insert(u *userData, e Event) {
+	u.add(e)
+	repo.invite(e)
+	repo.undo(func() {
+		u.remove(e)
+		repo.uninvite(e)
+	})
+}
+
+// drop убирает событие из данных пользователя и приглашений участников
+func (repo *ShardedRepository) drop(u *userData, e Event) {
+	u.remove(e)
+	repo.uninvite(e)
+	repo.undo(func() {
+		u.add(e)
+		repo.invite(e)
+	})
+}
+
+// claimNew назначает владельца новому событию, в транзакции владелец снимается при откате
+func (repo *ShardedRepository) claimNew(id, userID int) bool {
+	if !repo.claim(id, userID) {
+		return false
+	}
+	repo.undo(func() { repo.disown(id) })
+	return true
+}
+
+// release снимает владельца удаленного события, в транзакции владелец возвращается при откате
+func (repo *ShardedRepository) release(id, userID int) {
+	repo.disown(id)
+	repo.undo(func() { repo.claim(id, userID) })
+}
+
+// setTrash кладет событие в корзину пользователя или, если t равно nil, убирает событие id из нее
+func (repo *ShardedRepository) setTrash(u *userData, id int, t *TrashedEvent) {
+	prev, had := u.trash[id]
+	if t != nil {
+		u.trash[id] = *t
+	} else {
+		delete(u.trash, id)
+	}
+	repo.undo(func() {
+		if had {
+			u.trash[id] = prev
+		} else {
+			delete(u.trash, id)
+		}
+	})
+}
+
+// Create сохраняет новое событие, если в хранилище нет события с таким же ID
+func (repo *ShardedRepository) Create(event Event) (Event, error) {
+	s := repo.userStripe(event.UserID)
+	unlock, err := repo.lock(s, true)
+	defer unlock()
+	if err != nil {
+		return event, err
+	}
+
+	if event.ID == 0 {
+		event.ID = int(repo.lastID.Add(1))
+	} else {
+		repo.raiseLastID(event.ID)
+	}
+	if !repo.claimNew(event.ID, event.UserID) {
+		return event, ErrDuplicateEvent
+	}
+	event.Version = 1
+	repo.insert(repo.user(s, event.UserID), event)
+	return event, nil
+}
+
+// Update заменяет данные существующего события
+func (repo *ShardedRepository) Update(e Event, expectedVersion int) (Event, error) {
+	s := repo.userStripe(e.UserID)
+	unlock, err := repo.lock(s, true)
+	defer unlock()
+	if err != nil {
+		return e, err
+	}
+
+	old, ok := s.users[e.UserID].event(e.ID)
+	if !ok {
+		return e, ErrEventNotFound
+	}
+	if expectedVersion != 0 && old.Version != expectedVersion {
+		return e, versionConflict(expectedVersion, old.Version)
+	}
+	e.Version = old.Version + 1
+	u := s.users[e.UserID]
+	repo.drop(u, old)
+	repo.insert(u, e)
+	return e, nil
+}
+
+// event ищет событие по ID, u может быть nil
+func (u *userData) event(id int) (Event, bool) {
+	if u == nil {
+		return Event{}, false
+	}
+	e, ok := u.events[id]
+	return e, ok
+}
+
+// trashed ищет событие в корзине по ID, u может быть nil
+func (u *userData) trashed(id int) (TrashedEvent, bool) {
+	if u == nil {
+		return TrashedEvent{}, false
+	}
+	t, ok := u.trash[id]
+	return t, ok
+}
+
+// Delete удаляет событие пользователя
+func (repo *ShardedRepository) Delete(cEvent ConcreteEvent) error {
+	s := repo.userStripe(cEvent.UserID)
+	unlock, err := repo.lock(s, true)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+
+	old, ok := s.users[cEvent.UserID].event(cEvent.ID)
+	if !ok {
+		return ErrEventNotFound
+	}
+	if cEvent.ExpectedVersion != 0 && old.Version != cEvent.ExpectedVersion {
+		return versionConflict(cEvent.ExpectedVersion, old.Version)
+	}
+	repo.drop(s.users[cEvent.UserID], old)
+	repo.release(old.ID, cEvent.UserID)
+	return nil
+}
+
+// Get ищет событие пользователя по индексу ID
+func (repo *ShardedRepository) Get(userID, id int) (Event, error) {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, false)
+	defer unlock()
+	if err != nil {
+		return Event{}, err
+	}
+
+	e, ok := s.users[userID].event(id)
+	if !ok {
+		return Event{}, ErrEventNotFound
+	}
+	return e, nil
+}
+
+// UserEvents возвращает копию событий пользователя в порядке ID
+func (repo *ShardedRepository) UserEvents(userID int) ([]Event, error) {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, false)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return u.list(), nil
+}
+
+// invitedEvents читает события, на которые приглашен пользователь, из полос их владельцев.
+// Событие, удаленное между чтением приглашений и чтением полосы, пропускается
+func (repo *ShardedRepository) invitedEvents(userID int, match func(e Event) bool) ([]Event, error) {
+	ref := repo.ref(userID)
+	ref.Lock()
+	invitations := make(map[int]int, len(ref.invitations[userID]))
+	for id, owner := range ref.invitations[userID] {
+		invitations[id] = owner
+	}
+	ref.Unlock()
+
+	var res []Event
+	for id, owner := range invitations {
+		s := repo.userStripe(owner)
+		unlock, err := repo.lock(s, false)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		e, ok := s.users[owner].event(id)
+		unlock()
+		if ok && match(e) {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+// Invited ищет события, на которые приглашен пользователь, по индексу приглашений
+func (repo *ShardedRepository) Invited(userID int) ([]Event, error) {
+	res, err := repo.invitedEvents(userID, func(Event) bool { return true })
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, err
+}
+
+// Search ищет события пользователя по его обратному индексу, а события, на которые он приглашен, -
+// проверкой каждого приглашения
+func (repo *ShardedRepository) Search(userID int, terms, tags []string) ([]Event, error) {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, false)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	var res []Event
+	if u := s.users[userID]; u != nil {
+		if len(terms) == 0 && len(tags) == 0 {
+			res = u.list()
+		} else {
+			for id := range u.search.match(terms, tags) {
+				res = append(res, u.events[id])
+			}
+		}
+	}
+	unlock()
+
+	invited, err := repo.invitedEvents(userID, func(e Event) bool { return e.matches(terms, tags) })
+	if err != nil {
+		return nil, err
+	}
+	res = append(res, invited...)
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// matches проверяет, что событие содержит все слова terms и все теги tags
+func (e Event) matches(terms, tags []string) bool {
+	idx := newSearchIndex()
+	idx.add(e)
+	return len(terms)+len(tags) == 0 || idx.match(terms, tags)[e.ID]
+}
+
+// Overlapping ищет события пользователя в интервале по индексу времени
+func (repo *ShardedRepository) Overlapping(userID int, from, to time.Time) ([]Event, error) {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, false)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return u.dates.query(u.events, from, to), nil
+}
+
+// eachStripe вызывает fn для каждой полосы под ее блокировкой на чтение, захватывая полосы по одной
+func (repo *ShardedRepository) eachStripe(fn func(s *eventStripe)) error {
+	for _, s := range repo.stripes {
+		unlock, err := repo.lock(s, false)
+		if err == nil {
+			fn(s)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OverlappingAll ищет события всех пользователей в интервале, просматривая полосы по одной
+func (repo *ShardedRepository) OverlappingAll(from, to time.Time) ([]Event, error) {
+	var res []Event
+	err := repo.eachStripe(func(s *eventStripe) {
+		for _, u := range s.users {
+			res = append(res, u.dates.query(u.events, from, to)...)
+		}
+	})
+	return res, err
+}
+
+// PutTrash кладет событие в корзину
+func (repo *ShardedRepository) PutTrash(t TrashedEvent) error {
+	s := repo.userStripe(t.UserID)
+	unlock, err := repo.lock(s, true)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+
+	repo.setTrash(repo.user(s, t.UserID), t.ID, &t)
+	repo.raiseLastID(t.ID)
+	return nil
+}
+
+// Trash возвращает корзину пользователя, последние удаленные события идут первыми
+func (repo *ShardedRepository) Trash(userID int) ([]TrashedEvent, error) {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, false)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	res := []TrashedEvent{}
+	if u := s.users[userID]; u != nil {
+		for _, t := range u.trash {
+			res = append(res, t)
+		}
+	}
+	sortTrash(res)
+	return res, nil
+}
+
+// ExpiredTrash ищет просроченные события в корзинах всех полос
+func (repo *ShardedRepository) ExpiredTrash(before time.Time) ([]TrashedEvent, error) {
+	var res []TrashedEvent
+	err := repo.eachStripe(func(s *eventStripe) {
+		for _, u := range s.users {
+			for _, t := range u.trash {
+				if t.DeletedAt.Before(before) {
+					res = append(res, t)
+				}
+			}
+		}
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, err
+}
+
+// Restore переносит событие из корзины обратно в события пользователя
+func (repo *ShardedRepository) Restore(userID, id int) (Event, error) {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, true)
+	defer unlock()
+	if err != nil {
+		return Event{}, err
+	}
+
+	t, ok := s.users[userID].trashed(id)
+	if !ok {
+		return Event{}, ErrEventNotFound
+	}
+	if !repo.claimNew(id, userID) {
+		return Event{}, ErrDuplicateEvent
+	}
+	u := s.users[userID]
+	repo.setTrash(u, id, nil)
+	e := t.Event
+	e.Version++
+	repo.insert(u, e)
+	return e, nil
+}
+
+// Purge удаляет событие из корзины
+func (repo *ShardedRepository) Purge(userID, id int) error {
+	s := repo.userStripe(userID)
+	unlock, err := repo.lock(s, true)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.users[userID].trashed(id); !ok {
+		return ErrEventNotFound
+	}
+	repo.setTrash(s.users[userID], id, nil)
+	return nil
+}
+
+// AppendHistory дописывает запись в журнал изменений события
+func (repo *ShardedRepository) AppendHistory(entry AuditEntry) error {
+	ref := repo.ref(entry.EventID)
+	ref.Lock()
+	defer ref.Unlock()
+
+	n := len(ref.history[entry.EventID])
+	ref.history[entry.EventID] = append(ref.history[entry.EventID], entry)
+	repo.undo(func() {
+		ref.Lock()
+		defer ref.Unlock()
+		if n == 0 {
+			delete(ref.history, entry.EventID)
+		} else {
+			ref.history[entry.EventID] = ref.history[entry.EventID][:n]
+		}
+	})
+	return nil
+}
+
+// History возвращает копию журнала изменений события
+func (repo *ShardedRepository) History(id int) ([]AuditEntry, error) {
+	ref := repo.ref(id)
+	ref.Lock()
+	defer ref.Unlock()
+
+	entries, ok := ref.history[id]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	return append([]AuditEntry(nil), entries...), nil
+}
+
+// PutWebhook сохраняет вебхук
+func (repo *ShardedRepository) PutWebhook(h Webhook) (Webhook, error) {
+	repo.webhookMu.Lock()
+	defer repo.webhookMu.Unlock()
+
+	prev, existed := repo.webhooks.hooks[h.ID]
+	h = repo.webhooks.put(h)
+	repo.undo(func() {
+		repo.webhookMu.Lock()
+		defer repo.webhookMu.Unlock()
+		if existed {
+			repo.webhooks.hooks[h.ID] = prev
+		} else {
+			delete(repo.webhooks.hooks, h.ID)
+		}
+	})
+	return h, nil
+}
+
+// DeleteWebhook удаляет вебхук
+func (repo *ShardedRepository) DeleteWebhook(id int) error {
+	repo.webhookMu.Lock()
+	defer repo.webhookMu.Unlock()
+
+	prev := repo.webhooks.hooks[id]
+	if err := repo.webhooks.delete(id); err != nil {
+		return err
+	}
+	repo.undo(func() {
+		repo.webhookMu.Lock()
+		defer repo.webhookMu.Unlock()
+		repo.webhooks.hooks[id] = prev
+	})
+	return nil
+}
+
+// Webhooks возвращает копии всех вебхуков
+func (repo *ShardedRepository) Webhooks() ([]Webhook, error) {
+	repo.webhookMu.Lock()
+	defer repo.webhookMu.Unlock()
+
+	return repo.webhooks.list(), nil
+}
+
+// AppendDeadLetter сохраняет недоставленное изменение
+func (repo *ShardedRepository) AppendDeadLetter(dl DeadLetter) error {
+	repo.webhookMu.Lock()
+	defer repo.webhookMu.Unlock()
+
+	repo.webhooks.bury(dl)
+	repo.undo(func() {
+		repo.webhookMu.Lock()
+		defer repo.webhookMu.Unlock()
+		dead := repo.webhooks.dead
+		for ind := len(dead) - 1; ind >= 0; ind-- {
+			if dead[ind].WebhookID == dl.WebhookID && dead[ind].Payload.DeliveryID == dl.Payload.DeliveryID {
+				repo.webhooks.dead = slices.Delete(dead, ind, ind+1)
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// DeadLetters возвращает копию недоставленных изменений
+func (repo *ShardedRepository) DeadLetters() ([]DeadLetter, error) {
+	repo.webhookMu.Lock()
+	defer repo.webhookMu.Unlock()
+
+	return append([]DeadLetter(nil), repo.webhooks.dead...), nil
+}
+
+// Stats возвращает число событий пользователей и общие гистограммы ожидания блокировок полос
+func (repo *ShardedRepository) Stats() (RepositoryStats, error) {
+	stats := RepositoryStats{
+		Events:        make(map[int]int),
+		ReadLockWait:  repo.readWait,
+		WriteLockWait: repo.writeWait,
+	}
+	err := repo.eachStripe(func(s *eventStripe) {
+		for userID, u := range s.users {
+			stats.Events[userID] = len(u.events)
+		}
+	})
+	return stats, err
+}
+
+// Close для хранилища в памяти ничего не делает
+func (repo *ShardedRepository) Close() error {
+	return nil
+}
+
+// Transaction выполняет fn, захватывая полосы по мере обращения к ним и удерживая их до конца
+// транзакции. Полосы захватываются в порядке номеров, а полосу с меньшим номером транзакция
+// берет, только если та свободна. Иначе транзакции могли бы ждать друг друга вечно, поэтому
+// изменения отменяются и fn выполняется повторно, заранее захватив все полосы
+func (repo *ShardedRepository) Transaction(fn func(tx EventRepository) error) error {
+	if repo.tx != nil {
+		return fn(repo)
+	}
+	conflict, err := repo.attempt(fn, false)
+	if conflict {
+		_, err = repo.attempt(fn, true)
+	}
+	return err
+}
+
+// attempt выполняет одну попытку транзакции, exclusive захватывает все полосы заранее.
+// Возвращает признак конфликта за полосу и ошибку fn, при конфликте изменения отменяются
+func (repo *ShardedRepository) attempt(fn func(tx EventRepository) error, exclusive bool) (conflict bool, err error) {
+	tx := &shardedTx{held: make(map[int]*eventStripe), maxHeld: -1}
+	if exclusive {
+		for _, s := range repo.stripes {
+			s.Lock()
+			tx.held[s.ind] = s
+		}
+		tx.maxHeld = len(repo.stripes) - 1
+	}
+	view := &ShardedRepository{shardedData: repo.shardedData, tx: tx}
+	committed := false
+	// Откат выполняется и при панике в fn, чтобы хранилище не осталось в промежуточном состоянии
+	defer func() {
+		if !committed {
+			for ind := len(tx.undo) - 1; ind >= 0; ind-- {
+				tx.undo[ind]()
+			}
+		}
+		for _, s := range tx.held {
+			s.Unlock()
+		}
+	}()
+	// Ошибку конфликта fn могла обработать сама, но изменения после нее все равно отменяются
+	if err := fn(view); err != nil || tx.conflict {
+		return tx.conflict, err
+	}
+	committed = true
+	return false, nil
+}
+
+// shardedTx - состояние транзакции хранилища с полосами
+type shardedTx struct {
+	// held - захваченные полосы по номерам, maxHeld - наибольший номер среди них
+	held    map[int]*eventStripe
+	maxHeld int
+	// conflict - полоса не была захвачена, транзакцию нужно повторить
+	conflict bool
+	// undo - отмены изменений транзакции в порядке изменений. Отмены выполняются в обратном порядке,
+	// пока полосы еще захвачены
+	undo []func()
+}
+
+// acquire захватывает полосу на запись до конца транзакции. Полоса с номером меньше уже захваченных
+// берется без ожидания, при неудаче возвращается errStripeConflict
+func (tx *shardedTx) acquire(s *eventStripe) error {
+	if _, ok := tx.held[s.ind]; ok {
+		return nil
+	}
+	if s.ind > tx.maxHeld {
+		s.Lock()
+		tx.maxHeld = s.ind
+	} else if !s.TryLock() {
+		tx.conflict = true
+		return errStripeConflict
+	}
+	tx.held[s.ind] = s
+	return nil
+}
+
+// snapshotData - содержимое файла снимка
+type snapshotData struct {
+	LastID  int                  `json:"last_id"`
+	Events  map[int][]Event      `json:"events"`
+	Trash   []TrashedEvent       `json:"trash,omitempty"`
+	History map[int][]AuditEntry `json:"history,omitempty"`
+	// Webhooks и DeadLetters - вебхуки и недоставленные им изменения. WebhookLastID - последний
+	// выданный ID вебхука, чтобы ID удаленных вебхуков не выдавались повторно
+	Webhooks      []Webhook    `json:"webhooks,omitempty"`
+	WebhookLastID int          `json:"webhook_last_id,omitempty"`
+	DeadLetters   []DeadLetter `json:"dead_letters,omitempty"`
+}
+
+// snapshot возвращает копию всего содержимого хранилища
+func (repo *MemoryRepository) snapshot() snapshotData {
+	repo.RLock()
+	defer repo.RUnlock()
+
+	res := make(map[int][]Event, len(repo.m))
+	for userID, events := range repo.m {
+		res[userID] = append([]Event(nil), events...)
+	}
+	var trash []TrashedEvent
+	for _, userTrash := range repo.trash {
+		for _, t := range userTrash {
+			trash = append(trash, t)
+		}
+	}
+	history := make(map[int][]AuditEntry, len(repo.history))
+	for id, entries := range repo.history {
+		history[id] = append([]AuditEntry(nil), entries...)
+	}
+	return snapshotData{
+		LastID:        repo.lastID,
+		Events:        res,
+		Trash:         trash,
+		History:       history,
+		Webhooks:      repo.webhooks.list(),
+		WebhookLastID: repo.webhooks.lastID,
+		DeadLetters:   append([]DeadLetter(nil), repo.webhooks.dead...),
+	}
+}
+
+// walRecord - одна запись журнала изменений (write-ahead log)
+type walRecord struct {
+	Op              string        `json:"op"`
+	Event           Event         `json:"event"`
+	ExpectedVersion int           `json:"expected_version,omitempty"`
+	Target          ConcreteEvent `json:"target"`
+	// Batch - записи транзакции, которые применяются вместе
+	Batch []walRecord `json:"batch,omitempty"`
+	// Trashed - событие, которое кладется в корзину
+	Trashed *TrashedEvent `json:"trashed,omitempty"`
+	// Audit - запись журнала изменений
+	Audit *AuditEntry `json:"audit,omitempty"`
+	// Webhook - сохраняемый вебхук, ID удаляемого вебхука передается в Target.ID
+	Webhook *Webhook `json:"webhook,omitempty"`
+	// DeadLetter - недоставленное изменение
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+}
+
+const (
+	walCreate  = "create"
+	walUpdate  = "update"
+	walDelete  = "delete"
+	walBatch   = "batch"
+	walTrash   = "trash"
+	walRestore = "restore"
+	walPurge   = "purge"
+	walHistory = "history"
+
+	walWebhook       = "webhook"
+	walWebhookDelete = "webhook_delete"
+	walDeadLetter    = "dead_letter"
+)
+
+// FileRepository - хранилище на диске: все изменения дописываются в журнал, а содержимое
+// периодически сохраняется в снимок. При старте снимок загружается, а журнал проигрывается поверх него
+type FileRepository struct {
+	mem          *MemoryRepository
+	walPath      string
+	snapshotPath string
+	wal          *os.File
+	// mu упорядочивает запись в журнал, применение изменений и создание снимков
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewFileRepository открывает хранилище в каталоге dir и восстанавливает данные из снимка и журнала.
+// Если interval > 0, снимок создается с этим периодом в фоне
+func NewFileRepository(dir string, interval time.Duration) (*FileRepository, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	repo := &FileRepository{
+		mem:          NewMemoryRepository(),
+		walPath:      filepath.Join(dir, "events.wal"),
+		snapshotPath: filepath.Join(dir, "events.snapshot"),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if err := repo.load(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(repo.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	repo.wal = wal
+
+	if interval > 0 {
+		go repo.snapshotLoop(interval)
+	} else {
+		close(repo.done)
+	}
+	return repo, nil
+}
+
+// load читает снимок и проигрывает журнал
+func (repo *FileRepository) load() error {
+	data, err := os.ReadFile(repo.snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		var snapshot snapshotData
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("cannot read snapshot: %w", err)
+		}
+		// Снимки старого формата содержат только события пользователей
+		if snapshot.Events == nil {
+			if err := json.Unmarshal(data, &snapshot.Events); err != nil {
+				return fmt.Errorf("cannot read snapshot: %w", err)
+			}
+		}
+		repo.mem.restore(snapshot)
+	}
+
+	file, err := os.Open(repo.walPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	// offset - конец последней целой записи
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				// Строка без перевода строки в конце - запись, недописанная при аварийном завершении.
+				// Она не была подтверждена, и ее нужно отрезать: иначе следующая запись допишется
+				// к ней и при следующем запуске не прочитается вместе со всеми после нее
+				log.Printf("wal: dropping incomplete record %d", line)
+				return os.Truncate(repo.walPath, offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec walRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("cannot read wal record %d: %w", line, err)
+		}
+		rec.localize()
+		// В журнал попадают только примененные изменения, поэтому ошибка проигрывания означает порчу данных
+		if _, err := applyRecord(repo.mem, rec); err != nil {
+			return fmt.Errorf("cannot replay wal record %d: %w", line, err)
+		}
+		offset += int64(len(data))
+	}
+}
+
+// localize привязывает даты событий записи к их часовым поясам
+func (rec *walRecord) localize() {
+	rec.Event.localize()
+	if rec.Trashed != nil {
+		rec.Trashed.localize()
+	}
+	if rec.Audit != nil {
+		rec.Audit.localize()
+	}
+	if rec.DeadLetter != nil {
+		rec.DeadLetter.Payload.Event.localize()
+	}
+	for ind := range rec.Batch {
+		rec.Batch[ind].localize()
+	}
+}
+
+// applyRecord применяет запись журнала к хранилищу repo. Записи транзакции применяются в транзакции
+func applyRecord(repo EventRepository, rec walRecord) (Event, error) {
+	switch rec.Op {
+	case walCreate:
+		return repo.Create(rec.Event)
+	case walUpdate:
+		return repo.Update(rec.Event, rec.ExpectedVersion)
+	case walDelete:
+		return Event{}, repo.Delete(rec.Target)
+	case walTrash:
+		return Event{}, repo.PutTrash(*rec.Trashed)
+	case walRestore:
+		return repo.Restore(rec.Target.UserID, rec.Target.ID)
+	case walPurge:
+		return Event{}, repo.Purge(rec.Target.UserID, rec.Target.ID)
+	case walHistory:
+		return Event{}, repo.AppendHistory(*rec.Audit)
+	case walWebhook:
+		// Назначенный ID записывается в rec, чтобы при проигрывании вебхук получил тот же ID
+		h, err := repo.PutWebhook(*rec.Webhook)
+		*rec.Webhook = h
+		return Event{}, err
+	case walWebhookDelete:
+		return Event{}, repo.DeleteWebhook(rec.Target.ID)
+	case walDeadLetter:
+		return Event{}, repo.AppendDeadLetter(*rec.DeadLetter)
+	case walBatch:
+		return Event{}, repo.Transaction(func(tx EventRepository) error {
+			for _, r := range rec.Batch {
+				if _, err := applyRecord(tx, r); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		return Event{}, fmt.Errorf("unknown wal operation %q", rec.Op)
+	}
+}
+
+// write применяет запись в памяти в транзакции и дописывает ее в журнал. Отклоненное изменение
+// в журнал не попадает, а изменение, которое не удалось записать в журнал, откатывается
+func (repo *FileRepository) write(rec walRecord) (Event, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var e Event
+	err := repo.mem.Transaction(func(tx EventRepository) error {
+		var err error
+		if e, err = applyRecord(tx, rec); err != nil {
+			return err
+		}
+		// ID нового события назначает хранилище, при проигрывании событие должно получить тот же ID
+		if rec.Op == walCreate {
+			rec.Event.ID = e.ID
+		}
+		return repo.appendWAL(rec)
+	})
+	return e, err
+}
+
+// appendWAL дописывает запись в журнал и сбрасывает его на диск, вызывается под repo.mu.
+// Если запись не удалась, журнал обрезается до прежней длины, чтобы в нем не осталось недописанной строки
+func (repo *FileRepository) appendWAL(rec walRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	info, err := repo.wal.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = repo.wal.Write(append(line, '\n')); err == nil {
+		err = repo.wal.Sync()
+	}
+	if err != nil {
+		_ = repo.wal.Truncate(info.Size())
+	}
+	return err
+}
+
+// Transaction выполняет fn в транзакции хранилища в памяти и записывает все ее изменения
+// в журнал одной записью. Если запись в журнал не удалась, транзакция откатывается
+func (repo *FileRepository) Transaction(fn func(tx EventRepository) error) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.mem.Transaction(func(memTx EventRepository) error {
+		tx := &fileTx{EventRepository: memTx}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if len(tx.records) == 0 {
+			return nil
+		}
+		return repo.appendWAL(walRecord{Op: walBatch, Batch: tx.records})
+	})
+}
+
+// fileTx - транзакция файлового хранилища: изменения применяются в транзакции хранилища в памяти
+// и копятся для записи в журнал
+type fileTx struct {
+	EventRepository
+	records []walRecord
+}
+
+// Create сохраняет событие и запоминает запись журнала с назначенным ID
+func (tx *fileTx) Create(event Event) (Event, error) {
+	created, err := tx.EventRepository.Create(event)
+	if err == nil {
+		event.ID = created.ID
+		tx.records = append(tx.records, walRecord{Op: walCreate, Event: event})
+	}
+	return created, err
+}
+
+// Update изменяет событие и запоминает запись журнала
+func (tx *fileTx) Update(event Event, expectedVersion int) (Event, error) {
+	updated, err := tx.EventRepository.Update(event, expectedVersion)
+	if err == nil {
+		tx.records = append(tx.records, walRecord{Op: walUpdate, Event: event, ExpectedVersion: expectedVersion})
+	}
+	return updated, err
+}
+
+// Delete удаляет событие и запоминает запись журнала
+func (tx *fileTx) Delete(cEvent ConcreteEvent) error {
+	err := tx.EventRepository.Delete(cEvent)
+	if err == nil {
+		tx.records = append(tx.records, walRecord{Op: walDelete, Target: cEvent})
+	}
+	return err
+}
+
+// PutTrash кладет событие в корзину и запоминает запись журнала
+func (tx *fileTx) PutTrash(t TrashedEvent) error {
+	return tx.record(walRecord{Op: walTrash, Trashed: &t}, tx.EventRepository.PutTrash(t))
+}
+
+// Restore возвращает событие из корзины и запоминает запись журнала
+func (tx *fileTx) Restore(userID, id int) (Event, error) {
+	e, err := tx.EventRepository.Restore(userID, id)
+	return e, tx.record(walRecord{Op: walRestore, Target: ConcreteEvent{UserID: userID, ID: id}}, err)
+}
+
+// Purge удаляет событие из корзины и запоминает запись журнала
+func (tx *fileTx) Purge(userID, id int) error {
+	return tx.record(walRecord{Op: walPurge, Target: ConcreteEvent{UserID: userID, ID: id}}, tx.EventRepository.Purge(userID, id))
+}
+
+// AppendHistory дописывает журнал изменений и запоминает запись журнала
+func (tx *fileTx) AppendHistory(entry AuditEntry) error {
+	return tx.record(walRecord{Op: walHistory, Audit: &entry}, tx.EventRepository.AppendHistory(entry))
+}
+
+// PutWebhook сохраняет вебхук и запоминает запись журнала с назначенным ID
+func (tx *fileTx) PutWebhook(h Webhook) (Webhook, error) {
+	stored, err := tx.EventRepository.PutWebhook(h)
+	return stored, tx.record(walRecord{Op: walWebhook, Webhook: &stored}, err)
+}
+
+// DeleteWebhook удаляет вебхук и запоминает запись журнала
+func (tx *fileTx) DeleteWebhook(id int) error {
+	return tx.record(walRecord{Op: walWebhookDelete, Target: ConcreteEvent{ID: id}}, tx.EventRepository.DeleteWebhook(id))
+}
+
+// AppendDeadLetter сохраняет недоставленное изменение и запоминает запись журнала
+func (tx *fileTx) AppendDeadLetter(dl DeadLetter) error {
+	return tx.record(walRecord{Op: walDeadLetter, DeadLetter: &dl}, tx.EventRepository.AppendDeadLetter(dl))
+}
+
+// record запоминает запись журнала, если изменение err выполнено успешно
+func (tx *fileTx) record(rec walRecord, err error) error {
+	if err == nil {
+		tx.records = append(tx.records, rec)
+	}
+	return err
+}
+
+// Transaction внутри транзакции выполняет fn в ней же
+func (tx *fileTx) Transaction(fn func(tx EventRepository) error) error {
+	return fn(tx)
+}
+
+// Create сохраняет новое событие
+func (repo *FileRepository) Create(event Event) (Event, error) {
+	return repo.write(walRecord{Op: walCreate, Event: event})
+}
+
+// Update заменяет данные существующего события
+func (repo *FileRepository) Update(event Event, expectedVersion int) (Event, error) {
+	return repo.write(walRecord{Op: walUpdate, Event: event, ExpectedVersion: expectedVersion})
+}
+
+// Delete удаляет событие пользователя
+func (repo *FileRepository) Delete(cEvent ConcreteEvent) error {
+	_, err := repo.write(walRecord{Op: walDelete, Target: cEvent})
+	return err
+}
+
+// PutTrash кладет событие в корзину
+func (repo *FileRepository) PutTrash(t TrashedEvent) error {
+	_, err := repo.write(walRecord{Op: walTrash, Trashed: &t})
+	return err
+}
+
+// Restore возвращает событие из корзины
+func (repo *FileRepository) Restore(userID, id int) (Event, error) {
+	return repo.write(walRecord{Op: walRestore, Target: ConcreteEvent{UserID: userID, ID: id}})
+}
+
+// Purge удаляет событие из корзины
+func (repo *FileRepository) Purge(userID, id int) error {
+	_, err := repo.write(walRecord{Op: walPurge, Target: ConcreteEvent{UserID: userID, ID: id}})
+	return err
+}
+
+// AppendHistory дописывает журнал изменений
+func (repo *FileRepository) AppendHistory(entry AuditEntry) error {
+	_, err := repo.write(walRecord{Op: walHistory, Audit: &entry})
+	return err
+}
+
+// PutWebhook сохраняет вебхук
+func (repo *FileRepository) PutWebhook(h Webhook) (Webhook, error) {
+	_, err := repo.write(walRecord{Op: walWebhook, Webhook: &h})
+	return h, err
+}
+
+// DeleteWebhook удаляет вебхук
+func (repo *FileRepository) DeleteWebhook(id int) error {
+	_, err := repo.write(walRecord{Op: walWebhookDelete, Target: ConcreteEvent{ID: id}})
+	return err
+}
+
+// AppendDeadLetter сохраняет недоставленное изменение
+func (repo *FileRepository) AppendDeadLetter(dl DeadLetter) error {
+	_, err := repo.write(walRecord{Op: walDeadLetter, DeadLetter: &dl})
+	return err
+}
+
+// Webhooks читает вебхуки из памяти
+func (repo *FileRepository) Webhooks() ([]Webhook, error) {
+	return repo.mem.Webhooks()
+}
+
+// DeadLetters читает недоставленные изменения из памяти
+func (repo *FileRepository) DeadLetters() ([]DeadLetter, error) {
+	return repo.mem.DeadLetters()
+}
+
+// Trash читает корзину из памяти
+func (repo *FileRepository) Trash(userID int) ([]TrashedEvent, error) {
+	return repo.mem.Trash(userID)
+}
+
+// ExpiredTrash ищет просроченные события в памяти
+func (repo *FileRepository) ExpiredTrash(before time.Time) ([]TrashedEvent, error) {
+	return repo.mem.ExpiredTrash(before)
+}
+
+// History читает журнал изменений из памяти
+func (repo *FileRepository) History(id int) ([]AuditEntry, error) {
+	return repo.mem.History(id)
+}
+
+// Overlapping ищет события в памяти
+func (repo *FileRepository) Overlapping(userID int, from, to time.Time) ([]Event, error) {
+	return repo.mem.Overlapping(userID, from, to)
+}
+
+// Search ищет события в памяти
+func (repo *FileRepository) Search(userID int, terms, tags []string) ([]Event, error) {
+	return repo.mem.Search(userID, terms, tags)
+}
+
+// OverlappingAll ищет события всех пользователей в памяти
+func (repo *FileRepository) OverlappingAll(from, to time.Time) ([]Event, error) {
+	return repo.mem.OverlappingAll(from, to)
+}
+
+// Get читает событие из памяти
+func (repo *FileRepository) Get(userID, id int) (Event, error) {
+	return repo.mem.Get(userID, id)
+}
+
+// Invited читает приглашения пользователя из памяти
+func (repo *FileRepository) Invited(userID int) ([]Event, error) {
+	return repo.mem.Invited(userID)
+}
+
+// UserEvents читает события пользователя из памяти
+func (repo *FileRepository) UserEvents(userID int) ([]Event, error) {
+	return repo.mem.UserEvents(userID)
+}
+
+// Snapshot атомарно сохраняет все данные в файл снимка и очищает журнал
+func (repo *FileRepository) Snapshot() error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	data, err := json.Marshal(repo.mem.snapshot())
+	if err != nil {
+		return err
+	}
+	tmpPath := repo.snapshotPath + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, repo.snapshotPath); err != nil {
+		return err
+	}
+	// Переименование должно попасть на диск раньше очистки журнала, иначе после сбоя
+	// не останется ни нового снимка, ни журнала
+	if err := syncDir(filepath.Dir(repo.snapshotPath)); err != nil {
+		return err
+	}
+	// Все записи журнала уже попали в снимок
+	if err := repo.wal.Truncate(0); err != nil {
+		return err
+	}
+	_, err = repo.wal.Seek(0, io.SeekStart)
+	return err
+}
+
+// writeFileSync записывает файл и сбрасывает его содержимое на диск
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir сбрасывает на диск записи каталога: созданные и переименованные в нем файлы
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// snapshotLoop периодически создает снимок, пока хранилище не закрыто
+func (repo *FileRepository) snapshotLoop(interval time.Duration) {
+	defer close(repo.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := repo.Snapshot(); err != nil {
+				log.Println("snapshot failed:", err)
+			}
+		case <-repo.stop:
+			return
+		}
+	}
+}
+
+// Stats возвращает сведения хранилища в памяти
+func (repo *FileRepository) Stats() (RepositoryStats, error) {
+	return repo.mem.Stats()
+}
+
+// Close останавливает фоновые снимки, сохраняет финальный снимок и закрывает журнал
+func (repo *FileRepository) Close() error {
+	close(repo.stop)
+	<-repo.done
+	if err := repo.Snapshot(); err != nil {
+		return err
+	}
+	return repo.wal.Close()
+}
+
+// Date - момент времени события. В JSON принимается RFC 3339, время без смещения 2006-01-02T15:04:05
+// или дата 2006-01-02; значения без смещения трактуются в часовом поясе события. Отдается всегда RFC 3339
+type Date struct {
+	date time.Time
+	// floating - значение пришло без смещения и еще не привязано к часовому поясу события
+	floating bool
+	// dateOnly - значение пришло без времени суток
+	dateOnly bool
+}
+
+// LogLevel - уровень логирования
+type LogLevel int
+
+// Уровни логирования по возрастанию важности
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// logLevelNames - названия уровней логирования в конфигурации и в логе
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// String для типа LogLevel
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "unknown"
+	}
+	return logLevelNames[level]
+}
+
+// parseLogLevel разбирает название уровня логирования
+func parseLogLevel(s string) (LogLevel, error) {
+	for ind, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(ind), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger пишет в лог сообщения не ниже заданного уровня
+type Logger struct {
+	*log.Logger
+	level LogLevel
+}
+
+// logf пишет сообщение уровня level. Глубина вызова указывает файл вызывающего Debugf, Infof и т.д.
+func (l Logger) logf(level LogLevel, format string, v ...interface{}) {
+	if level < l.level {
+		return
+	}
+	_ = l.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, v...))
+}
+
+// Debugf пишет отладочное сообщение
+func (l Logger) Debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+
+// Infof пишет информационное сообщение
+func (l Logger) Infof(format string, v ...interface{}) { l.logf(LevelInfo, format, v...) }
+
+// Warnf пишет предупреждение
+func (l Logger) Warnf(format string, v ...interface{}) { l.logf(LevelWarn, format, v...) }
+
+// Errorf пишет сообщение об ошибке
+func (l Logger) Errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+// logJSON пишет запись entry одной строкой JSON без префикса логера, если level не ниже уровня логера
+func (l Logger) logJSON(level LogLevel, entry interface{}) {
+	if level < l.level {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		l.logf(LevelError, "cannot encode log entry: %v", err)
+		return
+	}
+	// Строка пишется одним вызовом, чтобы записи параллельных запросов не перемешивались
+	_, _ = l.Writer().Write(append(line, '\n'))
+}
+
+// CalendarService - бизнес-логика календаря без привязки к транспорту: изменения событий с журналом,
+// рассылка изменений и выборки. Один сервис обслуживают HTTP-сервер (Scope) и сервер JSON-RPC
+type CalendarService struct {
+	logger Logger
+	// reminders пересчитывает напоминания после изменения событий, может быть nil
+	reminders *ReminderScheduler
+	// broker рассылает изменения событий подписчикам /subscribe
+	broker *Broker
+	// webhooks доставляет изменения событий вебхукам пользователей
+	webhooks *WebhookDispatcher
+	// pending копит изменения пакета до фиксации транзакции, nil - изменения рассылаются сразу
+	pending *[]pendingChange
+	// clock дает время записей корзины и журнала изменений
+	clock Clock
+	// actor - пользователь, от имени которого выполняются изменения, 0 - сервер
+	actor           int
+	EventRepository EventRepository
+}
+
+// NewCalendarService создает сервис над хранилищем repo без напоминаний
+func NewCalendarService(repo EventRepository, logger Logger) *CalendarService {
+	cfg := defaultConfig()
+	return &CalendarService{
+		logger:          logger,
+		broker:          NewBroker(),
+		webhooks:        NewWebhookDispatcher(repo, cfg.WebhookWorkers, cfg.WebhookMaxAttempts, cfg.WebhookBackoff, realClock{}, logger),
+		clock:           realClock{},
+		EventRepository: repo,
+	}
+}
+
+// within возвращает копию сервиса, которая читает и пишет через транзакцию tx
+func (svc *CalendarService) within(tx EventRepository) *CalendarService {
+	s := *svc
+	s.EventRepository = tx
+	return &s
+}
+
+// As возвращает копию сервиса, изменения которой записываются в журнал от имени пользователя actor
+func (svc *CalendarService) As(actor int) *CalendarService {
+	s := *svc
+	s.actor = actor
+	return &s
+}
+
+// Scope - HTTP-сервер над CalendarService: маршруты, аутентификация и ограничения запросов
+type Scope struct {
+	srv *http.ServeMux
+	// auth проверяет токены запросов, nil отключает аутентификацию
+	auth *Authenticator
+	// serializers - форматы ответов со списками событий
+	serializers *SerializerRegistry
+	// limiter ограничивает частоту запросов, nil отключает ограничение
+	limiter *RateLimiter
+	// maxBodyBytes - максимальный размер тела запроса, 0 отключает ограничение
+	maxBodyBytes int64
+	// rejections считает запросы, отклоненные ограничениями
+	rejections *Rejections
+	// metrics считает запросы по маршрутам для /metrics
+	metrics *Metrics
+	// inflight - обрабатываемые запросы, остановка сервера ждет их завершения
+	inflight *sync.WaitGroup
+	*CalendarService
+}
+
+// Config - настройки сервера. Значения по умолчанию переопределяются файлом конфигурации,
+// затем переменными окружения, затем флагами командной строки
+type Config struct {
+	// Addr - адрес, на котором запускается сервер (listen_addr, LISTEN_ADDR, -addr).
+	// Для совместимости порт можно задать отдельно (port, SERVERPORT, -port), тогда адрес - localhost:порт
+	Addr string
+	// RPCAddr - адрес сервера JSON-RPC, пустой адрес его отключает (rpc_addr, RPC_ADDR, -rpc-addr).
+	// Без аутентификации допускается только loopback
+	RPCAddr string
+	// ReadTimeout - время на чтение запроса целиком (read_timeout, READ_TIMEOUT, -read-timeout)
+	ReadTimeout time.Duration
+	// WriteTimeout - время на запись ответа (write_timeout, WRITE_TIMEOUT, -write-timeout)
+	WriteTimeout time.Duration
+	// IdleTimeout - время ожидания следующего запроса keep-alive (idle_timeout, IDLE_TIMEOUT, -idle-timeout)
+	IdleTimeout time.Duration
+	// ShutdownTimeout - время на завершение обрабатываемых запросов при остановке
+	// (shutdown_timeout, SHUTDOWN_TIMEOUT, -shutdown-timeout)
+	ShutdownTimeout time.Duration
+	// LogLevel - минимальный уровень сообщений в логе (log_level, LOG_LEVEL, -log-level)
+	LogLevel LogLevel
+	// Storage - тип хранилища: memory, sharded или file (storage, STORAGE, -storage)
+	Storage string
+	// StorageStripes - число полос хранилища sharded (storage_stripes, STORAGE_STRIPES, -storage-stripes)
+	StorageStripes int
+	// StorageDir - каталог для журнала и снимков файлового хранилища (storage_dir, STORAGE_DIR, -storage-dir)
+	StorageDir string
+	// SnapshotInterval - период создания снимков файлового хранилища
+	// (snapshot_interval, SNAPSHOT_INTERVAL, -snapshot-interval)
+	SnapshotInterval time.Duration
+	// UsersFile - JSON-файл с пользователями (users_file, USERS_FILE, -users-file).
+	// Если файла по умолчанию нет, аутентификация отключается, а явно указанный файл обязателен
+	UsersFile string
+	// AuthSecret - ключ подписи токенов (auth_secret, AUTH_SECRET, -auth-secret)
+	AuthSecret string
+	// TokenTTL - время жизни токена (token_ttl, TOKEN_TTL, -token-ttl)
+	TokenTTL time.Duration
+	// ReminderWebhook - URL, на который кроме лога отправляются напоминания
+	// (reminder_webhook, REMINDER_WEBHOOK, -reminder-webhook)
+	ReminderWebhook string
+	// RateLimit - число запросов в секунду от одного пользователя или адреса, 0 отключает ограничение
+	// (rate_limit, RATE_LIMIT, -rate-limit)
+	RateLimit float64
+	// RateBurst - число запросов, которое можно сделать сразу сверх RateLimit (rate_burst, RATE_BURST, -rate-burst)
+	RateBurst int
+	// MaxBodyBytes - максимальный размер тела запроса (max_body_bytes, MAX_BODY_BYTES, -max-body-bytes)
+	MaxBodyBytes int64
+	// MaxHeaderBytes - максимальный размер заголовков запроса (max_header_bytes, MAX_HEADER_BYTES, -max-header-bytes)
+	MaxHeaderBytes int
+	// TrashRetention - время хранения удаленных событий в корзине, 0 - хранить всегда
+	// (trash_retention, TRASH_RETENTION, -trash-retention)
+	TrashRetention time.Duration
+	// TrashPurgeInterval - период очистки корзины (trash_purge_interval, TRASH_PURGE_INTERVAL, -trash-purge-interval)
+	TrashPurgeInterval time.Duration
+	// WebhookWorkers - число исполнителей доставки вебхуков (webhook_workers, WEBHOOK_WORKERS, -webhook-workers)
+	WebhookWorkers int
+	// WebhookMaxAttempts - число попыток доставки изменения вебхуку, не больше maxWebhookAttempts
+	// (webhook_max_attempts, WEBHOOK_MAX_ATTEMPTS, -webhook-max-attempts)
+	WebhookMaxAttempts int
+	// WebhookBackoff - пауза перед второй попыткой доставки, дальше она удваивается
+	// (webhook_backoff, WEBHOOK_BACKOFF, -webhook-backoff)
+	WebhookBackoff time.Duration
+	// WebhookAllowedNetworks - сети CIDR через запятую, в которые можно доставлять вебхуки, хотя это
+	// loopback, локальные или частные адреса (webhook_allowed_networks, WEBHOOK_ALLOWED_NETWORKS, -webhook-allowed-networks)
+	WebhookAllowedNetworks string
+}
+
+// defaultConfig возвращает настройки по умолчанию
+func defaultConfig() Config {
+	return Config{
+		Addr:               "localhost:8080",
+		ReadTimeout:        10 * time.Second,
+		WriteTimeout:       30 * time.Second,
+		IdleTimeout:        2 * time.Minute,
+		ShutdownTimeout:    15 * time.Second,
+		LogLevel:           LevelInfo,
+		Storage:            "memory",
+		StorageDir:         "data",
+		StorageStripes:     64,
+		SnapshotInterval:   time.Minute,
+		UsersFile:          "users.json",
+		TokenTTL:           12 * time.Hour,
+		RateLimit:          10,
+		RateBurst:          20,
+		MaxBodyBytes:       defaultMaxBodyBytes,
+		MaxHeaderBytes:     64 << 10,
+		TrashRetention:     30 * 24 * time.Hour,
+		TrashPurgeInterval: time.Hour,
+		WebhookWorkers:     4,
+		WebhookMaxAttempts: 5,
+		WebhookBackoff:     time.Second,
+	}
+}
+
+// defaultMaxBodyBytes - ограничение размера тела запроса по умолчанию
+const defaultMaxBodyBytes = 1 << 20
+
+// configOption - настройка, которую можно задать в файле (key), окружении (env) и флагом (flag)
+type configOption struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+// durationOption создает функцию установки неотрицательной длительности
+func durationOption(field func(cfg *Config) *time.Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errors.New("must not be negative")
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+// positiveInt разбирает целое число больше нуля
+func positiveInt(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return n, nil
+}
+
+// configOptions - все настройки в порядке применения: listen_addr идет после port и имеет приоритет
+var configOptions = []configOption{
+	{"port", "SERVERPORT", "port", "port on localhost to listen on", func(cfg *Config, value string) error {
+		cfg.Addr = "localhost:" + value
+		return nil
+	}},
+	{"listen_addr", "LISTEN_ADDR", "addr", "address to listen on", func(cfg *Config, value string) error {
+		cfg.Addr = value
+		return nil
+	}},
+	{"rpc_addr", "RPC_ADDR", "rpc-addr", "address of the JSON-RPC server, empty disables it", func(cfg *Config, value string) error {
+		if value != "" {
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return err
+			}
+		}
+		cfg.RPCAddr = value
+		return nil
+	}},
+	{"read_timeout", "READ_TIMEOUT", "read-timeout", "timeout for reading a request",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.ReadTimeout })},
+	{"write_timeout", "WRITE_TIMEOUT", "write-timeout", "timeout for writing a response",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.WriteTimeout })},
+	{"idle_timeout", "IDLE_TIMEOUT", "idle-timeout", "keep-alive timeout",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.IdleTimeout })},
+	{"shutdown_timeout", "SHUTDOWN_TIMEOUT", "shutdown-timeout", "timeout for draining requests on shutdown",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.ShutdownTimeout })},
+	{"log_level", "LOG_LEVEL", "log-level", "log level: debug, info, warn or error", func(cfg *Config, value string) error {
+		level, err := parseLogLevel(value)
+		cfg.LogLevel = level
+		return err
+	}},
+	{"storage", "STORAGE", "storage", "storage backend: memory, sharded or file", func(cfg *Config, value string) error {
+		if value != "memory" && value != "sharded" && value != "file" {
+			return fmt.Errorf("unknown storage %q", value)
+		}
+		cfg.Storage = value
+		return nil
+	}},
+	{"storage_dir", "STORAGE_DIR", "storage-dir", "directory for the file storage", func(cfg *Config, value string) error {
+		cfg.StorageDir = value
+		return nil
+	}},
+	{"storage_stripes", "STORAGE_STRIPES", "storage-stripes", "number of lock stripes of the sharded storage", func(cfg *Config, value string) error {
+		n, err := positiveInt(value)
+		cfg.StorageStripes = int(n)
+		return err
+	}},
+	{"snapshot_interval", "SNAPSHOT_INTERVAL", "snapshot-interval", "file storage snapshot period, 0 disables snapshots",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.SnapshotInterval })},
+	{"users_file", "USERS_FILE", "users-file", "JSON file with users", func(cfg *Config, value string) error {
+		cfg.UsersFile = value
+		return nil
+	}},
+	{"auth_secret", "AUTH_SECRET", "auth-secret", "token signing key, random if empty", func(cfg *Config, value string) error {
+		cfg.AuthSecret = value
+		return nil
+	}},
+	{"token_ttl", "TOKEN_TTL", "token-ttl", "token lifetime",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.TokenTTL })},
+	{"reminder_webhook", "REMINDER_WEBHOOK", "reminder-webhook", "URL to POST reminders to", func(cfg *Config, value string) error {
+		if !isHTTPURL(value) {
+			return errors.New("must be an http or https URL")
+		}
+		cfg.ReminderWebhook = value
+		return nil
+	}},
+	{"rate_limit", "RATE_LIMIT", "rate-limit", "requests per second per user or address, 0 disables the limit", func(cfg *Config, value string) error {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+			return errors.New("must be a non-negative number")
+		}
+		cfg.RateLimit = rate
+		return nil
+	}},
+	{"rate_burst", "RATE_BURST", "rate-burst", "requests allowed at once above the rate limit", func(cfg *Config, value string) error {
+		n, err := positiveInt(value)
+		cfg.RateBurst = int(n)
+		return err
+	}},
+	{"max_body_bytes", "MAX_BODY_BYTES", "max-body-bytes", "maximum request body size", func(cfg *Config, value string) error {
+		n, err := positiveInt(value)
+		cfg.MaxBodyBytes = n
+		return err
+	}},
+	{"max_header_bytes", "MAX_HEADER_BYTES", "max-header-bytes", "maximum request header size", func(cfg *Config, value string) error {
+		n, err := positiveInt(value)
+		cfg.MaxHeaderBytes = int(n)
+		return err
+	}},
+	{"trash_retention", "TRASH_RETENTION", "trash-retention", "how long deleted events stay in the trash, 0 keeps them forever",
+		durationOption(func(cfg *Config) *time.Duration { return &cfg.TrashRetention })},
+	{"trash_purge_interval", "TRASH_PURGE_INTERVAL", "trash-purge-interval", "period of purging expired events from the trash",
+		func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err == nil && d <= 0 {
+				err = errors.New("must be positive")
+			}
+			cfg.TrashPurgeInterval = d
+			return err
+		}},
+	{"webhook_workers", "WEBHOOK_WORKERS", "webhook-workers", "number of concurrent webhook deliveries", func(cfg *Config, value string) error {
+		n, err := positiveInt(value)
+		cfg.WebhookWorkers = int(n)
+		return err
+	}},
+	{"webhook_max_attempts", "WEBHOOK_MAX_ATTEMPTS", "webhook-max-attempts", "delivery attempts before a change goes to dead letters",
+		func(cfg *Config, value string) error {
+			n, err := positiveInt(value)
+			if err == nil && n > maxWebhookAttempts {
+				err = fmt.Errorf("must not exceed %d", maxWebhookAttempts)
+			}
+			cfg.WebhookMaxAttempts = int(n)
+			return err
+		}},
+	{"webhook_backoff", "WEBHOOK_BACKOFF", "webhook-backoff", "pause before the second delivery attempt, doubled for each next one",
+		func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err == nil && d <= 0 {
+				err = errors.New("must be positive")
+			}
+			cfg.WebhookBackoff = d
+			return err
+		}},
+	{"webhook_allowed_networks", "WEBHOOK_ALLOWED_NETWORKS", "webhook-allowed-networks",
+		"comma-separated CIDR networks webhooks may reach although they are loopback, link-local or private",
+		func(cfg *Config, value string) error {
+			_, err := parseNetworks(value)
+			cfg.WebhookAllowedNetworks = value
+			return err
+		}},
+}
+
+// parseConfigFile разбирает файл конфигурации: JSON-объект или строки "ключ: значение"
+// (подмножество YAML). Пустые строки и строки, начинающиеся с #, пропускаются
+func parseConfigFile(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var raw map[string]interface{}
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, fmt.Errorf("cannot decode json: %w", err)
+		}
+		for key, value := range raw {
+			switch value.(type) {
+			case string, float64, bool:
+				values[key] = fmt.Sprint(value)
+			default:
+				return nil, fmt.Errorf("%s: value must be a string, number or boolean", key)
+			}
+		}
+		return values, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNum)
+		}
+		value := strings.TrimSpace(kv[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[strings.TrimSpace(kv[0])] = value
+	}
+	return values, scanner.Err()
+}
+
+// loadConfig собирает конфигурацию из значений по умолчанию, файла (флаг -config или CONFIG),
+// переменных окружения getenv и флагов args
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("calendar", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("CONFIG"), "path to a JSON or key: value config file")
+	flagValues := make(map[string]*string, len(configOptions))
+	for _, opt := range configOptions {
+		flagValues[opt.flag] = fs.String(opt.flag, "", opt.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, err
+		}
+		values, err := parseConfigFile(data)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", *configPath, err)
+		}
+		known := make(map[string]bool, len(configOptions))
+		for _, opt := range configOptions {
+			known[opt.key] = true
+			if value, ok := values[opt.key]; ok {
+				if err := opt.set(&cfg, value); err != nil {
+					return cfg, fmt.Errorf("%s: bad %s: %w", *configPath, opt.key, err)
+				}
+			}
+		}
+		for key := range values {
+			if !known[key] {
+				return cfg, fmt.Errorf("%s: unknown option %q", *configPath, key)
+			}
+		}
+	}
+
+	for _, opt := range configOptions {
+		if value := getenv(opt.env); value != "" {
+			if err := opt.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("bad %s: %w", opt.env, err)
+			}
+		}
+	}
+
+	// Флаги применяются в порядке configOptions, а не в порядке fs.Visit, чтобы -addr имел приоритет над -port
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, opt := range configOptions {
+		if set[opt.flag] {
+			if err := opt.set(&cfg, *flagValues[opt.flag]); err != nil {
+				return cfg, fmt.Errorf("bad -%s: %w", opt.flag, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// newRepository создает хранилище, выбранное в конфигурации
+func newRepository(cfg Config) (EventRepository, error) {
+	switch cfg.Storage {
+	case "memory":
+		return NewMemoryRepository(), nil
+	case "file":
+		return NewFileRepository(cfg.StorageDir, cfg.SnapshotInterval)
+	case "sharded":
+		return NewShardedRepository(cfg.StorageStripes), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+	}
+}
+
+func CreateScope(repo EventRepository) *Scope {
+	logger := Logger{
+		Logger: log.New(os.Stdout, "logger: ", log.Lshortfile),
+		level:  LevelInfo,
+	}
+	return &Scope{
+		srv:             http.NewServeMux(),
+		serializers:     defaultSerializers(),
+		maxBodyBytes:    defaultMaxBodyBytes,
+		rejections:      &Rejections{},
+		metrics:         NewMetrics(),
+		inflight:        &sync.WaitGroup{},
+		CalendarService: NewCalendarService(repo, logger),
+	}
+}
+
+// routes регистрирует обработчики методов API из routeTable. Путь с несколькими методами
+// получает обработчик, выбирающий метод; для остальных методов он отвечает ошибкой
+func (scope *Scope) routes() {
+	var patterns []string
+	handlers := map[string]map[string]http.HandlerFunc{}
+	for _, rt := range scope.routeTable() {
+		if handlers[rt.pattern] == nil {
+			patterns = append(patterns, rt.pattern)
+			handlers[rt.pattern] = map[string]http.HandlerFunc{}
+		}
+		handlers[rt.pattern][rt.op.method] = rt.handler
+	}
+	for _, pattern := range patterns {
+		byMethod := handlers[pattern]
+		if len(byMethod) == 1 {
+			for _, handler := range byMethod {
+				scope.srv.HandleFunc(pattern, handler)
+			}
+			continue
+		}
+		scope.srv.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			handler, ok := byMethod[r.Method]
+			if !ok {
+				sendErr(w, "Not correct method", http.StatusBadRequest)
+				return
+			}
+			handler(w, r)
+		})
+	}
+}
+
+// apiRoute - метод API: путь, обработчик и описание для /openapi.json.
+// Один путь может встречаться с разными методами
+type apiRoute struct {
+	pattern string
+	handler http.HandlerFunc
+	op      apiOperation
+}
+
+// routeTable возвращает все методы API. По этой таблице регистрируются обработчики и строится
+// документ OpenAPI, поэтому новый метод без описания добавить нельзя
+func (scope *Scope) routeTable() []apiRoute {
+	formats, formatParam := scope.serializers.document(schemaRef("EventPage"))
+	formatErrors := append(readErrors[:len(readErrors):len(readErrors)], http.StatusNotAcceptable)
+	return []apiRoute{
+		{"/login", scope.Login, apiOperation{
+			method: http.MethodPost, summary: "Issue a bearer token for a user name and password",
+			body:    requestBody(schemaRef("LoginRequest"), schemaRef("LoginRequest")),
+			success: http.StatusOK, content: jsonContent(schemaRef("LoginResult")),
+			errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound,
+				http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInternalServerError},
+		}},
+
+		{"/create_event", scope.CreateEvent, apiOperation{
+			method: http.MethodPost, summary: "Create an event, the server assigns its ID",
+			body:    requestBody(schemaRef("EventRequest"), schemaRef("EventForm")),
+			success: http.StatusCreated, content: jsonContent(schemaRef("EventsResult")),
+			errors: businessErrors,
+		}},
+		{"/update_event", scope.UpdateEvent, apiOperation{
+			method: http.MethodPost, summary: "Update an event, a whole series or one occurrence",
+			body:    requestBody(schemaRef("EventRequest"), schemaRef("EventForm")),
+			success: http.StatusOK, content: jsonContent(schemaRef("EventsResult")),
+			errors: businessErrors,
+		}},
+		{"/delete_event", scope.RemoveEvent, apiOperation{
+			method: http.MethodPost, summary: "Delete an event, a whole series or one occurrence",
+			body:    requestBody(schemaRef("DeleteRequest"), schemaRef("DeleteRequest")),
+			success: http.StatusOK, content: jsonContent(schemaRef("EventsResult")),
+			errors: businessErrors,
+		}},
+		{"/restore_event", scope.RestoreEvent, apiOperation{
+			method: http.MethodPost, summary: "Restore a deleted event from the trash",
+			body:    requestBody(schemaRef("RestoreRequest"), schemaRef("RestoreRequest")),
+			success: http.StatusOK, content: jsonContent(schemaRef("EventsResult")),
+			errors: writeErrors,
+		}},
+		{"/invite", scope.InviteEvent, apiOperation{
+			method: http.MethodPost, summary: "Invite users to an event of the organizer",
+			body:    requestBody(schemaRef("InviteRequest"), schemaRef("InviteForm")),
+			success: http.StatusOK, content: jsonContent(schemaRef("EventsResult")),
+			errors: businessErrors,
+		}},
+		{"/respond", scope.RespondEvent, apiOperation{
+			method: http.MethodPost, summary: "Answer an invitation",
+			body:    requestBody(schemaRef("RespondRequest"), schemaRef("RespondRequest")),
+			success: http.StatusOK, content: jsonContent(schemaRef("EventsResult")),
+			errors: businessErrors,
+		}},
+		{"/batch", scope.BatchEvents, apiOperation{
+			method: http.MethodPost, summary: "Run create, update and delete operations atomically",
+			body:    requestBody(schemaRef("BatchRequest"), nil),
+			success: http.StatusOK, content: jsonContent(schemaRef("BatchResult")),
+			errors: businessErrors,
+			// Ошибки выполнения пакета содержат результаты операций
+			errorSchema: "BatchResult",
+		}},
+
+		{"/events_for_day", scope.DayEvents, apiOperation{
+			method: http.MethodGet, summary: "List events of a day",
+			params:  append([]apiObject{userIDParam, dateParam, tzParam, formatParam}, listParams...),
+			success: http.StatusOK, content: formats, errors: formatErrors,
+		}},
+		{"/events_for_week", scope.WeekEvents, apiOperation{
+			method: http.MethodGet, summary: "List events of the ISO week containing a date",
+			params:  append([]apiObject{userIDParam, dateParam, tzParam, formatParam}, listParams...),
+			success: http.StatusOK, content: formats, errors: formatErrors,
+		}},
+		{"/events_for_month", scope.MonthEvents, apiOperation{
+			method: http.MethodGet, summary: "List events of the calendar month containing a date",
+			params:  append([]apiObject{userIDParam, dateParam, tzParam, formatParam}, listParams...),
+			success: http.StatusOK, content: formats, errors: formatErrors,
+		}},
+		{"/events", scope.RangeEvents, apiOperation{
+			method: http.MethodGet, summary: "List events overlapping [from, to)",
+			params:  append([]apiObject{userIDParam, fromParam(true), toParam(true), tzParam}, listParams...),
+			success: http.StatusOK, content: jsonContent(schemaRef("EventPage")), errors: readErrors,
+		}},
+		{"/free_busy", scope.FreeBusyEvents, apiOperation{
+			method: http.MethodGet, summary: "Merged busy intervals and free slots in [from, to)",
+			params:  []apiObject{userIDParam, fromParam(true), toParam(true), tzParam},
+			success: http.StatusOK, content: jsonContent(schemaRef("FreeBusyResult")), errors: readErrors,
+		}},
+		{"/search", scope.SearchEventsHandler, apiOperation{
+			method: http.MethodGet, summary: "Full-text search over titles, descriptions and tags",
+			params: append([]apiObject{userIDParam,
+				queryParam("q", typed("string", "words that must all occur in the title or description"), false),
+				queryParam("tags", typed("string", "comma separated tags that must all be set"), false),
+				fromParam(false), toParam(false), tzParam}, listParams...),
+			success: http.StatusOK, content: jsonContent(schemaRef("SearchResult")), errors: readErrors,
+		}},
+		{"/trash", scope.TrashEvents, apiOperation{
+			method: http.MethodGet, summary: "List deleted events of a user, most recently deleted first",
+			params:  []apiObject{userIDParam},
+			success: http.StatusOK, content: jsonContent(schemaRef("TrashResult")), errors: readErrors,
+		}},
+		{"/event_history", scope.EventHistory, apiOperation{
+			method: http.MethodGet, summary: "Audit trail of an event: who changed it, when, old and new values",
+			params:  []apiObject{queryParam("id", typed("integer", "event ID"), true)},
+			success: http.StatusOK, content: jsonContent(schemaRef("HistoryResult")), errors: readErrors,
+		}},
+
+		{"/webhooks", scope.ListWebhooks, apiOperation{
+			method: http.MethodGet, summary: "List webhooks of a user, without their secrets",
+			params:  []apiObject{userIDParam},
+			success: http.StatusOK, content: jsonContent(schemaRef("WebhooksResult")), errors: readErrors,
+		}},
+		{"/webhooks", scope.CreateWebhook, apiOperation{
+			method: http.MethodPost, summary: "Register a webhook for event changes of a user, the response has its signing secret",
+			body:    requestBody(schemaRef("WebhookRequest"), schemaRef("WebhookForm")),
+			success: http.StatusCreated, content: jsonContent(schemaRef("WebhooksResult")), errors: writeErrors,
+		}},
+		{"/webhooks", scope.UpdateWebhook, apiOperation{
+			method: http.MethodPut, summary: "Change the URL, the changes or the secret of a webhook",
+			body:    requestBody(schemaRef("WebhookRequest"), schemaRef("WebhookForm")),
+			success: http.StatusOK, content: jsonContent(schemaRef("WebhooksResult")), errors: writeErrors,
+		}},
+		{"/webhooks", scope.DeleteWebhook, apiOperation{
+			method: http.MethodDelete, summary: "Delete a webhook, pending retries are dropped",
+			params:  []apiObject{userIDParam, queryParam("id", typed("integer", "webhook ID"), true)},
+			success: http.StatusOK, content: jsonContent(schemaRef("WebhooksResult")), errors: readErrors,
+		}},
+		{"/webhooks/dead_letters", scope.WebhookDeadLetters, apiOperation{
+			method: http.MethodGet, summary: "Changes that could not be delivered to webhooks of a user",
+			params:  []apiObject{userIDParam},
+			success: http.StatusOK, content: jsonContent(schemaRef("DeadLettersResult")), errors: readErrors,
+		}},
+
+		{"/export.ics", scope.ExportICS, apiOperation{
+			method: http.MethodGet, summary: "Export events of a user as iCalendar",
+			params:  []apiObject{userIDParam},
+			success: http.StatusOK, content: textContent("text/calendar"), errors: readErrors,
+		}},
+		{"/import_ics", scope.ImportICSEvents, apiOperation{
+			method: http.MethodPost, summary: "Import VEVENTs from an iCalendar file",
+			params: []apiObject{userIDParam},
+			body: apiObject{"required": true, "content": apiObject{
+				"text/calendar": apiObject{"schema": typed("string", "")},
+				"multipart/form-data": apiObject{"schema": objectSchema([]string{"file"}, apiObject{
+					"file": apiObject{"type": "string", "format": "binary"},
+				})},
+			}},
+			success: http.StatusOK, content: jsonContent(schemaRef("ImportResult")), errors: writeErrors,
+		}},
+
+		{"/subscribe", scope.Subscribe, apiOperation{
+			method: http.MethodGet, summary: "Stream event changes as Server-Sent Events",
+			params: []apiObject{userIDParam,
+				queryParam("last_event_id", typed("string", "resume after this change, like the Last-Event-ID header"), false)},
+			success: http.StatusOK, content: textContent("text/event-stream"), errors: readErrors,
+		}},
+
+		{"/metrics", scope.MetricsHandler, apiOperation{
+			method: http.MethodGet, summary: "Server metrics in Prometheus text format",
+			success: http.StatusOK, content: textContent("text/plain"),
+			errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+				http.StatusTooManyRequests, http.StatusInternalServerError},
+		}},
+		{"/openapi.json", scope.OpenAPI, apiOperation{
+			method: http.MethodGet, summary: "This document",
+			success: http.StatusOK, content: jsonContent(typed("object", "")),
+			errors: []int{http.StatusTooManyRequests},
+		}},
+	}
+}
+
+// apiObject - объект документа OpenAPI
+type apiObject = map[string]interface{}
+
+// apiOperation - описание метода API в OpenAPI
+type apiOperation struct {
+	method  string
+	summary string
+	params  []apiObject
+	// body - requestBody или nil
+	body apiObject
+	// success и content - код и содержимое успешного ответа
+	success int
+	content apiObject
+	// errors - коды ошибок, их тело описывает схема errorSchema (по умолчанию Error)
+	errors      []int
+	errorSchema string
+}
+
+// Наборы кодов ошибок методов чтения, изменения и методов с ошибками бизнес-логики
+var (
+	readErrors = []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+		http.StatusTooManyRequests, http.StatusInternalServerError}
+	writeErrors = []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+		http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInternalServerError}
+	businessErrors = append(writeErrors[:len(writeErrors):len(writeErrors)], http.StatusServiceUnavailable)
+)
+
+// errorDescriptions - описания кодов ошибок в документе
+var errorDescriptions = map[int]string{
+	http.StatusBadRequest:            "Malformed request or validation errors by field",
+	http.StatusUnauthorized:          "Missing or invalid bearer token",
+	http.StatusForbidden:             "The data of another user requires the admin role",
+	http.StatusNotFound:              "Authentication is not configured",
+	http.StatusNotAcceptable:         "None of the formats is acceptable by the Accept header",
+	http.StatusRequestEntityTooLarge: "Request body exceeds the size limit",
+	http.StatusTooManyRequests:       "Rate limit exceeded, see the Retry-After header",
+	http.StatusInternalServerError:   "Storage error, missing event or webhook",
+	http.StatusServiceUnavailable:    "Business logic error: overlap, version conflict or not invited",
+}
+
+// schemaRef ссылается на схему из components
+func schemaRef(name string) apiObject {
+	return apiObject{"$ref": "#/components/schemas/" + name}
+}
+
+// typed возвращает схему простого типа
+func typed(typ, description string) apiObject {
+	schema := apiObject{"type": typ}
+	if description != "" {
+		schema["description"] = description
+	}
+	return schema
+}
+
+// arrayOf возвращает схему массива
+func arrayOf(items apiObject) apiObject {
+	return apiObject{"type": "array", "items": items}
+}
+
+// enumOf возвращает схему строки с допустимыми значениями
+func enumOf(values ...string) apiObject {
+	return apiObject{"type": "string", "enum": values}
+}
+
+// objectSchema возвращает схему объекта
+func objectSchema(required []string, properties apiObject) apiObject {
+	schema := apiObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// queryParam описывает параметр строки запроса
+func queryParam(name string, schema apiObject, required bool) apiObject {
+	param := apiObject{"name": name, "in": "query", "required": required, "schema": schema}
+	if description, ok := schema["description"]; ok {
+		param["description"] = description
+	}
+	return param
+}
+
+// fromParam и toParam - границы интервала запроса
+func fromParam(required bool) apiObject {
+	return queryParam("from", typed("string", "interval start: date, local time or RFC 3339 time"), required)
+}
+
+func toParam(required bool) apiObject {
+	return queryParam("to", typed("string", "interval end, exclusive"), required)
+}
+
+// Общие параметры запросов
+var (
+	userIDParam = queryParam("user_id", typed("integer", "owner of the events"), true)
+	dateParam   = queryParam("date", typed("string", "date 2006-01-02"), true)
+	tzParam     = queryParam("tz", typed("string", "IANA time zone of dates in the query, UTC by default"), false)
+	listParams  = []apiObject{
+		queryParam("sort", enumOf("start", "-start", "end", "-end", "title", "-title"), false),
+		queryParam("limit", apiObject{"type": "integer", "minimum": 1, "maximum": maxPageLimit,
+			"description": fmt.Sprintf("page size, %d by default; csv and ics are not paged without limit or cursor", defaultPageLimit)}, false),
+		queryParam("cursor", typed("string", "next_cursor of the previous page"), false),
+	}
+)
+
+// jsonContent описывает ответ JSON
+func jsonContent(schema apiObject) apiObject {
+	return apiObject{"application/json": apiObject{"schema": schema}}
+}
+
+// textContent описывает текстовый ответ
+func textContent(mediaType string) apiObject {
+	return apiObject{mediaType: apiObject{"schema": typed("string", "")}}
+}
+
+// requestBody описывает тело запроса в JSON и, если form не nil, в виде формы
+func requestBody(jsonSchema, form apiObject) apiObject {
+	content := jsonContent(jsonSchema)
+	if form != nil {
+		content["application/x-www-form-urlencoded"] = apiObject{"schema": form}
+	}
+	return apiObject{"required": true, "content": content}
+}
+
+// document возвращает описание метода для раздела paths
+func (op apiOperation) document() apiObject {
+	errorSchema := op.errorSchema
+	if errorSchema == "" {
+		errorSchema = "Error"
+	}
+	responses := apiObject{
+		strconv.Itoa(op.success): apiObject{"description": http.StatusText(op.success), "content": op.content},
+	}
+	for _, status := range op.errors {
+		responses[strconv.Itoa(status)] = apiObject{
+			"description": errorDescriptions[status],
+			"content":     jsonContent(schemaRef(errorSchema)),
+		}
+	}
+	doc := apiObject{"summary": op.summary, "responses": responses}
+	if len(op.params) > 0 {
+		doc["parameters"] = op.params
+	}
+	if op.body != nil {
+		doc["requestBody"] = op.body
+	}
+	return doc
+}
+
+// apiSchemas - схемы запросов и ответов
+func apiSchemas() apiObject {
+	integer := typed("integer", "")
+	str := typed("string", "")
+	dateTime := apiObject{"type": "string", "format": "date-time"}
+	dateInput := typed("string", "date 2006-01-02, local time 2006-01-02T15:04:05 or RFC 3339 time")
+	applyTo := enumOf(ApplyToAll, ApplyToThis)
+	expectedVersion := typed("integer", "fail with 503 if the event has another version")
+	rsvp := enumOf(RSVPNeedsAction, RSVPAccepted, RSVPDeclined, RSVPTentative)
+	events := arrayOf(schemaRef("Event"))
+	events["nullable"] = true
+	intervals := arrayOf(schemaRef("Interval"))
+	intervals["nullable"] = true
+	changeType := enumOf(webhookChanges...)
+	changeTypes := arrayOf(changeType)
+	changeTypes["nullable"] = true
+	webhookSecret := typed("string", "HMAC-SHA256 signing key, random if not set on registration")
+
+	return apiObject{
+		"Error": objectSchema([]string{"error"}, apiObject{
+			"error":  str,
+			"fields": apiObject{"type": "object", "additionalProperties": str, "description": "validation errors by field"},
+		}),
+		"Event": objectSchema([]string{"user_id", "id", "version", "date", "end", "time_zone", "title", "description"}, apiObject{
+			"user_id":       typed("integer", "organizer"),
+			"id":            integer,
+			"version":       integer,
+			"date":          dateTime,
+			"end":           dateTime,
+			"time_zone":     str,
+			"title":         str,
+			"description":   str,
+			"recurrence":    schemaRef("Recurrence"),
+			"recurrence_id": dateTime,
+			"attendees":     arrayOf(schemaRef("Attendee")),
+			"tags":          arrayOf(str),
+			"reminders":     arrayOf(str),
+			"rsvp":          rsvp,
+		}),
+		"Recurrence": objectSchema([]string{"freq"}, apiObject{
+			"freq":      enumOf(FreqDaily, FreqWeekly, FreqMonthly, FreqYearly),
+			"interval":  integer,
+			"by_day":    arrayOf(enumOf(weekdayCodes...)),
+			"count":     integer,
+			"until":     str,
+			"exdates":   arrayOf(str),
+			"overrides": arrayOf(schemaRef("Override")),
+		}),
+		"Override": objectSchema([]string{"recurrence_id", "date", "end", "title", "description"}, apiObject{
+			"recurrence_id": str,
+			"date":          str,
+			"end":           str,
+			"title":         str,
+			"description":   str,
+		}),
+		"Attendee": objectSchema([]string{"user_id", "status"}, apiObject{
+			"user_id": integer,
+			"status":  rsvp,
+		}),
+		"Interval": objectSchema([]string{"start", "end"}, apiObject{
+			"start": dateTime,
+			"end":   dateTime,
+		}),
+		"EventRequest": objectSchema([]string{"user_id"}, apiObject{
+			"user_id":          integer,
+			"id":               integer,
+			"date":             dateInput,
+			"end":              dateInput,
+			"time_zone":        typed("string", "IANA time zone"),
+			"title":            str,
+			"description":      str,
+			"recurrence":       schemaRef("Recurrence"),
+			"attendees":        arrayOf(schemaRef("Attendee")),
+			"tags":             arrayOf(str),
+			"reminders":        arrayOf(typed("string", "offset before the start, like 15m")),
+			"scope":            applyTo,
+			"occurrence_date":  dateInput,
+			"reject_overlaps":  typed("boolean", "fail with 503 if the event overlaps another one"),
+			"expected_version": expectedVersion,
+		}),
+		"EventForm": objectSchema([]string{"user_id"}, apiObject{
+			"user_id":          integer,
+			"id":               integer,
+			"date":             dateInput,
+			"end":              dateInput,
+			"time_zone":        typed("string", "IANA time zone"),
+			"title":            str,
+			"description":      str,
+			"rrule":            typed("string", "RFC 5545 RRULE, like FREQ=WEEKLY;BYDAY=MO"),
+			"exdates":          typed("string", "comma separated dates"),
+			"attendees":        typed("string", "comma separated user IDs"),
+			"tags":             typed("string", "comma separated tags"),
+			"reminders":        typed("string", "comma separated offsets, like 15m,1h"),
+			"scope":            applyTo,
+			"occurrence_date":  dateInput,
+			"reject_overlaps":  typed("boolean", ""),
+			"expected_version": expectedVersion,
+		}),
+		"DeleteRequest": objectSchema([]string{"user_id", "id"}, apiObject{
+			"user_id":          integer,
+			"id":               integer,
+			"expected_version": expectedVersion,
+			"scope":            applyTo,
+			"occurrence_date":  dateInput,
+		}),
+		"InviteRequest": objectSchema([]string{"user_id", "id", "attendees"}, apiObject{
+			"user_id":          typed("integer", "organizer"),
+			"id":               integer,
+			"attendees":        arrayOf(integer),
+			"expected_version": expectedVersion,
+		}),
+		"InviteForm": objectSchema([]string{"user_id", "id", "attendees"}, apiObject{
+			"user_id":          typed("integer", "organizer"),
+			"id":               integer,
+			"attendees":        typed("string", "comma separated user IDs"),
+			"expected_version": expectedVersion,
+		}),
+		"RestoreRequest": objectSchema([]string{"user_id", "id"}, apiObject{
+			"user_id": integer,
+			"id":      integer,
+		}),
+		"RespondRequest": objectSchema([]string{"user_id", "id", "status"}, apiObject{
+			"user_id": typed("integer", "attendee"),
+			"id":      integer,
+			"status":  enumOf("accept", "decline", "tentative"),
+		}),
+		"LoginRequest": objectSchema([]string{"username", "password"}, apiObject{
+			"username": str,
+			"password": str,
+		}),
+		"LoginResult": objectSchema([]string{"result", "token", "expires_at"}, apiObject{
+			"result":     str,
+			"token":      str,
+			"expires_at": dateTime,
+		}),
+		"BatchRequest": objectSchema([]string{"operations"}, apiObject{
+			"operations": apiObject{
+				"type":     "array",
+				"maxItems": maxBatchOperations,
+				"items": apiObject{"allOf": []apiObject{
+					objectSchema([]string{"op"}, apiObject{"op": enumOf(BatchCreate, BatchUpdate, BatchDelete)}),
+					schemaRef("EventRequest"),
+				}},
+			},
+		}),
+		// results нет в ошибках проверки пакета, до выполнения операций
+		"BatchResult": objectSchema(nil, apiObject{
+			"result": str,
+			"error":  typed("string", "the failed operation, the whole batch is rolled back"),
+			"fields": apiObject{"type": "object", "additionalProperties": str},
+			"results": arrayOf(objectSchema([]string{"index", "op"}, apiObject{
+				"index": integer,
+				"op":    enumOf(BatchCreate, BatchUpdate, BatchDelete),
+				"event": schemaRef("Event"),
+				"error": str,
+			})),
+		}),
+		"EventsResult": objectSchema([]string{"result", "events"}, apiObject{
+			"result": str,
+			"events": events,
+		}),
+		"EventPage": objectSchema([]string{"result", "events"}, apiObject{
+			"result":      str,
+			"events":      events,
+			"next_cursor": typed("string", "cursor of the next page, absent on the last page"),
+		}),
+		"SearchResult": objectSchema([]string{"result", "events", "total"}, apiObject{
+			"result":      str,
+			"events":      events,
+			"total":       typed("integer", "matches on all pages"),
+			"next_cursor": str,
+		}),
+		"FreeBusyResult": objectSchema([]string{"result", "busy", "free"}, apiObject{
+			"result": str,
+			"busy":   intervals,
+			"free":   intervals,
+		}),
+		"TrashResult": objectSchema([]string{"result", "events"}, apiObject{
+			"result": str,
+			"events": arrayOf(apiObject{"allOf": []apiObject{
+				schemaRef("Event"),
+				objectSchema([]string{"deleted_at", "deleted_by"}, apiObject{
+					"deleted_at": dateTime,
+					"deleted_by": integer,
+				}),
+			}}),
+		}),
+		"HistoryResult": objectSchema([]string{"result", "history"}, apiObject{
+			"result": str,
+			"history": arrayOf(objectSchema([]string{"event_id", "user_id", "action", "actor", "time"}, apiObject{
+				"event_id": integer,
+				"user_id":  typed("integer", "owner of the event"),
+				"action":   enumOf(AuditCreate, AuditUpdate, AuditDelete, AuditRestore, AuditPurge),
+				"actor":    typed("integer", "user who made the change, 0 for the server"),
+				"time":     dateTime,
+				"old":      schemaRef("Event"),
+				"new":      schemaRef("Event"),
+			})),
+		}),
+		"WebhookRequest": objectSchema([]string{"user_id", "url"}, apiObject{
+			"user_id": integer,
+			"id":      typed("integer", "webhook to change, not used on registration"),
+			"url":     typed("string", "http or https URL, loopback, link-local and private addresses are rejected"),
+			"events":  arrayOf(changeType),
+			"secret":  webhookSecret,
+		}),
+		"WebhookForm": objectSchema([]string{"user_id", "url"}, apiObject{
+			"user_id": integer,
+			"id":      typed("integer", "webhook to change, not used on registration"),
+			"url":     typed("string", "http or https URL, loopback, link-local and private addresses are rejected"),
+			"events":  typed("string", "comma separated changes: create, update, delete"),
+			"secret":  webhookSecret,
+		}),
+		"Webhook": objectSchema([]string{"id", "user_id", "url", "events", "created_at"}, apiObject{
+			"id":         integer,
+			"user_id":    integer,
+			"url":        str,
+			"events":     changeTypes,
+			"secret":     typed("string", "signing key, returned only when it is set"),
+			"created_at": dateTime,
+		}),
+		"WebhooksResult": objectSchema([]string{"result", "webhooks"}, apiObject{
+			"result":   str,
+			"webhooks": arrayOf(schemaRef("Webhook")),
+		}),
+		"WebhookPayload": objectSchema([]string{"delivery_id", "webhook_id", "type", "time", "event"}, apiObject{
+			"delivery_id": typed("string", "the same in all attempts of a delivery"),
+			"webhook_id":  integer,
+			"type":        changeType,
+			"time":        dateTime,
+			"event":       schemaRef("Event"),
+		}),
+		"DeadLettersResult": objectSchema([]string{"result", "dead_letters"}, apiObject{
+			"result": str,
+			"dead_letters": arrayOf(objectSchema([]string{"webhook_id", "user_id", "url", "payload", "attempts", "last_error", "failed_at"}, apiObject{
+				"webhook_id": integer,
+				"user_id":    integer,
+				"url":        str,
+				"payload":    schemaRef("WebhookPayload"),
+				"attempts":   integer,
+				"last_error": str,
+				"failed_at":  dateTime,
+			})),
+		}),
+		"ImportResult": objectSchema([]string{"result", "events"}, apiObject{
+			"result": str,
+			"events": events,
+			"errors": arrayOf(objectSchema([]string{"index", "error"}, apiObject{
+				"index": integer,
+				"uid":   str,
+				"error": str,
+			})),
+		}),
+	}
+}
+
+// OpenAPIDocument возвращает описание API в формате OpenAPI 3
+func (scope *Scope) OpenAPIDocument() apiObject {
+	paths := apiObject{}
+	for _, rt := range scope.routeTable() {
+		item, ok := paths[rt.pattern].(apiObject)
+		if !ok {
+			item = apiObject{}
+			paths[rt.pattern] = item
+		}
+		item[strings.ToLower(rt.op.method)] = rt.op.document()
+	}
+	return apiObject{
+		"openapi": "3.0.3",
+		"info": apiObject{
+			"title":       "Calendar",
+			"version":     "1.0.0",
+			"description": "Write methods accept application/x-www-form-urlencoded or application/json bodies.",
+		},
+		"paths": paths,
+		"components": apiObject{
+			"schemas": apiSchemas(),
+			"securitySchemes": apiObject{
+				"bearer": apiObject{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []apiObject{{"bearer": []string{}}},
+	}
+}
+
+// OpenAPI отдает документ OpenAPI
+func (scope *Scope) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+	sendJSON(w, scope.OpenAPIDocument(), http.StatusOK)
+}
+
+// startingServer настраивает роуты и обслуживает запросы на cfg.Addr до отмены ctx
+func (scope *Scope) startingServer(ctx context.Context, cfg Config) error {
+	scope.routes()
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	return scope.serve(ctx, ln, cfg)
+}
+
+// serve обслуживает запросы на ln. После отмены ctx сервер перестает принимать соединения
+// и ждет завершения обрабатываемых запросов не дольше cfg.ShutdownTimeout. После этого соединения
+// закрываются, но serve возвращается только после завершения всех обработчиков: иначе хранилище
+// закрылось бы, пока они в него пишут
+func (scope *Scope) serve(ctx context.Context, ln net.Listener, cfg Config) error {
+	server := &http.Server{
+		Handler:        scope.Handler(),
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+		ErrorLog:       scope.logger.Logger,
+	}
+	// Shutdown ждет завершения обработчиков, поэтому потоки /subscribe закрываются сразу
+	server.RegisterOnShutdown(scope.broker.Close)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ln)
+	}()
+	scope.logger.Infof("listening on %s", ln.Addr())
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	scope.logger.Infof("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		scope.logger.Warnf("shutdown: %v, waiting for running requests", err)
+		_ = server.Close()
+		scope.inflight.Wait()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Middleware - обертка над обработчиком HTTP
+type Middleware func(http.Handler) http.Handler
+
+// chain оборачивает handler в middlewares: первый из них выполняется первым
+func chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for ind := len(middlewares) - 1; ind >= 0; ind-- {
+		handler = middlewares[ind](handler)
+	}
+	return handler
+}
+
+// Handler возвращает роуты, обернутые в middleware: учет обрабатываемых запросов, идентификатор запроса, журнал запросов,
+// метрики, перехват паник, аутентификация, ограничение частоты запросов и размера тела.
+// Ограничение частоты идет после аутентификации, чтобы считать запросы по пользователю
+func (scope *Scope) Handler() http.Handler {
+	return chain(scope.srv, scope.trackRequests, requestIDMiddleware, scope.logRequests, scope.observeRequests, scope.recoverPanics,
+		scope.authenticate, scope.rateLimit, scope.limitBody)
+}
+
+// trackRequests учитывает обрабатываемые запросы в scope.inflight
+func (scope *Scope) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope.inflight.Add(1)
+		defer scope.inflight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDHeader - заголовок с идентификатором запроса
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen ограничивает длину идентификатора запроса от клиента
+const maxRequestIDLen = 128
+
+// requestIDKey - ключ идентификатора запроса в контексте
+type requestIDKey struct{}
+
+// RequestID возвращает идентификатор запроса из контекста
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID проверяет, что идентификатор от клиента можно записать в лог и заголовок ответа
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID создает случайный идентификатор запроса
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware берет идентификатор запроса из заголовка X-Request-ID или создает новый,
+// кладет его в контекст запроса и возвращает в заголовке ответа
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// statusRecorder запоминает код статуса и размер ответа
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader запоминает код статуса
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write запоминает размер ответа. Без явного WriteHeader статус равен 200
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+// Flush передает данные клиенту, если это поддерживает исходный ResponseWriter
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap возвращает исходный ResponseWriter для http.ResponseController
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestLogEntry - запись журнала запросов
+type requestLogEntry struct {
+	Time      string  `json:"time"`
+	Level     string  `json:"level"`
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Query     string  `json:"query,omitempty"`
+	Status    int     `json:"status"`
+	Size      int     `json:"size"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// logRequests пишет в лог одну строку JSON на каждый обработанный запрос.
+// Ответы с кодом 5xx пишутся с уровнем error
+func (scope *Scope) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = LevelError
+		}
+		scope.logger.logJSON(level, requestLogEntry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			Level:     level.String(),
+			RequestID: RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     r.URL.RawQuery,
+			Status:    rec.status,
+			Size:      rec.size,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		})
+	})
+}
+
+// recoverPanics превращает панику обработчика в ответ HTTP 500 с JSON-ошибкой
+func (scope *Scope) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// ErrAbortHandler - штатный способ прервать ответ, его обрабатывает сам http.Server
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			scope.logger.Errorf("request %s: panic: %v\n%s", RequestID(r.Context()), p, debug.Stack())
+			if rec, ok := w.(*statusRecorder); ok && rec.status != 0 {
+				// Ответ уже начат, заменить его ошибкой нельзя
+				return
+			}
+			sendErr(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Причины отклонения запроса до обработчика
+const (
+	RejectRateLimit    = "rate_limit"
+	RejectBodyTooLarge = "body_too_large"
+)
+
+// rejection - причина и маршрут отклоненного запроса
+type rejection struct {
+	Reason string
+	Route  string
+}
+
+// Rejections считает запросы, отклоненные ограничениями, по причине и маршруту
+type Rejections struct {
+	mu     sync.Mutex
+	counts map[rejection]int64
+}
+
+// Inc увеличивает счетчик отклоненных запросов
+func (rj *Rejections) Inc(reason, route string) {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	if rj.counts == nil {
+		rj.counts = map[rejection]int64{}
+	}
+	rj.counts[rejection{reason, route}]++
+}
+
+// Snapshot возвращает копию счетчиков
+func (rj *Rejections) Snapshot() map[rejection]int64 {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	counts := make(map[rejection]int64, len(rj.counts))
+	for key, n := range rj.counts {
+		counts[key] = n
+	}
+	return counts
+}
+
+// route возвращает шаблон маршрута, которым будет обработан запрос, или "other" для неизвестных путей.
+// В отличие от пути запроса, число маршрутов ограничено, и их можно использовать как метку метрик
+func (scope *Scope) route(r *http.Request) string {
+	if _, pattern := scope.srv.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
+
+// rateLimitSweepInterval - период удаления неактивных корзин ограничителя
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket - корзина токенов одного клиента
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter ограничивает частоту запросов алгоритмом token bucket: у каждого ключа своя корзина
+// на burst токенов, которая пополняется со скоростью rate токенов в секунду
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter создает ограничитель на rate запросов в секунду с всплесками до burst запросов
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// refill пополняет корзину на момент now
+func (l *RateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = min(l.burst, b.tokens+elapsed*l.rate)
+		b.updated = now
+	}
+}
+
+// Allow забирает токен из корзины key. Если токенов нет, возвращает false и время до появления токена
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep удаляет заполненные корзины: они не отличаются от новых, а без удаления
+// карта росла бы с каждым новым клиентом
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now); b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey возвращает ключ ограничения: пользователя из токена или адрес клиента
+func rateLimitKey(r *http.Request) string {
+	if identity, ok := IdentityFrom(r.Context()); ok {
+		return "user:" + strconv.Itoa(identity.UserID)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// rateLimit отклоняет запросы сверх лимита с кодом 429 и заголовком Retry-After.
+// Без настроенного RateLimiter запросы не ограничиваются
+func (scope *Scope) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := scope.limiter.Allow(rateLimitKey(r)); !ok {
+			scope.rejections.Inc(RejectRateLimit, scope.route(r))
+			seconds := int((wait + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+			sendErr(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody - тело запроса, ограниченное http.MaxBytesReader. При первом превышении
+// лимита вызывается onLimit
+type limitedBody struct {
+	io.ReadCloser
+	onLimit func()
+	limited bool
+}
+
+// Read читает тело и отмечает превышение лимита
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !b.limited && bodyTooLarge(err) {
+		b.limited = true
+		b.onLimit()
+	}
+	return n, err
+}
+
+// bodyTooLarge проверяет, что ошибка вызвана превышением размера тела запроса
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// limitBody ограничивает тело запроса scope.maxBodyBytes байтами. Запросы с большим Content-Length
+// отклоняются сразу с кодом 413, остальные - при чтении тела
+func (scope *Scope) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope.maxBodyBytes <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := scope.route(r)
+		if r.ContentLength > scope.maxBodyBytes {
+			scope.rejections.Inc(RejectBodyTooLarge, route)
+			sendErr(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = &limitedBody{
+			ReadCloser: http.MaxBytesReader(w, r.Body, scope.maxBodyBytes),
+			onLimit:    func() { scope.rejections.Inc(RejectBodyTooLarge, route) },
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Histogram - гистограмма наблюдений с фиксированными верхними границами корзин
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// counts - число наблюдений в каждой корзине, последняя корзина - +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// latencyBuckets - границы гистограммы времени обработки запросов в секундах
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// lockWaitBuckets - границы гистограммы ожидания блокировки хранилища в секундах
+var lockWaitBuckets = []float64{1e-6, 1e-5, 1e-4, 1e-3, 1e-2, 0.1, 1}
+
+// NewHistogram создает гистограмму с возрастающими границами bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe добавляет наблюдение
+func (h *Histogram) Observe(v float64) {
+	ind := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[ind]++
+	h.sum += v
+	h.count++
+}
+
+// Count возвращает число наблюдений и их сумму
+func (h *Histogram) Count() (uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+// metricsWriter пишет метрики в текстовом формате Prometheus
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// header пишет описание и тип метрики
+func (mw *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(&mw.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper экранирует значения меток
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels форматирует пары имя, значение в {имя="значение",...}
+func formatLabels(labels ...string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for ind := 0; ind+1 < len(labels); ind += 2 {
+		parts = append(parts, labels[ind]+`="`+labelEscaper.Replace(labels[ind+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatFloat форматирует значение метрики
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sample пишет одно значение метрики
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(&mw.b, "%s%s %s\n", name, formatLabels(labels...), formatFloat(value))
+}
+
+// histogram пишет корзины (с накоплением), сумму и число наблюдений гистограммы
+func (mw *metricsWriter) histogram(name string, h *Histogram, labels ...string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for ind, n := range counts {
+		cumulative += n
+		le := math.Inf(1)
+		if ind < len(h.bounds) {
+			le = h.bounds[ind]
+		}
+		mw.sample(name+"_bucket", float64(cumulative), append(labels[:len(labels):len(labels)], "le", formatFloat(le))...)
+	}
+	mw.sample(name+"_sum", sum, labels...)
+	mw.sample(name+"_count", float64(count), labels...)
+}
+
+// requestKey - маршрут, метод и код ответа запроса
+type requestKey struct {
+	Route  string
+	Method string
+	Status int
+}
+
+// Metrics собирает число запросов и время их обработки по маршрутам
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[string]*Histogram
+}
+
+// NewMetrics создает пустые метрики
+func NewMetrics() *Metrics {
+	return &Metrics{requests: map[requestKey]uint64{}, latency: map[string]*Histogram{}}
+}
+
+// knownMethods - методы, которые попадают в метки как есть. Остальные считаются как OTHER,
+// чтобы клиент не мог создать произвольное число меток
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// Observe учитывает обработанный запрос
+func (m *Metrics) Observe(route, method string, status int, latency time.Duration) {
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	m.requests[requestKey{route, method, status}]++
+	h, ok := m.latency[route]
+	if !ok {
+		h = NewHistogram(latencyBuckets)
+		m.latency[route] = h
+	}
+	m.mu.Unlock()
+	h.Observe(latency.Seconds())
+}
+
+// observeRequests учитывает каждый запрос в scope.metrics
+func (scope *Scope) observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := scope.route(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		scope.metrics.Observe(route, r.Method, rec.status, time.Since(start))
+	})
+}
+
+// writeMetrics пишет все метрики сервера в текстовом формате Prometheus
+func (scope *Scope) writeMetrics(mw *metricsWriter) error {
+	m := scope.metrics
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	counts := make(map[requestKey]uint64, len(keys))
+	for _, key := range keys {
+		counts[key] = m.requests[key]
+	}
+	routes := make([]string, 0, len(m.latency))
+	latency := make(map[string]*Histogram, len(m.latency))
+	for route, h := range m.latency {
+		routes = append(routes, route)
+		latency[route] = h
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Status < b.Status
+	})
+	mw.header("calendar_http_requests_total", "counter", "Number of HTTP requests by route, method and status code.")
+	for _, key := range keys {
+		mw.sample("calendar_http_requests_total", float64(counts[key]),
+			"route", key.Route, "method", key.Method, "status", strconv.Itoa(key.Status))
+	}
+
+	sort.Strings(routes)
+	mw.header("calendar_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range routes {
+		mw.histogram("calendar_http_request_duration_seconds", latency[route], "route", route)
+	}
+
+	rejections := scope.rejections.Snapshot()
+	rejected := make([]rejection, 0, len(rejections))
+	for key := range rejections {
+		rejected = append(rejected, key)
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		if rejected[i].Reason != rejected[j].Reason {
+			return rejected[i].Reason < rejected[j].Reason
+		}
+		return rejected[i].Route < rejected[j].Route
+	})
+	mw.header("calendar_rejected_requests_total", "counter", "Number of requests rejected by rate and size limits.")
+	for _, key := range rejected {
+		mw.sample("calendar_rejected_requests_total", float64(rejections[key]), "reason", key.Reason, "route", key.Route)
+	}
+
+	stats, err := scope.EventRepository.Stats()
+	if err != nil {
+		return err
+	}
+	users := make([]int, 0, len(stats.Events))
+	for userID := range stats.Events {
+		users = append(users, userID)
+	}
+	sort.Ints(users)
+	mw.header("calendar_repository_events", "gauge", "Number of stored events by owner.")
+	for _, userID := range users {
+		mw.sample("calendar_repository_events", float64(stats.Events[userID]), "user_id", strconv.Itoa(userID))
+	}
+	mw.header("calendar_repository_lock_wait_seconds", "histogram", "Time spent waiting for the repository lock.")
+	mw.histogram("calendar_repository_lock_wait_seconds", stats.ReadLockWait, "mode", "read")
+	mw.histogram("calendar_repository_lock_wait_seconds", stats.WriteLockWait, "mode", "write")
+	return nil
+}
+
+// MetricsHandler отдает метрики в текстовом формате Prometheus. При включенной аутентификации
+// метрики доступны только администраторам: в них есть идентификаторы пользователей
+func (scope *Scope) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+	if scope.auth != nil {
+		if identity, ok := IdentityFrom(r.Context()); !ok || identity.Role != RoleAdmin {
+			sendErr(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	var mw metricsWriter
+	if err := scope.writeMetrics(&mw); err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = io.WriteString(w, mw.b.String())
+}
+
+// Роли пользователей
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Ошибки аутентификации и авторизации
+var (
+	ErrBadCredentials = errors.New("invalid username or password")
+	ErrBadToken       = errors.New("invalid or expired token")
+	ErrForbidden      = errors.New("access to another user's data is forbidden")
+)
+
+// User - учетная запись в локальном хранилище пользователей
+type User struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Role - user или admin. Администратор может действовать от имени других пользователей
+	Role string `json:"role"`
+	// PasswordHash - хеш пароля, созданный HashPassword
+	PasswordHash string `json:"password_hash"`
+}
+
+// UserStore - локальное хранилище пользователей, доступное только для чтения
+type UserStore struct {
+	byName map[string]User
+}
+
+// NewUserStore создает хранилище из списка пользователей
+func NewUserStore(users []User) (*UserStore, error) {
+	store := &UserStore{byName: make(map[string]User, len(users))}
+	ids := make(map[int]bool, len(users))
+	for _, u := range users {
+		if u.ID <= 0 || u.Name == "" {
+			return nil, fmt.Errorf("user %q: id and name are required", u.Name)
+		}
+		if u.Role == "" {
+			u.Role = RoleUser
+		}
+		if u.Role != RoleUser && u.Role != RoleAdmin {
+			return nil, fmt.Errorf("user %q: unknown role %q", u.Name, u.Role)
+		}
+		if _, ok := store.byName[u.Name]; ok || ids[u.ID] {
+			return nil, fmt.Errorf("user %q: duplicate name or id", u.Name)
+		}
+		store.byName[u.Name] = u
+		ids[u.ID] = true
+	}
+	return store, nil
+}
+
+// LoadUserStore читает пользователей из JSON-файла со списком User
+func LoadUserStore(path string) (*UserStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewUserStore(users)
+}
+
+// Authenticate проверяет имя и пароль пользователя
+func (store *UserStore) Authenticate(name, password string) (User, error) {
+	u, ok := store.byName[name]
+	if !ok {
+		// Пароль проверяется и для неизвестного имени, чтобы время ответа не выдавало существующих пользователей
+		_ = checkPassword(dummyPasswordHash, password)
+		return User{}, ErrBadCredentials
+	}
+	if !checkPassword(u.PasswordHash, password) {
+		return User{}, ErrBadCredentials
+	}
+	return u, nil
+}
+
+// Параметры хеширования паролей PBKDF2-SHA256
+const (
+	passwordHashScheme = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+)
+
+// dummyPasswordHash проверяется при входе под несуществующим именем
+var dummyPasswordHash = passwordHashScheme + "$" + strconv.Itoa(passwordIterations) + "$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+// HashPassword создает хеш пароля вида pbkdf2-sha256$итерации$соль$ключ
+func HashPassword(password string) (string, error) {
+	return hashPassword(password, passwordIterations)
+}
+
+// hashPassword создает хеш пароля с заданным числом итераций
+func hashPassword(password string, iterations int) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, passwordKeyLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword сравнивает пароль с хешем за время, не зависящее от совпадающего префикса
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, errSalt := enc.DecodeString(parts[2])
+	expected, errKey := enc.DecodeString(parts[3])
+	if errSalt != nil || errKey != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	return err == nil && hmac.Equal(key, expected)
+}
+
+// Identity - аутентифицированный пользователь запроса
+type Identity struct {
+	UserID int    `json:"uid"`
+	Role   string `json:"role"`
+}
+
+// tokenClaims - содержимое токена
+type tokenClaims struct {
+	Identity
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Authenticator выпускает и проверяет токены вида base64(claims).base64(HMAC-SHA256(claims))
+type Authenticator struct {
+	users  *UserStore
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewAuthenticator создает Authenticator с ключом подписи secret и временем жизни токена ttl
+func NewAuthenticator(users *UserStore, secret []byte, ttl time.Duration) *Authenticator {
+	return &Authenticator{users: users, secret: secret, ttl: ttl, now: time.Now}
+}
+
+// sign возвращает подпись payload
+func (a *Authenticator) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Login проверяет учетные данные и выпускает токен. Возвращает токен и время его истечения
+func (a *Authenticator) Login(name, password string) (string, time.Time, error) {
+	u, err := a.users.Authenticate(name, password)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := a.now().Add(a.ttl).Truncate(time.Second)
+	claims, err := json.Marshal(tokenClaims{Identity{UserID: u.ID, Role: u.Role}, expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	enc := base64.RawURLEncoding
+	payload := enc.EncodeToString(claims)
+	return payload + "." + enc.EncodeToString(a.sign(payload)), expires, nil
+}
+
+// Verify проверяет подпись и срок действия токена
+func (a *Authenticator) Verify(token string) (Identity, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Identity{}, ErrBadToken
+	}
+	enc := base64.RawURLEncoding
+	got, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, a.sign(payload)) {
+		return Identity{}, ErrBadToken
+	}
+	data, err := enc.DecodeString(payload)
+	if err != nil {
+		return Identity{}, ErrBadToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil || a.now().Unix() >= claims.ExpiresAt {
+		return Identity{}, ErrBadToken
+	}
+	return claims.Identity, nil
+}
+
+// identityKey - ключ Identity в контексте запроса
+type identityKey struct{}
+
+// IdentityFrom возвращает аутентифицированного пользователя запроса
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// publicPaths - методы, доступные без токена
+var publicPaths = map[string]bool{
+	"/login":        true,
+	"/openapi.json": true,
+}
+
+// authenticate проверяет заголовок Authorization: Bearer и кладет Identity в контекст запроса.
+// Без настроенного Authenticator запросы пропускаются без проверки
+func (scope *Scope) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope.auth == nil || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar"`)
+			sendErr(w, "authorization required", http.StatusUnauthorized)
+			return
+		}
+		identity, err := scope.auth.Verify(strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar", error="invalid_token"`)
+			sendErr(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// canAccess проверяет, может ли пользователь запроса работать с данными userID:
+// свои данные доступны всем, чужие - только администратору
+func (scope *Scope) canAccess(r *http.Request, userID int) error {
+	if scope.auth == nil {
+		return nil
+	}
+	identity, ok := IdentityFrom(r.Context())
+	if !ok {
+		return ErrBadToken
+	}
+	if identity.UserID != userID && identity.Role != RoleAdmin {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authorize отправляет 403 (или 401 без аутентификации), если данные userID недоступны, и возвращает false
+func (scope *Scope) authorize(w http.ResponseWriter, r *http.Request, userID int) bool {
+	err := scope.canAccess(r, userID)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrForbidden):
+		sendErr(w, err.Error(), http.StatusForbidden)
+	default:
+		sendErr(w, err.Error(), http.StatusUnauthorized)
+	}
+	return false
+}
+
+// Login выпускает токен по имени и паролю из формы или JSON {"username": ..., "password": ...}
+func (scope *Scope) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+	if scope.auth == nil {
+		sendErr(w, "authentication is not configured", http.StatusNotFound)
+		return
+	}
+
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err := decodeRequest(r, &creds, func(f formReader) {
+		creds.Username, creds.Password = f.str("username"), f.str("password")
+	})
+	if err == nil {
+		fe := fieldErrors{}
+		if creds.Username == "" {
+			fe.add("username", "required")
+		}
+		if creds.Password == "" {
+			fe.add("password", "required")
+		}
+		err = fe.err()
+	}
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	token, expires, err := scope.auth.Login(creds.Username, creds.Password)
+	if errors.Is(err, ErrBadCredentials) {
+		sendErr(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := struct {
+		Result    string `json:"result"`
+		Token     string `json:"token"`
+		ExpiresAt string `json:"expires_at"`
+	}{"Success", token, expires.UTC().Format(time.RFC3339)}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// newReminderScheduler создает планировщик напоминаний из конфигурации. Состояние планировщика
+// сохраняется рядом с файловым хранилищем, для хранилища в памяти оно не нужно
+func newReminderScheduler(cfg Config, repo EventRepository, logger Logger) (*ReminderScheduler, error) {
+	sinks := []NotificationSink{LogSink{Logger: logger}}
+	if cfg.ReminderWebhook != "" {
+		sinks = append(sinks, WebhookSink{URL: cfg.ReminderWebhook})
+	}
+	statePath := ""
+	if cfg.Storage == "file" {
+		statePath = filepath.Join(cfg.StorageDir, "reminders.json")
+	}
+	s, err := NewReminderScheduler(repo, realClock{}, logger, statePath, sinks...)
+	if err != nil {
+		return nil, fmt.Errorf("reminders: %w", err)
+	}
+	return s, nil
+}
+
+// newAuthenticator создает Authenticator из конфигурации. Без ключа подписи он создается случайно,
+// и токены перестают действовать после перезапуска. Если нет файла пользователей по умолчанию,
+// возвращается nil: аутентификация отключена
+func newAuthenticator(cfg Config, logger Logger) (*Authenticator, error) {
+	users, err := LoadUserStore(cfg.UsersFile)
+	if os.IsNotExist(err) && cfg.UsersFile == defaultConfig().UsersFile {
+		logger.Warnf("users file %s not found, authentication is disabled", cfg.UsersFile)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+	secret := []byte(cfg.AuthSecret)
+	if len(secret) == 0 {
+		logger.Warnf("auth secret is not configured, tokens will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return NewAuthenticator(users, secret, cfg.TokenTTL), nil
+}
+
+// CreateNewEvent создает новое событие и сохраняет его в хранилище. Если ID не задан,
+// его назначает хранилище. Возвращает сохраненное событие
+func (svc *CalendarService) CreateNewEvent(event Event, opts WriteOptions) (Event, error) {
+	if err := event.normalize(); err != nil {
+		return event, err
+	}
+	// Участники отвечают на приглашение сами
+	event.Attendees = mergeAttendees(nil, event.Attendees)
+	event.RSVP = ""
+	return svc.commit(ChangeCreate, AuditCreate, nil, func(tx EventRepository) (Event, error) {
+		if opts.RejectOverlaps {
+			if err := svc.within(tx).checkOverlaps(event.UserID, event.ID, event.upcoming()); err != nil {
+				return event, err
+			}
+		}
+		return tx.Create(event)
+	})
+}
+
+// actingAs возвращает сервис, изменения которого записываются в журнал от имени пользователя
+// запроса, а без аутентификации - от имени userID, с данными которого работает запрос
+func (scope *Scope) actingAs(r *http.Request, userID int) *CalendarService {
+	if identity, ok := IdentityFrom(r.Context()); ok {
+		userID = identity.UserID
+	}
+	return scope.As(userID)
+}
+
+// commit выполняет изменение fn и запись о нем в журнал изменений события в одной транзакции.
+// old - событие до изменения, читается после fn, nil - события не было. Для changeType ""
+// изменение не рассылается подписчикам
+func (svc *CalendarService) commit(changeType, action string, old *Event, fn func(tx EventRepository) (Event, error)) (Event, error) {
+	var e Event
+	err := svc.EventRepository.Transaction(func(tx EventRepository) error {
+		var err error
+		if e, err = fn(tx); err != nil {
+			return err
+		}
+		entry := AuditEntry{
+			EventID: e.ID,
+			UserID:  e.UserID,
+			Action:  action,
+			Actor:   svc.actor,
+			Time:    svc.clock.Now().UTC(),
+		}
+		if old != nil {
+			prev := *old
+			entry.Old = &prev
+		}
+		if action != AuditDelete && action != AuditPurge {
+			entry.New = &e
+		}
+		return tx.AppendHistory(entry)
+	})
+	if changeType == "" {
+		return e, err
+	}
+	return e, svc.changed(changeType, e, err)
+}
+
+// changed вызывается после записи в хранилище: при успешной записи изменение changeType события e
+// рассылается подписчикам и вебхукам и напоминания пересчитываются, а внутри пакета - откладываются до фиксации.
+// Возвращает err без изменений
+func (svc *CalendarService) changed(changeType string, e Event, err error) error {
+	switch {
+	case err != nil:
+	case svc.pending != nil:
+		*svc.pending = append(*svc.pending, pendingChange{changeType, e})
+	default:
+		svc.broker.Publish(changeType, e)
+		svc.webhooks.Notify(changeType, e)
+		svc.reminders.Reschedule()
+	}
+	return err
+}
+
+func (scope *Scope) CreateEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	req, err := parseEventRequest(r)
+	err = mergeValidation(err, ValidateEvent(req, true))
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+	event := req.Event
+	// ID всегда назначает сервер
+	event.ID = 0
+	event, err = scope.actingAs(r, req.UserID).CreateNewEvent(event, req.WriteOptions)
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusBadRequest))
+		return
+	}
+	sendRes(w, "Success", []Event{event}, http.StatusCreated)
+}
+
+// UpdateEventFunc обновляет существующее событие. Для серии с target.ApplyTo == "this" меняется
+// только повторение с датой target.OccurrenceDate, иначе - вся серия. Возвращает сохраненное событие
+func (svc *CalendarService) UpdateEventFunc(e Event, target SeriesTarget, opts WriteOptions) (Event, error) {
+	stored, err := svc.EventRepository.Get(e.UserID, e.ID)
+	if err != nil {
+		return e, err
+	}
+	if opts.ExpectedVersion != 0 && stored.Version != opts.ExpectedVersion {
+		return e, versionConflict(opts.ExpectedVersion, stored.Version)
+	}
+	// Даты без смещения трактуются в часовом поясе, в котором событие уже сохранено
+	if e.TimeZone == "" {
+		e.TimeZone = stored.TimeZone
+	}
+
+	if target.ApplyTo != ApplyToThis {
+		// Правило, исключения и изменения повторений сохраняются, если клиент их не передал
+		if e.Recurrence == nil {
+			e.Recurrence = stored.Recurrence
+		} else if stored.Recurrence != nil && e.Recurrence.ExDates == nil && e.Recurrence.Overrides == nil {
+			e.Recurrence = e.Recurrence.clone()
+			e.Recurrence.ExDates = append([]Date(nil), stored.Recurrence.ExDates...)
+			e.Recurrence.Overrides = append([]Override(nil), stored.Recurrence.Overrides...)
+		}
+		// Участники сохраняются, если клиент их не передал, а ответы оставшихся участников не сбрасываются
+		if e.Attendees == nil {
+			e.Attendees = stored.Attendees
+		} else {
+			e.Attendees = mergeAttendees(stored.Attendees, e.Attendees)
+		}
+		if e.Tags == nil {
+			e.Tags = stored.Tags
+		}
+		e.RecurrenceID = nil
+		e.RSVP = ""
+		if err := e.normalize(); err != nil {
+			return e, err
+		}
+		// Событие могли изменить между чтением и записью: запись проверяет прочитанную версию
+		return svc.commit(ChangeUpdate, AuditUpdate, &stored, func(tx EventRepository) (Event, error) {
+			if opts.RejectOverlaps {
+				if err := svc.within(tx).checkOverlaps(e.UserID, e.ID, e.upcoming()); err != nil {
+					return e, err
+				}
+			}
+			return tx.Update(e, stored.Version)
+		})
+	}
+
+	if err := e.normalize(); err != nil {
+		return e, err
+	}
+	occurrence, ok := stored.occurrenceStart(target.OccurrenceDate)
+	if !ok {
+		return e, ErrOccurrenceNotFound
+	}
+	old := stored
+	stored.Recurrence = stored.Recurrence.clone()
+	stored.Recurrence.setOverride(Override{
+		RecurrenceID: occurrence,
+		Date:         Date{date: e.Date.date.In(stored.location())},
+		End:          Date{date: e.End.date.In(stored.location())},
+		Title:        e.Title,
+		Description:  e.Description,
+	})
+	return svc.commit(ChangeUpdate, AuditUpdate, &old, func(tx EventRepository) (Event, error) {
+		if opts.RejectOverlaps {
+			if err := svc.within(tx).checkOverlaps(e.UserID, e.ID, []Event{stored.occurrence(occurrence.date)}); err != nil {
+				return e, err
+			}
+		}
+		return tx.Update(stored, stored.Version)
+	})
+}
+
+func (scope *Scope) UpdateEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+	req, err := parseEventRequest(r)
+	err = mergeValidation(err, ValidateEvent(req, false))
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+	updated, err := scope.actingAs(r, req.UserID).UpdateEventFunc(req.Event, req.SeriesTarget, req.WriteOptions)
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	sendRes(w, "Success", []Event{updated}, http.StatusOK)
+}
+
+// attendeeStatus возвращает ответ участника userID или пустую строку, если он не приглашен
+func (e Event) attendeeStatus(userID int) string {
+	for _, a := range e.Attendees {
+		if a.UserID == userID {
+			return a.Status
+		}
+	}
+	return ""
+}
+
+// mergeAttendees строит новый список участников: ответы тех, кто уже был в stored, сохраняются,
+// новые участники ждут ответа
+func mergeAttendees(stored, attendees []Attendee) []Attendee {
+	res := make([]Attendee, 0, len(attendees))
+	for _, a := range attendees {
+		status := RSVPNeedsAction
+		for _, s := range stored {
+			if s.UserID == a.UserID {
+				status = s.Status
+			}
+		}
+		res = append(res, Attendee{UserID: a.UserID, Status: status})
+	}
+	return res
+}
+
+// InviteFunc приглашает пользователей attendees на событие организатора organizerID.
+// Уже приглашенные пользователи пропускаются. Возвращает сохраненное событие
+func (svc *CalendarService) InviteFunc(organizerID, id int, attendees []int, expectedVersion int) (Event, error) {
+	stored, err := svc.EventRepository.Get(organizerID, id)
+	if err != nil {
+		return stored, err
+	}
+	if expectedVersion != 0 && stored.Version != expectedVersion {
+		return stored, versionConflict(expectedVersion, stored.Version)
+	}
+	old := stored
+	list := append([]Attendee(nil), stored.Attendees...)
+	for _, userID := range attendees {
+		if stored.attendeeStatus(userID) == "" {
+			list = append(list, Attendee{UserID: userID})
+		}
+	}
+	stored.Attendees = mergeAttendees(stored.Attendees, list)
+	return svc.commit(ChangeUpdate, AuditUpdate, &old, func(tx EventRepository) (Event, error) {
+		return tx.Update(stored, stored.Version)
+	})
+}
+
+// RespondFunc сохраняет ответ status пользователя userID на приглашение на событие id
+func (svc *CalendarService) RespondFunc(userID, id int, status string) (Event, error) {
+	invited, err := svc.EventRepository.Invited(userID)
+	if err != nil {
+		return Event{}, err
+	}
+	for _, e := range invited {
+		if e.ID != id {
+			continue
+		}
+		old := e
+		e.Attendees = append([]Attendee(nil), e.Attendees...)
+		for ind := range e.Attendees {
+			if e.Attendees[ind].UserID == userID {
+				e.Attendees[ind].Status = status
+			}
+		}
+		updated, err := svc.commit(ChangeUpdate, AuditUpdate, &old, func(tx EventRepository) (Event, error) {
+			return tx.Update(e, e.Version)
+		})
+		if err != nil {
+			return updated, err
+		}
+		updated.RSVP = status
+		return updated, nil
+	}
+	return Event{}, ErrNotInvited
+}
+
+// RemoveEventFunc удаляет событие в корзину. Для серии с cEvent.ApplyTo == "this" удаляется только
+// повторение с датой cEvent.OccurrenceDate: она добавляется в исключения правила
+func (svc *CalendarService) RemoveEventFunc(cEvent ConcreteEvent) error {
+	if cEvent.ApplyTo != ApplyToThis {
+		var stored Event
+		_, err := svc.commit(ChangeDelete, AuditDelete, &stored, func(tx EventRepository) (Event, error) {
+			var err error
+			if stored, err = tx.Get(cEvent.UserID, cEvent.ID); err != nil {
+				return stored, err
+			}
+			if err := tx.Delete(cEvent); err != nil {
+				return stored, err
+			}
+			return stored, tx.PutTrash(TrashedEvent{Event: stored, DeletedAt: svc.clock.Now().UTC(), DeletedBy: svc.actor})
+		})
+		return err
+	}
+
+	stored, err := svc.EventRepository.Get(cEvent.UserID, cEvent.ID)
+	if err != nil {
+		return err
+	}
+	if cEvent.ExpectedVersion != 0 && stored.Version != cEvent.ExpectedVersion {
+		return versionConflict(cEvent.ExpectedVersion, stored.Version)
+	}
+	occurrence, ok := stored.occurrenceStart(cEvent.OccurrenceDate)
+	if !ok {
+		return ErrOccurrenceNotFound
+	}
+	old := stored
+	stored.Recurrence = stored.Recurrence.clone()
+	stored.Recurrence.removeOverride(occurrence.date)
+	stored.Recurrence.ExDates = append(stored.Recurrence.ExDates, occurrence)
+	_, err = svc.commit(ChangeUpdate, AuditUpdate, &old, func(tx EventRepository) (Event, error) {
+		return tx.Update(stored, stored.Version)
+	})
+	return err
+}
+
+func (scope *Scope) RemoveEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	cEvent, err := parseConcreteEvent(r)
+	err = mergeValidation(err, ValidateConcreteEvent(cEvent))
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, cEvent.UserID) {
+		return
+	}
+
+	err = scope.actingAs(r, cEvent.UserID).RemoveEventFunc(cEvent)
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	sendRes(w, "Success", nil, http.StatusOK)
+}
+
+// RestoreEventFunc возвращает событие id пользователя userID из корзины
+func (svc *CalendarService) RestoreEventFunc(userID, id int) (Event, error) {
+	return svc.commit(ChangeCreate, AuditRestore, nil, func(tx EventRepository) (Event, error) {
+		return tx.Restore(userID, id)
+	})
+}
+
+// PurgeTrash окончательно удаляет события, пролежавшие в корзине дольше retention.
+// Возвращает число удаленных событий
+func (svc *CalendarService) PurgeTrash(retention time.Duration) (int, error) {
+	expired, err := svc.EventRepository.ExpiredTrash(svc.clock.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, t := range expired {
+		_, err := svc.commit("", AuditPurge, &t.Event, func(tx EventRepository) (Event, error) {
+			return t.Event, tx.Purge(t.UserID, t.ID)
+		})
+		// Событие могли восстановить после ExpiredTrash
+		if errors.Is(err, ErrEventNotFound) {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// RunTrashPurge раз в interval очищает корзину от событий старше retention до отмены ctx
+func (svc *CalendarService) RunTrashPurge(ctx context.Context, retention, interval time.Duration) {
+	for {
+		n, err := svc.PurgeTrash(retention)
+		if err != nil {
+			svc.logger.Errorf("trash purge: %v", err)
+		} else if n > 0 {
+			svc.logger.Infof("trash purge: %d events purged", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-svc.clock.After(interval):
+		}
+	}
+}
+
+// TrashEvents отдает корзину пользователя
+func (scope *Scope) TrashEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		sendBadRequest(w, &ValidationError{Fields: map[string]string{"user_id": "must be a positive integer"}})
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	trash, err := scope.EventRepository.Trash(userID)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := struct {
+		Result string         `json:"result"`
+		Events []TrashedEvent `json:"events"`
+	}{"Success", trash}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// RestoreRequest - тело запроса /restore_event
+type RestoreRequest struct {
+	UserID int `json:"user_id"`
+	ID     int `json:"id"`
+}
+
+// validate проверяет запрос восстановления
+func (req RestoreRequest) validate() error {
+	fe := fieldErrors{}
+	if req.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	if req.ID <= 0 {
+		fe.add("id", "must be a positive integer")
+	}
+	return fe.err()
+}
+
+// RestoreEvent возвращает событие из корзины
+func (scope *Scope) RestoreEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	var req RestoreRequest
+	err := decodeRequest(r, &req, func(f formReader) {
+		req = RestoreRequest{UserID: f.int("user_id"), ID: f.int("id")}
+	})
+	if err = mergeValidation(err, req.validate()); err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+
+	event, err := scope.actingAs(r, req.UserID).RestoreEventFunc(req.UserID, req.ID)
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	sendRes(w, "Success", []Event{event}, http.StatusOK)
+}
+
+// EventHistory отдает журнал изменений события. Журнал доступен владельцу события, для остальных
+// чужое событие неотличимо от несуществующего: иначе по ответам можно было бы узнать занятые ID
+func (scope *Scope) EventHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		sendBadRequest(w, &ValidationError{Fields: map[string]string{"id": "must be a positive integer"}})
+		return
+	}
+	entries, err := scope.EventRepository.History(id)
+	owner := 0
+	if err == nil {
+		owner = entries[0].UserID
+	}
+	switch accessErr := scope.canAccess(r, owner); {
+	case errors.Is(accessErr, ErrForbidden):
+		err = ErrEventNotFound
+	case accessErr != nil:
+		sendErr(w, accessErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	response := struct {
+		Result  string       `json:"result"`
+		History []AuditEntry `json:"history"`
+	}{"Success", entries}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// InviteRequest - тело запроса /invite
+type InviteRequest struct {
+	// UserID - организатор события
+	UserID int `json:"user_id"`
+	ID     int `json:"id"`
+	// Attendees - приглашаемые пользователи
+	Attendees []int `json:"attendees"`
+	// ExpectedVersion - версия, которую клиент видел перед изменением, 0 - не проверять
+	ExpectedVersion int `json:"expected_version,omitempty"`
+}
+
+// validate проверяет запрос приглашения
+func (req InviteRequest) validate() error {
+	fe := fieldErrors{}
+	if req.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	if req.ID <= 0 {
+		fe.add("id", "must be a positive integer")
+	}
+	if len(req.Attendees) == 0 {
+		fe.add("attendees", "required")
+	}
+	validateAttendees(fe, "attendees", req.UserID, req.Attendees)
+	return fe.err()
+}
+
+// InviteEvent приглашает пользователей на событие
+func (scope *Scope) InviteEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	var req InviteRequest
+	err := decodeRequest(r, &req, func(f formReader) {
+		req = InviteRequest{
+			UserID:          f.int("user_id"),
+			ID:              f.int("id"),
+			Attendees:       f.ints("attendees"),
+			ExpectedVersion: f.int("expected_version"),
+		}
+	})
+	if err = mergeValidation(err, req.validate()); err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+
+	event, err := scope.actingAs(r, req.UserID).InviteFunc(req.UserID, req.ID, req.Attendees, req.ExpectedVersion)
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	sendRes(w, "Success", []Event{event}, http.StatusOK)
+}
+
+// rsvpAnswers - допустимые ответы на приглашение в /respond
+var rsvpAnswers = map[string]string{
+	"accept":        RSVPAccepted,
+	"decline":       RSVPDeclined,
+	"tentative":     RSVPTentative,
+	RSVPAccepted:    RSVPAccepted,
+	RSVPDeclined:    RSVPDeclined,
+	RSVPNeedsAction: RSVPNeedsAction,
+}
+
+// RespondRequest - тело запроса /respond
+type RespondRequest struct {
+	// UserID - приглашенный пользователь
+	UserID int `json:"user_id"`
+	ID     int `json:"id"`
+	// Status - accept, decline или tentative
+	Status string `json:"status"`
+}
+
+// validate проверяет ответ на приглашение и возвращает статус участника, соответствующий ответу
+func (req RespondRequest) validate() (string, error) {
+	fe := fieldErrors{}
+	if req.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	if req.ID <= 0 {
+		fe.add("id", "must be a positive integer")
+	}
+	status, ok := rsvpAnswers[strings.ToLower(req.Status)]
+	if !ok {
+		fe.add("status", "must be accept, decline or tentative")
+	}
+	return status, fe.err()
+}
+
+// RespondEvent сохраняет ответ пользователя на приглашение
+func (scope *Scope) RespondEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	var req RespondRequest
+	err := decodeRequest(r, &req, func(f formReader) {
+		req = RespondRequest{
+			UserID: f.int("user_id"),
+			ID:     f.int("id"),
+			Status: f.str("status"),
+		}
+	})
+	status, verr := req.validate()
+	if err = mergeValidation(err, verr); err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+
+	event, err := scope.actingAs(r, req.UserID).RespondFunc(req.UserID, req.ID, status)
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	sendRes(w, "Success", []Event{event}, http.StatusOK)
+}
+
+// Операции /batch
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// maxBatchOperations ограничивает число операций в одном пакете
+const maxBatchOperations = 10000
+
+// BatchOperation - операция пакета. Для create и update поля те же, что у create_event и update_event,
+// для delete используются user_id, id, expected_version, scope и occurrence_date
+type BatchOperation struct {
+	Op string `json:"op"`
+	EventRequest
+}
+
+// concreteEvent возвращает цель операции удаления
+func (op BatchOperation) concreteEvent() ConcreteEvent {
+	return ConcreteEvent{
+		UserID:          op.UserID,
+		ID:              op.ID,
+		ExpectedVersion: op.ExpectedVersion,
+		SeriesTarget:    op.SeriesTarget,
+	}
+}
+
+// BatchResult - результат операции пакета
+type BatchResult struct {
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	Event *Event `json:"event,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchError - ошибка операции, из-за которой пакет отменен
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch rolled back: operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// pendingChange - изменение пакета, которое рассылается после фиксации транзакции
+type pendingChange struct {
+	changeType string
+	event      Event
+}
+
+// ValidateBatch проверяет операции пакета. Ошибки полей операции i имеют вид operations[i].поле
+func ValidateBatch(ops []BatchOperation) error {
+	fe := fieldErrors{}
+	if len(ops) == 0 {
+		fe.add("operations", "required")
+	} else if len(ops) > maxBatchOperations {
+		fe.add("operations", fmt.Sprintf("must contain at most %d operations", maxBatchOperations))
+	}
+	for ind, op := range ops {
+		prefix := fmt.Sprintf("operations[%d].", ind)
+		var err error
+		switch op.Op {
+		case BatchCreate:
+			err = ValidateEvent(op.EventRequest, true)
+		case BatchUpdate:
+			err = ValidateEvent(op.EventRequest, false)
+		case BatchDelete:
+			err = ValidateConcreteEvent(op.concreteEvent())
+		default:
+			fe.add(prefix+"op", "must be create, update or delete")
+		}
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			for field, msg := range verr.Fields {
+				fe.add(prefix+field, msg)
+			}
+		}
+	}
+	return fe.err()
+}
+
+// Batch выполняет операции в одной транзакции хранилища: при ошибке любой операции изменения
+// всех операций отменяются и возвращается *BatchError. Подписчики и напоминания узнают
+// об изменениях только после фиксации. Возвращает результаты выполненных операций
+func (svc *CalendarService) Batch(ops []BatchOperation) ([]BatchResult, error) {
+	var results []BatchResult
+	var pending []pendingChange
+	err := svc.EventRepository.Transaction(func(tx EventRepository) error {
+		results, pending = nil, nil
+		txSvc := *svc.within(tx)
+		txSvc.pending = &pending
+		for ind, op := range ops {
+			opSvc := txSvc
+			// Без аутентификации изменения записываются от имени владельца событий операции
+			if opSvc.actor == 0 {
+				opSvc.actor = op.UserID
+			}
+			event, err := opSvc.applyBatchOperation(op)
+			result := BatchResult{Index: ind, Op: op.Op}
+			if err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				return &BatchError{Index: ind, Err: err}
+			}
+			if op.Op != BatchDelete {
+				result.Event = &event
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+	for _, change := range pending {
+		_ = svc.changed(change.changeType, change.event, nil)
+	}
+	return results, nil
+}
+
+// applyBatchOperation выполняет одну операцию пакета
+func (svc *CalendarService) applyBatchOperation(op BatchOperation) (Event, error) {
+	switch op.Op {
+	case BatchCreate:
+		event := op.Event
+		// ID всегда назначает сервер
+		event.ID = 0
+		return svc.CreateNewEvent(event, op.WriteOptions)
+	case BatchUpdate:
+		return svc.UpdateEventFunc(op.Event, op.SeriesTarget, op.WriteOptions)
+	case BatchDelete:
+		return Event{}, svc.RemoveEventFunc(op.concreteEvent())
+	default:
+		return Event{}, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// BatchEvents выполняет пакет операций из JSON {"operations": [...]}. Если пакет отменен,
+// в ответе кроме ошибки есть результаты операций до отмененной включительно
+func (scope *Scope) BatchEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Operations []BatchOperation `json:"operations"`
+	}
+	err := decodeRequest(r, &req, func(f formReader) {
+		f.fe.add("operations", "form requests are not supported, use application/json")
+	})
+	if err == nil {
+		err = ValidateBatch(req.Operations)
+	}
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	for _, op := range req.Operations {
+		if !scope.authorize(w, r, op.UserID) {
+			return
+		}
+	}
+
+	results, err := scope.actingAs(r, 0).Batch(req.Operations)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var berr *BatchError
+		if errors.As(err, &berr) && req.Operations[berr.Index].Op == BatchCreate {
+			status = http.StatusBadRequest
+		}
+		response := struct {
+			Error   string        `json:"error"`
+			Results []BatchResult `json:"results"`
+		}{err.Error(), results}
+		sendJSON(w, response, errStatus(err, status))
+		return
+	}
+	response := struct {
+		Result  string        `json:"result"`
+		Results []BatchResult `json:"results"`
+	}{"Success", results}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// Типы изменений в ленте /subscribe
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+	// ChangeReset означает, что часть изменений потеряна и клиенту нужно перечитать события
+	ChangeReset = "reset"
+)
+
+// Настройки ленты изменений
+const (
+	// changeHistorySize - сколько последних изменений хранится для возобновления по Last-Event-ID
+	changeHistorySize = 1024
+	// subscriberBuffer - сколько изменений ждет медленного подписчика, прежде чем он будет отключен
+	subscriberBuffer = 64
+	// keepAliveInterval - период комментариев, не дающих прокси закрыть простаивающее соединение
+	keepAliveInterval = 15 * time.Second
+)
+
+// ChangeEvent - изменение события, доставляемое одному пользователю
+type ChangeEvent struct {
+	// Seq - номер изменения, возрастает в пределах процесса
+	Seq uint64 `json:"-"`
+	// ID - id в SSE: эпоха брокера и Seq через дефис
+	ID   string `json:"-"`
+	Type string `json:"type"`
+	// UserID - получатель: организатор или участник события
+	UserID int   `json:"user_id"`
+	Event  Event `json:"event"`
+}
+
+// Subscription - подписка пользователя на изменения. Канал C закрывается при отписке,
+// остановке брокера или переполнении буфера медленного подписчика
+type Subscription struct {
+	C      <-chan ChangeEvent
+	ch     chan ChangeEvent
+	userID int
+	// lagged - подписка закрыта из-за переполнения буфера, а не остановкой брокера
+	lagged bool
+}
+
+// Lagged сообщает, что подписка закрыта из-за отставания подписчика. Читать после закрытия C
+func (sub *Subscription) Lagged() bool {
+	return sub.lagged
+}
+
+// Broker - pub/sub изменений событий внутри процесса. Публикация никогда не ждет подписчиков
+type Broker struct {
+	mu sync.Mutex
+	// epoch отличает id изменений этого брокера от id, выданных до перезапуска: номера начинаются заново
+	epoch   string
+	seq     uint64
+	history []ChangeEvent
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// NewBroker создает брокер изменений
+func NewBroker() *Broker {
+	return &Broker{epoch: newEpoch(), subs: make(map[*Subscription]struct{})}
+}
+
+// newEpoch создает случайную эпоху брокера
+func newEpoch() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// eventID возвращает id изменения seq в SSE
+func (b *Broker) eventID(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventID разбирает id изменения. У id без эпохи, выданных до ее появления, epoch пуста
+func parseEventID(id string) (epoch string, seq uint64, err error) {
+	ind := strings.LastIndexByte(id, '-')
+	seq, err = strconv.ParseUint(id[ind+1:], 10, 64)
+	if ind < 0 {
+		return "", seq, err
+	}
+	return id[:ind], seq, err
+}
+
+// Publish рассылает изменение события организатору и участникам
+func (b *Broker) Publish(changeType string, e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.RSVP = ""
+	recipients := append([]int{e.UserID}, attendeeIDs(e.Attendees)...)
+	for _, userID := range recipients {
+		b.seq++
+		change := ChangeEvent{Seq: b.seq, ID: b.eventID(b.seq), Type: changeType, UserID: userID, Event: e}
+		change.Event.RSVP = e.attendeeStatus(userID)
+		b.history = append(b.history, change)
+		for sub := range b.subs {
+			if sub.userID != userID {
+				continue
+			}
+			select {
+			case sub.ch <- change:
+			default:
+				// Медленный подписчик отключается, пропущенное он получит при переподключении с Last-Event-ID
+				sub.lagged = true
+				b.remove(sub)
+			}
+		}
+	}
+	if extra := len(b.history) - changeHistorySize; extra > 0 {
+		b.history = append(b.history[:0:0], b.history[extra:]...)
+	}
+}
+
+// Subscribe подписывает пользователя на изменения. Если lastID не пуст, возвращает изменения после него;
+// complete == false, если часть этих изменений уже вытеснена из истории или lastID выдан до перезапуска
+func (b *Broker) Subscribe(userID int, lastID string) (sub *Subscription, missed []ChangeEvent, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan ChangeEvent, subscriberBuffer)
+	sub = &Subscription{C: ch, ch: ch, userID: userID}
+	if b.closed {
+		close(ch)
+		return sub, nil, true
+	}
+	b.subs[sub] = struct{}{}
+	if lastID == "" {
+		return sub, nil, true
+	}
+	epoch, lastSeq, err := parseEventID(lastID)
+	if err != nil || epoch != b.epoch {
+		return sub, nil, false
+	}
+
+	complete = lastSeq <= b.seq
+	if len(b.history) > 0 && b.history[0].Seq > lastSeq+1 {
+		complete = false
+	}
+	for _, change := range b.history {
+		if change.Seq > lastSeq && change.UserID == userID {
+			missed = append(missed, change)
+		}
+	}
+	return sub, missed, complete
+}
+
+// Unsubscribe отменяет подписку
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+// remove удаляет подписку и закрывает ее канал, вызывается под блокировкой
+func (b *Broker) remove(sub *Subscription) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Close закрывает все подписки, новые подписки сразу закрываются
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		b.remove(sub)
+	}
+}
+
+// writeSSE пишет одно сообщение Server-Sent Events, пустой id не пишется
+func writeSSE(w io.Writer, id, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+// Subscribe отдает изменения событий пользователя потоком Server-Sent Events. Клиент, переподключившийся
+// с заголовком Last-Event-ID (или параметром last_event_id), получает пропущенные изменения,
+// а если их уже нет в истории или id выдан до перезапуска сервера - сообщение reset
+func (scope *Scope) Subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil || userID <= 0 {
+		sendErr(w, "Incorrect args", http.StatusBadRequest)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+	if lastEventID != "" {
+		if _, _, err := parseEventID(lastEventID); err != nil {
+			sendErr(w, "Incorrect Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// Поток живет дольше WriteTimeout сервера
+	_ = rc.SetWriteDeadline(time.Time{})
+	sub, missed, complete := scope.broker.Subscribe(userID, lastEventID)
+	defer scope.broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !complete {
+		if err := writeSSE(w, "", ChangeReset, map[string]int{"user_id": userID}); err != nil {
+			return
+		}
+	}
+	for _, change := range missed {
+		if err := writeSSE(w, change.ID, change.Type, change); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case change, ok := <-sub.C:
+			if !ok {
+				// Поток закрыт: клиент переподключится и продолжит с последнего полученного id
+				if sub.Lagged() {
+					scope.logger.Warnf("subscribe: user %d is too slow, stream closed", userID)
+				}
+				return
+			}
+			if err := writeSSE(w, change.ID, change.Type, change); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Заголовки запросов вебхуков
+const (
+	// webhookSignatureHeader - подпись тела: sha256=<hex HMAC-SHA256 с секретом вебхука>
+	webhookSignatureHeader = "X-Calendar-Signature"
+	webhookEventHeader     = "X-Calendar-Event"
+	webhookDeliveryHeader  = "X-Calendar-Delivery"
+)
+
+// Настройки доставки вебхуков
+const (
+	// webhookQueueSize - сколько доставок ждет исполнителей. Доставка в переполненную очередь
+	// сразу попадает в список недоставленных
+	webhookQueueSize = 1024
+	// deadLetterLimit - сколько последних недоставленных изменений хранится
+	deadLetterLimit = 1000
+	// webhookTimeout - время на одну попытку доставки
+	webhookTimeout = 10 * time.Second
+	// maxWebhookBackoff ограничивает паузу между попытками
+	maxWebhookBackoff = time.Hour
+	// maxWebhookAttempts ограничивает webhook_max_attempts: с паузой в час доставка иначе
+	// повторялась бы неделями
+	maxWebhookAttempts = 100
+)
+
+// errWebhookShutdown - причина, по которой недоставленные при остановке изменения попадают в список недоставленных
+var errWebhookShutdown = errors.New("server is shutting down")
+
+// webhookChanges - изменения, на которые можно подписать вебхук
+var webhookChanges = []string{ChangeCreate, ChangeUpdate, ChangeDelete}
+
+// Webhook - подписка внешнего сервиса на изменения событий пользователя
+type Webhook struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	URL    string `json:"url"`
+	// Events - изменения create, update и delete, о которых сообщать; пустой список - обо всех
+	Events []string `json:"events"`
+	// Secret - ключ подписи запросов, отдается только при создании и смене
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wants проверяет, подписан ли вебхук на изменение changeType
+func (h Webhook) wants(changeType string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, changeType)
+}
+
+// WebhookPayload - тело запроса вебхука
+type WebhookPayload struct {
+	// DeliveryID одинаков во всех попытках доставки, по нему получатель отбрасывает повторы
+	DeliveryID string    `json:"delivery_id"`
+	WebhookID  int       `json:"webhook_id"`
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Event      Event     `json:"event"`
+}
+
+// DeadLetter - изменение, которое не удалось доставить за все попытки
+type DeadLetter struct {
+	WebhookID int            `json:"webhook_id"`
+	UserID    int            `json:"user_id"`
+	URL       string         `json:"url"`
+	Payload   WebhookPayload `json:"payload"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error"`
+	FailedAt  time.Time      `json:"failed_at"`
+}
+
+// webhookDelivery - доставка изменения одному вебхуку
+type webhookDelivery struct {
+	hook     Webhook
+	payload  WebhookPayload
+	body     []byte
+	attempts int
+}
+
+// signWebhook подписывает тело запроса секретом вебхука
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher хранит вебхуки в хранилище и доставляет им изменения событий пулом исполнителей.
+// Неудачная попытка повторяется с экспоненциально растущей паузой, после maxAttempts попыток
+// изменение попадает в список недоставленных
+type WebhookDispatcher struct {
+	// mu упорядочивает изменения вебхуков: изменение читает вебхук и сохраняет его целиком
+	mu    sync.Mutex
+	repo  EventRepository
+	queue chan *webhookDelivery
+	// retries - доставки, ждущие следующей попытки вне очереди
+	retries sync.WaitGroup
+
+	Client      *http.Client
+	clock       Clock
+	logger      Logger
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	// allowed - сети, в которые можно доставлять вебхуки, хотя адреса в них закрыты по умолчанию
+	allowed []*net.IPNet
+}
+
+// NewWebhookDispatcher создает диспетчер вебхуков хранилища repo с workers исполнителями.
+// backoff - пауза перед второй попыткой, перед каждой следующей она удваивается
+func NewWebhookDispatcher(repo EventRepository, workers, maxAttempts int, backoff time.Duration, clock Clock, logger Logger) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		repo:        repo,
+		queue:       make(chan *webhookDelivery, webhookQueueSize),
+		clock:       clock,
+		logger:      logger,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+	// Адрес проверяется при каждом соединении, уже после разрешения имени: имя могло смениться
+	// на внутренний адрес после регистрации вебхука, а ответ - перенаправить запрос во внутреннюю сеть.
+	// Прокси не используется, иначе проверялся бы адрес прокси
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !d.allows(ip) {
+			return fmt.Errorf("%w: %s", errWebhookAddress, host)
+		}
+		return nil
+	}}
+	d.Client = &http.Client{Timeout: webhookTimeout, Transport: &http.Transport{DialContext: dialer.DialContext}}
+	return d
+}
+
+// errWebhookAddress - адрес получателя вебхука закрыт
+var errWebhookAddress = errors.New("webhook address is not allowed")
+
+// allows проверяет, можно ли доставлять вебхуки по адресу ip. Адреса loopback, локальных
+// и частных сетей закрыты: иначе через вебхук можно обращаться к внутренним сервисам
+// и метаданным облака (169.254.169.254). Сети allowed открыты всегда
+func (d *WebhookDispatcher) allows(ip net.IP) bool {
+	for _, n := range d.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// checkURL проверяет адрес вебхука до регистрации: хост, заданный IP-адресом или localhost,
+// должен быть открыт. Имена разрешаются только при доставке
+func (d *WebhookDispatcher) checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil && !d.allows(ip) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// parseNetworks разбирает список сетей CIDR через запятую
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// newWebhookSecret создает случайный ключ подписи
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Register сохраняет новый вебхук. Без секрета он создается случайным. Возвращает вебхук с секретом
+func (d *WebhookDispatcher) Register(h Webhook) (Webhook, error) {
+	if h.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return h, err
+		}
+		h.Secret = secret
+	}
+	h.ID = 0
+	h.CreatedAt = d.clock.Now().UTC()
+	return d.repo.PutWebhook(h)
+}
+
+// webhook возвращает вебхук пользователя по ID
+func (d *WebhookDispatcher) webhook(userID, id int) (Webhook, error) {
+	hooks, err := d.repo.Webhooks()
+	if err != nil {
+		return Webhook{}, err
+	}
+	for _, h := range hooks {
+		if h.ID == id && h.UserID == userID {
+			return h, nil
+		}
+	}
+	return Webhook{}, ErrWebhookNotFound
+}
+
+// Update меняет адрес и список изменений вебхука пользователя, а если задан h.Secret, - и секрет.
+// Возвращает вебхук без секрета, если он не менялся
+func (d *WebhookDispatcher) Update(h Webhook) (Webhook, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stored, err := d.webhook(h.UserID, h.ID)
+	if err != nil {
+		return h, err
+	}
+	stored.URL = h.URL
+	stored.Events = h.Events
+	if h.Secret != "" {
+		stored.Secret = h.Secret
+	}
+	if _, err := d.repo.PutWebhook(stored); err != nil {
+		return h, err
+	}
+	if h.Secret == "" {
+		stored.Secret = ""
+	}
+	return stored, nil
+}
+
+// Delete удаляет вебхук пользователя. Доставки, ждущие повтора, отбрасываются
+func (d *WebhookDispatcher) Delete(userID, id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.webhook(userID, id); err != nil {
+		return err
+	}
+	return d.repo.DeleteWebhook(id)
+}
+
+// List возвращает вебхуки пользователя без секретов в порядке ID
+func (d *WebhookDispatcher) List(userID int) ([]Webhook, error) {
+	hooks, err := d.repo.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	res := []Webhook{}
+	for _, h := range hooks {
+		if h.UserID == userID {
+			h.Secret = ""
+			res = append(res, h)
+		}
+	}
+	return res, nil
+}
+
+// DeadLetters возвращает недоставленные изменения вебхуков пользователя, старые идут первыми
+func (d *WebhookDispatcher) DeadLetters(userID int) ([]DeadLetter, error) {
+	dead, err := d.repo.DeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	res := []DeadLetter{}
+	for _, dl := range dead {
+		if dl.UserID == userID {
+			res = append(res, dl)
+		}
+	}
+	return res, nil
+}
+
+// Notify ставит изменение события в очередь доставки вебхукам его организатора. Для nil ничего не делает
+func (d *WebhookDispatcher) Notify(changeType string, e Event) {
+	if d == nil {
+		return
+	}
+	hooks, err := d.repo.Webhooks()
+	if err != nil {
+		d.logger.Errorf("webhooks: %v", err)
+		return
+	}
+
+	e.RSVP = ""
+	now := d.clock.Now().UTC()
+	for _, h := range hooks {
+		if h.UserID != e.UserID || !h.wants(changeType) {
+			continue
+		}
+		payload := WebhookPayload{DeliveryID: newRequestID(), WebhookID: h.ID, Type: changeType, Time: now, Event: e}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			d.logger.Errorf("webhook %d: %v", h.ID, err)
+			continue
+		}
+		delivery := &webhookDelivery{hook: h, payload: payload, body: body}
+		select {
+		case d.queue <- delivery:
+		default:
+			d.bury(delivery, errors.New("delivery queue is full"))
+		}
+	}
+}
+
+// Run запускает исполнителей и ждет их завершения после отмены ctx. Доставки, которые
+// к этому моменту не удались, попадают в список недоставленных, а не теряются молча
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range d.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-d.queue:
+					d.deliver(ctx, delivery)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	d.retries.Wait()
+	for {
+		select {
+		case delivery := <-d.queue:
+			d.bury(delivery, errWebhookShutdown)
+		default:
+			return
+		}
+	}
+}
+
+// deliver выполняет одну попытку доставки и при неудаче планирует следующую. Вебхук перечитывается:
+// его могли изменить или удалить, пока доставка ждала
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery *webhookDelivery) {
+	hook, err := d.webhook(delivery.hook.UserID, delivery.hook.ID)
+	if errors.Is(err, ErrWebhookNotFound) {
+		return
+	}
+	if err != nil {
+		d.logger.Errorf("webhook %d: %v", delivery.hook.ID, err)
+		return
+	}
+	delivery.hook = hook
+	delivery.attempts++
+	err = d.send(ctx, delivery)
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		d.bury(delivery, errWebhookShutdown)
+		return
+	}
+	if delivery.attempts >= d.maxAttempts {
+		d.bury(delivery, err)
+		return
+	}
+	wait := d.retryWait(delivery.attempts)
+	d.logger.Warnf("webhook %d: attempt %d failed: %v, retry in %s", hook.ID, delivery.attempts, err, wait)
+	// Пауза не занимает исполнителя: доставка вернется в очередь по истечении wait
+	d.retries.Add(1)
+	go func() {
+		defer d.retries.Done()
+		select {
+		case <-ctx.Done():
+			d.bury(delivery, errWebhookShutdown)
+			return
+		case <-d.clock.After(wait):
+		}
+		// Доставку, попавшую в очередь уже после остановки, похоронит Run
+		select {
+		case <-ctx.Done():
+			d.bury(delivery, errWebhookShutdown)
+		case d.queue <- delivery:
+		}
+	}()
+}
+
+// retryWait возвращает паузу после attempts неудачных попыток: backoff, удвоенный attempts-1 раз,
+// но не больше maxWebhookBackoff. Удвоение останавливается раньше, чем сдвиг переполнит Duration
+func (d *WebhookDispatcher) retryWait(attempts int) time.Duration {
+	shift := attempts - 1
+	if shift >= 32 || d.backoff > maxWebhookBackoff>>shift {
+		return maxWebhookBackoff
+	}
+	return d.backoff << shift
+}
+
+// send отправляет подписанный запрос, ответ не из диапазона 2xx считается ошибкой
+func (d *WebhookDispatcher) send(ctx context.Context, delivery *webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signWebhook(delivery.hook.Secret, delivery.body))
+	req.Header.Set(webhookEventHeader, delivery.payload.Type)
+	req.Header.Set(webhookDeliveryHeader, delivery.payload.DeliveryID)
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", delivery.hook.URL, res.Status)
+	}
+	return nil
+}
+
+// bury сохраняет доставку в списке недоставленных
+func (d *WebhookDispatcher) bury(delivery *webhookDelivery, err error) {
+	d.logger.Errorf("webhook %d: giving up after %d attempts: %v", delivery.hook.ID, delivery.attempts, err)
+	dl := DeadLetter{
+		WebhookID: delivery.hook.ID,
+		UserID:    delivery.hook.UserID,
+		URL:       delivery.hook.URL,
+		Payload:   delivery.payload,
+		Attempts:  delivery.attempts,
+		LastError: err.Error(),
+		FailedAt:  d.clock.Now().UTC(),
+	}
+	if err := d.repo.AppendDeadLetter(dl); err != nil {
+		d.logger.Errorf("webhook %d: cannot save dead letter: %v", delivery.hook.ID, err)
+	}
+}
+
+// WebhookRequest - тело запросов /webhooks
+type WebhookRequest struct {
+	UserID int `json:"user_id"`
+	// ID - изменяемый вебхук, при создании не задается
+	ID     int      `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// isHTTPURL проверяет, что s - абсолютный URL http или https
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// parseWebhookRequest разбирает и проверяет тело запроса создания (create) или изменения вебхука
+func (scope *Scope) parseWebhookRequest(r *http.Request, create bool) (WebhookRequest, error) {
+	var req WebhookRequest
+	err := decodeRequest(r, &req, func(f formReader) {
+		req = WebhookRequest{
+			UserID: f.int("user_id"),
+			ID:     f.int("id"),
+			URL:    f.str("url"),
+			Events: f.list("events"),
+			Secret: f.str("secret"),
+		}
+	})
+	fe := fieldErrors{}
+	if req.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	if !create && req.ID <= 0 {
+		fe.add("id", "must be a positive integer")
+	}
+	if !isHTTPURL(req.URL) {
+		fe.add("url", "must be an http or https URL")
+	} else if scope.webhooks.checkURL(req.URL) != nil {
+		fe.add("url", "must not point to a loopback, link-local or private address")
+	}
+	for _, change := range req.Events {
+		if !slices.Contains(webhookChanges, change) {
+			fe.add("events", "must contain only create, update and delete")
+		}
+	}
+	return req, mergeValidation(err, fe.err())
+}
+
+// webhookUserID разбирает user_id из строки запроса
+func webhookUserID(r *http.Request) (int, error) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		return 0, &ValidationError{Fields: map[string]string{"user_id": "must be a positive integer"}}
+	}
+	return userID, nil
+}
+
+// sendWebhooks отправляет вебхуки
+func sendWebhooks(w http.ResponseWriter, hooks []Webhook, status int) {
+	response := struct {
+		Result   string    `json:"result"`
+		Webhooks []Webhook `json:"webhooks"`
+	}{"Success", hooks}
+	sendJSON(w, response, status)
+}
+
+// ListWebhooks отдает вебхуки пользователя
+func (scope *Scope) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, err := webhookUserID(r)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	hooks, err := scope.webhooks.List(userID)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendWebhooks(w, hooks, http.StatusOK)
+}
+
+// CreateWebhook регистрирует вебхук. Секрет подписи есть только в этом ответе
+func (scope *Scope) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	req, err := scope.parseWebhookRequest(r, true)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+	hook, err := scope.webhooks.Register(Webhook{UserID: req.UserID, URL: req.URL, Events: req.Events, Secret: req.Secret})
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendWebhooks(w, []Webhook{hook}, http.StatusCreated)
+}
+
+// UpdateWebhook меняет адрес, список изменений и, если он передан, секрет вебхука
+func (scope *Scope) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	req, err := scope.parseWebhookRequest(r, false)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, req.UserID) {
+		return
+	}
+	hook, err := scope.webhooks.Update(Webhook{ID: req.ID, UserID: req.UserID, URL: req.URL, Events: req.Events, Secret: req.Secret})
+	if err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	sendWebhooks(w, []Webhook{hook}, http.StatusOK)
+}
+
+// DeleteWebhook удаляет вебхук, user_id и id передаются в строке запроса
+func (scope *Scope) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := webhookUserID(r)
+	id, idErr := strconv.Atoi(r.URL.Query().Get("id"))
+	if idErr != nil || id <= 0 {
+		fe := fieldErrors{}
+		fe.add("id", "must be a positive integer")
+		err = mergeValidation(err, fe.err())
+	}
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	if err := scope.webhooks.Delete(userID, id); err != nil {
+		sendErr(w, err.Error(), errStatus(err, http.StatusInternalServerError))
+		return
+	}
+	sendWebhooks(w, []Webhook{}, http.StatusOK)
+}
+
+// WebhookDeadLetters отдает изменения, которые не удалось доставить вебхукам пользователя
+func (scope *Scope) WebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+	userID, err := webhookUserID(r)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	dead, err := scope.webhooks.DeadLetters(userID)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := struct {
+		Result      string       `json:"result"`
+		DeadLetters []DeadLetter `json:"dead_letters"`
+	}{"Success", dead}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// errStatus возвращает HTTP 503 для ошибок бизнес-логики и fallback для остальных ошибок
+func errStatus(err error, fallback int) int {
+	if errors.Is(err, ErrOverlap) || errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrNotInvited) {
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+// sendJSON сериализует ответ в JSON и отправляет его с заданным кодом статуса
+func sendJSON(writer http.ResponseWriter, response interface{}, status int) {
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Заголовки нужно выставить до WriteHeader, иначе они не попадут в ответ
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_, _ = writer.Write(jsonResponse)
+}
+
+// sendErr отправляет заданную ошибку с заданным кодов статуса
+func sendErr(writer http.ResponseWriter, errorStr string, status int) {
+	response := struct {
+		Error string `json:"error"`
+	}{errorStr}
+	sendJSON(writer, response, status)
+}
+
+// sendBadRequest отправляет ошибку разбора или проверки запроса с кодом 400.
+// Для *ValidationError в ответ добавляются ошибки по полям, слишком большое тело дает код 413
+func sendBadRequest(writer http.ResponseWriter, err error) {
+	if bodyTooLarge(err) {
+		sendErr(writer, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		sendErr(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := struct {
+		Error  string            `json:"error"`
+		Fields map[string]string `json:"fields"`
+	}{"validation failed", verr.Fields}
+	sendJSON(writer, response, http.StatusBadRequest)
+}
+
+// sendRes отправляет результат запроса
+func sendRes(writer http.ResponseWriter, resStr string, events []Event, status int) {
+	response := struct {
+		Result string  `json:"result"`
+		Events []Event `json:"events"`
+	}{resStr, events}
+	sendJSON(writer, response, status)
+}
+
+// ValidationError - ошибка входных данных с описанием проблемы в каждом поле
+type ValidationError struct {
+	Fields map[string]string
+}
+
+// Error перечисляет поля с ошибками
+func (verr *ValidationError) Error() string {
+	names := make([]string, 0, len(verr.Fields))
+	for name := range verr.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "invalid fields: " + strings.Join(names, ", ")
+}
+
+// dateFieldMessage описывает допустимые форматы даты в ошибке поля
+const dateFieldMessage = "must be a date 2006-01-02, local time 2006-01-02T15:04:05 or RFC 3339 time"
+
+// fieldErrors накапливает ошибки по полям
+type fieldErrors map[string]string
+
+// add запоминает первую ошибку поля
+func (fe fieldErrors) add(field, msg string) {
+	if _, ok := fe[field]; !ok {
+		fe[field] = msg
+	}
+}
+
+// err возвращает *ValidationError или nil, если ошибок нет
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: fe}
+}
+
+// mergeValidation объединяет ошибки разбора и проверки запроса, чтобы клиент сразу увидел
+// все неверные поля. Ошибка разбора, не относящаяся к полям, возвращается как есть
+func mergeValidation(parseErr, validateErr error) error {
+	if parseErr == nil {
+		return validateErr
+	}
+	var perr, verr *ValidationError
+	if !errors.As(parseErr, &perr) || !errors.As(validateErr, &verr) {
+		return parseErr
+	}
+	fe := fieldErrors(perr.Fields)
+	for field, msg := range verr.Fields {
+		fe.add(field, msg)
+	}
+	return fe.err()
+}
+
+// ValidateEvent проверяет событие перед созданием (create == true) или изменением и
+// возвращает *ValidationError со всеми найденными ошибками
+func ValidateEvent(req EventRequest, create bool) error {
+	fe := fieldErrors{}
+	event := req.Event
+	if event.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	if !create && event.ID <= 0 {
+		fe.add("id", "must be a positive integer")
+	}
+	if event.Title == "" {
+		fe.add("title", "required")
+	}
+	if event.Description == "" {
+		fe.add("description", "required")
+	}
+	if event.Date.date.IsZero() {
+		fe.add("date", "required")
+	}
+	if err := event.Recurrence.validate(); err != nil {
+		fe.add("recurrence", err.Error())
+	}
+	if req.ExpectedVersion < 0 {
+		fe.add("expected_version", "must not be negative")
+	}
+	validateTarget(fe, req.SeriesTarget)
+	validateAttendees(fe, "attendees", event.UserID, attendeeIDs(event.Attendees))
+	validateReminders(fe, event.Reminders)
+	for _, tag := range event.Tags {
+		if len(tag) > maxTagLen {
+			fe.add("tags", fmt.Sprintf("must be at most %d bytes long", maxTagLen))
+		}
+	}
+
+	// Часовой пояс и порядок дат проверяются на копии: нормализацию выполняет бизнес-логика
+	check := event
+	check.Recurrence = nil
+	if err := check.normalize(); errors.Is(err, ErrEndBeforeStart) {
+		fe.add("end", "must not be before date")
+	} else if err != nil {
+		fe.add("time_zone", "unknown time zone")
+	}
+	return fe.err()
+}
+
+// attendeeIDs возвращает user_id участников
+func attendeeIDs(attendees []Attendee) []int {
+	ids := make([]int, 0, len(attendees))
+	for _, a := range attendees {
+		ids = append(ids, a.UserID)
+	}
+	return ids
+}
+
+// validateAttendees проверяет, что участники - существующие идентификаторы без повторов и без организатора
+func validateAttendees(fe fieldErrors, field string, organizerID int, ids []int) {
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		switch {
+		case id <= 0:
+			fe.add(field, "user ids must be positive integers")
+		case id == organizerID:
+			fe.add(field, "must not include the organizer")
+		case seen[id]:
+			fe.add(field, "must not contain duplicates")
+		}
+		seen[id] = true
+	}
+}
+
+// validateReminders проверяет смещения напоминаний
+func validateReminders(fe fieldErrors, reminders []Offset) {
+	seen := make(map[Offset]bool, len(reminders))
+	for _, o := range reminders {
+		switch {
+		case o < 0 || time.Duration(o) > maxReminderOffset:
+			fe.add("reminders", "must be between 0s and "+maxReminderOffset.String())
+		case seen[o]:
+			fe.add("reminders", "must not contain duplicates")
+		}
+		seen[o] = true
+	}
+}
+
+// ValidateConcreteEvent проверяет параметры удаления события
+func ValidateConcreteEvent(cEvent ConcreteEvent) error {
+	fe := fieldErrors{}
+	if cEvent.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	if cEvent.ID <= 0 {
+		fe.add("id", "must be a positive integer")
+	}
+	if cEvent.ExpectedVersion < 0 {
+		fe.add("expected_version", "must not be negative")
+	}
+	validateTarget(fe, cEvent.SeriesTarget)
+	return fe.err()
+}
+
+// validateTarget проверяет указание на повторение серии
+func validateTarget(fe fieldErrors, target SeriesTarget) {
+	switch target.ApplyTo {
+	case "", ApplyToAll:
+	case ApplyToThis:
+		if target.OccurrenceDate == nil {
+			fe.add("occurrence_date", "required when scope is this")
+		}
+	default:
+		fe.add("scope", "must be all or this")
+	}
+}
+
+// isJSONRequest определяет формат тела по Content-Type. Без заголовка формат угадывается
+// по первому символу, чтобы старые клиенты, отправлявшие JSON без Content-Type, продолжили работать
+func isJSONRequest(r *http.Request, body []byte) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		trimmed := bytes.TrimSpace(body)
+		return len(trimmed) > 0 && trimmed[0] == '{'
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// decodeJSON разбирает JSON, указывая поле, в котором тип значения не совпал
+func decodeJSON(body []byte, v interface{}) error {
+	err := json.Unmarshal(body, v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return &ValidationError{Fields: map[string]string{typeErr.Field: "must be " + typeErr.Type.String()}}
+	}
+	if err != nil {
+		if verr := invalidDates(body); verr != nil {
+			return verr
+		}
+		return fmt.Errorf("cannot decode json: %w", err)
+	}
+	return nil
+}
+
+// invalidDates ищет в JSON верхнего уровня поля с неверными датами: ошибка из
+// Date.UnmarshalJSON приходит без имени поля
+func invalidDates(body []byte) error {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(body, &raw) != nil {
+		return nil
+	}
+	fe := fieldErrors{}
+	for _, name := range []string{"date", "end", "occurrence_date"} {
+		value, ok := raw[name]
+		if !ok || string(value) == "null" {
+			continue
+		}
+		var d Date
+		if d.UnmarshalJSON(value) != nil {
+			fe.add(name, dateFieldMessage)
+		}
+	}
+	return fe.err()
+}
+
+// formReader читает поля формы, накапливая ошибки разбора по полям
+type formReader struct {
+	values url.Values
+	fe     fieldErrors
+}
+
+// str возвращает строковое поле
+func (f formReader) str(name string) string {
+	return f.values.Get(name)
+}
+
+// int разбирает целое поле, пустое поле равно 0
+func (f formReader) int(name string) int {
+	value := f.values.Get(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		f.fe.add(name, "must be an integer")
+	}
+	return n
+}
+
+// bool разбирает логическое поле, пустое поле равно false
+func (f formReader) bool(name string) bool {
+	value := f.values.Get(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		f.fe.add(name, "must be a boolean")
+	}
+	return b
+}
+
+// date разбирает поле с датой в тех же форматах, что и JSON
+func (f formReader) date(name string) Date {
+	value := f.values.Get(name)
+	if value == "" {
+		return Date{}
+	}
+	d, err := parseDate(value)
+	if err != nil {
+		f.fe.add(name, dateFieldMessage)
+	}
+	return d
+}
+
+// ints разбирает список целых чисел через запятую
+func (f formReader) ints(name string) []int {
+	value := f.values.Get(name)
+	if value == "" {
+		return nil
+	}
+	var res []int
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			f.fe.add(name, "must be a comma separated list of integers")
+			return nil
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// offsets читает смещения напоминаний через запятую: 15m,1h
+func (f formReader) offsets(name string) []Offset {
+	value := f.values.Get(name)
+	if value == "" {
+		return nil
+	}
+	var res []Offset
+	for _, s := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			f.fe.add(name, "must be a comma separated list of durations like 15m")
+			return nil
+		}
+		res = append(res, Offset(d))
+	}
+	return res
+}
+
+// list разбирает список строк через запятую
+func (f formReader) list(name string) []string {
+	value := f.values.Get(name)
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// attendees читает участников события: список user_id через запятую
+func (f formReader) attendees(name string) []Attendee {
+	var res []Attendee
+	for _, userID := range f.ints(name) {
+		res = append(res, Attendee{UserID: userID})
+	}
+	return res
+}
+
+// target читает указание на повторение серии
+func (f formReader) target() SeriesTarget {
+	target := SeriesTarget{ApplyTo: f.str("scope")}
+	if f.str("occurrence_date") != "" {
+		d := f.date("occurrence_date")
+		target.OccurrenceDate = &d
+	}
+	return target
+}
+
+// recurrence читает правило повторения: rrule в синтаксисе RFC 5545 (FREQ=WEEKLY;BYDAY=MO)
+// и список исключений exdates через запятую
+func (f formReader) recurrence() *Recurrence {
+	value := f.str("rrule")
+	if value == "" {
+		return nil
+	}
+	r, err := parseRRule(value, time.UTC)
+	if err != nil {
+		f.fe.add("rrule", err.Error())
+		return nil
+	}
+	// UNTIL без суффикса Z задан во времени события, как и остальные даты формы без смещения
+	if r.Until != nil {
+		for _, part := range strings.Split(value, ";") {
+			kv := strings.SplitN(part, "=", 2)
+			if strings.EqualFold(kv[0], "UNTIL") && !strings.HasSuffix(kv[1], "Z") {
+				r.Until.floating = true
+				r.Until.dateOnly = len(kv[1]) == len(icsDateLayout)
+			}
+		}
+	}
+	if exdates := f.str("exdates"); exdates != "" {
+		for _, value := range strings.Split(exdates, ",") {
+			d, err := parseDate(strings.TrimSpace(value))
+			if err != nil {
+				f.fe.add("exdates", "must be a comma separated list of dates")
+				break
+			}
+			r.ExDates = append(r.ExDates, d)
+		}
+	}
+	return r
+}
+
+// readBody читает тело запроса целиком
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %w", err)
+	}
+	return body, nil
+}
+
+// maxFormMemory - объем multipart формы, который хранится в памяти
+const maxFormMemory = 1 << 20
+
+// formValues разбирает тело формы application/x-www-form-urlencoded или multipart/form-data
+func formValues(r *http.Request, body []byte) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+			if bodyTooLarge(err) {
+				return nil, err
+			}
+			return nil, errors.New("cannot decode form")
+		}
+		return url.Values(r.MultipartForm.Value), nil
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, errors.New("cannot decode form")
+	}
+	return values, nil
+}
+
+// decodeRequest разбирает тело запроса: JSON декодируется в v, а поля формы
+// application/x-www-form-urlencoded или multipart/form-data переносит в v функция fromForm
+func decodeRequest(r *http.Request, v interface{}, fromForm func(f formReader)) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if isJSONRequest(r, body) {
+		return decodeJSON(body, v)
+	}
+	values, err := formValues(r, body)
+	if err != nil {
+		return err
+	}
+	f := formReader{values: values, fe: fieldErrors{}}
+	fromForm(f)
+	return f.fe.err()
+}
+
+// parseEventRequest разбирает тело create_event и update_event в формате
+// application/x-www-form-urlencoded (как требует задание) или application/json
+func parseEventRequest(r *http.Request) (EventRequest, error) {
+	var req EventRequest
+	err := decodeRequest(r, &req, func(f formReader) {
+		req.Event = Event{
+			UserID:      f.int("user_id"),
+			ID:          f.int("id"),
+			Date:        f.date("date"),
+			End:         f.date("end"),
+			TimeZone:    f.str("time_zone"),
+			Title:       f.str("title"),
+			Description: f.str("description"),
+			Recurrence:  f.recurrence(),
+			Attendees:   f.attendees("attendees"),
+			Reminders:   f.offsets("reminders"),
+			Tags:        f.list("tags"),
+		}
+		req.SeriesTarget = f.target()
+		req.WriteOptions = WriteOptions{
+			RejectOverlaps:  f.bool("reject_overlaps"),
+			ExpectedVersion: f.int("expected_version"),
+		}
+	})
+	return req, err
+}
+
+// parseConcreteEvent разбирает тело delete_event в формате формы или JSON
+func parseConcreteEvent(r *http.Request) (ConcreteEvent, error) {
+	var cEvent ConcreteEvent
+	err := decodeRequest(r, &cEvent, func(f formReader) {
+		cEvent = ConcreteEvent{
+			UserID:          f.int("user_id"),
+			ID:              f.int("id"),
+			ExpectedVersion: f.int("expected_version"),
+			SeriesTarget:    f.target(),
+		}
+	})
+	return cEvent, err
+}
+
+// UnmarshalJSON для типа Date
+func (d *Date) UnmarshalJSON(input []byte) error {
+	if string(input) == "null" {
+		*d = Date{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		return err
+	}
+	parsed, err := parseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// parseDate разбирает время RFC 3339, локальное время без смещения или дату без времени.
+// Два последних варианта привязываются к часовому поясу события при нормализации
+func parseDate(s string) (Date, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return Date{date: t}, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05", s); err == nil {
+		return Date{date: t, floating: true}, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return Date{}, fmt.Errorf("bad date %q", s)
+	}
+	return Date{date: t, floating: true, dateOnly: true}, nil
+}
+
+// String для типа Date
+func (d Date) String() string {
+	return d.date.String()
+}
+
+// MarshalJSON для типа Date
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.date.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.date.Format(time.RFC3339))
+}
+
+// in привязывает значение к часовому поясу loc. У значения без времени суток время берется
+// из clock, чтобы дата исключения или повторения указывала на начало повторения в этот день
+func (d Date) in(loc *time.Location, clock time.Time) Date {
+	if d.date.IsZero() {
+		return Date{}
+	}
+	if !d.floating {
+		return Date{date: d.date.In(loc)}
+	}
+	year, month, day := d.date.Date()
+	hour, min, sec := d.date.Clock()
+	if d.dateOnly {
+		hour, min, sec = clock.Clock()
+	}
+	return Date{date: time.Date(year, month, day, hour, min, sec, 0, loc)}
+}
+
+// normalize привязывает все даты события к его часовому поясу и проверяет, что окончание не раньше начала.
+// Повторный вызов ничего не меняет
+func (e *Event) normalize() error {
+	if e.TimeZone == "" {
+		e.TimeZone = "UTC"
+	}
+	e.Tags = normalizeTags(e.Tags)
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time_zone %q", e.TimeZone)
+	}
+
+	allDay := e.Date.dateOnly
+	e.Date = e.Date.in(loc, time.Time{})
+	end := e.End.in(loc, time.Time{})
+	if end.date.IsZero() {
+		end = e.Date
+		if allDay {
+			end = Date{date: e.Date.date.AddDate(0, 0, 1)}
+		}
+	}
+	if end.date.Before(e.Date.date) {
+		return ErrEndBeforeStart
+	}
+	e.End = end
+
+	if e.Recurrence == nil {
+		return nil
+	}
+	clock := e.Date.date
+	r := e.Recurrence.clone()
+	if r.Until != nil {
+		until := r.Until.in(loc, clock)
+		r.Until = &until
+	}
+	for ind := range r.ExDates {
+		r.ExDates[ind] = r.ExDates[ind].in(loc, clock)
+	}
+	for ind := range r.Overrides {
+		o := &r.Overrides[ind]
+		o.RecurrenceID = o.RecurrenceID.in(loc, clock)
+		o.Date = o.Date.in(loc, time.Time{})
+		o.End = o.End.in(loc, time.Time{})
+		if o.End.date.IsZero() {
+			o.End = Date{date: o.Date.date.Add(e.duration())}
+		}
+		if o.End.date.Before(o.Date.date) {
+			return ErrEndBeforeStart
+		}
+	}
+	e.Recurrence = r
+	return nil
+}
+
+// localize привязывает даты события, прочитанные из снимка или журнала, к его часовому поясу.
+// После JSON у них фиксированное смещение, и серия после перехода на летнее время сдвинулась бы на час
+func (e *Event) localize() {
+	loc := e.location()
+	at := func(d Date) Date {
+		if d.date.IsZero() || d.floating {
+			return d
+		}
+		return Date{date: d.date.In(loc)}
+	}
+	e.Date = at(e.Date)
+	e.End = at(e.End)
+	if e.RecurrenceID != nil {
+		id := at(*e.RecurrenceID)
+		e.RecurrenceID = &id
+	}
+	if e.Recurrence == nil {
+		return
+	}
+	r := e.Recurrence.clone()
+	if r.Until != nil {
+		until := at(*r.Until)
+		r.Until = &until
+	}
+	for ind := range r.ExDates {
+		r.ExDates[ind] = at(r.ExDates[ind])
+	}
+	for ind := range r.Overrides {
+		o := &r.Overrides[ind]
+		o.RecurrenceID = at(o.RecurrenceID)
+		o.Date = at(o.Date)
+		o.End = at(o.End)
+	}
+	e.Recurrence = r
+}
+
+// localize привязывает к часовым поясам события записи журнала изменений
+func (entry *AuditEntry) localize() {
+	for _, e := range []*Event{entry.Old, entry.New} {
+		if e != nil {
+			e.localize()
+		}
+	}
+}
+
+// location возвращает часовой пояс события
+func (e Event) location() *time.Location {
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// duration возвращает длительность события
+func (e Event) duration() time.Duration {
+	if e.End.date.Before(e.Date.date) {
+		return 0
+	}
+	return e.End.date.Sub(e.Date.date)
+}
+
+// overlaps проверяет, пересекается ли событие с интервалом [from, to).
+// Событие без длительности попадает в интервал, если начинается внутри него
+func (e Event) overlaps(from, to time.Time) bool {
+	start := e.Date.date
+	return start.Before(to) && (e.End.date.After(from) || !start.Before(from))
+}
+
+// Частоты повторения события
+const (
+	FreqDaily   = "daily"
+	FreqWeekly  = "weekly"
+	FreqMonthly = "monthly"
+	FreqYearly  = "yearly"
+)
+
+// maxOccurrences ограничивает разворачивание правила без COUNT и UNTIL
+const maxOccurrences = 100000
+
+// weekdayCodes - коды дней недели из RFC 5545, неделя начинается с понедельника
+var weekdayCodes = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+// Recurrence - правило повторения события, подмножество RRULE из RFC 5545
+type Recurrence struct {
+	// Freq - частота: daily, weekly, monthly или yearly
+	Freq string `json:"freq"`
+	// Interval - шаг повторения в единицах Freq, по умолчанию 1
+	Interval int `json:"interval,omitempty"`
+	// ByDay - дни недели (MO, TU, ...), поддерживаются для daily и weekly
+	ByDay []string `json:"by_day,omitempty"`
+	// Count - общее количество повторений
+	Count int `json:"count,omitempty"`
+	// Until - последняя дата повторения включительно
+	Until *Date `json:"until,omitempty"`
+	// ExDates - даты удаленных повторений
+	ExDates []Date `json:"exdates,omitempty"`
+	// Overrides - отдельно измененные повторения
+	Overrides []Override `json:"overrides,omitempty"`
+}
+
+// Override - измененное повторение серии, RecurrenceID - его исходное начало
+type Override struct {
+	RecurrenceID Date   `json:"recurrence_id"`
+	Date         Date   `json:"date"`
+	End          Date   `json:"end"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+}
+
+// validate проверяет правило повторения, пустое правило корректно
+func (r *Recurrence) validate() error {
+	if r == nil {
+		return nil
+	}
+	switch r.Freq {
+	case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+	default:
+		return fmt.Errorf("unknown recurrence freq %q", r.Freq)
+	}
+	if r.Interval < 0 || r.Count < 0 {
+		return errors.New("recurrence interval and count must not be negative")
+	}
+	if r.Count > 0 && r.Until != nil {
+		return errors.New("recurrence count and until are mutually exclusive")
+	}
+	if len(r.ByDay) > 0 && r.Freq != FreqDaily && r.Freq != FreqWeekly {
+		return errors.New("recurrence by_day is supported only for daily and weekly freq")
+	}
+	for _, code := range r.ByDay {
+		if weekdayIndex(code) < 0 {
+			return fmt.Errorf("unknown weekday %q", code)
+		}
+	}
+	return nil
+}
+
+// clone делает глубокую копию правила, чтобы не менять данные, принадлежащие хранилищу
+func (r *Recurrence) clone() *Recurrence {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.ByDay = append([]string(nil), r.ByDay...)
+	c.ExDates = append([]Date(nil), r.ExDates...)
+	c.Overrides = append([]Override(nil), r.Overrides...)
+	if r.Until != nil {
+		until := *r.Until
+		c.Until = &until
+	}
+	return &c
+}
+
+// weekdayIndex возвращает номер дня недели по коду (понедельник - 0) или -1
+func weekdayIndex(code string) int {
+	for ind, c := range weekdayCodes {
+		if c == code {
+			return ind
+		}
+	}
+	return -1
+}
+
+// mondayIndex возвращает номер дня недели даты, считая с понедельника
+func mondayIndex(t time.Time) int {
+	return (int(t.Weekday()) + 6) % 7
+}
+
+// weekdays возвращает отсортированные номера дней недели, в которые повторяется событие
+func (r *Recurrence) weekdays(start time.Time) []int {
+	if len(r.ByDay) == 0 {
+		return []int{mondayIndex(start)}
+	}
+	days := make([]int, 0, len(r.ByDay))
+	for _, code := range r.ByDay {
+		days = append(days, weekdayIndex(code))
+	}
+	sort.Ints(days)
+	return days
+}
+
+// each перебирает даты повторений по порядку, начиная со start, пока fn возвращает true.
+// Удаленные даты тоже перебираются: по RFC 5545 они учитываются в COUNT. Правило без COUNT
+// перебирается не со start, а с периода незадолго до from, поэтому даты раньше from могут быть пропущены
+func (r *Recurrence) each(start, from time.Time, fn func(time.Time) bool) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = 1
+	}
+	first := 0
+	if r.Count == 0 {
+		first = r.firstPeriod(start, from, interval)
+	}
+	n := 0
+	emit := func(t time.Time) bool {
+		if t.Before(start) {
+			return true
+		}
+		if r.Until != nil && t.After(r.Until.date) || r.Count > 0 && n >= r.Count {
+			return false
+		}
+		n++
+		return fn(t)
+	}
+
+	year, month, day := start.Date()
+	for period := first; period < maxOccurrences && n < maxOccurrences; period++ {
+		switch r.Freq {
+		case FreqDaily:
+			t := start.AddDate(0, 0, period*interval)
+			if len(r.ByDay) > 0 && !containsInt(r.weekdays(start), mondayIndex(t)) {
+				continue
+			}
+			if !emit(t) {
+				return
+			}
+		case FreqWeekly:
+			monday := start.AddDate(0, 0, 7*period*interval-mondayIndex(start))
+			for _, wd := range r.weekdays(start) {
+				if !emit(monday.AddDate(0, 0, wd)) {
+					return
+				}
+			}
+		case FreqMonthly, FreqYearly:
+			var t time.Time
+			if r.Freq == FreqMonthly {
+				t = time.Date(year, month+time.Month(period*interval), day, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			} else {
+				t = time.Date(year+period*interval, month, day, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			}
+			// 31 число или 29 февраля есть не в каждом периоде, такие периоды пропускаются
+			if t.Day() != day {
+				continue
+			}
+			if !emit(t) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// firstPeriod возвращает номер периода, начиная с которого перебор не пропустит даты не раньше from.
+// Оценка берется с запасом в период, чтобы переход на летнее время и разная длина месяцев
+// не сдвигали ее за from
+func (r *Recurrence) firstPeriod(start, from time.Time, interval int) int {
+	if !from.After(start) {
+		return 0
+	}
+	var periods int
+	switch r.Freq {
+	case FreqDaily:
+		periods = int(from.Sub(start) / (24 * time.Hour))
+	case FreqWeekly:
+		periods = int(from.Sub(start) / (7 * 24 * time.Hour))
+	case FreqMonthly:
+		fromYear, fromMonth, _ := from.In(start.Location()).Date()
+		periods = (fromYear-start.Year())*12 + int(fromMonth-start.Month())
+	case FreqYearly:
+		periods = from.In(start.Location()).Year() - start.Year()
+	}
+	return max(0, periods/interval-1)
+}
+
+// containsInt проверяет наличие числа в срезе
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded проверяет, удалено ли повторение с исходной датой t
+func (r *Recurrence) excluded(t time.Time) bool {
+	for _, d := range r.ExDates {
+		if d.date.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// override ищет изменения для повторения с исходной датой t
+func (r *Recurrence) override(t time.Time) (Override, bool) {
+	for _, o := range r.Overrides {
+		if o.RecurrenceID.date.Equal(t) {
+			return o, true
+		}
+	}
+	return Override{}, false
+}
+
+// setOverride добавляет или заменяет изменения повторения
+func (r *Recurrence) setOverride(o Override) {
+	r.removeOverride(o.RecurrenceID.date)
+	r.Overrides = append(r.Overrides, o)
+}
+
+// removeOverride удаляет изменения повторения с исходной датой t
+func (r *Recurrence) removeOverride(t time.Time) {
+	overrides := r.Overrides[:0]
+	for _, o := range r.Overrides {
+		if !o.RecurrenceID.date.Equal(t) {
+			overrides = append(overrides, o)
+		}
+	}
+	r.Overrides = overrides
+}
+
+// HasOccurrence проверяет, что у события есть неудаленное повторение с исходной датой t
+func (e Event) HasOccurrence(t time.Time) bool {
+	if e.Recurrence == nil {
+		return e.Date.date.Equal(t)
+	}
+	found := false
+	e.Recurrence.each(e.Date.date, t, func(occ time.Time) bool {
+		found = occ.Equal(t)
+		return occ.Before(t)
+	})
+	return found && !e.Recurrence.excluded(t)
+}
+
+// occurrenceStart привязывает указанную клиентом дату повторения к часовому поясу серии
+// и проверяет, что такое повторение есть
+func (e Event) occurrenceStart(d *Date) (Date, bool) {
+	if e.Recurrence == nil || d == nil {
+		return Date{}, false
+	}
+	start := d.in(e.location(), e.Date.date)
+	return start, e.HasOccurrence(start.date)
+}
+
+// occurrence возвращает копию события для повторения с исходной датой t с учетом изменений
+func (e Event) occurrence(t time.Time) Event {
+	occ := e
+	occ.Date = Date{date: t}
+	occ.End = Date{date: t.Add(e.duration())}
+	occ.RecurrenceID = &Date{date: t}
+	if o, ok := e.Recurrence.override(t); ok {
+		occ.Date = o.Date
+		occ.End = o.End
+		occ.Title = o.Title
+		occ.Description = o.Description
+	}
+	return occ
+}
+
+// Occurrences возвращает повторения события, пересекающиеся с интервалом [from, to)
+func (e Event) Occurrences(from, to time.Time) []Event {
+	if e.Recurrence == nil {
+		if e.overlaps(from, to) {
+			return []Event{e}
+		}
+		return nil
+	}
+
+	// Неперенесенные повторения, начавшиеся раньше lower, закончились до from
+	lower := from.Add(-e.duration())
+	var result []Event
+	e.Recurrence.each(e.Date.date, lower, func(t time.Time) bool {
+		if !t.Before(to) {
+			return false
+		}
+		if t.Before(lower) {
+			return true
+		}
+		if occ := e.occurrence(t); !e.Recurrence.excluded(t) && occ.overlaps(from, to) {
+			result = append(result, occ)
+		}
+		return true
+	})
+	// Повторения до и после перебранных дат могли быть перенесены внутрь интервала
+	for _, o := range e.Recurrence.Overrides {
+		t := o.RecurrenceID.date
+		if (t.Before(lower) || !t.Before(to)) && e.occurrence(t).overlaps(from, to) && e.HasOccurrence(t) {
+			result = append(result, e.occurrence(t))
+		}
+	}
+	return result
+}
+
+// eventsInRange возвращает события пользователя и повторения серий в интервале [from, to)
+func (svc *CalendarService) eventsInRange(userID int, from, to time.Time) ([]Event, error) {
+	allUserEvents, err := svc.EventRepository.Overlapping(userID, from, to)
+	if err != nil && !errors.Is(err, ErrUnknownUser) {
+		return nil, err
+	}
+	invited, invErr := svc.EventRepository.Invited(userID)
+	if invErr != nil {
+		return nil, invErr
+	}
+	if err != nil && len(invited) == 0 {
+		return nil, err
+	}
+
+	var result []Event
+	for _, event := range allUserEvents {
+		result = append(result, event.Occurrences(from, to)...)
+	}
+	for _, event := range invited {
+		status := event.attendeeStatus(userID)
+		for _, occ := range event.Occurrences(from, to) {
+			occ.RSVP = status
+			result = append(result, occ)
+		}
+	}
+	return result, nil
+}
+
+// overlapHorizon - на сколько вперед от начала серии проверяются пересечения ее повторений
+const overlapHorizon = 366 * 24 * time.Hour
+
+// upcoming возвращает разовое событие или повторения серии в пределах overlapHorizon
+func (e Event) upcoming() []Event {
+	if e.Recurrence == nil {
+		return []Event{e}
+	}
+	return e.Occurrences(e.Date.date, e.Date.date.Add(overlapHorizon))
+}
+
+// checkOverlaps возвращает ErrOverlap, если одно из occurrences пересекается с другим событием
+// пользователя. События без длительности время не занимают и не пересекаются. Вызывается
+// на сервисе транзакции записи, иначе параллельная запись может пройти ту же проверку
+func (svc *CalendarService) checkOverlaps(userID, id int, occurrences []Event) error {
+	for _, occ := range occurrences {
+		if occ.duration() == 0 {
+			continue
+		}
+		others, err := svc.eventsInRange(userID, occ.Date.date, occ.End.date)
+		if errors.Is(err, ErrUnknownUser) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			if other.ID != id && other.duration() > 0 && other.RSVP != RSVPDeclined {
+				return fmt.Errorf("%w: event %d at %s", ErrOverlap, other.ID, other.Date.date.Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
+
+// Interval - промежуток времени [Start, End)
+type Interval struct {
+	Start Date `json:"start"`
+	End   Date `json:"end"`
+}
+
+// FreeBusy возвращает объединенные интервалы занятости пользователя и свободные промежутки между
+// ними в [from, to). Интервалы обрезаются по границам запроса и отдаются в часовом поясе from
+func (svc *CalendarService) FreeBusy(userID int, from, to time.Time) ([]Interval, []Interval, error) {
+	events, err := svc.eventsInRange(userID, from, to)
+	if err != nil && !errors.Is(err, ErrUnknownUser) {
+		return nil, nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Date.date.Before(events[j].Date.date)
+	})
+
+	loc := from.Location()
+	busy := []Interval{}
+	for _, e := range events {
+		// Отклоненные приглашения не занимают время
+		if e.duration() == 0 || e.RSVP == RSVPDeclined {
+			continue
+		}
+		start, end := e.Date.date, e.End.date
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if n := len(busy); n > 0 && !start.After(busy[n-1].End.date) {
+			if end.After(busy[n-1].End.date) {
+				busy[n-1].End = Date{date: end.In(loc)}
+			}
+			continue
+		}
+		busy = append(busy, Interval{Start: Date{date: start.In(loc)}, End: Date{date: end.In(loc)}})
+	}
+
+	free := []Interval{}
+	cursor := from
+	for _, b := range busy {
+		if b.Start.date.After(cursor) {
+			free = append(free, Interval{Start: Date{date: cursor.In(loc)}, End: b.Start})
+		}
+		cursor = b.End.date
+	}
+	if cursor.Before(to) {
+		free = append(free, Interval{Start: Date{date: cursor.In(loc)}, End: Date{date: to.In(loc)}})
+	}
+	return busy, free, nil
+}
+
+// Ограничения поиска
+const (
+	// maxTagLen - наибольшая длина тега
+	maxTagLen = 64
+	// defaultPageLimit и maxPageLimit - размер страницы результатов по умолчанию и наибольший
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// SearchQuery - параметры поиска событий
+type SearchQuery struct {
+	UserID int
+	// Text - слова, которые должны встречаться в названии или описании
+	Text string
+	// Tags - теги, которые должны быть у события
+	Tags []string
+	// From и To ограничивают поиск событиями с повторениями в [From, To), нулевые значения не ограничивают
+	From, To time.Time
+}
+
+// SearchEvents ищет события пользователя и события, на которые он приглашен. Результат отсортирован
+// по началу события, у приглашений заполнен RSVP
+func (svc *CalendarService) SearchEvents(q SearchQuery) ([]Event, error) {
+	events, err := svc.EventRepository.Search(q.UserID, tokenize(q.Text), normalizeTags(q.Tags))
+	if err != nil {
+		return nil, err
+	}
+
+	res := events[:0]
+	for _, e := range events {
+		if !q.From.IsZero() || !q.To.IsZero() {
+			from, to := q.From, q.To
+			if to.IsZero() {
+				to = maxTime
+			}
+			if len(e.Occurrences(from, to)) == 0 {
+				continue
+			}
+		}
+		if e.UserID != q.UserID {
+			e.RSVP = e.attendeeStatus(q.UserID)
+		}
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return compareEvents(defaultSort, res[i], res[j]) < 0
+	})
+	return res, nil
+}
+
+// maxTime - момент, после которого событий заведомо нет
+var maxTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// SearchEventsHandler ищет события по словам q, тегам tags (через запятую) и интервалу [from, to).
+// Результаты отдаются страницами, как и остальные списки событий
+func (scope *Scope) SearchEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	fe := fieldErrors{}
+	q := SearchQuery{Text: query.Get("q")}
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil || userID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	q.UserID = userID
+	if tags := query.Get("tags"); tags != "" {
+		q.Tags = strings.Split(tags, ",")
+	}
+	loc, err := parseTZ(query.Get("tz"))
+	if err != nil {
+		fe.add("tz", "unknown time zone")
+		loc = time.UTC
+	}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if s := query.Get(name); s != "" {
+			if *t, err = parseTimeParam(s, loc); err != nil {
+				fe.add(name, "must be a date 2006-01-02 or RFC 3339 time")
+			}
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.To.After(q.From) {
+		fe.add("to", "must be after from")
+	}
+	opts := parseListOptions(query, fe)
+	if err := fe.err(); err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, q.UserID) {
+		return
+	}
+
+	events, err := scope.SearchEvents(q)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, next := opts.Page(events)
+	response := struct {
+		Result     string  `json:"result"`
+		Events     []Event `json:"events"`
+		Total      int     `json:"total"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}{"Success", page, len(events), next}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// parseTimeParam разбирает момент времени в RFC 3339 или дату 2006-01-02 в часовом поясе loc
+func parseTimeParam(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
+	}
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
+
+// FreeBusyEvents отдает занятые и свободные промежутки пользователя
+func (scope *Scope) FreeBusyEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil {
+		sendErr(w, "Incorrect args", http.StatusBadRequest)
+		return
+	}
+	loc, err := parseTZ(query.Get("tz"))
+	if err != nil {
+		sendErr(w, "Incorrect args", http.StatusBadRequest)
+		return
+	}
+	from, errFrom := parseTimeParam(query.Get("from"), loc)
+	to, errTo := parseTimeParam(query.Get("to"), loc)
+	if errFrom != nil || errTo != nil || !to.After(from) {
+		sendErr(w, "Incorrect args", http.StatusBadRequest)
+		return
+	}
+
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	busy, free, err := scope.FreeBusy(userID, from, to)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := struct {
+		Result string     `json:"result"`
+		Busy   []Interval `json:"busy"`
+		Free   []Interval `json:"free"`
+	}{"Success", busy, free}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// parseTZ загружает часовой пояс из параметра tz, пустой параметр означает UTC
+func parseTZ(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(tz)
+}
+
+// Порядок сортировки списков событий: по полю по возрастанию или, с минусом, по убыванию.
+// При равенстве поля события упорядочиваются по началу и ID
+var sortFields = map[string]func(a, b Event) int{
+	"start": func(a, b Event) int { return a.Date.date.Compare(b.Date.date) },
+	"end":   func(a, b Event) int { return a.End.date.Compare(b.End.date) },
+	"title": func(a, b Event) int { return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title)) },
+}
+
+// defaultSort - сортировка списков по умолчанию
+const defaultSort = "start"
+
+// compareEvents сравнивает события в порядке sort
+func compareEvents(sort string, a, b Event) int {
+	field := strings.TrimPrefix(sort, "-")
+	if c := sortFields[field](a, b); c != 0 {
+		if strings.HasPrefix(sort, "-") {
+			return -c
+		}
+		return c
+	}
+	if c := a.Date.date.Compare(b.Date.date); c != 0 {
+		return c
+	}
+	if c := a.ID - b.ID; c != 0 {
+		return c
+	}
+	return a.recurrenceTime().Compare(b.recurrenceTime())
+}
+
+// recurrenceTime возвращает исходное начало повторения или нулевое время для разового события
+func (e Event) recurrenceTime() time.Time {
+	if e.RecurrenceID == nil {
+		return time.Time{}
+	}
+	return e.RecurrenceID.date
+}
+
+// pageCursor - позиция в списке: ключ сортировки последнего отданного события
+type pageCursor struct {
+	Sort         string    `json:"s"`
+	Start        time.Time `json:"t"`
+	End          time.Time `json:"e"`
+	Title        string    `json:"n,omitempty"`
+	ID           int       `json:"i"`
+	RecurrenceID time.Time `json:"r,omitempty"`
+}
+
+// event восстанавливает из курсора событие с теми же ключами сортировки
+func (c pageCursor) event() Event {
+	e := Event{Date: Date{date: c.Start}, End: Date{date: c.End}, Title: c.Title, ID: c.ID}
+	if !c.RecurrenceID.IsZero() {
+		e.RecurrenceID = &Date{date: c.RecurrenceID}
+	}
+	return e
+}
+
+// encodeCursor создает непрозрачный курсор, указывающий на событие e
+func encodeCursor(sort string, e Event) string {
+	c := pageCursor{Sort: sort, Start: e.Date.date, End: e.End.date, Title: e.Title, ID: e.ID, RecurrenceID: e.recurrenceTime()}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor разбирает курсор
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	return c, err
+}
+
+// ListOptions - сортировка и страница списка событий
+type ListOptions struct {
+	// Sort - start, end или title, с минусом - по убыванию
+	Sort string
+	// Limit - размер страницы, 0 - все события после курсора
+	Limit int
+	// After - курсор предыдущей страницы, nil - первая страница
+	After *pageCursor
+}
+
+// parseListOptions разбирает параметры sort, limit и cursor, ошибки записываются в fe
+func parseListOptions(query url.Values, fe fieldErrors) ListOptions {
+	opts := ListOptions{Sort: defaultSort, Limit: defaultPageLimit}
+	if s := query.Get("sort"); s != "" {
+		if _, ok := sortFields[strings.TrimPrefix(s, "-")]; !ok {
+			fe.add("sort", "must be start, end or title, optionally prefixed with -")
+		}
+		opts.Sort = s
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			fe.add("limit", fmt.Sprintf("must be between 1 and %d", maxPageLimit))
+		}
+		opts.Limit = n
+	}
+	if s := query.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		switch {
+		case err != nil:
+			fe.add("cursor", "malformed cursor")
+		case c.Sort != opts.Sort:
+			fe.add("cursor", "cursor was issued for a different sort order")
+		default:
+			opts.After = &c
+		}
+	}
+	return opts
+}
+
+// Page сортирует события и возвращает страницу после курсора и курсор следующей страницы
+// (пустой, если страница последняя)
+func (opts ListOptions) Page(events []Event) ([]Event, string) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return compareEvents(opts.Sort, events[i], events[j]) < 0
+	})
+	start := 0
+	if opts.After != nil {
+		after := opts.After.event()
+		start = sort.Search(len(events), func(i int) bool {
+			return compareEvents(opts.Sort, events[i], after) > 0
+		})
+	}
+	end := start + opts.Limit
+	if opts.Limit == 0 || end >= len(events) {
+		return events[start:], ""
+	}
+	return events[start:end], encodeCursor(opts.Sort, events[end-1])
+}
+
+// sendPage отправляет страницу списка событий
+func sendPage(writer http.ResponseWriter, events []Event, nextCursor string) {
+	response := struct {
+		Result     string  `json:"result"`
+		Events     []Event `json:"events"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}{"Success", events, nextCursor}
+	sendJSON(writer, response, http.StatusOK)
+}
+
+// EventSerializer - формат ответа со списком событий
+type EventSerializer struct {
+	// Name - значение параметра format
+	Name string
+	// ContentType - тип содержимого ответа, по нему формат выбирается из заголовка Accept
+	ContentType string
+	// Write пишет страницу событий, nextCursor пуст на последней странице
+	Write func(w io.Writer, events []Event, nextCursor string) error
+	// Unpaged - без явных limit и cursor список отдается целиком: календари и таблицы,
+	// которые загружают такие ответы, не знают о заголовке X-Next-Cursor
+	Unpaged bool
+}
+
+// mediaType возвращает тип содержимого без параметров
+func (s EventSerializer) mediaType() string {
+	mediaType, _, _ := mime.ParseMediaType(s.ContentType)
+	return mediaType
+}
+
+// SerializerRegistry - форматы списков событий. Обработчики выбирают формат через Negotiate,
+// поэтому новый формат добавляется регистрацией без изменения обработчиков
+type SerializerRegistry struct {
+	mu      sync.RWMutex
+	formats []EventSerializer
+}
+
+// NewSerializerRegistry создает реестр с форматами formats, первый из них используется по умолчанию
+func NewSerializerRegistry(formats ...EventSerializer) *SerializerRegistry {
+	reg := &SerializerRegistry{}
+	for _, s := range formats {
+		reg.Register(s)
+	}
+	return reg
+}
+
+// Register добавляет формат или заменяет формат с тем же именем
+func (reg *SerializerRegistry) Register(s EventSerializer) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for i, f := range reg.formats {
+		if f.Name == s.Name {
+			reg.formats[i] = s
+			return
+		}
+	}
+	reg.formats = append(reg.formats, s)
+}
+
+// Formats возвращает зарегистрированные форматы в порядке регистрации
+func (reg *SerializerRegistry) Formats() []EventSerializer {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return slices.Clone(reg.formats)
+}
+
+// Negotiate выбирает формат ответа: по параметру format, иначе по заголовку Accept с учетом q.
+// Из форматов с одинаковым q выбирается зарегистрированный раньше, без Accept - первый.
+// Неизвестный format - *ValidationError, неподходящий Accept - ErrNotAcceptable
+func (reg *SerializerRegistry) Negotiate(r *http.Request) (EventSerializer, error) {
+	formats := reg.Formats()
+	if len(formats) == 0 {
+		return EventSerializer{}, ErrNotAcceptable
+	}
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, s := range formats {
+			if s.Name == name {
+				return s, nil
+			}
+		}
+		names := make([]string, len(formats))
+		for i, s := range formats {
+			names[i] = s.Name
+		}
+		fe := fieldErrors{}
+		fe.add("format", "must be one of "+strings.Join(names, ", "))
+		return EventSerializer{}, fe.err()
+	}
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return formats[0], nil
+	}
+	ranges := parseAccept(strings.Join(accept, ","))
+	best, bestQ := -1, 0.0
+	for i, s := range formats {
+		if q := acceptQuality(ranges, s.mediaType()); q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return EventSerializer{}, ErrNotAcceptable
+	}
+	return formats[best], nil
+}
+
+// acceptRange - диапазон типов из заголовка Accept
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept разбирает заголовок Accept, диапазоны с ошибками пропускаются
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+	return ranges
+}
+
+// acceptQuality возвращает q самого точного диапазона, в который входит mediaType, или 0
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, 0
+	for _, ar := range ranges {
+		s := 0
+		switch ar.mediaType {
+		case mediaType:
+			s = 3
+		case typ + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+		if s > specificity {
+			q, specificity = ar.q, s
+		}
+	}
+	return q
+}
+
+// document описывает форматы в OpenAPI: содержимое ответа (у JSON - схема jsonSchema) и параметр format
+func (reg *SerializerRegistry) document(jsonSchema apiObject) (apiObject, apiObject) {
+	content := apiObject{}
+	var names []string
+	for _, s := range reg.Formats() {
+		names = append(names, s.Name)
+		if s.mediaType() == "application/json" {
+			content[s.mediaType()] = apiObject{"schema": jsonSchema}
+		} else {
+			content[s.mediaType()] = apiObject{"schema": typed("string", "")}
+		}
+	}
+	param := queryParam("format", enumOf(names...), false)
+	param["description"] = "response format, overrides the Accept header"
+	return content, param
+}
+
+// defaultSerializers возвращает встроенные форматы: JSON (по умолчанию), CSV и календарь iCalendar
+func defaultSerializers() *SerializerRegistry {
+	return NewSerializerRegistry(
+		EventSerializer{Name: "json", ContentType: "application/json", Write: writeJSONPage},
+		EventSerializer{Name: "csv", ContentType: "text/csv; charset=utf-8", Write: writeCSVPage, Unpaged: true},
+		EventSerializer{Name: "ics", ContentType: "text/calendar; charset=utf-8", Write: writeICSPage, Unpaged: true},
+	)
+}
+
+// writeJSONPage пишет страницу событий так же, как sendPage
+func writeJSONPage(w io.Writer, events []Event, nextCursor string) error {
+	response := struct {
+		Result     string  `json:"result"`
+		Events     []Event `json:"events"`
+		NextCursor string  `json:"next_cursor,omitempty"`
+	}{"Success", events, nextCursor}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// csvHeader - столбцы выгрузки CSV
+var csvHeader = []string{"id", "user_id", "version", "start", "end", "time_zone", "title", "description",
+	"recurrence_id", "tags", "attendees", "rsvp"}
+
+// writeCSVPage пишет события таблицей CSV с заголовком csvHeader. Время записывается в RFC 3339,
+// метки и участники - через точку с запятой, участник - в виде user_id:status
+func writeCSVPage(w io.Writer, events []Event, _ string) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write(csvHeader)
+	for _, e := range events {
+		recurrenceID := ""
+		if e.RecurrenceID != nil {
+			recurrenceID = csvTime(*e.RecurrenceID)
+		}
+		attendees := make([]string, len(e.Attendees))
+		for i, a := range e.Attendees {
+			attendees[i] = fmt.Sprintf("%d:%s", a.UserID, a.Status)
+		}
+		_ = cw.Write([]string{
+			strconv.Itoa(e.ID), strconv.Itoa(e.UserID), strconv.Itoa(e.Version),
+			csvTime(e.Date), csvTime(e.End), e.TimeZone, csvSafe(e.Title), csvSafe(e.Description),
+			recurrenceID, csvSafe(strings.Join(e.Tags, ";")), strings.Join(attendees, ";"), e.RSVP,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvTime форматирует время события для CSV, пустое время дает пустую ячейку
+func csvTime(d Date) string {
+	if d.date.IsZero() {
+		return ""
+	}
+	return d.date.Format(time.RFC3339)
+}
+
+// csvSafe не дает электронным таблицам принять пользовательский текст за формулу
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeICSPage пишет события календарем для подписки, см. EncodeICSFeed
+func writeICSPage(w io.Writer, events []Event, _ string) error {
+	_, err := io.WriteString(w, EncodeICSFeed(events))
+	return err
+}
+
+// sendSerialized отправляет страницу событий в формате s. Курсор следующей страницы
+// передается и в заголовке X-Next-Cursor: в CSV и iCalendar для него нет места
+func sendSerialized(writer http.ResponseWriter, s EventSerializer, events []Event, nextCursor string) {
+	var buf bytes.Buffer
+	if err := s.Write(&buf, events, nextCursor); err != nil {
+		sendErr(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if nextCursor != "" {
+		writer.Header().Set("X-Next-Cursor", nextCursor)
+	}
+	writer.Header().Set("Content-Type", s.ContentType)
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(buf.Bytes())
+}
+
+// parseDayQuery разбирает user_id, date, часовой пояс tz (по умолчанию UTC) и параметры страницы.
+// Дата трактуется в часовом поясе tz, поэтому границы дня совпадают с сутками пользователя
+func parseDayQuery(r *http.Request) (int, time.Time, ListOptions, error) {
+	query := r.URL.Query()
+	fe := fieldErrors{}
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil || userID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	loc, err := parseTZ(query.Get("tz"))
+	if err != nil {
+		fe.add("tz", "unknown time zone")
+		loc = time.UTC
+	}
+	date, err := time.ParseInLocation("2006-01-02", query.Get("date"), loc)
+	if err != nil {
+		fe.add("date", "must be a date 2006-01-02")
+	}
+	opts := parseListOptions(query, fe)
+	return userID, date, opts, fe.err()
+}
+
+// listHandler отдает страницу событий пользователя за период, который rangeFunc строит по дате запроса,
+// в формате, выбранном по параметру format или заголовку Accept
+func (scope *Scope) listHandler(rangeFunc func(userID int, date time.Time) ([]Event, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			sendErr(w, "Not correct method", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+		userID, date, opts, err := parseDayQuery(r)
+		serializer, formatErr := scope.serializers.Negotiate(r)
+		if errors.Is(formatErr, ErrNotAcceptable) {
+			sendErr(w, formatErr.Error(), http.StatusNotAcceptable)
+			return
+		}
+		if err = mergeValidation(err, formatErr); err != nil {
+			sendBadRequest(w, err)
+			return
+		}
+		if !scope.authorize(w, r, userID) {
+			return
+		}
+		if query := r.URL.Query(); serializer.Unpaged && !query.Has("limit") && !query.Has("cursor") {
+			opts.Limit = 0
+		}
+		events, err := rangeFunc(userID, date)
+		if err != nil {
+			sendErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page, next := opts.Page(events)
+		sendSerialized(w, serializer, page, next)
+	}
+}
+
+// DayEventsFunc возвращает события и повторения серий за день
+func (svc *CalendarService) DayEventsFunc(userID int, date time.Time) ([]Event, error) {
+	return svc.eventsInRange(userID, date, date.AddDate(0, 0, 1))
+}
+
+// DayEvents отдает события за день date
+func (scope *Scope) DayEvents(w http.ResponseWriter, r *http.Request) {
+	scope.listHandler(scope.DayEventsFunc)(w, r)
+}
+
+// WeekEventsFunc возвращает события и повторения серий за неделю ISO 8601 (с понедельника), содержащую дату
+func (svc *CalendarService) WeekEventsFunc(userID int, date time.Time) ([]Event, error) {
+	year, month, day := date.Date()
+	monday := time.Date(year, month, day-mondayIndex(date), 0, 0, 0, 0, date.Location())
+	return svc.eventsInRange(userID, monday, monday.AddDate(0, 0, 7))
+}
+
+// WeekEvents отдает события за неделю, содержащую date
+func (scope *Scope) WeekEvents(w http.ResponseWriter, r *http.Request) {
+	scope.listHandler(scope.WeekEventsFunc)(w, r)
+}
+
+// MonthEventsFunc возвращает события и повторения серий за календарный месяц даты
+func (svc *CalendarService) MonthEventsFunc(userID int, date time.Time) ([]Event, error) {
+	first := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+	return svc.eventsInRange(userID, first, first.AddDate(0, 1, 0))
+}
+
+// MonthEvents отдает события за календарный месяц, содержащий date
+func (scope *Scope) MonthEvents(w http.ResponseWriter, r *http.Request) {
+	scope.listHandler(scope.MonthEventsFunc)(w, r)
+}
+
+// RangeEvents отдает события и повторения серий, пересекающиеся с интервалом [from, to)
+func (scope *Scope) RangeEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	fe := fieldErrors{}
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil || userID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	loc, err := parseTZ(query.Get("tz"))
+	if err != nil {
+		fe.add("tz", "unknown time zone")
+		loc = time.UTC
+	}
+	from, err := parseTimeParam(query.Get("from"), loc)
+	if err != nil {
+		fe.add("from", "must be a date 2006-01-02 or RFC 3339 time")
+	}
+	to, err := parseTimeParam(query.Get("to"), loc)
+	if err != nil {
+		fe.add("to", "must be a date 2006-01-02 or RFC 3339 time")
+	} else if !to.After(from) {
+		fe.add("to", "must be after from")
+	}
+	opts := parseListOptions(query, fe)
+	if err := fe.err(); err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+
+	events, err := scope.eventsInRange(userID, from, to)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, next := opts.Page(events)
+	sendPage(w, page, next)
+}
+
+// Форматы дат в iCalendar: дата (VALUE=DATE), время в UTC и время в часовом поясе из TZID
+const (
+	icsDateLayout  = "20060102"
+	icsUTCLayout   = "20060102T150405Z"
+	icsLocalLayout = "20060102T150405"
+)
+
+// icsUserURI - префикс адреса пользователя этого сервера в ORGANIZER и ATTENDEE
+const icsUserURI = "urn:dev11:user:"
+
+// icsUID формирует UID события. При импорте по UID измененные повторения находят свою серию
+func icsUID(e Event) string {
+	return fmt.Sprintf("%d-%d@dev11", e.ID, e.UserID)
+}
+
+// icsEscape экранирует текстовое значение по RFC 5545
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsUnescape снимает экранирование текстового значения
+func icsUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// icsSplitList разбивает значение со списком текстов по неэкранированным запятым
+func icsSplitList(value string) []string {
+	var (
+		items []string
+		start int
+	)
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			items = append(items, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, value[start:])
+}
+
+// writeICSLine записывает строку содержимого, перенося ее после 75 байт, как требует RFC 5545
+func writeICSLine(b *strings.Builder, line string) {
+	// Строки продолжения начинаются с пробела, он тоже входит в 75 байт
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// Нельзя разрезать многобайтовый символ UTF-8
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// icsAllDay проверяет, можно ли записать событие датами без времени: в iCalendar у VALUE=DATE
+// нет часового пояса, поэтому так выгружаются только события в UTC на полные сутки
+func icsAllDay(timeZone string, start, end Date) bool {
+	return timeZone == "UTC" && start.date.Equal(start.date.Truncate(24*time.Hour)) &&
+		end.date.Equal(start.date.AddDate(0, 0, 1))
+}
+
+// icsTimeProp формирует свойство с датой или списком дат в форме, соответствующей событию
+func icsTimeProp(name, timeZone string, allDay bool, dates ...Date) string {
+	values := make([]string, 0, len(dates))
+	for _, d := range dates {
+		switch {
+		case allDay:
+			values = append(values, d.date.Format(icsDateLayout))
+		case timeZone == "UTC":
+			values = append(values, d.date.UTC().Format(icsUTCLayout))
+		default:
+			values = append(values, d.date.Format(icsLocalLayout))
+		}
+	}
+	switch {
+	case allDay:
+		name += ";VALUE=DATE"
+	case timeZone != "UTC":
+		name += ";TZID=" + timeZone
+	}
+	return name + ":" + strings.Join(values, ",")
+}
+
+// formatRRule формирует значение свойства RRULE, UNTIL по RFC 5545 записывается в UTC
+func formatRRule(r *Recurrence, allDay bool) string {
+	parts := []string{"FREQ=" + strings.ToUpper(r.Freq)}
+	if r.Interval > 0 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		parts = append(parts, "BYDAY="+strings.Join(r.ByDay, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil && allDay {
+		parts = append(parts, "UNTIL="+r.Until.date.Format(icsDateLayout))
+	} else if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.date.UTC().Format(icsUTCLayout))
+	}
+	return strings.Join(parts, ";")
+}
+
+// icsEventProps формирует свойства события, общие для серии и ее измененных повторений
+func icsEventProps(e Event) []string {
+	var props []string
+	if len(e.Tags) > 0 {
+		tags := make([]string, len(e.Tags))
+		for i, tag := range e.Tags {
+			tags[i] = icsEscape(tag)
+		}
+		props = append(props, "CATEGORIES:"+strings.Join(tags, ","))
+	}
+	if len(e.Attendees) > 0 {
+		props = append(props, "ORGANIZER:"+icsUserURI+strconv.Itoa(e.UserID))
+	}
+	for _, a := range e.Attendees {
+		props = append(props, "ATTENDEE;PARTSTAT="+strings.ToUpper(a.Status)+":"+icsUserURI+strconv.Itoa(a.UserID))
+	}
+	// Вложенные VALARM по RFC 5545 идут после всех свойств события
+	for _, o := range e.Reminders {
+		props = append(props, "BEGIN:VALARM", "ACTION:DISPLAY", "DESCRIPTION:"+icsEscape(e.Title),
+			"TRIGGER:"+formatICSDuration(-time.Duration(o)), "END:VALARM")
+	}
+	return props
+}
+
+// formatICSDuration записывает длительность в форме RFC 5545, например -P1DT2H30M
+func formatICSDuration(d time.Duration) string {
+	res := "P"
+	if d < 0 {
+		res, d = "-P", -d
+	}
+	days, d := d/(24*time.Hour), d%(24*time.Hour)
+	hours, minutes, seconds := d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second
+	if days > 0 {
+		res += fmt.Sprintf("%dD", days)
+	}
+	if days > 0 && d < time.Second {
+		return res
+	}
+	res += "T"
+	if hours > 0 {
+		res += fmt.Sprintf("%dH", hours)
+	}
+	if minutes > 0 {
+		res += fmt.Sprintf("%dM", minutes)
+	}
+	if seconds > 0 || hours == 0 && minutes == 0 {
+		res += fmt.Sprintf("%dS", seconds)
+	}
+	return res
+}
+
+// parseICSDuration разбирает длительность RFC 5545. Длительности больше maxReminderOffset
+// не нужны ни одному разбираемому свойству и отклоняются, чтобы сумма не переполнилась
+func parseICSDuration(value string) (time.Duration, error) {
+	bad := fmt.Errorf("bad duration %q", value)
+	s, sign := value, time.Duration(1)
+	switch {
+	case strings.HasPrefix(s, "-"):
+		s, sign = s[1:], -1
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") || len(s) == 1 {
+		return 0, bad
+	}
+	s = s[1:]
+
+	var (
+		d        time.Duration
+		timePart bool
+	)
+	for s != "" {
+		if s[0] == 'T' && !timePart && len(s) > 1 {
+			s, timePart = s[1:], true
+			continue
+		}
+		digits := 0
+		for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits == len(s) {
+			return 0, bad
+		}
+		n, err := strconv.Atoi(s[:digits])
+		if err != nil {
+			return 0, bad
+		}
+		var unit time.Duration
+		switch u := s[digits]; {
+		case !timePart && u == 'W':
+			unit = 7 * 24 * time.Hour
+		case !timePart && u == 'D':
+			unit = 24 * time.Hour
+		case timePart && u == 'H':
+			unit = time.Hour
+		case timePart && u == 'M':
+			unit = time.Minute
+		case timePart && u == 'S':
+			unit = time.Second
+		default:
+			return 0, bad
+		}
+		if n > int((maxReminderOffset-d)/unit) {
+			return 0, fmt.Errorf("duration %q is too long", value)
+		}
+		d += time.Duration(n) * unit
+		s = s[digits+1:]
+	}
+	return sign * d, nil
+}
+
+// parseICSTrigger разбирает TRIGGER напоминания в смещение до начала события.
+// Напоминания к абсолютному времени и к окончанию события не поддерживаются
+func parseICSTrigger(prop icsProperty) (Offset, error) {
+	if strings.ToUpper(prop.params["VALUE"]) == "DATE-TIME" || strings.ToUpper(prop.params["RELATED"]) == "END" {
+		return 0, fmt.Errorf("unsupported TRIGGER %q", prop.value)
+	}
+	d, err := parseICSDuration(prop.value)
+	return Offset(-d), err
+}
+
+// writeVEvent записывает один компонент VEVENT
+func writeVEvent(b *strings.Builder, uid, timeZone string, start, end Date, title, description string, props ...string) {
+	allDay := icsAllDay(timeZone, start, end)
+	writeICSLine(b, "BEGIN:VEVENT")
+	writeICSLine(b, "UID:"+uid)
+	writeICSLine(b, "DTSTAMP:"+time.Now().UTC().Format(icsUTCLayout))
+	writeICSLine(b, icsTimeProp("DTSTART", timeZone, allDay, start))
+	if !allDay {
+		writeICSLine(b, icsTimeProp("DTEND", timeZone, allDay, end))
+	}
+	writeICSLine(b, "SUMMARY:"+icsEscape(title))
+	writeICSLine(b, "DESCRIPTION:"+icsEscape(description))
+	for _, prop := range props {
+		writeICSLine(b, prop)
+	}
+	writeICSLine(b, "END:VEVENT")
+}
+
+// writeICSHeader начинает календарь
+func writeICSHeader(b *strings.Builder) {
+	writeICSLine(b, "BEGIN:VCALENDAR")
+	writeICSLine(b, "VERSION:2.0")
+	writeICSLine(b, "PRODID:-//dev11//calendar//EN")
+}
+
+// icsFeedRefresh - как часто клиенту, подписанному на календарь, запрашивать его снова
+const icsFeedRefresh = "PT1H"
+
+// EncodeICSFeed сериализует развернутые повторения из выборки за период в календарь для подписки.
+// Каждое повторение выгружается отдельным VEVENT без RRULE, с UID серии и свойством RECURRENCE-ID
+func EncodeICSFeed(events []Event) string {
+	var b strings.Builder
+	writeICSHeader(&b)
+	writeICSLine(&b, "REFRESH-INTERVAL;VALUE=DURATION:"+icsFeedRefresh)
+	writeICSLine(&b, "X-PUBLISHED-TTL:"+icsFeedRefresh)
+	for _, e := range events {
+		var props []string
+		if e.RecurrenceID != nil {
+			props = append(props, icsTimeProp("RECURRENCE-ID", e.TimeZone, icsAllDay(e.TimeZone, e.Date, e.End), *e.RecurrenceID))
+		}
+		props = append(props, icsEventProps(e)...)
+		writeVEvent(&b, icsUID(e), e.TimeZone, e.Date, e.End, e.Title, e.Description, props...)
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// EncodeICS сериализует события в календарь iCalendar. Измененные повторения серии
+// выгружаются отдельными VEVENT с тем же UID и свойством RECURRENCE-ID
+func EncodeICS(events []Event) string {
+	var b strings.Builder
+	writeICSHeader(&b)
+
+	for _, e := range events {
+		uid := icsUID(e)
+		if e.Recurrence == nil {
+			writeVEvent(&b, uid, e.TimeZone, e.Date, e.End, e.Title, e.Description, icsEventProps(e)...)
+			continue
+		}
+
+		allDay := icsAllDay(e.TimeZone, e.Date, e.End)
+		props := []string{"RRULE:" + formatRRule(e.Recurrence, allDay)}
+		if len(e.Recurrence.ExDates) > 0 {
+			props = append(props, icsTimeProp("EXDATE", e.TimeZone, allDay, e.Recurrence.ExDates...))
+		}
+		writeVEvent(&b, uid, e.TimeZone, e.Date, e.End, e.Title, e.Description, append(props, icsEventProps(e)...)...)
+
+		// Форма RECURRENCE-ID должна совпадать с DTSTART серии. Клиенты не переносят свойства
+		// серии на отдельные VEVENT, поэтому общие свойства повторяются
+		for _, o := range e.Recurrence.Overrides {
+			writeVEvent(&b, uid, e.TimeZone, o.Date, o.End, o.Title, o.Description,
+				append([]string{icsTimeProp("RECURRENCE-ID", e.TimeZone, allDay, o.RecurrenceID)}, icsEventProps(e)...)...)
+		}
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// icsProperty - разобранная строка содержимого iCalendar
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// icsComponent - свойства одного VEVENT по именам в порядке появления: некоторые свойства,
+// например CATEGORIES, могут повторяться. Из вложенных VALARM сохраняется только TRIGGER,
+// под именем VALARM
+type icsComponent map[string][]icsProperty
+
+// prop возвращает последнее свойство с именем name
+func (c icsComponent) prop(name string) (icsProperty, bool) {
+	if props := c[name]; len(props) > 0 {
+		return props[len(props)-1], true
+	}
+	return icsProperty{}, false
+}
+
+// value возвращает значение последнего свойства с именем name или пустую строку
+func (c icsComponent) value(name string) string {
+	prop, _ := c.prop(name)
+	return prop.value
+}
+
+// parseICSLine разбирает строку вида NAME;PARAM=VALUE:VALUE
+func parseICSLine(line string) (icsProperty, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return icsProperty{}, fmt.Errorf("malformed line %q", line)
+	}
+	head := strings.Split(line[:colon], ";")
+	prop := icsProperty{
+		name:   strings.ToUpper(head[0]),
+		params: make(map[string]string),
+		value:  line[colon+1:],
+	}
+	for _, param := range head[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+			prop.params[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+	return prop, nil
+}
+
+// parseICSComponents разворачивает перенесенные строки и собирает свойства всех VEVENT
+func parseICSComponents(data string) ([]icsComponent, error) {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 || strings.ToUpper(lines[0]) != "BEGIN:VCALENDAR" {
+		return nil, errors.New("not an iCalendar file")
+	}
+
+	var (
+		components []icsComponent
+		current    icsComponent
+		// alarm - TRIGGER разбираемого VALARM, nil вне VALARM
+		alarm *icsProperty
+	)
+	for _, line := range lines {
+		prop, err := parseICSLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case prop.name == "BEGIN" && strings.ToUpper(prop.value) == "VEVENT":
+			current, alarm = make(icsComponent), nil
+		case prop.name == "END" && strings.ToUpper(prop.value) == "VEVENT":
+			if current != nil {
+				components = append(components, current)
+			}
+			current = nil
+		case current == nil:
+		case prop.name == "BEGIN" && strings.ToUpper(prop.value) == "VALARM":
+			alarm = &icsProperty{}
+		case prop.name == "END" && strings.ToUpper(prop.value) == "VALARM":
+			if alarm != nil && alarm.name != "" {
+				current["VALARM"] = append(current["VALARM"], *alarm)
+			}
+			alarm = nil
+		case alarm != nil:
+			// Описание и действие напоминания не должны попасть в свойства события
+			if prop.name == "TRIGGER" {
+				*alarm = prop
+			}
+		default:
+			current[prop.name] = append(current[prop.name], prop)
+		}
+	}
+	return components, nil
+}
+
+// parseICSTime разбирает DATE, DATE-TIME в UTC или DATE-TIME в часовом поясе loc.
+// Второе значение сообщает, что была указана дата без времени
+func parseICSTime(value string, loc *time.Location) (Date, bool, error) {
+	var (
+		t   time.Time
+		err error
+	)
+	dateOnly := len(value) == len(icsDateLayout)
+	switch {
+	case dateOnly:
+		t, err = time.ParseInLocation(icsDateLayout, value, loc)
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse(icsUTCLayout, value)
+		t = t.In(loc)
+	default:
+		t, err = time.ParseInLocation(icsLocalLayout, value, loc)
+	}
+	if err != nil {
+		return Date{}, false, fmt.Errorf("bad date %q", value)
+	}
+	return Date{date: t}, dateOnly, nil
+}
+
+// parsePropTimes разбирает значения свойства с датами с учетом параметра TZID
+func parsePropTimes(prop icsProperty, loc *time.Location) ([]Date, bool, error) {
+	if tzid, ok := prop.params["TZID"]; ok {
+		var err error
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return nil, false, fmt.Errorf("unknown TZID %q", tzid)
+		}
+	}
+	var (
+		dates    []Date
+		dateOnly bool
+	)
+	for _, value := range strings.Split(prop.value, ",") {
+		d, isDate, err := parseICSTime(value, loc)
+		if err != nil {
+			return nil, false, err
+		}
+		dates = append(dates, d)
+		dateOnly = isDate
+	}
+	return dates, dateOnly, nil
+}
+
+// parseRRule разбирает значение свойства RRULE
+func parseRRule(value string, loc *time.Location) (*Recurrence, error) {
+	r := &Recurrence{}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad rrule part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			r.Freq = strings.ToLower(kv[1])
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(kv[1])
+		case "COUNT":
+			r.Count, err = strconv.Atoi(kv[1])
+		case "BYDAY":
+			r.ByDay = strings.Split(strings.ToUpper(kv[1]), ",")
+		case "UNTIL":
+			var until Date
+			until, _, err = parseICSTime(kv[1], loc)
+			r.Until = &until
+		default:
+			return nil, fmt.Errorf("unsupported rrule part %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad rrule part %q", part)
+		}
+	}
+	return r, r.validate()
+}
+
+// icsEvent собирает событие из свойств VEVENT
+func icsEvent(c icsComponent, userID int) (Event, error) {
+	event := Event{
+		UserID:      userID,
+		Title:       icsUnescape(c.value("SUMMARY")),
+		Description: icsUnescape(c.value("DESCRIPTION")),
+	}
+
+	for _, categories := range c["CATEGORIES"] {
+		for _, tag := range icsSplitList(categories.value) {
+			event.Tags = append(event.Tags, icsUnescape(tag))
+		}
+	}
+	// Участники с адресами других серверов, например mailto:, сюда не относятся и пропускаются
+	for _, attendee := range c["ATTENDEE"] {
+		id, err := strconv.Atoi(strings.TrimPrefix(attendee.value, icsUserURI))
+		if !strings.HasPrefix(attendee.value, icsUserURI) || err != nil {
+			continue
+		}
+		status := strings.ToLower(attendee.params["PARTSTAT"])
+		switch status {
+		case RSVPAccepted, RSVPDeclined, RSVPTentative:
+		default:
+			status = RSVPNeedsAction
+		}
+		event.Attendees = append(event.Attendees, Attendee{UserID: id, Status: status})
+	}
+	for _, trigger := range c["VALARM"] {
+		offset, err := parseICSTrigger(trigger)
+		if err != nil {
+			return event, err
+		}
+		event.Reminders = append(event.Reminders, offset)
+	}
+
+	start, ok := c.prop("DTSTART")
+	if !ok {
+		return event, errors.New("missing DTSTART")
+	}
+	event.TimeZone = "UTC"
+	if tzid, ok := start.params["TZID"]; ok {
+		event.TimeZone = tzid
+	}
+	loc, err := time.LoadLocation(event.TimeZone)
+	if err != nil {
+		return event, fmt.Errorf("unknown TZID %q", event.TimeZone)
+	}
+	dates, dateOnly, err := parsePropTimes(start, loc)
+	if err != nil {
+		return event, err
+	}
+	event.Date = dates[0]
+
+	// Без DTEND событие на дату длится сутки, а событие со временем не имеет длительности
+	event.End = event.Date
+	if dateOnly {
+		event.End = Date{date: event.Date.date.AddDate(0, 0, 1)}
+	}
+	if end, ok := c.prop("DTEND"); ok {
+		if dates, _, err = parsePropTimes(end, loc); err != nil {
+			return event, err
+		}
+		event.End = dates[0]
+	}
+
+	if rrule, ok := c.prop("RRULE"); ok {
+		if event.Recurrence, err = parseRRule(rrule.value, loc); err != nil {
+			return event, err
+		}
+		if exdate, ok := c.prop("EXDATE"); ok {
+			if event.Recurrence.ExDates, _, err = parsePropTimes(exdate, loc); err != nil {
+				return event, err
+			}
+		}
+	}
+	return event, nil
+}
+
+// ImportError - ошибка импорта одного VEVENT
+type ImportError struct {
+	Index int    `json:"index"`
+	UID   string `json:"uid"`
+	Error string `json:"error"`
+}
+
+// ImportICS разбирает календарь и создает события пользователя через CreateNewEvent.
+// ID событиям всегда назначает хранилище, даже если UID выдан этим сервером: иначе клиент
+// выбирал бы ID сам. По той же причине участники приглашаются заново и отвечают сами,
+// PARTSTAT из файла не сохраняется. Ошибка в одном VEVENT не мешает импорту остальных
+func (svc *CalendarService) ImportICS(data string, userID int) ([]Event, []ImportError, error) {
+	components, err := parseICSComponents(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		masters   []Event
+		masterIdx []int
+		importErr []ImportError
+	)
+	byUID := make(map[string]int)
+	for ind, c := range components {
+		if _, ok := c.prop("RECURRENCE-ID"); ok {
+			continue
+		}
+		event, err := icsEvent(c, userID)
+		if err != nil {
+			importErr = append(importErr, ImportError{Index: ind, UID: c.value("UID"), Error: err.Error()})
+			continue
+		}
+		byUID[c.value("UID")] = len(masters)
+		masters = append(masters, event)
+		masterIdx = append(masterIdx, ind)
+	}
+
+	// Измененные повторения присоединяются к своей серии до ее сохранения
+	for ind, c := range components {
+		recurrenceID, ok := c.prop("RECURRENCE-ID")
+		if !ok {
+			continue
+		}
+		addErr := func(err error) {
+			importErr = append(importErr, ImportError{Index: ind, UID: c.value("UID"), Error: err.Error()})
+		}
+		master, ok := byUID[c.value("UID")]
+		if !ok || masters[master].Recurrence == nil {
+			addErr(errors.New("recurring event for RECURRENCE-ID not found"))
+			continue
+		}
+		loc := masters[master].location()
+		original, _, err := parsePropTimes(recurrenceID, loc)
+		if err != nil {
+			addErr(err)
+			continue
+		}
+		occurrence, err := icsEvent(c, userID)
+		if err != nil {
+			addErr(err)
+			continue
+		}
+		masters[master].Recurrence.setOverride(Override{
+			RecurrenceID: original[0],
+			Date:         Date{date: occurrence.Date.date.In(loc)},
+			End:          Date{date: occurrence.End.date.In(loc)},
+			Title:        occurrence.Title,
+			Description:  occurrence.Description,
+		})
+	}
+
+	var created []Event
+	for ind, event := range masters {
+		event, err := svc.CreateNewEvent(event, WriteOptions{})
+		if err != nil {
+			importErr = append(importErr, ImportError{Index: masterIdx[ind], UID: components[masterIdx[ind]].value("UID"), Error: err.Error()})
+			continue
+		}
+		created = append(created, event)
+	}
+	sort.Slice(importErr, func(i, j int) bool { return importErr[i].Index < importErr[j].Index })
+	return created, importErr, nil
+}
+
+// ExportICS отдает события пользователя в формате iCalendar
+func (scope *Scope) ExportICS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		sendErr(w, "Incorrect args", http.StatusBadRequest)
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	events, err := scope.EventRepository.UserEvents(userID)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="calendar.ics"`)
+	_, _ = io.WriteString(w, EncodeICS(events))
+}
+
+// ImportICSEvents принимает .ics файл в теле запроса или в поле file формы multipart/form-data.
+// user_id читается только из строки запроса: разбор формы прочитал бы тело с файлом
+func (scope *Scope) ImportICSEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErr(w, "Not correct method", http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			if !bodyTooLarge(err) {
+				err = errors.New("file is required")
+			}
+			sendBadRequest(w, err)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		sendErr(w, "Incorrect args", http.StatusBadRequest)
+		return
+	}
+	if !scope.authorize(w, r, userID) {
+		return
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		sendBadRequest(w, err)
+		return
+	}
+
+	created, importErr, err := scope.actingAs(r, userID).ImportICS(string(data), userID)
+	if err != nil {
+		sendErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := struct {
+		Result string        `json:"result"`
+		Events []Event       `json:"events"`
+		Errors []ImportError `json:"errors,omitempty"`
+	}{"Success", created, importErr}
+	sendJSON(w, response, http.StatusOK)
+}
+
+// Offset - смещение напоминания до начала события, в JSON - строка time.ParseDuration ("15m")
+type Offset time.Duration
+
+// MarshalJSON для типа Offset
+func (o Offset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(o).String())
+}
+
+// UnmarshalJSON для типа Offset
+func (o *Offset) UnmarshalJSON(input []byte) error {
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*o = Offset(d)
+	return nil
+}
+
+// maxReminderOffset - наибольшее смещение напоминания до начала события
+const maxReminderOffset = 4 * 7 * 24 * time.Hour
+
+// Clock - источник времени планировщика, подменяется в тестах
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock - системные часы
+type realClock struct{}
+
+// Now возвращает текущее время
+func (realClock) Now() time.Time { return time.Now() }
+
+// After ждет d по системным часам
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Notification - напоминание о событии для одного получателя
+type Notification struct {
+	// UserID - получатель: организатор или участник, не отклонивший приглашение
+	UserID  int    `json:"user_id"`
+	EventID int    `json:"event_id"`
+	Title   string `json:"title"`
+	// Start - начало повторения, о котором напоминание
+	Start  Date   `json:"start"`
+	Before Offset `json:"before"`
+	// FireAt - время, на которое было запланировано напоминание
+	FireAt time.Time `json:"fire_at"`
+}
+
+// NotificationSink доставляет напоминания
+type NotificationSink interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// LogSink пишет напоминания в лог
+type LogSink struct {
+	Logger Logger
+}
+
+// Notify пишет напоминание в лог
+func (sink LogSink) Notify(_ context.Context, n Notification) error {
+	sink.Logger.Infof("reminder: user %d, event %d %q at %s", n.UserID, n.EventID, n.Title, n.Start)
+	return nil
+}
+
+// WebhookSink отправляет напоминания POST-запросом с JSON на URL
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify отправляет напоминание, ответ не из диапазона 2xx считается ошибкой
+func (sink WebhookSink) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := sink.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", sink.URL, res.Status)
+	}
+	return nil
+}
+
+// ChannelSink передает напоминания в канал, используется в тестах и внутри процесса
+type ChannelSink chan Notification
+
+// Notify ждет, пока напоминание примут из канала, или отмены ctx
+func (sink ChannelSink) Notify(ctx context.Context, n Notification) error {
+	select {
+	case sink <- n:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Настройки планировщика напоминаний
+const (
+	// reminderLookahead - наибольшее время ожидания между проверками хранилища
+	reminderLookahead = time.Minute
+	// reminderMaxLateness - напоминания, опоздавшие больше чем на это время (например, пока
+	// сервер был выключен), пропускаются
+	reminderMaxLateness = time.Hour
+	// reminderSendTimeout ограничивает доставку одного напоминания в один приемник
+	reminderSendTimeout = 10 * time.Second
+)
+
+// ReminderScheduler вычисляет наступившие напоминания по хранилищу и доставляет их в приемники.
+// Момент, до которого напоминания уже доставлены, сохраняется в файл, поэтому после перезапуска
+// напоминания не повторяются, а пропущенные за время простоя доставляются
+type ReminderScheduler struct {
+	repo   EventRepository
+	sinks  []NotificationSink
+	clock  Clock
+	logger Logger
+	// statePath - файл состояния, пустая строка - не сохранять состояние
+	statePath string
+	// firedThrough - напоминания, запланированные не позже этого момента, уже доставлены
+	firedThrough time.Time
+	wake         chan struct{}
+	mu           sync.Mutex
+}
+
+// reminderState - содержимое файла состояния планировщика
+type reminderState struct {
+	FiredThrough time.Time `json:"fired_through"`
+}
+
+// NewReminderScheduler создает планировщик и читает его состояние из statePath
+func NewReminderScheduler(repo EventRepository, clock Clock, logger Logger, statePath string, sinks ...NotificationSink) (*ReminderScheduler, error) {
+	s := &ReminderScheduler{
+		repo:         repo,
+		sinks:        sinks,
+		clock:        clock,
+		logger:       logger,
+		statePath:    statePath,
+		firedThrough: clock.Now(),
+		wake:         make(chan struct{}, 1),
+	}
+	if statePath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state reminderState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", statePath, err)
+	}
+	s.firedThrough = state.FiredThrough
+	return s, nil
+}
+
+// Reschedule будит планировщик, чтобы он пересчитал напоминания после изменения событий.
+// Для nil ничего не делает
+func (s *ReminderScheduler) Reschedule() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run доставляет напоминания до отмены ctx
+func (s *ReminderScheduler) Run(ctx context.Context) {
+	for {
+		next, err := s.RunDue(ctx)
+		if err != nil {
+			s.logger.Errorf("reminders: %v", err)
+		}
+		wait := reminderLookahead
+		if !next.IsZero() {
+			if d := next.Sub(s.clock.Now()); d < wait {
+				wait = d
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// RunDue доставляет напоминания, наступившие с прошлого вызова, и возвращает время следующего
+// напоминания в пределах reminderLookahead или нулевое время
+func (s *ReminderScheduler) RunDue(ctx context.Context) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	due, next, err := s.pending(s.firedThrough, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	skipped := 0
+	for _, n := range due {
+		if now.Sub(n.FireAt) > reminderMaxLateness {
+			skipped++
+			continue
+		}
+		for _, sink := range s.sinks {
+			sendCtx, cancel := context.WithTimeout(ctx, reminderSendTimeout)
+			if err := sink.Notify(sendCtx, n); err != nil {
+				s.logger.Errorf("reminders: event %d, user %d: %v", n.EventID, n.UserID, err)
+			}
+			cancel()
+		}
+	}
+	if skipped > 0 {
+		s.logger.Warnf("reminders: skipped %d reminders older than %s", skipped, reminderMaxLateness)
+	}
+	if now.After(s.firedThrough) {
+		s.firedThrough = now
+		if err := s.saveState(); err != nil {
+			return next, err
+		}
+	}
+	return next, nil
+}
+
+// pending вычисляет напоминания со временем в (after, now] и ближайшее напоминание после now
+func (s *ReminderScheduler) pending(after, now time.Time) ([]Notification, time.Time, error) {
+	horizon := now.Add(reminderLookahead)
+	// Напоминание за offset до начала S срабатывает в S - offset, поэтому начала ищутся до horizon + maxReminderOffset
+	events, err := s.repo.OverlappingAll(after, horizon.Add(maxReminderOffset+time.Nanosecond))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var (
+		due  []Notification
+		next time.Time
+	)
+	for _, event := range events {
+		if len(event.Reminders) == 0 {
+			continue
+		}
+		for _, occ := range event.Occurrences(after, horizon.Add(maxReminderOffset+time.Nanosecond)) {
+			for _, offset := range event.Reminders {
+				fireAt := occ.Date.date.Add(-time.Duration(offset))
+				if !fireAt.After(after) || fireAt.After(horizon) {
+					continue
+				}
+				if fireAt.After(now) {
+					if next.IsZero() || fireAt.Before(next) {
+						next = fireAt
+					}
+					continue
+				}
+				for _, userID := range occ.reminderRecipients() {
+					due = append(due, Notification{
+						UserID:  userID,
+						EventID: occ.ID,
+						Title:   occ.Title,
+						Start:   occ.Date,
+						Before:  offset,
+						FireAt:  fireAt,
+					})
+				}
+			}
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].FireAt.Before(due[j].FireAt) })
+	return due, next, nil
+}
+
+// reminderRecipients возвращает организатора и участников, не отклонивших приглашение
+func (e Event) reminderRecipients() []int {
+	res := []int{e.UserID}
+	for _, a := range e.Attendees {
+		if a.Status != RSVPDeclined {
+			res = append(res, a.UserID)
+		}
+	}
+	return res
+}
+
+// saveState атомарно сохраняет состояние планировщика, вызывается под блокировкой
+func (s *ReminderScheduler) saveState() error {
+	if s.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(reminderState{FiredThrough: s.firedThrough})
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath)
+}
+
+// Коды ошибок JSON-RPC 2.0. Коды от -32000 до -32099 - ошибки календаря
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	// rpcBusinessError - пересечение, конфликт версий или отсутствие приглашения, в HTTP - код 503
+	rpcBusinessError = -32000
+	// rpcNotFound - событие, повторение, пользователь или запись корзины не найдены
+	rpcNotFound = -32001
+	// rpcUnauthorized - соединение не аутентифицировано или токен истек, в HTTP - код 401
+	rpcUnauthorized = -32002
+	// rpcForbidden - данные другого пользователя недоступны, в HTTP - код 403
+	rpcForbidden = -32003
+	// rpcRateLimited - превышена частота вызовов, в HTTP - код 429
+	rpcRateLimited = -32004
+)
+
+// rpcAuthenticate - метод аутентификации соединения JSON-RPC токеном, выданным /login
+const rpcAuthenticate = "rpc.authenticate"
+
+// maxRPCLineBytes - наибольший размер строки запроса JSON-RPC
+const maxRPCLineBytes = 1 << 20
+
+// RPCError - ошибка JSON-RPC. Data содержит ошибки по полям для rpcInvalidParams
+// и результаты операций для отмененного пакета
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Error возвращает сообщение ошибки
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// rpcRequest - запрос JSON-RPC. Запрос без id - уведомление, ответ на него не отправляется
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcResponse - ответ JSON-RPC: Result при успехе или Error
+type rpcResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError        `json:"error,omitempty"`
+	ID      json.RawMessage  `json:"id"`
+}
+
+// rpcErrorFrom переводит ошибку сервиса в ошибку JSON-RPC
+func rpcErrorFrom(err error) *RPCError {
+	var rerr *RPCError
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &rerr):
+		return rerr
+	case errors.As(err, &verr):
+		return &RPCError{Code: rpcInvalidParams, Message: "validation failed", Data: verr.Fields}
+	case errors.Is(err, ErrBadToken):
+		return &RPCError{Code: rpcUnauthorized, Message: err.Error()}
+	case errors.Is(err, ErrForbidden):
+		return &RPCError{Code: rpcForbidden, Message: err.Error()}
+	case errStatus(err, 0) == http.StatusServiceUnavailable:
+		return &RPCError{Code: rpcBusinessError, Message: err.Error()}
+	case errors.Is(err, ErrEventNotFound), errors.Is(err, ErrOccurrenceNotFound), errors.Is(err, ErrUnknownUser):
+		return &RPCError{Code: rpcNotFound, Message: err.Error()}
+	default:
+		return &RPCError{Code: rpcInternalError, Message: err.Error()}
+	}
+}
+
+// rpcCaller - сервис и пользователь вызова JSON-RPC, identity == nil - аутентификация отключена
+type rpcCaller struct {
+	svc      *CalendarService
+	identity *Identity
+}
+
+// access проверяет, может ли вызывающий работать с данными userID: как и в HTTP API,
+// свои данные доступны всем, чужие - только администратору
+func (c rpcCaller) access(userID int) error {
+	if c.identity != nil && c.identity.UserID != userID && c.identity.Role != RoleAdmin {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// actor возвращает пользователя, от имени которого изменения записываются в журнал:
+// вызывающего, а без аутентификации - userID
+func (c rpcCaller) actor(userID int) int {
+	if c.identity != nil {
+		return c.identity.UserID
+	}
+	return userID
+}
+
+// as проверяет доступ к данным userID и возвращает сервис, изменения которого записываются
+// в журнал от имени вызывающего
+func (c rpcCaller) as(userID int) (*CalendarService, error) {
+	if err := c.access(userID); err != nil {
+		return nil, err
+	}
+	return c.svc.As(c.actor(userID)), nil
+}
+
+// rpcMethod выполняет метод JSON-RPC с параметрами params
+type rpcMethod func(c rpcCaller, params json.RawMessage) (interface{}, error)
+
+// rpcParams декодирует именованные параметры метода в v
+func rpcParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		params = json.RawMessage("{}")
+	}
+	if params[0] != '{' {
+		return &RPCError{Code: rpcInvalidParams, Message: "params must be an object"}
+	}
+	return decodeJSON(params, v)
+}
+
+// rpcUserParams - параметры методов, которым нужен только пользователь
+type rpcUserParams struct {
+	UserID int `json:"user_id"`
+}
+
+// validate проверяет пользователя
+func (p rpcUserParams) validate() error {
+	if p.UserID <= 0 {
+		return &ValidationError{Fields: map[string]string{"user_id": "must be a positive integer"}}
+	}
+	return nil
+}
+
+// rpcRangeParams - параметры выборок: пользователь, часовой пояс tz (по умолчанию UTC)
+// и дата date (для выборок за день, неделю и месяц) или интервал [from, to)
+type rpcRangeParams struct {
+	UserID int    `json:"user_id"`
+	Date   string `json:"date"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	TZ     string `json:"tz"`
+}
+
+// location проверяет пользователя и часовой пояс
+func (p rpcRangeParams) location(fe fieldErrors) *time.Location {
+	if p.UserID <= 0 {
+		fe.add("user_id", "must be a positive integer")
+	}
+	loc, err := parseTZ(p.TZ)
+	if err != nil {
+		fe.add("tz", "unknown time zone")
+		return time.UTC
+	}
+	return loc
+}
+
+// day возвращает начало дня date в часовом поясе tz
+func (p rpcRangeParams) day() (time.Time, error) {
+	fe := fieldErrors{}
+	date, err := time.ParseInLocation("2006-01-02", p.Date, p.location(fe))
+	if err != nil {
+		fe.add("date", "must be a date 2006-01-02")
+	}
+	return date, fe.err()
+}
+
+// interval возвращает интервал [from, to)
+func (p rpcRangeParams) interval() (time.Time, time.Time, error) {
+	fe := fieldErrors{}
+	loc := p.location(fe)
+	from, err := parseTimeParam(p.From, loc)
+	if err != nil {
+		fe.add("from", "must be a date 2006-01-02 or RFC 3339 time")
+	}
+	to, err := parseTimeParam(p.To, loc)
+	if err != nil {
+		fe.add("to", "must be a date 2006-01-02 or RFC 3339 time")
+	} else if !to.After(from) {
+		fe.add("to", "must be after from")
+	}
+	return from, to, fe.err()
+}
+
+// rpcPeriodMethod возвращает метод выборки событий за период, который rangeFunc строит по дате
+func rpcPeriodMethod(rangeFunc func(svc *CalendarService, userID int, date time.Time) ([]Event, error)) rpcMethod {
+	return func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var p rpcRangeParams
+		if err := rpcParams(params, &p); err != nil {
+			return nil, err
+		}
+		date, err := p.day()
+		if err == nil {
+			err = c.access(p.UserID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		events, err := rangeFunc(c.svc, p.UserID, date)
+		if err != nil {
+			return nil, err
+		}
+		return sortedEvents(events), nil
+	}
+}
+
+// sortedEvents упорядочивает выборку так же, как списки HTTP API по умолчанию
+func sortedEvents(events []Event) []Event {
+	if events == nil {
+		return []Event{}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return compareEvents(defaultSort, events[i], events[j]) < 0
+	})
+	return events
+}
+
+// rpcMethods - методы JSON-RPC. Параметры, проверки и права доступа те же, что у методов HTTP API
+var rpcMethods = map[string]rpcMethod{
+	"calendar.create_event": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req EventRequest
+		err := rpcParams(params, &req)
+		if err = mergeValidation(err, ValidateEvent(req, true)); err != nil {
+			return nil, err
+		}
+		event := req.Event
+		// ID всегда назначает сервер
+		event.ID = 0
+		svc, err := c.as(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return svc.CreateNewEvent(event, req.WriteOptions)
+	},
+	"calendar.update_event": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req EventRequest
+		err := rpcParams(params, &req)
+		if err = mergeValidation(err, ValidateEvent(req, false)); err != nil {
+			return nil, err
+		}
+		svc, err := c.as(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return svc.UpdateEventFunc(req.Event, req.SeriesTarget, req.WriteOptions)
+	},
+	"calendar.delete_event": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req ConcreteEvent
+		err := rpcParams(params, &req)
+		if err = mergeValidation(err, ValidateConcreteEvent(req)); err != nil {
+			return nil, err
+		}
+		svc, err := c.as(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, svc.RemoveEventFunc(req)
+	},
+	"calendar.restore_event": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req RestoreRequest
+		err := rpcParams(params, &req)
+		if err = mergeValidation(err, req.validate()); err != nil {
+			return nil, err
+		}
+		svc, err := c.as(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return svc.RestoreEventFunc(req.UserID, req.ID)
+	},
+	"calendar.invite": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req InviteRequest
+		err := rpcParams(params, &req)
+		if err = mergeValidation(err, req.validate()); err != nil {
+			return nil, err
+		}
+		svc, err := c.as(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return svc.InviteFunc(req.UserID, req.ID, req.Attendees, req.ExpectedVersion)
+	},
+	"calendar.respond": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req RespondRequest
+		err := rpcParams(params, &req)
+		status, verr := req.validate()
+		if err = mergeValidation(err, verr); err != nil {
+			return nil, err
+		}
+		svc, err := c.as(req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return svc.RespondFunc(req.UserID, req.ID, status)
+	},
+	"calendar.batch": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var req struct {
+			Operations []BatchOperation `json:"operations"`
+		}
+		err := rpcParams(params, &req)
+		if err == nil {
+			err = ValidateBatch(req.Operations)
+		}
+		for _, op := range req.Operations {
+			if err == nil {
+				err = c.access(op.UserID)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		results, err := c.svc.As(c.actor(0)).Batch(req.Operations)
+		if err != nil {
+			rerr := rpcErrorFrom(err)
+			rerr.Data = results
+			return nil, rerr
+		}
+		return results, nil
+	},
+	"calendar.events_for_day":   rpcPeriodMethod((*CalendarService).DayEventsFunc),
+	"calendar.events_for_week":  rpcPeriodMethod((*CalendarService).WeekEventsFunc),
+	"calendar.events_for_month": rpcPeriodMethod((*CalendarService).MonthEventsFunc),
+	"calendar.events": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var p rpcRangeParams
+		if err := rpcParams(params, &p); err != nil {
+			return nil, err
+		}
+		from, to, err := p.interval()
+		if err == nil {
+			err = c.access(p.UserID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		events, err := c.svc.eventsInRange(p.UserID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return sortedEvents(events), nil
+	},
+	"calendar.free_busy": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var p rpcRangeParams
+		if err := rpcParams(params, &p); err != nil {
+			return nil, err
+		}
+		from, to, err := p.interval()
+		if err == nil {
+			err = c.access(p.UserID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		busy, free, err := c.svc.FreeBusy(p.UserID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Busy []Interval `json:"busy"`
+			Free []Interval `json:"free"`
+		}{busy, free}, nil
+	},
+	"calendar.trash": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var p rpcUserParams
+		err := rpcParams(params, &p)
+		err = mergeValidation(err, p.validate())
+		if err == nil {
+			err = c.access(p.UserID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.svc.EventRepository.Trash(p.UserID)
+	},
+	"calendar.history": func(c rpcCaller, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			ID int `json:"id"`
+		}
+		err := rpcParams(params, &p)
+		if err == nil && p.ID <= 0 {
+			err = &ValidationError{Fields: map[string]string{"id": "must be a positive integer"}}
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Как и в HTTP API, чужое событие неотличимо от несуществующего
+		entries, err := c.svc.EventRepository.History(p.ID)
+		owner := 0
+		if err == nil {
+			owner = entries[0].UserID
+		}
+		if errors.Is(c.access(owner), ErrForbidden) {
+			err = ErrEventNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return entries, nil
+	},
+}
+
+// RPCServer обслуживает JSON-RPC 2.0 поверх TCP тем же CalendarService, что и HTTP-сервер.
+// Запрос или пакет запросов передается одной строкой JSON, ответ на него - тоже одной строкой.
+// С аутентификацией соединение сначала вызывает rpc.authenticate с токеном /login, и каждый вызов
+// проверяется по тем же правилам, что запросы HTTP API
+type RPCServer struct {
+	svc    *CalendarService
+	logger Logger
+	// auth проверяет токены соединений, nil отключает аутентификацию
+	auth *Authenticator
+	// limiter ограничивает частоту вызовов пользователя или адреса, nil отключает ограничение
+	limiter *RateLimiter
+	// maxLineBytes - наибольший размер строки запроса
+	maxLineBytes int
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewRPCServer создает сервер JSON-RPC для сервиса svc
+func NewRPCServer(svc *CalendarService) *RPCServer {
+	return &RPCServer{svc: svc, logger: svc.logger, maxLineBytes: maxRPCLineBytes, conns: make(map[net.Conn]struct{})}
+}
+
+// rpcSession - состояние соединения JSON-RPC
+type rpcSession struct {
+	// host - адрес клиента, по нему ограничивается частота вызовов без токена
+	host string
+	// token - токен, переданный rpc.authenticate
+	token string
+}
+
+// listenRPC открывает адрес сервера JSON-RPC. Без аутентификации вызовы могут действовать от имени
+// любого пользователя, поэтому такой сервер слушает только loopback
+func listenRPC(addr string, authenticated bool) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc_addr: %w", err)
+	}
+	if ip := net.ParseIP(host); !authenticated && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("rpc_addr %q: without authentication the JSON-RPC server listens only on a loopback address", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve принимает соединения на ln до отмены ctx. После отмены новые соединения не принимаются,
+// начатые вызовы завершаются, а соединения закрываются
+func (s *RPCServer) Serve(ctx context.Context, ln net.Listener) error {
+	s.logger.Infof("rpc listening on %s", ln.Addr())
+	stop := context.AfterFunc(ctx, func() {
+		_ = ln.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Чтение прерывается, а ответ на начатый вызов еще записывается
+		for conn := range s.conns {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	})
+	defer stop()
+
+	var err error
+	for {
+		var conn net.Conn
+		conn, err = ln.Accept()
+		if err != nil {
+			break
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		// Соединение, принятое одновременно с отменой, AfterFunc мог уже не застать
+		if ctx.Err() != nil {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+		go s.serveConn(conn)
+	}
+	s.wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// serveConn читает запросы из conn по одному на строку и отвечает на них по порядку
+func (s *RPCServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+		s.wg.Done()
+	}()
+	session := &rpcSession{host: conn.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(session.host); err == nil {
+		session.host = host
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), s.maxLineBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if res := s.handleLine(session, line); res != nil {
+			if _, err := conn.Write(append(res, '\n')); err != nil {
+				return
+			}
+		}
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		res, _ := json.Marshal(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &RPCError{Code: rpcInvalidRequest, Message: "request line is too long"}})
+		_, _ = conn.Write(append(res, '\n'))
+	}
+}
+
+// handleLine выполняет запрос или пакет запросов и возвращает строку ответа, nil - отвечать не нужно
+func (s *RPCServer) handleLine(session *rpcSession, line []byte) []byte {
+	if !json.Valid(line) {
+		res, _ := json.Marshal(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &RPCError{Code: rpcParseError, Message: "parse error"}})
+		return res
+	}
+	if line[0] != '[' {
+		res := s.call(session, line)
+		if res == nil {
+			return nil
+		}
+		data, _ := json.Marshal(res)
+		return data
+	}
+
+	var batch []json.RawMessage
+	_ = json.Unmarshal(line, &batch)
+	if len(batch) == 0 {
+		res, _ := json.Marshal(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &RPCError{Code: rpcInvalidRequest, Message: "empty batch"}})
+		return res
+	}
+	responses := []*rpcResponse{}
+	for _, raw := range batch {
+		if res := s.call(session, raw); res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(responses)
+	return data
+}
+
+// call выполняет один запрос. Для уведомления возвращает nil
+func (s *RPCServer) call(session *rpcSession, raw json.RawMessage) (res *rpcResponse) {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		id := req.ID
+		if len(id) == 0 {
+			id = json.RawMessage("null")
+		}
+		return &rpcResponse{JSONRPC: "2.0", ID: id, Error: &RPCError{Code: rpcInvalidRequest, Message: "invalid request"}}
+	}
+	notification := len(req.ID) == 0
+	defer func() {
+		if p := recover(); p != nil {
+			s.logger.Errorf("rpc %s: panic: %v\n%s", req.Method, p, debug.Stack())
+			res = &rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: &RPCError{Code: rpcInternalError, Message: "internal error"}}
+		}
+		if notification {
+			res = nil
+		}
+	}()
+
+	caller := rpcCaller{svc: s.svc}
+	var authErr error
+	if s.auth != nil {
+		if identity, err := s.auth.Verify(session.token); err == nil {
+			caller.identity = &identity
+		} else {
+			authErr = err
+		}
+	}
+	if s.limiter != nil {
+		key := "addr:" + session.host
+		if caller.identity != nil {
+			key = "user:" + strconv.Itoa(caller.identity.UserID)
+		}
+		if ok, wait := s.limiter.Allow(key); !ok {
+			seconds := int((wait + time.Second - 1) / time.Second)
+			return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: &RPCError{Code: rpcRateLimited,
+				Message: "rate limit exceeded", Data: map[string]int{"retry_after": max(seconds, 1)}}}
+		}
+	}
+
+	var result interface{}
+	var err error
+	method, ok := rpcMethods[req.Method]
+	switch {
+	case req.Method == rpcAuthenticate:
+		result, err = s.authenticate(session, req.Params)
+	case authErr != nil:
+		err = authErr
+	case !ok:
+		return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: &RPCError{Code: rpcMethodNotFound, Message: "method not found"}}
+	default:
+		result, err = method(caller, req.Params)
+	}
+	if err != nil {
+		return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcErrorFrom(err)}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcErrorFrom(err)}
+	}
+	msg := json.RawMessage(data)
+	return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: &msg}
+}
+
+// authenticate проверяет токен из params и запоминает его для следующих вызовов соединения.
+// Токен проверяется и при каждом вызове, поэтому после истечения его нужно передать заново
+func (s *RPCServer) authenticate(session *rpcSession, params json.RawMessage) (interface{}, error) {
+	if s.auth == nil {
+		return nil, &RPCError{Code: rpcInvalidRequest, Message: "authentication is disabled"}
+	}
+	var p struct {
+		Token string `json:"token"`
+	}
+	if err := rpcParams(params, &p); err != nil {
+		return nil, err
+	}
+	identity, err := s.auth.Verify(p.Token)
+	if err != nil {
+		return nil, err
+	}
+	session.token = p.Token
+	return struct {
+		UserID int    `json:"user_id"`
+		Role   string `json:"role"`
+	}{identity.UserID, identity.Role}, nil
+}
+
+func main() {
+	// calendar hash-password <пароль> печатает хеш для поля password_hash файла пользователей
+	if len(os.Args) == 3 && os.Args[1] == "hash-password" {
+		hash, err := HashPassword(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	repo, err := newRepository(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scope := CreateScope(repo)
+	scope.logger.level = cfg.LogLevel
+	scope.maxBodyBytes = cfg.MaxBodyBytes
+	scope.webhooks = NewWebhookDispatcher(repo, cfg.WebhookWorkers, cfg.WebhookMaxAttempts, cfg.WebhookBackoff, scope.clock, scope.logger)
+	// Сети уже проверены при разборе настроек
+	scope.webhooks.allowed, _ = parseNetworks(cfg.WebhookAllowedNetworks)
+	if cfg.RateLimit > 0 {
+		scope.limiter = NewRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	scope.auth, err = newAuthenticator(cfg, scope.logger)
+	if err == nil {
+		scope.reminders, err = newReminderScheduler(cfg, repo, scope.logger)
+	}
+	// Адрес JSON-RPC открывается до запуска: сервер, который не смог его открыть, не стартует
+	var rpcListener net.Listener
+	if err == nil && cfg.RPCAddr != "" {
+		rpcListener, err = listenRPC(cfg.RPCAddr, scope.auth != nil)
+	}
+	if err != nil {
+		scope.logger.Errorf("%v", err)
+		_ = repo.Close()
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	remindersDone := make(chan struct{})
+	go func() {
+		defer close(remindersDone)
+		scope.reminders.Run(ctx)
+	}()
+	purgeDone := make(chan struct{})
+	go func() {
+		defer close(purgeDone)
+		if cfg.TrashRetention > 0 {
+			scope.RunTrashPurge(ctx, cfg.TrashRetention, cfg.TrashPurgeInterval)
+		}
+	}()
+
+	webhooksDone := make(chan struct{})
+	go func() {
+		defer close(webhooksDone)
+		scope.webhooks.Run(ctx)
+	}()
+	rpcDone := make(chan struct{})
+	go func() {
+		defer close(rpcDone)
+		if rpcListener == nil {
+			return
+		}
+		rpc := NewRPCServer(scope.CalendarService)
+		rpc.auth = scope.auth
+		rpc.limiter = scope.limiter
+		rpc.maxLineBytes = int(cfg.MaxBodyBytes)
+		if err := rpc.Serve(ctx, rpcListener); err != nil {
+			scope.logger.Errorf("rpc: %v", err)
+		}
+	}()
+
+	err = scope.startingServer(ctx, cfg)
+	if err != nil {
+		scope.logger.Errorf("server: %v", err)
+	}
+	stop()
+	<-remindersDone
+	<-purgeDone
+	<-webhooksDone
+	<-rpcDone
+	// Хранилище закрывается после завершения всех запросов: файловое хранилище при этом записывает снимок
+	if closeErr := repo.Close(); closeErr != nil {
+		scope.logger.Errorf("storage: %v", closeErr)
+		err = closeErr
+	}
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,3261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestEvent создает событие на заданную дату
+func newTestEvent(userID, id int, date string, title string) Event {
+	d, _ := time.Parse("2006-01-02", date)
+	return Event{UserID: userID, ID: id, Date: Date{date: d}, Title: title, Description: title}
+}
+
+// repositories создает пустые хранилища в памяти, которые должны вести себя одинаково
+func repositories() map[string]EventRepository {
+	return map[string]EventRepository{
+		"memory":  NewMemoryRepository(),
+		"sharded": NewShardedRepository(4),
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	for name, repo := range repositories() {
+		t.Run(name, func(t *testing.T) {
+			if _, err := repo.Create(newTestEvent(1, 1, "2023-07-10", "standup")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.Create(newTestEvent(2, 1, "2023-07-10", "standup")); !errors.Is(err, ErrDuplicateEvent) {
+				t.Errorf("Create duplicate = %v, expected %v", err, ErrDuplicateEvent)
+			}
+			if _, err := repo.Update(newTestEvent(1, 1, "2023-07-11", "retro"), 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.Update(newTestEvent(1, 2, "2023-07-11", "retro"), 0); !errors.Is(err, ErrEventNotFound) {
+				t.Errorf("Update missing = %v, expected %v", err, ErrEventNotFound)
+			}
+
+			events, err := repo.UserEvents(1)
+			if err != nil || len(events) != 1 || events[0].Title != "retro" {
+				t.Errorf("UserEvents(1) = %v, %v", events, err)
+			}
+			if _, err := repo.UserEvents(2); !errors.Is(err, ErrUnknownUser) {
+				t.Errorf("UserEvents(2) error = %v, expected %v", err, ErrUnknownUser)
+			}
+
+			if err := repo.Delete(ConcreteEvent{UserID: 1, ID: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.Delete(ConcreteEvent{UserID: 1, ID: 1}); !errors.Is(err, ErrEventNotFound) {
+				t.Errorf("Delete missing = %v, expected %v", err, ErrEventNotFound)
+			}
+
+			// Приглашения и поиск связывают пользователей разных полос
+			planning := newTestEvent(2, 0, "2023-07-12", "planning")
+			planning.Attendees = []Attendee{{UserID: 3, Status: RSVPNeedsAction}}
+			planning, err = repo.Create(planning)
+			if err != nil || planning.ID != 2 {
+				t.Fatalf("Create = %+v, %v", planning, err)
+			}
+			if invited, err := repo.Invited(3); err != nil || len(invited) != 1 || invited[0].ID != planning.ID {
+				t.Errorf("Invited(3) = %v, %v", invited, err)
+			}
+			if found, err := repo.Search(3, []string{"planning"}, nil); err != nil || len(found) != 1 {
+				t.Errorf("Search(3) = %v, %v", found, err)
+			}
+			day := planning.Date.date
+			if found, err := repo.Overlapping(2, day, day.Add(time.Hour)); err != nil || len(found) != 1 {
+				t.Errorf("Overlapping(2) = %v, %v", found, err)
+			}
+			if found, _ := repo.OverlappingAll(day.Add(time.Hour), day.Add(2*time.Hour)); len(found) != 0 {
+				t.Errorf("OverlappingAll after the event = %v", found)
+			}
+
+			if err := repo.Delete(ConcreteEvent{UserID: 2, ID: planning.ID}); err != nil {
+				t.Fatal(err)
+			}
+			_ = repo.PutTrash(TrashedEvent{Event: planning, DeletedAt: day})
+			if invited, _ := repo.Invited(3); len(invited) != 0 {
+				t.Errorf("Invited(3) after delete = %v", invited)
+			}
+			restored, err := repo.Restore(2, planning.ID)
+			if err != nil || restored.Version != 2 {
+				t.Errorf("Restore = %+v, %v", restored, err)
+			}
+			if _, err := repo.Restore(2, planning.ID); !errors.Is(err, ErrEventNotFound) {
+				t.Errorf("second Restore = %v, expected %v", err, ErrEventNotFound)
+			}
+			stats, _ := repo.Stats()
+			if !reflect.DeepEqual(stats.Events, map[int]int{1: 0, 2: 1}) {
+				t.Errorf("Stats = %v", stats.Events)
+			}
+		})
+	}
+}
+
+func TestFileRepositoryRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = repo.Create(newTestEvent(1, 0, "2023-07-10", "standup"))
+	_, _ = repo.Create(newTestEvent(1, 0, "2023-07-11", "retro"))
+	// Снимок в середине: часть данных восстановится из снимка, часть - из журнала
+	if err := repo.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = repo.Update(newTestEvent(1, 1, "2023-07-12", "planning"), 1)
+	_ = repo.Delete(ConcreteEvent{UserID: 1, ID: 2})
+	_, _ = repo.Create(newTestEvent(2, 0, "2023-07-13", "demo"))
+	// Отклоненные изменения в журнал не попадают
+	if _, err := repo.Update(newTestEvent(1, 1, "2023-07-14", "stale"), 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Update with stale version = %v, expected %v", err, ErrVersionConflict)
+	}
+	if _, err := repo.Create(newTestEvent(2, 3, "2023-07-14", "duplicate")); !errors.Is(err, ErrDuplicateEvent) {
+		t.Errorf("Create duplicate = %v, expected %v", err, ErrDuplicateEvent)
+	}
+	// Имитация аварийного завершения: журнал закрывается без финального снимка
+	_ = repo.wal.Close()
+	wal, err := os.ReadFile(filepath.Join(dir, "events.wal"))
+	if n := bytes.Count(wal, []byte("\n")); err != nil || n != 3 {
+		t.Errorf("wal has %d records, expected 3: %v", n, err)
+	}
+
+	restored, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	events, err := restored.UserEvents(1)
+	if err != nil || len(events) != 1 || events[0].Title != "planning" || events[0].Date.date.Day() != 12 {
+		t.Errorf("restored UserEvents(1) = %v, %v", events, err)
+	}
+	events, err = restored.UserEvents(2)
+	if err != nil || len(events) != 1 || events[0].Title != "demo" {
+		t.Errorf("restored UserEvents(2) = %v, %v", events, err)
+	}
+
+	// Запись журнала, которую нельзя применить, означает порчу данных: хранилище не открывается
+	broken := t.TempDir()
+	rec := `{"op": "update", "event": {"user_id": 1, "id": 5, "date": "2023-07-10T00:00:00Z"}, "expected_version": 1}` + "\n"
+	if err := os.WriteFile(filepath.Join(broken, "events.wal"), []byte(rec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileRepository(broken, 0); !errors.Is(err, ErrEventNotFound) {
+		t.Errorf("NewFileRepository with a broken wal = %v, expected %v", err, ErrEventNotFound)
+	}
+	// Испорченная строка, за которой есть записи, тоже не пропускается молча
+	if err := os.WriteFile(filepath.Join(broken, "events.wal"), []byte("{\"op\": \"cre\n"+rec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileRepository(broken, 0); err == nil {
+		t.Error("NewFileRepository with a corrupted record in the middle of the wal succeeded")
+	}
+}
+
+func TestFileRepositoryTornWAL(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range []string{"2023-07-10", "2023-07-11"} {
+		if _, err := repo.Create(newTestEvent(1, 0, day, "standup")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Аварийное завершение посреди записи: в журнале остается начало строки без перевода строки
+	if _, err := repo.wal.WriteString(`{"op": "create", "event": {"user_id": 1, "ti`); err != nil {
+		t.Fatal(err)
+	}
+	_ = repo.wal.Close()
+
+	// Записи после перезапуска не должны склеиться с недописанной строкой и потеряться при следующем
+	for restart := 1; restart <= 2; restart++ {
+		repo, err = NewFileRepository(dir, 0)
+		if err != nil {
+			t.Fatalf("restart %d: %v", restart, err)
+		}
+		if _, err := repo.Create(newTestEvent(1, 0, "2023-07-12", "retro")); err != nil {
+			t.Fatal(err)
+		}
+		_ = repo.wal.Close()
+	}
+	repo, err = NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if events, _ := repo.UserEvents(1); len(events) != 4 {
+		t.Errorf("events after two crashes = %d, expected 4", len(events))
+	}
+}
+
+// Серия в Europe/Berlin после перезапуска повторяется в то же местное время и после перехода на летнее время,
+// восстановлена ли она из снимка или из журнала
+func TestFileRepositoryRestoreAcrossDST(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekly := func(userID int) Event {
+		e := newTimedEvent(userID, 0, "2023-03-20T10:00:00+01:00", time.Hour)
+		e.TimeZone = "Europe/Berlin"
+		e.Recurrence = &Recurrence{Freq: FreqWeekly}
+		if err := e.normalize(); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	if _, err := repo.Create(weekly(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Create(weekly(2)); err != nil {
+		t.Fatal(err)
+	}
+	_ = repo.wal.Close()
+
+	restored, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	from, _ := time.Parse(time.RFC3339, "2023-03-27T00:00:00Z")
+	for userID := 1; userID <= 2; userID++ {
+		events, _ := restored.UserEvents(userID)
+		if len(events) != 1 {
+			t.Fatalf("restored UserEvents(%d) = %v", userID, events)
+		}
+		occ := events[0].Occurrences(from, from.Add(24*time.Hour))
+		if len(occ) != 1 || occ[0].Date.date.UTC().Format(time.RFC3339) != "2023-03-27T08:00:00Z" {
+			t.Errorf("user %d: occurrences after restart = %v, expected 2023-03-27T08:00:00Z", userID, occ)
+		}
+	}
+}
+
+// occurrenceDays возвращает даты повторений в формате 2006-01-02
+func occurrenceDays(events []Event) []string {
+	res := make([]string, 0, len(events))
+	for _, e := range events {
+		res = append(res, e.Date.date.Format("2006-01-02"))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestOccurrences(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	until := Date{date: day("2023-03-31")}
+
+	var table = []struct {
+		name       string
+		start      string
+		recurrence *Recurrence
+		from, to   string
+		expected   []string
+	}{
+		{
+			name:       "single event",
+			start:      "2023-01-02",
+			recurrence: nil,
+			from:       "2023-01-01", to: "2023-02-01",
+			expected: []string{"2023-01-02"},
+		},
+		{
+			name:       "daily with interval and count",
+			start:      "2023-01-02",
+			recurrence: &Recurrence{Freq: FreqDaily, Interval: 2, Count: 3},
+			from:       "2023-01-01", to: "2023-02-01",
+			expected: []string{"2023-01-02", "2023-01-04", "2023-01-06"},
+		},
+		{
+			name:       "weekly by day",
+			start:      "2023-01-02",
+			recurrence: &Recurrence{Freq: FreqWeekly, ByDay: []string{"FR", "MO"}, Count: 4},
+			from:       "2023-01-01", to: "2023-02-01",
+			expected: []string{"2023-01-02", "2023-01-06", "2023-01-09", "2023-01-13"},
+		},
+		{
+			name:       "weekly window in the middle of series",
+			start:      "2023-01-02",
+			recurrence: &Recurrence{Freq: FreqWeekly},
+			from:       "2023-03-01", to: "2023-03-14",
+			expected: []string{"2023-03-06", "2023-03-13"},
+		},
+		{
+			name:       "monthly skips short months",
+			start:      "2023-01-31",
+			recurrence: &Recurrence{Freq: FreqMonthly, Until: &until},
+			from:       "2023-01-01", to: "2024-01-01",
+			expected: []string{"2023-01-31", "2023-03-31"},
+		},
+		{
+			name:       "daily window years after start",
+			start:      "2003-01-02",
+			recurrence: &Recurrence{Freq: FreqDaily, Interval: 3},
+			from:       "2023-07-01", to: "2023-07-08",
+			expected: []string{"2023-07-01", "2023-07-04", "2023-07-07"},
+		},
+		{
+			name:       "monthly window years after start",
+			start:      "2003-01-31",
+			recurrence: &Recurrence{Freq: FreqMonthly},
+			from:       "2023-02-01", to: "2023-04-01",
+			expected: []string{"2023-03-31"},
+		},
+		{
+			name:       "yearly with exdate",
+			start:      "2020-05-01",
+			recurrence: &Recurrence{Freq: FreqYearly, ExDates: []Date{{date: day("2021-05-01")}}},
+			from:       "2020-01-01", to: "2023-01-01",
+			expected: []string{"2020-05-01", "2022-05-01"},
+		},
+	}
+
+	for _, test := range table {
+		e := Event{UserID: 1, ID: 1, Date: Date{date: day(test.start)}, Recurrence: test.recurrence}
+		got := occurrenceDays(e.Occurrences(day(test.from), day(test.to)))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: Occurrences = %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
+
+// Повторение, перенесенное из давно прошедшего периода, находится, хотя перебор дат его пропускает
+func TestOccurrencesMovedFromSkippedPeriod(t *testing.T) {
+	start, _ := time.Parse(time.RFC3339, "2003-01-06T10:00:00Z")
+	moved, _ := time.Parse(time.RFC3339, "2023-07-05T10:00:00Z")
+	e := Event{UserID: 1, ID: 1, Date: Date{date: start}, End: Date{date: start.Add(time.Hour)},
+		Recurrence: &Recurrence{Freq: FreqWeekly, Overrides: []Override{{
+			RecurrenceID: Date{date: start.AddDate(0, 0, 7)},
+			Date:         Date{date: moved},
+			End:          Date{date: moved.Add(time.Hour)},
+		}}}}
+	got := occurrenceDays(e.Occurrences(moved.AddDate(0, 0, -2), moved.AddDate(0, 0, 2)))
+	if expected := []string{"2023-07-03", "2023-07-05"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Occurrences = %v, expected %v", got, expected)
+	}
+}
+
+func TestUpdateAndRemoveOccurrence(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	series := newTestEvent(1, 1, "2023-07-03", "standup")
+	series.Recurrence = &Recurrence{Freq: FreqWeekly, Count: 4}
+	if _, err := scope.CreateNewEvent(series, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := Date{date: series.Date.date.AddDate(0, 0, 7)}
+	moved := newTestEvent(1, 1, "2023-07-11", "moved standup")
+	if _, err := scope.UpdateEventFunc(moved, SeriesTarget{ApplyTo: ApplyToThis, OccurrenceDate: &second}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	third := Date{date: series.Date.date.AddDate(0, 0, 14)}
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: 1, SeriesTarget: SeriesTarget{ApplyTo: ApplyToThis, OccurrenceDate: &third}}); err != nil {
+		t.Fatal(err)
+	}
+	missing := Date{date: series.Date.date.AddDate(0, 0, 1)}
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: 1, SeriesTarget: SeriesTarget{ApplyTo: ApplyToThis, OccurrenceDate: &missing}}); !errors.Is(err, ErrOccurrenceNotFound) {
+		t.Errorf("RemoveEventFunc missing occurrence = %v, expected %v", err, ErrOccurrenceNotFound)
+	}
+
+	events, err := scope.MonthEventsFunc(1, series.Date.date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"2023-07-03", "2023-07-11", "2023-07-24"}
+	if got := occurrenceDays(events); !reflect.DeepEqual(got, expected) {
+		t.Errorf("MonthEventsFunc = %v, expected %v", got, expected)
+	}
+
+	// Изменение всей серии сохраняет исключения и измененные повторения
+	renamed := newTestEvent(1, 1, "2023-07-03", "daily")
+	if _, err := scope.UpdateEventFunc(renamed, SeriesTarget{}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	events, _ = scope.MonthEventsFunc(1, series.Date.date)
+	if got := occurrenceDays(events); !reflect.DeepEqual(got, expected) {
+		t.Errorf("MonthEventsFunc after series update = %v, expected %v", got, expected)
+	}
+}
+
+func TestICSDuration(t *testing.T) {
+	for _, d := range []time.Duration{0, 15 * time.Minute, -15 * time.Minute, 24 * time.Hour, -(2*24*time.Hour + time.Hour + 30*time.Second)} {
+		if parsed, err := parseICSDuration(formatICSDuration(d)); err != nil || parsed != d {
+			t.Errorf("duration %v formatted as %q is parsed as %v, %v", d, formatICSDuration(d), parsed, err)
+		}
+	}
+	for value, expected := range map[string]time.Duration{"-P1W": -7 * 24 * time.Hour, "+PT1H15M": 75 * time.Minute, "P1DT12H": 36 * time.Hour} {
+		if d, err := parseICSDuration(value); err != nil || d != expected {
+			t.Errorf("parseICSDuration(%q) = %v, %v, expected %v", value, d, err, expected)
+		}
+	}
+	for _, value := range []string{"", "P", "PT", "15M", "P1H", "PT1D", "P1DT", "PT-1M", "P9223372036854775807W", "P5W"} {
+		if _, err := parseICSDuration(value); err == nil {
+			t.Errorf("parseICSDuration(%q) is accepted", value)
+		}
+	}
+}
+
+func TestICSRoundTrip(t *testing.T) {
+	source := CreateScope(NewMemoryRepository())
+	series := newTestEvent(1, 1, "2023-07-03", "standup")
+	series.Description = "daily sync; room 4, floor 2\nbring coffee"
+	series.Tags = []string{"work", "room 4, floor 2"}
+	series.Reminders = []Offset{Offset(15 * time.Minute), Offset(24*time.Hour + 90*time.Minute)}
+	series.Attendees = []Attendee{{UserID: 3}, {UserID: 4}}
+	exdate := Date{date: series.Date.date.AddDate(0, 0, 14)}
+	series.Recurrence = &Recurrence{Freq: FreqWeekly, Interval: 1, ByDay: []string{"MO", "TH"}, Count: 10, ExDates: []Date{exdate}}
+	series.Recurrence.setOverride(Override{
+		RecurrenceID: Date{date: series.Date.date.AddDate(0, 0, 7)},
+		Date:         Date{date: series.Date.date.AddDate(0, 0, 8)},
+		Title:        "moved standup",
+		Description:  "Вторник вместо понедельника, потому что в понедельник праздник и офис закрыт весь день",
+	})
+	single := newTestEvent(1, 2, "2023-07-05", "review")
+	single.Tags = []string{"review;code"}
+	single.Reminders = []Offset{0}
+	for _, e := range []Event{series, single} {
+		if _, err := source.CreateNewEvent(e, WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := source.RespondFunc(3, 1, RSVPAccepted); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	source.ExportICS(rec, httptest.NewRequest(http.MethodGet, "/export.ics?user_id=1", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("ExportICS status = %d, content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, line := range strings.Split(rec.Body.String(), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line is not folded: %q", line)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), "ATTENDEE;PARTSTAT=ACCEPTED:urn:dev11:user:3\r\n") {
+		t.Errorf("export has no attendee answer:\n%s", rec.Body.String())
+	}
+
+	target := CreateScope(NewMemoryRepository())
+	// Ошибка в чужом событии не должна мешать импорту остальных
+	body := strings.Replace(rec.Body.String(), "END:VCALENDAR", "BEGIN:VEVENT\r\nUID:foreign@example.com\r\nSUMMARY:no start\r\nEND:VEVENT\r\nEND:VCALENDAR", 1)
+	rec = httptest.NewRecorder()
+	target.ImportICSEvents(rec, httptest.NewRequest(http.MethodPost, "/import_ics?user_id=1", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ImportICSEvents status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var response struct {
+		Errors []ImportError `json:"errors"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &response)
+	if len(response.Errors) != 1 || response.Errors[0].UID != "foreign@example.com" {
+		t.Errorf("import errors = %+v, expected one error for foreign event", response.Errors)
+	}
+
+	// Тело с типом формы не разбирается как форма: иначе файл был бы прочитан до импорта
+	req := httptest.NewRequest(http.MethodPost, "/import_ics?user_id=2", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	target.ImportICSEvents(rec, req)
+	if events, _ := target.EventRepository.UserEvents(2); rec.Code != http.StatusOK || len(events) == 0 {
+		t.Errorf("import with a form content type = %d %s, events %v", rec.Code, rec.Body.String(), events)
+	}
+
+	expected, _ := source.EventRepository.UserEvents(1)
+	// Ответы участников не импортируются: приглашенные отвечают заново
+	for i := range expected {
+		if len(expected[i].Attendees) > 0 {
+			expected[i].Version = 1
+			expected[i].Attendees = mergeAttendees(nil, expected[i].Attendees)
+		}
+	}
+	imported, _ := target.EventRepository.UserEvents(1)
+	if !reflect.DeepEqual(imported, expected) {
+		t.Errorf("imported events = %+v, expected %+v", imported, expected)
+	}
+
+	// ID из UID не используется: повторный импорт своей выгрузки создает новые события,
+	// а UID с чужим или огромным ID не сдвигает ID хранилища
+	forged := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:9223372036854775807-1@dev11\r\nDTSTART:20230710T090000Z\r\n" +
+		"SUMMARY:forged\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	if _, importErr, err := source.ImportICS(body, 1); err != nil || len(importErr) != 1 {
+		t.Errorf("reimport of own export = %+v, %v", importErr, err)
+	}
+	if _, importErr, err := source.ImportICS(forged, 1); err != nil || len(importErr) != 0 {
+		t.Errorf("import of forged UID = %+v, %v", importErr, err)
+	}
+	next, err := source.CreateNewEvent(newTestEvent(1, 0, "2023-07-20", "next"), WriteOptions{})
+	if events, _ := source.EventRepository.UserEvents(1); err != nil || next.ID != 6 || len(events) != 6 {
+		t.Errorf("event after reimport = %+v, %v, %d events", next, err, len(events))
+	}
+}
+
+func TestTimeZones(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	var event Event
+	input := `{"user_id": 1, "id": 1, "date": "2023-07-04T01:30:00", "end": "2023-07-04T02:30:00",
+		"time_zone": "Europe/Moscow", "title": "night call", "description": "call",
+		"recurrence": {"freq": "daily", "count": 3, "exdates": ["2023-07-05"]}}`
+	if err := json.Unmarshal([]byte(input), &event); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scope.CreateNewEvent(event, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var table = []struct {
+		tz, date string
+		expected []string
+	}{
+		{tz: "Europe/Moscow", date: "2023-07-03", expected: []string{}},
+		{tz: "Europe/Moscow", date: "2023-07-04", expected: []string{"2023-07-04T01:30:00+03:00"}},
+		{tz: "Europe/Moscow", date: "2023-07-05", expected: []string{}},
+		{tz: "UTC", date: "2023-07-03", expected: []string{"2023-07-04T01:30:00+03:00"}},
+		{tz: "UTC", date: "2023-07-05", expected: []string{"2023-07-06T01:30:00+03:00"}},
+	}
+	for _, test := range table {
+		req := httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1&date="+test.date+"&tz="+test.tz, nil)
+		rec := httptest.NewRecorder()
+		scope.DayEvents(rec, req)
+		var response struct {
+			Events []struct {
+				Date string `json:"date"`
+				End  string `json:"end"`
+			} `json:"events"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, e := range response.Events {
+			got = append(got, e.Date)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("events_for_day %s %s = %v, expected %v", test.date, test.tz, got, test.expected)
+		}
+	}
+
+	// Выгрузка и загрузка сохраняют часовой пояс и время
+	rec := httptest.NewRecorder()
+	scope.ExportICS(rec, httptest.NewRequest(http.MethodGet, "/export.ics?user_id=1", nil))
+	if !strings.Contains(rec.Body.String(), "DTSTART;TZID=Europe/Moscow:20230704T013000") {
+		t.Errorf("export has no zoned DTSTART:\n%s", rec.Body.String())
+	}
+	target := CreateScope(NewMemoryRepository())
+	if _, importErr, err := target.ImportICS(rec.Body.String(), 1); err != nil || len(importErr) != 0 {
+		t.Fatalf("ImportICS = %v, %v", importErr, err)
+	}
+	expected, _ := scope.EventRepository.Get(1, 1)
+	imported, _ := target.EventRepository.Get(1, 1)
+	if !imported.Date.date.Equal(expected.Date.date) || !imported.End.date.Equal(expected.End.date) ||
+		imported.TimeZone != expected.TimeZone || !imported.Recurrence.ExDates[0].date.Equal(expected.Recurrence.ExDates[0].date) {
+		t.Errorf("imported event = %+v, expected %+v", imported, expected)
+	}
+
+	invalid := newTestEvent(1, 2, "2023-07-04", "broken")
+	invalid.End = Date{date: invalid.Date.date.Add(-time.Hour)}
+	if _, err := scope.CreateNewEvent(invalid, WriteOptions{}); !errors.Is(err, ErrEndBeforeStart) {
+		t.Errorf("CreateNewEvent with end before start = %v, expected %v", err, ErrEndBeforeStart)
+	}
+}
+
+// newTimedEvent создает событие в UTC с началом start (RFC 3339) и заданной длительностью
+func newTimedEvent(userID, id int, start string, duration time.Duration) Event {
+	t, _ := time.Parse(time.RFC3339, start)
+	return Event{UserID: userID, ID: id, Date: Date{date: t}, End: Date{date: t.Add(duration)}, Title: "meeting", Description: "meeting"}
+}
+
+func TestRejectOverlaps(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	reject := WriteOptions{RejectOverlaps: true}
+	standup := newTimedEvent(1, 1, "2023-07-03T10:00:00Z", 30*time.Minute)
+	standup.Recurrence = &Recurrence{Freq: FreqDaily}
+	if _, err := scope.CreateNewEvent(standup, reject); err != nil {
+		t.Fatal(err)
+	}
+
+	var table = []struct {
+		event    Event
+		opts     WriteOptions
+		conflict bool
+	}{
+		{event: newTimedEvent(1, 2, "2023-08-10T10:15:00Z", time.Hour), opts: reject, conflict: true},
+		{event: newTimedEvent(1, 3, "2023-08-10T10:30:00Z", time.Hour), opts: reject, conflict: false},
+		{event: newTimedEvent(1, 4, "2023-08-10T11:00:00Z", time.Hour), opts: reject, conflict: true},
+		{event: newTimedEvent(1, 5, "2023-08-10T11:00:00Z", time.Hour), opts: WriteOptions{}, conflict: false},
+		{event: newTimedEvent(2, 8, "2023-08-10T10:00:00Z", time.Hour), opts: reject, conflict: false},
+		{event: newTimedEvent(1, 6, "2023-08-10T10:00:00Z", 0), opts: reject, conflict: false},
+	}
+	for _, test := range table {
+		_, err := scope.CreateNewEvent(test.event, test.opts)
+		if test.conflict && !errors.Is(err, ErrOverlap) || !test.conflict && err != nil {
+			t.Errorf("CreateNewEvent(%d/%d) = %v, conflict expected: %v", test.event.UserID, test.event.ID, err, test.conflict)
+		}
+	}
+
+	// Перенос события само на себя не конфликтует, а на время стендапа - конфликтует
+	moved := newTimedEvent(1, 3, "2023-08-10T10:30:00Z", 30*time.Minute)
+	if _, err := scope.UpdateEventFunc(moved, SeriesTarget{}, reject); err != nil {
+		t.Errorf("UpdateEventFunc without conflict = %v", err)
+	}
+	moved = newTimedEvent(1, 3, "2023-08-11T09:45:00Z", 30*time.Minute)
+	if _, err := scope.UpdateEventFunc(moved, SeriesTarget{}, reject); !errors.Is(err, ErrOverlap) {
+		t.Errorf("UpdateEventFunc with conflict = %v, expected %v", err, ErrOverlap)
+	}
+
+	body := `{"user_id": 1, "id": 7, "date": "2023-08-12T10:00:00Z", "end": "2023-08-12T11:00:00Z",
+		"title": "t", "description": "d", "reject_overlaps": true}`
+	rec := httptest.NewRecorder()
+	scope.CreateEvent(rec, httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(body)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("create_event with overlap status = %d, expected %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// Параллельные создания пересекающихся событий: проверка и запись выполняются в одной транзакции,
+// поэтому сохраняется ровно одно событие
+func TestRejectOverlapsParallel(t *testing.T) {
+	repos := repositories()
+	file, err := NewFileRepository(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	repos["file"] = file
+
+	for name, repo := range repos {
+		t.Run(name, func(t *testing.T) {
+			svc := NewCalendarService(repo, Logger{})
+			const rounds, writers = 20, 8
+			// Каждый раунд пишет события своего пользователя, все писатели раунда стартуют одновременно
+			for userID := 1; userID <= rounds; userID++ {
+				var wg sync.WaitGroup
+				var created atomic.Int32
+				ready := make(chan struct{})
+				for ind := 0; ind < writers; ind++ {
+					wg.Add(1)
+					go func(ind int) {
+						defer wg.Done()
+						<-ready
+						start := fmt.Sprintf("2023-07-03T10:%02d:00Z", ind)
+						_, err := svc.CreateNewEvent(newTimedEvent(userID, 0, start, time.Hour), WriteOptions{RejectOverlaps: true})
+						switch {
+						case err == nil:
+							created.Add(1)
+						case !errors.Is(err, ErrOverlap):
+							t.Errorf("CreateNewEvent = %v", err)
+						}
+					}(ind)
+				}
+				close(ready)
+				wg.Wait()
+				events, _ := repo.UserEvents(userID)
+				if created.Load() != 1 || len(events) != 1 {
+					t.Fatalf("user %d: created %d events, stored %d, expected 1", userID, created.Load(), len(events))
+				}
+			}
+		})
+	}
+}
+
+func TestFreeBusy(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	for _, e := range []Event{
+		newTimedEvent(1, 1, "2023-07-03T09:00:00Z", time.Hour),
+		newTimedEvent(1, 2, "2023-07-03T09:30:00Z", time.Hour),
+		newTimedEvent(1, 3, "2023-07-03T13:00:00Z", time.Hour),
+		newTimedEvent(1, 4, "2023-07-03T16:30:00Z", 2*time.Hour),
+		newTimedEvent(1, 5, "2023-07-03T12:00:00Z", 0),
+	} {
+		if _, err := scope.CreateNewEvent(e, WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	scope.FreeBusyEvents(rec, httptest.NewRequest(http.MethodGet,
+		"/free_busy?user_id=1&from=2023-07-03T08:00:00Z&to=2023-07-03T17:00:00Z", nil))
+	var response struct {
+		Busy []map[string]string `json:"busy"`
+		Free []map[string]string `json:"free"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	expectedBusy := []map[string]string{
+		{"start": "2023-07-03T09:00:00Z", "end": "2023-07-03T10:30:00Z"},
+		{"start": "2023-07-03T13:00:00Z", "end": "2023-07-03T14:00:00Z"},
+		{"start": "2023-07-03T16:30:00Z", "end": "2023-07-03T17:00:00Z"},
+	}
+	expectedFree := []map[string]string{
+		{"start": "2023-07-03T08:00:00Z", "end": "2023-07-03T09:00:00Z"},
+		{"start": "2023-07-03T10:30:00Z", "end": "2023-07-03T13:00:00Z"},
+		{"start": "2023-07-03T14:00:00Z", "end": "2023-07-03T16:30:00Z"},
+	}
+	if !reflect.DeepEqual(response.Busy, expectedBusy) || !reflect.DeepEqual(response.Free, expectedFree) {
+		t.Errorf("free_busy = %+v / %+v, expected %+v / %+v", response.Busy, response.Free, expectedBusy, expectedFree)
+	}
+
+	rec = httptest.NewRecorder()
+	scope.FreeBusyEvents(rec, httptest.NewRequest(http.MethodGet, "/free_busy?user_id=1&from=2023-07-04&to=2023-07-03", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("free_busy with to before from status = %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIntervalIndexMatchesScan(t *testing.T) {
+	repo := NewMemoryRepository()
+	var all []Event
+	base, _ := time.Parse(time.RFC3339, "2023-01-01T00:00:00Z")
+	for id := 1; id <= 2000; id++ {
+		start := base.Add(time.Duration(id*37%5000) * time.Hour)
+		e := Event{UserID: 1, ID: id, Date: Date{date: start}, End: Date{date: start.Add(time.Duration(id%50) * time.Hour)}}
+		all = append(all, e)
+		_, _ = repo.Create(e)
+	}
+	for id := 1; id <= 2000; id += 3 {
+		_ = repo.Delete(ConcreteEvent{UserID: 1, ID: id})
+	}
+
+	from, to := base.Add(1000*time.Hour), base.Add(1100*time.Hour)
+	expected := map[int]bool{}
+	for _, e := range all {
+		if e.ID%3 != 1 && e.overlaps(from, to) {
+			expected[e.ID] = true
+		}
+	}
+	found, _ := repo.Overlapping(1, from, to)
+	got := map[int]bool{}
+	for _, e := range found {
+		got[e.ID] = true
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Overlapping found %d events, expected %d", len(got), len(expected))
+	}
+
+	// После удаления самых длинных событий отсечение по длительности снова сужается
+	for id := 1; id <= 2000; id++ {
+		if id%50 >= 10 {
+			_ = repo.Delete(ConcreteEvent{UserID: 1, ID: id})
+		}
+	}
+	if d := repo.index[1].maxDuration; d != 9*time.Hour {
+		t.Errorf("maxDuration after delete = %v, expected %v", d, 9*time.Hour)
+	}
+}
+
+func TestServerIDsAndVersions(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := CreateScope(repo)
+
+	body := `{"user_id": 1, "id": 100, "date": "2023-07-03", "title": "standup", "description": "sync"}`
+	var ids []int
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		scope.CreateEvent(rec, httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(body)))
+		var response struct {
+			Events []struct {
+				ID      int `json:"id"`
+				Version int `json:"version"`
+			} `json:"events"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || len(response.Events) != 1 {
+			t.Fatalf("create_event response = %s", rec.Body.String())
+		}
+		if response.Events[0].Version != 1 {
+			t.Errorf("new event version = %d, expected 1", response.Events[0].Version)
+		}
+		ids = append(ids, response.Events[0].ID)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("allocated ids = %v, expected [1 2 3]", ids)
+	}
+
+	update := newTestEvent(1, 1, "2023-07-04", "moved")
+	if _, err := scope.UpdateEventFunc(update, SeriesTarget{}, WriteOptions{ExpectedVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scope.UpdateEventFunc(update, SeriesTarget{}, WriteOptions{ExpectedVersion: 1}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("stale update = %v, expected %v", err, ErrVersionConflict)
+	}
+	rec := httptest.NewRecorder()
+	scope.RemoveEvent(rec, httptest.NewRequest(http.MethodPost, "/delete_event",
+		strings.NewReader(`{"user_id": 1, "id": 1, "expected_version": 1}`)))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "version conflict") {
+		t.Errorf("stale delete = %d %s", rec.Code, rec.Body.String())
+	}
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: 1, ExpectedVersion: 2}); err != nil {
+		t.Errorf("delete with current version = %v", err)
+	}
+
+	// После удаления последнего события и перезапуска ID не выдаются повторно
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	created, err := restored.Create(newTestEvent(1, 0, "2023-07-05", "new"))
+	if err != nil || created.ID != 4 {
+		t.Errorf("Create after restart = %d, %v, expected id 4", created.ID, err)
+	}
+}
+
+func TestFormRequestsAndFieldErrors(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	post := func(handler http.HandlerFunc, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	const form = "application/x-www-form-urlencoded"
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	rec := post(scope.CreateEvent, form,
+		"user_id=1&date=2023-07-03T10:00:00&end=2023-07-03T11:00:00&time_zone=Europe/Moscow&title=standup&description=sync&rrule=FREQ%3DDAILY%3BCOUNT%3D3&exdates=2023-07-04")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("form create = %d %s", rec.Code, rec.Body.String())
+	}
+	event, err := scope.EventRepository.Get(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := occurrenceDays(event.Occurrences(day("2023-07-01"), day("2023-07-10"))); !reflect.DeepEqual(got, []string{"2023-07-03", "2023-07-05"}) {
+		t.Errorf("form event occurrences = %v", got)
+	}
+	if event.Date.date.Format(time.RFC3339) != "2023-07-03T10:00:00+03:00" {
+		t.Errorf("form event date = %v", event.Date)
+	}
+
+	rec = post(scope.UpdateEvent, "application/json; charset=utf-8",
+		`{"user_id": 1, "id": 1, "date": "2023-07-03", "title": "retro", "description": "sync", "expected_version": 1}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("json update = %d %s", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		contentType string
+		body        string
+		fields      map[string]string
+	}{
+		{"missing fields", scope.CreateEvent, form, "user_id=1&date=2023-07-03",
+			map[string]string{"title": "required", "description": "required"}},
+		{"bad form values", scope.CreateEvent, form, "user_id=x&date=03.07.2023&title=a&description=b&reject_overlaps=maybe",
+			map[string]string{"user_id": "must be an integer", "date": dateFieldMessage, "reject_overlaps": "must be a boolean"}},
+		{"json types", scope.CreateEvent, "application/json", `{"user_id": "1", "date": "2023-07-03", "title": "a", "description": "b"}`,
+			map[string]string{"user_id": "must be int"}},
+		{"json date", scope.CreateEvent, "", `{"user_id": 1, "date": "tomorrow", "title": "a", "description": "b"}`,
+			map[string]string{"date": dateFieldMessage}},
+		{"end before start", scope.CreateEvent, form, "user_id=1&date=2023-07-03T10:00:00&end=2023-07-03T09:00:00&title=a&description=b",
+			map[string]string{"end": "must not be before date"}},
+		{"update without id", scope.UpdateEvent, form, "user_id=1&date=2023-07-03&title=a&description=b&time_zone=Mars/Base",
+			map[string]string{"id": "must be a positive integer", "time_zone": "unknown time zone"}},
+		{"delete occurrence", scope.RemoveEvent, form, "user_id=1&id=1&scope=this",
+			map[string]string{"occurrence_date": "required when scope is this"}},
+	}
+	for _, test := range tests {
+		rec := post(test.handler, test.contentType, test.body)
+		var response struct {
+			Error  string            `json:"error"`
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: response %s", test.name, rec.Body.String())
+		}
+		if rec.Code != http.StatusBadRequest || response.Error == "" || !reflect.DeepEqual(response.Fields, test.fields) {
+			t.Errorf("%s = %d %s, expected fields %v", test.name, rec.Code, rec.Body.String(), test.fields)
+		}
+	}
+
+	rec = post(scope.RemoveEvent, form, "user_id=1&id=1&scope=this&occurrence_date=2023-07-05")
+	if rec.Code != http.StatusOK {
+		t.Errorf("form delete occurrence = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calendar.yaml")
+	file := "# calendar\nport: 9000\nread_timeout: 3s\nlog_level: \"debug\"\nstorage: file\nstorage_dir: /var/lib/calendar\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONFIG": path, "READ_TIMEOUT": "4s", "IDLE_TIMEOUT": "1m"}
+	cfg, err := loadConfig([]string{"-idle-timeout", "90s", "-addr", ":7000"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultConfig()
+	expected.Addr = ":7000"
+	expected.ReadTimeout = 4 * time.Second
+	expected.IdleTimeout = 90 * time.Second
+	expected.LogLevel = LevelDebug
+	expected.Storage = "file"
+	expected.StorageDir = "/var/lib/calendar"
+	if cfg != expected {
+		t.Errorf("config = %+v, expected %+v", cfg, expected)
+	}
+
+	jsonPath := filepath.Join(t.TempDir(), "calendar.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"listen_addr": "127.0.0.1:8000", "snapshot_interval": "0s"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfig([]string{"-config", jsonPath}, func(string) string { return "" })
+	if err != nil || cfg.Addr != "127.0.0.1:8000" || cfg.SnapshotInterval != 0 {
+		t.Errorf("json config = %+v, %v", cfg, err)
+	}
+
+	cfg, err = loadConfig([]string{"-rate-limit", "0.5", "-rate-burst", "3", "-max-body-bytes", "4096"}, func(string) string { return "" })
+	if err != nil || cfg.RateLimit != 0.5 || cfg.RateBurst != 3 || cfg.MaxBodyBytes != 4096 {
+		t.Errorf("limits config = %+v, %v", cfg, err)
+	}
+
+	bad := []struct {
+		args []string
+		env  map[string]string
+	}{
+		{[]string{"-storage", "redis"}, nil},
+		{nil, map[string]string{"WRITE_TIMEOUT": "soon"}},
+		{nil, map[string]string{"LOG_LEVEL": "loud"}},
+		{[]string{"-config", path, "-read-timeout", "-1s"}, nil},
+		{[]string{"-rate-limit", "-5"}, nil},
+		{nil, map[string]string{"MAX_BODY_BYTES": "0"}},
+		{[]string{"-trash-purge-interval", "0s"}, nil},
+		{[]string{"-storage-stripes", "0"}, nil},
+		{[]string{"-webhook-backoff", "0s"}, nil},
+		{[]string{"-webhook-max-attempts", "1000000"}, nil},
+		{[]string{"-rpc-addr", "9090"}, nil},
+	}
+	for _, test := range bad {
+		if _, err := loadConfig(test.args, func(key string) string { return test.env[key] }); err == nil {
+			t.Errorf("loadConfig(%v, %v) expected error", test.args, test.env)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := CreateScope(repo)
+	scope.routes()
+	started := make(chan struct{})
+	scope.srv.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		scope.CreateEvent(w, r)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- scope.serve(ctx, ln, defaultConfig())
+	}()
+
+	resCh := make(chan *http.Response, 1)
+	go func() {
+		body := `{"user_id": 1, "date": "2023-07-03", "title": "standup", "description": "sync"}`
+		res, err := http.Post("http://"+ln.Addr().String()+"/slow", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		resCh <- res
+	}()
+	<-started
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("serve = %v", err)
+	}
+	if res := <-resCh; res == nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("in-flight request was not drained: %v", res)
+	} else {
+		res.Body.Close()
+	}
+	if _, err := http.Get("http://" + ln.Addr().String() + "/events_for_day"); err == nil {
+		t.Error("server accepts connections after shutdown")
+	}
+
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if events, _ := restored.UserEvents(1); len(events) != 1 {
+		t.Errorf("restored events = %v, expected the event created during shutdown", events)
+	}
+}
+
+func TestShutdownTimeoutWaitsForHandlers(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.routes()
+	started := make(chan struct{})
+	var finished atomic.Bool
+	scope.srv.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		finished.Store(true)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- scope.serve(ctx, ln, cfg)
+	}()
+	go func() {
+		if res, err := http.Get("http://" + ln.Addr().String() + "/slow"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+
+	// Хранилище закрывается после serve, поэтому serve не должен вернуться раньше обработчика
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) || !finished.Load() {
+		t.Errorf("serve = %v, handler finished %v", err, finished.Load())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(&logs, "", 0)
+	scope.routes()
+	scope.srv.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	handler := scope.Handler()
+	if _, err := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-03", "standup"), WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", nil)
+	req.Header.Set("X-Request-ID", "client-id-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Request-ID") != "client-id-1" {
+		t.Errorf("events_for_day = %d, request id %q", rec.Code, rec.Header().Get("X-Request-ID"))
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/panic", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("panic = %d %s", rec.Code, rec.Body.String())
+	}
+	generated := rec.Header().Get("X-Request-ID")
+	if len(generated) != 32 {
+		t.Errorf("generated request id = %q", generated)
+	}
+
+	var entries []requestLogEntry
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var entry requestLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("log = %s, expected 2 JSON lines", logs.String())
+	}
+	first, second := entries[0], entries[1]
+	if first.RequestID != "client-id-1" || first.Method != http.MethodGet || first.Path != "/events_for_day" ||
+		first.Status != http.StatusOK || first.Size == 0 || first.Level != "info" {
+		t.Errorf("first log entry = %+v", first)
+	}
+	if second.RequestID != generated || second.Status != http.StatusInternalServerError || second.Level != "error" {
+		t.Errorf("second log entry = %+v", second)
+	}
+	if !strings.Contains(logs.String(), "panic: boom") {
+		t.Errorf("log = %s, expected panic message", logs.String())
+	}
+}
+
+func TestAuth(t *testing.T) {
+	hash := func(password string) string {
+		h, err := hashPassword(password, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	users, err := NewUserStore([]User{
+		{ID: 1, Name: "alice", PasswordHash: hash("wonderland")},
+		{ID: 2, Name: "bob", PasswordHash: hash("builder")},
+		{ID: 3, Name: "root", Role: RoleAdmin, PasswordHash: hash("toor")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.auth = NewAuthenticator(users, []byte("secret"), time.Hour)
+	scope.routes()
+	handler := scope.Handler()
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" && !strings.HasPrefix(body, "{") {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(name, password string) string {
+		rec := do(http.MethodPost, "/login", "", "username="+name+"&password="+password)
+		var response struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("login %s = %d %s", name, rec.Code, rec.Body.String())
+		}
+		return response.Token
+	}
+
+	if rec := do(http.MethodPost, "/login", "", `{"username": "alice", "password": "queen"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password = %d %s", rec.Code, rec.Body.String())
+	}
+	alice, bob, root := login("alice", "wonderland"), login("bob", "builder"), login("root", "toor")
+
+	const event = "user_id=1&date=2023-07-03&title=standup&description=sync"
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", http.MethodPost, "/create_event", "", event, http.StatusUnauthorized},
+		{"forged token", http.MethodPost, "/create_event", alice + "x", event, http.StatusUnauthorized},
+		{"own event", http.MethodPost, "/create_event", alice, event, http.StatusCreated},
+		{"another user's event", http.MethodPost, "/create_event", bob, event, http.StatusForbidden},
+		{"another user's day", http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", bob, "", http.StatusForbidden},
+		{"another user's export", http.MethodGet, "/export.ics?user_id=1", bob, "", http.StatusForbidden},
+		{"another user's delete", http.MethodPost, "/delete_event", bob, "user_id=1&id=1", http.StatusForbidden},
+		{"metrics without admin role", http.MethodGet, "/metrics", alice, "", http.StatusForbidden},
+		{"own day", http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", alice, "", http.StatusOK},
+		{"admin reads", http.MethodGet, "/free_busy?user_id=1&from=2023-07-03&to=2023-07-04", root, "", http.StatusOK},
+		{"admin deletes", http.MethodPost, "/delete_event", root, "user_id=1&id=1", http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := do(test.method, test.target, test.token, test.body)
+		if rec.Code != test.status || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+			t.Errorf("%s = %d %s, expected %d", test.name, rec.Code, rec.Body.String(), test.status)
+		}
+	}
+
+	scope.auth.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := scope.auth.Verify(alice); !errors.Is(err, ErrBadToken) {
+		t.Errorf("expired token = %v, expected %v", err, ErrBadToken)
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	logger := Logger{Logger: log.New(io.Discard, "", 0)}
+	cfg := defaultConfig()
+	cfg.UsersFile = filepath.Join(t.TempDir(), cfg.UsersFile)
+	if _, err := newAuthenticator(cfg, logger); err == nil {
+		t.Error("newAuthenticator with a missing configured users file succeeded")
+	}
+
+	// Без файла пользователей по умолчанию сервер запускается без аутентификации
+	t.Chdir(t.TempDir())
+	if auth, err := newAuthenticator(defaultConfig(), logger); auth != nil || err != nil {
+		t.Errorf("newAuthenticator without default users file = %v, %v, expected nil, nil", auth, err)
+	}
+}
+
+func TestInvitations(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	post := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	day := func(userID int) []Event {
+		events, err := scope.DayEventsFunc(userID, time.Date(2023, 7, 3, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("events of user %d: %v", userID, err)
+		}
+		return events
+	}
+
+	rec := post(scope.CreateEvent, "user_id=1&date=2023-07-03T10:00:00&end=2023-07-03T11:00:00&title=planning&description=q3&attendees=2")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(scope.InviteEvent, "user_id=1&id=1&attendees=2,3"); rec.Code != http.StatusOK {
+		t.Fatalf("invite = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(scope.InviteEvent, "user_id=1&id=1&attendees=1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invite organizer = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(scope.RespondEvent, "user_id=2&id=1&status=accept"); rec.Code != http.StatusOK {
+		t.Fatalf("respond = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(scope.RespondEvent, "user_id=3&id=1&status=decline"); rec.Code != http.StatusOK {
+		t.Fatalf("respond = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(scope.RespondEvent, "user_id=4&id=1&status=accept"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("respond without invitation = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(scope.RespondEvent, "user_id=2&id=1&status=maybe"); rec.Code != http.StatusBadRequest {
+		t.Errorf("respond with unknown status = %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Изменение организатора видно участникам, их ответы сохраняются
+	update := newTimedEvent(1, 1, "2023-07-03T14:00:00Z", time.Hour)
+	update.Title = "planning moved"
+	if _, err := scope.UpdateEventFunc(update, SeriesTarget{}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for userID, expected := range map[int]string{1: "", 2: RSVPAccepted, 3: RSVPDeclined} {
+		events := day(userID)
+		if len(events) != 1 || events[0].Title != "planning moved" || events[0].RSVP != expected {
+			t.Errorf("events of user %d = %+v, expected rsvp %q", userID, events, expected)
+		}
+	}
+
+	_, free, err := scope.FreeBusy(3, time.Date(2023, 7, 3, 0, 0, 0, 0, time.UTC), time.Date(2023, 7, 4, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(free) != 1 {
+		t.Errorf("declined invitation blocks time: free = %v, %v", free, err)
+	}
+	if _, err := scope.CreateNewEvent(newTimedEvent(2, 0, "2023-07-03T14:30:00Z", time.Hour), WriteOptions{RejectOverlaps: true}); !errors.Is(err, ErrOverlap) {
+		t.Errorf("overlap with accepted invitation = %v, expected %v", err, ErrOverlap)
+	}
+
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if invited, _ := scope.EventRepository.Invited(2); len(invited) != 0 {
+		t.Errorf("invitations after delete = %v", invited)
+	}
+}
+
+// fakeClock - часы, которые двигает тест
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+func TestReminders(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "reminders.json")
+	repo := NewMemoryRepository()
+	scope := CreateScope(repo)
+	clock := &fakeClock{now: time.Date(2023, 7, 3, 8, 50, 0, 0, time.UTC)}
+	sink := make(ChannelSink, 10)
+	logger := Logger{Logger: log.New(io.Discard, "", 0)}
+	newScheduler := func() *ReminderScheduler {
+		s, err := NewReminderScheduler(repo, clock, logger, statePath, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	received := func() []Notification {
+		var res []Notification
+		for {
+			select {
+			case n := <-sink:
+				res = append(res, n)
+			default:
+				return res
+			}
+		}
+	}
+
+	scope.reminders = newScheduler()
+	event := newTimedEvent(1, 0, "2023-07-03T10:00:00Z", time.Hour)
+	event.Reminders = []Offset{Offset(15 * time.Minute), Offset(time.Hour)}
+	event.Attendees = []Attendee{{UserID: 2}}
+	event, err := scope.CreateNewEvent(event, WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := scope.reminders.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10*time.Minute + time.Second)
+	if _, err := scope.reminders.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(); len(got) != 2 || got[0].Before != Offset(time.Hour) || got[0].UserID != 1 || got[1].UserID != 2 {
+		t.Errorf("9:00 reminders = %+v", got)
+	}
+	clock.Advance(44 * time.Minute)
+	next, err := scope.reminders.RunDue(context.Background())
+	if err != nil || !next.Equal(time.Date(2023, 7, 3, 9, 45, 0, 0, time.UTC)) {
+		t.Errorf("next reminder = %v, %v, expected 9:45", next, err)
+	}
+
+	// Перенос события пересчитывает напоминания, после перезапуска они не повторяются
+	event.Date = Date{date: time.Date(2023, 7, 3, 11, 30, 0, 0, time.UTC)}
+	event.End = Date{date: time.Date(2023, 7, 3, 12, 30, 0, 0, time.UTC)}
+	if _, err := scope.UpdateEventFunc(event, SeriesTarget{}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scope.RespondFunc(2, event.ID, RSVPDeclined); err != nil {
+		t.Fatal(err)
+	}
+	scope.reminders = newScheduler()
+	clock.Advance(5 * time.Minute)
+	if _, err := scope.reminders.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(); len(got) != 0 {
+		t.Errorf("9:49 reminders = %+v, expected none after moving the event", got)
+	}
+
+	// Фоновый планировщик просыпается по часам и доставляет напоминание за час в 10:30
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scope.reminders.Run(ctx)
+		close(done)
+	}()
+	deadline := time.After(5 * time.Second)
+	var got []Notification
+	for len(got) == 0 {
+		select {
+		case n := <-sink:
+			got = append(got, n)
+		case <-deadline:
+			t.Fatal("background scheduler did not deliver the reminder")
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Minute)
+		}
+	}
+	cancel()
+	<-done
+	if n := got[0]; n.UserID != 1 || n.Before != Offset(time.Hour) || !n.FireAt.Equal(time.Date(2023, 7, 3, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("background reminder = %+v", n)
+	}
+	if extra := received(); len(extra) != 0 {
+		t.Errorf("reminders to the declined attendee = %+v", extra)
+	}
+
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: event.ID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.routes()
+	server := httptest.NewServer(scope.Handler())
+	defer server.Close()
+
+	type message struct {
+		id, event string
+		change    ChangeEvent
+	}
+	subscribe := func(lastEventID string) (<-chan message, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/subscribe?user_id=2", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("subscribe = %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		messages := make(chan message, 10)
+		go func() {
+			defer close(messages)
+			defer res.Body.Close()
+			scanner := bufio.NewScanner(res.Body)
+			var m message
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "id: "):
+					m.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					m.event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m.change)
+				case line == "" && m.event != "":
+					messages <- m
+					m = message{}
+				}
+			}
+		}()
+		return messages, cancel
+	}
+	next := func(messages <-chan message) message {
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from /subscribe")
+			return message{}
+		}
+	}
+
+	messages, cancel := subscribe("")
+	// Подписчик 2 получает изменения событий, на которые приглашен, но не чужие события
+	if _, err := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-03", "private"), WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	shared := newTestEvent(1, 0, "2023-07-03", "shared")
+	shared.Attendees = []Attendee{{UserID: 2}}
+	shared, err := scope.CreateNewEvent(shared, WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := next(messages)
+	if created.event != ChangeCreate || created.change.Event.ID != shared.ID || created.change.Event.RSVP != RSVPNeedsAction {
+		t.Errorf("create message = %+v", created)
+	}
+	cancel()
+
+	// Изменения, сделанные без подписки, приходят после переподключения с Last-Event-ID
+	if _, err := scope.RespondFunc(2, shared.ID, RSVPAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: shared.ID}); err != nil {
+		t.Fatal(err)
+	}
+	messages, cancel = subscribe(created.id)
+	defer cancel()
+	if m := next(messages); m.event != ChangeUpdate || m.change.Event.RSVP != RSVPAccepted {
+		t.Errorf("resumed update = %+v", m)
+	}
+	if m := next(messages); m.event != ChangeDelete || m.change.Event.ID != shared.ID {
+		t.Errorf("resumed delete = %+v", m)
+	}
+
+	if !strings.HasPrefix(created.id, scope.broker.epoch+"-") {
+		t.Errorf("event id = %q, expected epoch %q", created.id, scope.broker.epoch)
+	}
+
+	// Идентификаторы из прошлого запуска нельзя продолжить, даже если номер еще не выдан заново
+	for _, id := range []string{"100000", "1", "0badc0de-1"} {
+		stale, staleCancel := subscribe(id)
+		if m := next(stale); m.event != ChangeReset {
+			t.Errorf("stale Last-Event-ID %q message = %+v, expected reset", id, m)
+		}
+		staleCancel()
+	}
+}
+
+func TestBrokerRestart(t *testing.T) {
+	before := NewBroker()
+	before.Publish(ChangeCreate, Event{UserID: 1, ID: 1})
+	sub, _, _ := before.Subscribe(1, "")
+	before.Publish(ChangeCreate, Event{UserID: 1, ID: 2})
+	lastID := (<-sub.C).ID
+
+	// После перезапуска номера начинаются заново, и номер lastID уже выдан другому изменению
+	after := NewBroker()
+	for i := 1; i <= 3; i++ {
+		after.Publish(ChangeUpdate, Event{UserID: 1, ID: i})
+	}
+	if _, missed, complete := after.Subscribe(1, lastID); complete || len(missed) != 0 {
+		t.Errorf("resume with id %q of another run: complete = %v, missed %+v", lastID, complete, missed)
+	}
+	if _, missed, complete := after.Subscribe(1, after.eventID(2)); !complete || len(missed) != 1 || missed[0].Event.ID != 3 {
+		t.Errorf("resume within the run: complete = %v, missed %+v", complete, missed)
+	}
+}
+
+func TestBrokerSlowSubscriber(t *testing.T) {
+	broker := NewBroker()
+	slow, _, _ := broker.Subscribe(1, "")
+	fast, _, _ := broker.Subscribe(1, "")
+	var received int
+	done := make(chan struct{})
+	go func() {
+		for range fast.C {
+			received++
+		}
+		close(done)
+	}()
+
+	for i := 1; i <= subscriberBuffer*2; i++ {
+		broker.Publish(ChangeCreate, Event{UserID: 1, ID: i})
+	}
+	if _, ok := <-slow.C; !ok {
+		t.Fatal("slow subscriber lost buffered changes")
+	}
+	for range slow.C {
+	}
+	if !slow.Lagged() {
+		t.Error("slow subscriber was not disconnected")
+	}
+	_, missed, complete := broker.Subscribe(1, broker.eventID(subscriberBuffer))
+	if !complete || len(missed) != subscriberBuffer || missed[0].Event.ID != subscriberBuffer+1 {
+		t.Errorf("resume after lag: complete = %v, %d missed", complete, len(missed))
+	}
+
+	broker.Close()
+	<-done
+	if received == 0 {
+		t.Error("fast subscriber received nothing")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	create := func(userID int, date, title, description string, tags ...string) Event {
+		e := newTestEvent(userID, 0, date, title)
+		e.Description = description
+		e.Tags = tags
+		created, err := scope.CreateNewEvent(e, WriteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+	standup := create(1, "2023-07-03", "Daily Standup", "Sync with the backend team", "Work", "team")
+	create(1, "2023-07-04", "Dentist", "Checkup", "personal")
+	retro := create(1, "2023-07-10", "Sprint retro", "Team retrospective", "work")
+	shared := create(2, "2023-07-05", "Backend planning", "Quarter goals", "work")
+	create(2, "2023-07-06", "Backend secrets", "Not shared", "work")
+	if _, err := scope.InviteFunc(2, shared.ID, []int{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(params string) ([]int, int) {
+		rec := httptest.NewRecorder()
+		scope.SearchEventsHandler(rec, httptest.NewRequest(http.MethodGet, "/search?user_id=1&"+params, nil))
+		var response struct {
+			Events []Event `json:"events"`
+			Total  int     `json:"total"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("search %s = %d %s", params, rec.Code, rec.Body.String())
+		}
+		ids := []int{}
+		for _, e := range response.Events {
+			ids = append(ids, e.ID)
+		}
+		return ids, response.Total
+	}
+	tests := []struct {
+		params   string
+		expected []int
+	}{
+		{"q=BACKEND", []int{standup.ID, shared.ID}},
+		{"q=team+sync", []int{standup.ID}},
+		{"q=team", []int{standup.ID, retro.ID}},
+		{"tags=work", []int{standup.ID, shared.ID, retro.ID}},
+		{"tags=Work,team", []int{standup.ID}},
+		{"tags=work&from=2023-07-04&to=2023-07-07", []int{shared.ID}},
+		{"q=unknown", []int{}},
+	}
+	for _, test := range tests {
+		if got, _ := search(test.params); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("search %s = %v, expected %v", test.params, got, test.expected)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	scope.SearchEventsHandler(rec, httptest.NewRequest(http.MethodGet, "/search?user_id=1&tags=work&limit=2", nil))
+	var firstPage struct {
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &firstPage); err != nil || firstPage.NextCursor == "" {
+		t.Fatalf("first page = %s", rec.Body.String())
+	}
+	if got, total := search("tags=work&limit=2&cursor=" + firstPage.NextCursor); !reflect.DeepEqual(got, []int{retro.ID}) || total != 3 {
+		t.Errorf("second page = %v of %d", got, total)
+	}
+
+	// Индекс обновляется при изменении и удалении событий
+	retro.Title, retro.Tags = "Sprint review", []string{"demo"}
+	if _, err := scope.UpdateEventFunc(retro, SeriesTarget{}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := scope.RemoveEventFunc(ConcreteEvent{UserID: 1, ID: standup.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := search("q=retro"); len(got) != 0 {
+		t.Errorf("search for the old title = %v", got)
+	}
+	if got, _ := search("q=review&tags=demo"); !reflect.DeepEqual(got, []int{retro.ID}) {
+		t.Errorf("search for the new title = %v", got)
+	}
+	if got, _ := search("tags=team"); !reflect.DeepEqual(got, []int{}) {
+		t.Errorf("search for a deleted event = %v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	scope.SearchEventsHandler(rec, httptest.NewRequest(http.MethodGet, "/search?user_id=1&limit=0&from=soon", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"limit"`) || !strings.Contains(rec.Body.String(), `"from"`) {
+		t.Errorf("bad search params = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	// Ежедневная серия с 1 по 20 июля 2023 (1 июля - суббота) и разовые события
+	series := newTestEvent(1, 0, "2023-07-01", "daily")
+	series.Recurrence = &Recurrence{Freq: FreqDaily, Count: 20}
+	for _, e := range []Event{series, newTestEvent(1, 0, "2023-06-30", "before"), newTestEvent(1, 0, "2023-07-31", "after")} {
+		if _, err := scope.CreateNewEvent(e, WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	// Неделя ISO 8601 со среды 5 июля - с понедельника 3 по воскресенье 9 июля
+	week, err := scope.WeekEventsFunc(1, day("2023-07-05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"2023-07-03", "2023-07-04", "2023-07-05", "2023-07-06", "2023-07-07", "2023-07-08", "2023-07-09"}
+	if got := occurrenceDays(week); !reflect.DeepEqual(got, expected) {
+		t.Errorf("week = %v, expected %v", got, expected)
+	}
+	// Воскресенье относится к неделе, начавшейся в понедельник перед ним
+	if week, _ := scope.WeekEventsFunc(1, day("2023-07-02")); len(week) != 3 {
+		t.Errorf("week of Sunday 2 July = %v, expected 30 June - 2 July", occurrenceDays(week))
+	}
+	if month, _ := scope.MonthEventsFunc(1, day("2023-07-15")); len(month) != 21 {
+		t.Errorf("month = %d events, expected 21", len(month))
+	}
+
+	list := func(target string) ([]string, string) {
+		rec := httptest.NewRecorder()
+		scope.srv = http.NewServeMux()
+		scope.routes()
+		scope.srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var response struct {
+			Events     []Event `json:"events"`
+			NextCursor string  `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s = %d %s", target, rec.Code, rec.Body.String())
+		}
+		var days []string
+		for _, e := range response.Events {
+			days = append(days, e.Date.date.Format("2006-01-02"))
+		}
+		return days, response.NextCursor
+	}
+
+	var pages [][]string
+	target := "/events?user_id=1&from=2023-06-01&to=2023-08-01&limit=8&sort=-start"
+	for cursor := ""; ; {
+		days, next := list(target + cursor)
+		pages = append(pages, days)
+		if next == "" {
+			break
+		}
+		cursor = "&cursor=" + next
+		// Новое событие на уже пройденных страницах не сдвигает следующие страницы
+		if len(pages) == 1 {
+			if _, err := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-30", "late"), WriteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(pages) != 3 || len(pages[0]) != 8 || len(pages[2]) != 6 {
+		t.Fatalf("pages = %v", pages)
+	}
+	if pages[0][0] != "2023-07-31" || pages[1][0] != "2023-07-13" || pages[2][5] != "2023-06-30" {
+		t.Errorf("pages are not ordered by start descending: %v", pages)
+	}
+
+	if days, _ := list("/events_for_day?user_id=1&date=2023-07-30&sort=title"); !reflect.DeepEqual(days, []string{"2023-07-30"}) {
+		t.Errorf("day = %v", days)
+	}
+
+	rec := httptest.NewRecorder()
+	scope.srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events_for_week?user_id=1&date=2023-07-05&sort=color&cursor=xyz", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"sort"`) || !strings.Contains(rec.Body.String(), `"cursor"`) {
+		t.Errorf("bad list params = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEventFormats(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	series := newTestEvent(1, 0, "2023-07-03", "=standup")
+	series.Date.date = series.Date.date.Add(9 * time.Hour)
+	series.End = Date{date: series.Date.date.Add(30 * time.Minute)}
+	series.Recurrence = &Recurrence{Freq: FreqDaily, Count: 5}
+	series.Tags = []string{"=team", "daily"}
+	for _, e := range []Event{series, newTestEvent(1, 0, "2023-07-04", "retro, sprint 5")} {
+		if _, err := scope.CreateNewEvent(e, WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scope.routes()
+	handler := scope.Handler()
+	do := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name, target, accept string
+		status               int
+		contentType          string
+	}{
+		{"default", "/events_for_week?user_id=1&date=2023-07-05", "", http.StatusOK, "application/json"},
+		{"any", "/events_for_week?user_id=1&date=2023-07-05", "*/*", http.StatusOK, "application/json"},
+		{"csv by Accept", "/events_for_week?user_id=1&date=2023-07-05", "text/csv", http.StatusOK, "text/csv"},
+		{"preferred by q", "/events_for_week?user_id=1&date=2023-07-05",
+			"application/json;q=0.5, text/calendar, text/csv;q=0.9", http.StatusOK, "text/calendar"},
+		{"more specific range wins", "/events_for_week?user_id=1&date=2023-07-05",
+			"text/*;q=0.8, text/csv;q=0, */*;q=0.1", http.StatusOK, "text/calendar"},
+		{"format overrides Accept", "/events_for_day?user_id=1&date=2023-07-04&format=csv", "application/json", http.StatusOK, "text/csv"},
+		{"unknown format", "/events_for_month?user_id=1&date=2023-07-04&format=xml", "", http.StatusBadRequest, "application/json"},
+		{"not acceptable", "/events_for_month?user_id=1&date=2023-07-04", "image/png, application/json;q=0", http.StatusNotAcceptable, "application/json"},
+	}
+	for _, test := range tests {
+		rec := do(test.target, test.accept)
+		mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		if rec.Code != test.status || mediaType != test.contentType {
+			t.Errorf("%s = %d %s %s, expected %d %s", test.name, rec.Code, mediaType, rec.Body.String(), test.status, test.contentType)
+		}
+	}
+	if rec := do("/events_for_month?user_id=1&date=2023-07-04&format=xml&date=x", ""); !strings.Contains(rec.Body.String(), `"format"`) {
+		t.Errorf("unknown format = %s", rec.Body.String())
+	}
+
+	// CSV: заголовок, повторения серии и разовое событие; текст, похожий на формулу, экранируется
+	rec := do("/events_for_week?user_id=1&date=2023-07-05&format=csv&limit=3", "")
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || !reflect.DeepEqual(records[0], csvHeader) || rec.Header().Get("X-Next-Cursor") == "" {
+		t.Fatalf("csv = %q, next cursor %q", records, rec.Header().Get("X-Next-Cursor"))
+	}
+	expected := []string{"1", "1", "1", "2023-07-03T09:00:00Z", "2023-07-03T09:30:00Z", "UTC", "'=standup", "'=standup",
+		"2023-07-03T09:00:00Z", "'=team;daily", "", ""}
+	if !reflect.DeepEqual(records[1], expected) || records[2][6] != "retro, sprint 5" {
+		t.Errorf("csv rows = %q", records[1:])
+	}
+
+	// Календарь для подписки: повторения - отдельные VEVENT с RECURRENCE-ID, без RRULE
+	rec = do("/events_for_week?user_id=1&date=2023-07-05", "text/calendar")
+	feed := rec.Body.String()
+	if strings.Count(feed, "BEGIN:VEVENT") != 6 || strings.Count(feed, "RECURRENCE-ID:") != 5 || strings.Contains(feed, "RRULE") ||
+		!strings.Contains(feed, "REFRESH-INTERVAL;VALUE=DURATION:PT1H") || !strings.Contains(rec.Header().Get("Vary"), "Accept") {
+		t.Errorf("feed = %s", feed)
+	}
+
+	// Без limit и cursor календарь и CSV отдаются целиком, а не первой страницей по умолчанию
+	for _, start := range []string{"2023-07-01T09:00:00Z", "2023-07-01T15:00:00Z"} {
+		e := newTimedEvent(2, 0, start, time.Hour)
+		e.Recurrence = &Recurrence{Freq: FreqDaily}
+		if _, err := scope.CreateNewEvent(e, WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec = do("/events_for_month?user_id=2&date=2023-07-01&format=ics", "")
+	if n := strings.Count(rec.Body.String(), "BEGIN:VEVENT"); n != 62 || rec.Header().Get("X-Next-Cursor") != "" {
+		t.Errorf("unpaged feed has %d events, next cursor %q", n, rec.Header().Get("X-Next-Cursor"))
+	}
+	rec = do("/events_for_month?user_id=2&date=2023-07-01&format=csv", "")
+	if records, _ := csv.NewReader(rec.Body).ReadAll(); len(records) != 63 || rec.Header().Get("X-Next-Cursor") != "" {
+		t.Errorf("unpaged csv has %d rows, next cursor %q", len(records), rec.Header().Get("X-Next-Cursor"))
+	}
+	rec = do("/events_for_month?user_id=2&date=2023-07-01&format=ics&limit=10", "")
+	if n := strings.Count(rec.Body.String(), "BEGIN:VEVENT"); n != 10 || rec.Header().Get("X-Next-Cursor") == "" {
+		t.Errorf("feed with limit has %d events, next cursor %q", n, rec.Header().Get("X-Next-Cursor"))
+	}
+	if rec := do("/events_for_month?user_id=2&date=2023-07-01", ""); strings.Count(rec.Body.String(), `"title"`) != defaultPageLimit {
+		t.Errorf("json is not paged: %d events", strings.Count(rec.Body.String(), `"title"`))
+	}
+
+	// Новый формат подключается регистрацией, без изменения обработчиков
+	scope.serializers.Register(EventSerializer{Name: "titles", ContentType: "text/plain; charset=utf-8",
+		Write: func(w io.Writer, events []Event, _ string) error {
+			for _, e := range events {
+				if _, err := fmt.Fprintln(w, e.Title); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+	if rec := do("/events_for_day?user_id=1&date=2023-07-04", "text/plain"); rec.Body.String() != "retro, sprint 5\n=standup\n" {
+		t.Errorf("titles = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	now := time.Date(2023, 7, 3, 9, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+	for i, expected := range []bool{true, true, false} {
+		if ok, _ := limiter.Allow("a"); ok != expected {
+			t.Errorf("request %d allowed = %v", i, ok)
+		}
+	}
+	if ok, wait := limiter.Allow("a"); ok || wait != time.Second {
+		t.Errorf("exhausted bucket = %v, wait %v", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("buckets are not independent")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("bucket is not refilled")
+	}
+	now = now.Add(rateLimitSweepInterval)
+	limiter.Allow("c")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("idle buckets are not removed: %d left", len(limiter.buckets))
+	}
+
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.limiter = limiter
+	scope.maxBodyBytes = 256
+	scope.routes()
+	handler := scope.Handler()
+	do := func(remoteAddr, target string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, body)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	form := "user_id=1&title=standup&description=daily&date=2023-07-03T09:00:00"
+	for i := 0; i < 2; i++ {
+		if rec := do("10.0.0.1:1000", "/create_event", strings.NewReader(form), "application/x-www-form-urlencoded"); rec.Code != http.StatusCreated {
+			t.Fatalf("create %d = %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	rec := do("10.0.0.1:1001", "/create_event", strings.NewReader(form), "application/x-www-form-urlencoded")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" || !strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("over the limit = %d, Retry-After %q, %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+	if rec := do("10.0.0.2:1000", "/create_event", strings.NewReader(form), "application/x-www-form-urlencoded"); rec.Code != http.StatusCreated {
+		t.Errorf("another address = %d", rec.Code)
+	}
+
+	scope.limiter = nil
+	large := `{"user_id": 1, "title": "standup", "date": "2023-07-03", "description": "` + strings.Repeat("x", 300) + `"}`
+	if rec := do("10.0.0.1:1000", "/create_event", strings.NewReader(large), "application/json"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body = %d %s", rec.Code, rec.Body.String())
+	}
+	// Тело без Content-Length ограничивается при чтении
+	if rec := do("10.0.0.1:1000", "/create_event", io.MultiReader(strings.NewReader(large)), "application/json"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large chunked body = %d %s", rec.Code, rec.Body.String())
+	}
+	ics := "--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.ics\"\r\n\r\n" + strings.Repeat("X", 300) + "\r\n--b--\r\n"
+	if rec := do("10.0.0.1:1000", "/import_ics?user_id=1", io.MultiReader(strings.NewReader(ics)), "multipart/form-data; boundary=b"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large import = %d %s", rec.Code, rec.Body.String())
+	}
+
+	expected := map[rejection]int64{
+		{RejectRateLimit, "/create_event"}:    1,
+		{RejectBodyTooLarge, "/create_event"}: 2,
+		{RejectBodyTooLarge, "/import_ics"}:   1,
+	}
+	if got := scope.rejections.Snapshot(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("rejections = %v, expected %v", got, expected)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.routes()
+	handler := scope.Handler()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, userID := range []string{"1", "1", "2"} {
+		if rec := do(http.MethodPost, "/create_event", "user_id="+userID+"&title=a&description=b&date=2023-07-03"); rec.Code != http.StatusCreated {
+			t.Fatalf("create = %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	do(http.MethodPost, "/create_event", "user_id=1")
+	do(http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", "")
+	do(http.MethodGet, "/no/such/route", "")
+	scope.rejections.Inc(RejectRateLimit, "/create_event")
+
+	rec := do(http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("metrics = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE calendar_http_requests_total counter",
+		`calendar_http_requests_total{route="/create_event",method="POST",status="201"} 3`,
+		`calendar_http_requests_total{route="/create_event",method="POST",status="400"} 1`,
+		`calendar_http_requests_total{route="/events_for_day",method="GET",status="200"} 1`,
+		`calendar_http_requests_total{route="other",method="GET",status="404"} 1`,
+		"# TYPE calendar_http_request_duration_seconds histogram",
+		`calendar_http_request_duration_seconds_bucket{route="/create_event",le="+Inf"} 4`,
+		`calendar_http_request_duration_seconds_count{route="/create_event"} 4`,
+		`calendar_rejected_requests_total{reason="rate_limit",route="/create_event"} 1`,
+		`calendar_repository_events{user_id="1"} 2`,
+		`calendar_repository_events{user_id="2"} 1`,
+		"# TYPE calendar_repository_lock_wait_seconds histogram",
+		`calendar_repository_lock_wait_seconds_bucket{mode="write",le="+Inf"} `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+	// Корзины гистограммы накапливаются и не убывают
+	var prev float64
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, `calendar_http_request_duration_seconds_bucket{route="/create_event"`) {
+			continue
+		}
+		var value float64
+		if _, err := fmt.Sscan(line[strings.LastIndex(line, " ")+1:], &value); err != nil || value < prev {
+			t.Errorf("bad bucket line %q", line)
+		}
+		prev = value
+	}
+
+	stats, _ := scope.EventRepository.Stats()
+	if n, _ := stats.WriteLockWait.Count(); n < 3 {
+		t.Errorf("write lock waits = %d, expected at least 3", n)
+	}
+
+	if got := formatLabels("path", "a\"b\\c\nd"); got != `{path="a\"b\\c\nd"}` {
+		t.Errorf("escaped labels = %s", got)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := CreateScope(repo)
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.routes()
+	handler := scope.Handler()
+	standup, err := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-03", "standup"), WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _, _ := scope.broker.Subscribe(1, "")
+	defer scope.broker.Unsubscribe(sub)
+
+	post := func(body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := post(`{"operations": [
+		{"op": "create", "user_id": 2, "title": "planning", "description": "q3", "date": "2023-07-04"},
+		{"op": "update", "user_id": 1, "id": 1, "title": "daily", "description": "sync", "date": "2023-07-03", "expected_version": 1},
+		{"op": "create", "user_id": 1, "title": "retro", "description": "sprint", "date": "2023-07-07"}
+	]}`)
+	var response struct {
+		Error   string        `json:"error"`
+		Results []BatchResult `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil || code != http.StatusOK || len(response.Results) != 3 {
+		t.Fatalf("batch = %d %s", code, body)
+	}
+	if r := response.Results[1]; r.Op != BatchUpdate || r.Event == nil || r.Event.Version != 2 {
+		t.Errorf("update result = %+v", r)
+	}
+	if len(sub.C) != 2 {
+		t.Errorf("published %d changes of user 1, expected 2", len(sub.C))
+	}
+
+	// Вторая операция конфликтует по версии: создание из первой операции отменяется
+	code, body = post(`{"operations": [
+		{"op": "create", "user_id": 3, "title": "lunch", "description": "team", "date": "2023-07-05"},
+		{"op": "delete", "user_id": 1, "id": 1, "expected_version": 1},
+		{"op": "delete", "user_id": 2, "id": 2}
+	]}`)
+	response.Results = nil
+	if err := json.Unmarshal([]byte(body), &response); err != nil || code != http.StatusServiceUnavailable {
+		t.Fatalf("conflicting batch = %d %s", code, body)
+	}
+	if len(response.Results) != 2 || response.Results[1].Error == "" || !strings.Contains(response.Error, "operation 1") {
+		t.Errorf("conflicting batch response = %+v", response)
+	}
+	if _, err := repo.UserEvents(3); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("rolled back create is visible: %v", err)
+	}
+	if len(sub.C) != 2 {
+		t.Errorf("rolled back batch published changes")
+	}
+
+	code, body = post(`{"operations": [{"op": "move", "user_id": 1}, {"op": "create", "user_id": 1}]}`)
+	if code != http.StatusBadRequest || !strings.Contains(body, `"operations[0].op"`) || !strings.Contains(body, `"operations[1].title"`) {
+		t.Errorf("invalid batch = %d %s", code, body)
+	}
+
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	updated, err := restored.Get(1, standup.ID)
+	if err != nil || updated.Title != "daily" || updated.Version != 2 {
+		t.Errorf("restored update = %+v, %v", updated, err)
+	}
+	if events, _ := restored.UserEvents(1); len(events) != 2 {
+		t.Errorf("restored user 1 events = %d, expected 2", len(events))
+	}
+	if _, err := restored.UserEvents(3); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("rolled back create is restored: %v", err)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	for name, repo := range repositories() {
+		t.Run(name, func(t *testing.T) {
+			standup, _ := repo.Create(newTestEvent(1, 0, "2023-07-03", "standup"))
+			before, _ := repo.Search(1, nil, nil)
+
+			errBoom := errors.New("boom")
+			err := repo.Transaction(func(tx EventRepository) error {
+				if _, err := tx.Create(newTestEvent(1, 0, "2023-07-04", "retro")); err != nil {
+					return err
+				}
+				changed := standup
+				changed.Title = "daily"
+				if _, err := tx.Update(changed, 1); err != nil {
+					return err
+				}
+				if err := tx.Delete(ConcreteEvent{UserID: 1, ID: standup.ID}); err != nil {
+					return err
+				}
+				if _, err := tx.Create(newTestEvent(2, 0, "2023-07-04", "planning")); err != nil {
+					return err
+				}
+				return errBoom
+			})
+			if !errors.Is(err, errBoom) {
+				t.Fatalf("Transaction = %v", err)
+			}
+			after, _ := repo.Search(1, nil, nil)
+			if !reflect.DeepEqual(before, after) {
+				t.Errorf("events after rollback = %+v, expected %+v", after, before)
+			}
+			if found, _ := repo.Search(1, []string{"retro"}, nil); len(found) != 0 {
+				t.Errorf("search index is not rolled back: %+v", found)
+			}
+			if found, _ := repo.Overlapping(1, standup.Date.date, standup.Date.date.Add(time.Hour)); len(found) != 1 {
+				t.Errorf("interval index is not rolled back: %+v", found)
+			}
+			if _, err := repo.Overlapping(2, standup.Date.date, standup.Date.date.Add(time.Hour)); !errors.Is(err, ErrUnknownUser) {
+				t.Errorf("new user is not rolled back: %v", err)
+			}
+		})
+	}
+}
+
+func TestTrashAndHistory(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)}
+	scope := CreateScope(repo)
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.clock = clock
+	scope.routes()
+	handler := scope.Handler()
+	do := func(method, target, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	standup, _ := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-03", "standup"), WriteOptions{})
+	retro, _ := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-07", "retro"), WriteOptions{})
+	if code, body := do(http.MethodPost, "/update_event", "user_id=1&id=1&title=daily&description=sync&date=2023-07-03"); code != http.StatusOK {
+		t.Fatalf("update = %d %s", code, body)
+	}
+	for _, id := range []int{standup.ID, retro.ID} {
+		if code, body := do(http.MethodPost, "/delete_event", fmt.Sprintf("user_id=1&id=%d", id)); code != http.StatusOK {
+			t.Fatalf("delete %d = %d %s", id, code, body)
+		}
+		clock.Advance(time.Hour)
+	}
+	trash, _ := repo.Trash(1)
+	if len(trash) != 2 || trash[0].ID != retro.ID || trash[1].Title != "daily" || trash[1].DeletedBy != 1 {
+		t.Fatalf("trash = %+v", trash)
+	}
+	if events, _ := repo.UserEvents(1); len(events) != 0 {
+		t.Errorf("deleted events are still listed: %+v", events)
+	}
+
+	code, body := do(http.MethodPost, "/restore_event", "user_id=1&id=1")
+	if code != http.StatusOK || !strings.Contains(body, `"version":3`) {
+		t.Fatalf("restore = %d %s", code, body)
+	}
+	if code, _ := do(http.MethodPost, "/restore_event", "user_id=1&id=1"); code != http.StatusInternalServerError {
+		t.Errorf("second restore = %d", code)
+	}
+
+	code, body = do(http.MethodGet, "/event_history?id=1", "")
+	var response struct {
+		History []AuditEntry `json:"history"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil || code != http.StatusOK {
+		t.Fatalf("history = %d %s", code, body)
+	}
+	var actions []string
+	for _, entry := range response.History {
+		actions = append(actions, entry.Action)
+	}
+	if want := []string{AuditCreate, AuditUpdate, AuditDelete, AuditRestore}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("actions = %v, expected %v", actions, want)
+	}
+	update, del := response.History[1], response.History[2]
+	if update.Actor != 1 || update.Old == nil || update.Old.Title != "standup" || update.New == nil || update.New.Title != "daily" {
+		t.Errorf("update entry = %+v", update)
+	}
+	if del.Old == nil || del.Old.Title != "daily" || del.New != nil || !del.Time.Equal(time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("delete entry = %+v", del)
+	}
+	if code, _ := do(http.MethodGet, "/event_history?id=99", ""); code != http.StatusInternalServerError {
+		t.Errorf("history of a missing event = %d", code)
+	}
+
+	// Отмененный пакет не оставляет записей в журнале и корзине
+	_, err = scope.Batch([]BatchOperation{
+		{Op: BatchDelete, EventRequest: EventRequest{Event: Event{UserID: 1, ID: standup.ID}}},
+		{Op: BatchDelete, EventRequest: EventRequest{Event: Event{UserID: 1, ID: 99}}},
+	})
+	if err == nil {
+		t.Fatal("batch with a missing event succeeded")
+	}
+	if history, _ := repo.History(standup.ID); len(history) != 4 {
+		t.Errorf("history after rollback = %d entries", len(history))
+	}
+	if trash, _ := repo.Trash(1); len(trash) != 1 {
+		t.Errorf("trash after rollback = %+v", trash)
+	}
+
+	clock.Advance(22 * time.Hour)
+	if n, err := scope.PurgeTrash(24 * time.Hour); err != nil || n != 0 {
+		t.Errorf("purge before retention = %d %v", n, err)
+	}
+	clock.Advance(2 * time.Hour)
+	if n, err := scope.PurgeTrash(24 * time.Hour); err != nil || n != 1 {
+		t.Errorf("purge after retention = %d %v", n, err)
+	}
+	if history, _ := repo.History(retro.ID); len(history) != 3 || history[2].Action != AuditPurge || history[2].Actor != 0 {
+		t.Errorf("retro history = %+v", history)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if trash, _ := reopened.Trash(1); len(trash) != 0 {
+		t.Errorf("trash after reopen = %+v", trash)
+	}
+	if history, _ := reopened.History(standup.ID); len(history) != 4 {
+		t.Errorf("history after reopen = %+v", history)
+	}
+	if e, err := reopened.Get(1, standup.ID); err != nil || e.Version != 3 {
+		t.Errorf("restored event after reopen = %+v %v", e, err)
+	}
+}
+
+func TestShardedTransactionConflict(t *testing.T) {
+	repo := NewShardedRepository(4)
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- repo.Transaction(func(tx EventRepository) error {
+			if _, err := tx.Create(newTestEvent(1, 0, "2023-07-03", "standup")); err != nil {
+				return err
+			}
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	// Вторая транзакция держит полосу пользователя 2 и не может ждать полосу пользователя 1
+	calls := 0
+	go func() {
+		done <- repo.Transaction(func(tx EventRepository) error {
+			calls++
+			if _, err := tx.Create(newTestEvent(2, 0, "2023-07-04", "planning")); err != nil {
+				return err
+			}
+			_, err := tx.Create(newTestEvent(1, 0, "2023-07-05", "retro"))
+			// Повтор ждет все полосы, поэтому первая транзакция завершается после конфликта
+			if errors.Is(err, errStripeConflict) {
+				close(release)
+			}
+			return err
+		})
+	}()
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("fn called %d times, expected a retry after the conflict", calls)
+	}
+	first, _ := repo.UserEvents(1)
+	second, _ := repo.UserEvents(2)
+	if len(first) != 2 || len(second) != 1 {
+		t.Errorf("events = %v, %v", first, second)
+	}
+}
+
+func TestShardedRepositoryParallel(t *testing.T) {
+	repo := NewShardedRepository(8)
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				// Соседние исполнители меняют пары пользователей в разном порядке
+				users := []int{w, (w + 1) % workers}
+				if i%2 == 1 {
+					users[0], users[1] = users[1], users[0]
+				}
+				err := repo.Transaction(func(tx EventRepository) error {
+					for _, userID := range users {
+						if _, err := tx.Create(newTestEvent(userID, 0, "2023-07-03", "standup")); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = repo.Search(w, []string{"standup"}, nil)
+				_, _ = repo.OverlappingAll(time.Time{}, time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+	stats, _ := repo.Stats()
+	for userID := range workers {
+		if stats.Events[userID] != 2*rounds {
+			t.Errorf("user %d has %d events, expected %d", userID, stats.Events[userID], 2*rounds)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	type received struct {
+		header  http.Header
+		payload WebhookPayload
+		body    []byte
+	}
+	deliveries := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("payload %s: %v", body, err)
+		}
+		deliveries <- received{r.Header, payload, body}
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.webhooks = NewWebhookDispatcher(scope.EventRepository, 2, 3, time.Millisecond, realClock{}, scope.logger)
+	// Получатели теста слушают loopback, закрытый по умолчанию
+	scope.webhooks.allowed, _ = parseNetworks("127.0.0.0/8, ::1/128")
+	scope.routes()
+	handler := scope.Handler()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scope.webhooks.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	do := func(method, target, body string) (int, string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := do(http.MethodPost, "/webhooks", "user_id=1&url="+receiver.URL+"&secret=s3cret")
+	if code != http.StatusCreated || !strings.Contains(body, `"secret":"s3cret"`) {
+		t.Fatalf("create webhook = %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/webhooks", "user_id=1&url="+failing.URL+"&events=create"); code != http.StatusCreated {
+		t.Fatalf("create failing webhook = %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/webhooks", "user_id=1&url=ftp://example.com&events=move"); code != http.StatusBadRequest ||
+		!strings.Contains(body, `"url"`) || !strings.Contains(body, `"events"`) {
+		t.Errorf("invalid webhook = %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/webhooks", "user_id=1&url=http://169.254.169.254/latest/meta-data"); code != http.StatusBadRequest ||
+		!strings.Contains(body, "link-local") {
+		t.Errorf("webhook to the metadata address = %d %s", code, body)
+	}
+	if code, body := do(http.MethodGet, "/webhooks?user_id=1", ""); code != http.StatusOK ||
+		strings.Contains(body, "secret") || strings.Count(body, `"url"`) != 2 {
+		t.Errorf("list = %d %s", code, body)
+	}
+
+	standup, err := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-03", "standup"), WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := do(http.MethodPost, "/update_event", "user_id=1&id=1&title=daily&description=sync&date=2023-07-03"); code != http.StatusOK {
+		t.Fatalf("update = %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/delete_event", "user_id=1&id=1"); code != http.StatusOK {
+		t.Fatalf("delete = %d %s", code, body)
+	}
+	// Изменения одного события доставляются параллельно, порядок не гарантирован
+	got := map[string]WebhookPayload{}
+	for range 3 {
+		select {
+		case d := <-deliveries:
+			if sig := d.header.Get(webhookSignatureHeader); sig != signWebhook("s3cret", d.body) {
+				t.Errorf("signature = %q", sig)
+			}
+			if d.header.Get(webhookEventHeader) != d.payload.Type || d.header.Get(webhookDeliveryHeader) != d.payload.DeliveryID {
+				t.Errorf("headers = %v, payload %+v", d.header, d.payload)
+			}
+			got[d.payload.Type] = d.payload
+		case <-time.After(5 * time.Second):
+			t.Fatalf("deliveries = %v", got)
+		}
+	}
+	if got[ChangeCreate].Event.Title != standup.Title || got[ChangeUpdate].Event.Title != "daily" || got[ChangeDelete].Event.ID != standup.ID {
+		t.Errorf("payloads = %+v", got)
+	}
+
+	// Неудачная доставка повторяется maxAttempts раз и попадает в недоставленные
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body = do(http.MethodGet, "/webhooks/dead_letters?user_id=1", "")
+		if strings.Contains(body, `"attempts":3`) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var dead struct {
+		DeadLetters []DeadLetter `json:"dead_letters"`
+	}
+	if err := json.Unmarshal([]byte(body), &dead); err != nil || code != http.StatusOK || len(dead.DeadLetters) != 1 {
+		t.Fatalf("dead letters = %d %s", code, body)
+	}
+	if dl := dead.DeadLetters[0]; dl.WebhookID != 2 || dl.Attempts != 3 || dl.Payload.Type != ChangeCreate ||
+		!strings.Contains(dl.LastError, "500") {
+		t.Errorf("dead letter = %+v", dl)
+	}
+
+	if code, body := do(http.MethodPut, "/webhooks", "user_id=1&id=1&url="+receiver.URL+"&events=delete"); code != http.StatusOK ||
+		strings.Contains(body, "secret") || !strings.Contains(body, `"events":["delete"]`) {
+		t.Errorf("update webhook = %d %s", code, body)
+	}
+	if code, _ := do(http.MethodPut, "/webhooks", "user_id=2&id=1&url="+receiver.URL); code != http.StatusInternalServerError {
+		t.Errorf("update webhook of another user = %d", code)
+	}
+	if code, _ := do(http.MethodDelete, "/webhooks?user_id=1&id=2", ""); code != http.StatusOK {
+		t.Errorf("delete webhook = %d", code)
+	}
+	if code, _ := do(http.MethodPatch, "/webhooks", ""); code != http.StatusBadRequest {
+		t.Errorf("PATCH /webhooks = %d", code)
+	}
+	if _, err := scope.CreateNewEvent(newTestEvent(1, 0, "2023-07-04", "retro"), WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := do(http.MethodPost, "/delete_event", "user_id=1&id=2"); code != http.StatusOK {
+		t.Fatalf("delete = %d %s", code, body)
+	}
+	select {
+	case d := <-deliveries:
+		if d.payload.Type != ChangeDelete || d.payload.Event.Title != "retro" {
+			t.Errorf("filtered delivery = %+v", d.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delete is not delivered")
+	}
+}
+
+func TestWebhookRetryWait(t *testing.T) {
+	d := NewWebhookDispatcher(NewMemoryRepository(), 1, maxWebhookAttempts, time.Second, realClock{}, Logger{Logger: log.New(io.Discard, "", 0)})
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 12: 2048 * time.Second, 13: time.Hour, 34: time.Hour, 64: time.Hour, 99: time.Hour} {
+		if wait := d.retryWait(attempts); wait != expected {
+			t.Errorf("retryWait(%d) = %v, expected %v", attempts, wait, expected)
+		}
+	}
+}
+
+func TestWebhookShutdown(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	clock := &fakeClock{now: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)}
+	d := NewWebhookDispatcher(NewMemoryRepository(), 1, 3, time.Minute, clock, Logger{Logger: log.New(io.Discard, "", 0)})
+	d.allowed, _ = parseNetworks("127.0.0.0/8, ::1/128")
+	if _, err := d.Register(Webhook{UserID: 1, URL: failing.URL}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+
+	// Первая попытка не удалась, вторая ждет паузы
+	d.Notify(ChangeCreate, newTestEvent(1, 1, "2023-07-03", "standup"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		clock.mu.Lock()
+		waiting := len(clock.waiters)
+		clock.mu.Unlock()
+		if waiting > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	cancel()
+	<-done
+	// Изменение, поставленное в очередь после остановки исполнителей
+	d.Notify(ChangeDelete, newTestEvent(1, 1, "2023-07-03", "standup"))
+	d.Run(ctx)
+
+	letters, err := d.DeadLetters(1)
+	if err != nil || len(letters) != 2 {
+		t.Fatalf("dead letters = %+v, %v", letters, err)
+	}
+	for _, dl := range letters {
+		if dl.LastError != errWebhookShutdown.Error() || dl.Payload.Type == ChangeCreate && dl.Attempts != 1 {
+			t.Errorf("dead letter = %+v", dl)
+		}
+	}
+}
+
+func TestWebhookAddressCheck(t *testing.T) {
+	d := NewWebhookDispatcher(NewMemoryRepository(), 1, 1, time.Millisecond, realClock{}, Logger{Logger: log.New(io.Discard, "", 0)})
+	for _, test := range []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://93.184.216.34/hook", true},
+		{"http://127.0.0.1:8080/hook", false},
+		{"http://LOCALHOST/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://192.168.0.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::ffff:169.254.169.254]/", false},
+		{"http://0.0.0.0/hook", false},
+	} {
+		if err := d.checkURL(test.url); (err == nil) != test.allowed {
+			t.Errorf("checkURL(%q) = %v, expected allowed %v", test.url, err, test.allowed)
+		}
+	}
+
+	// Имя, которое разрешается в закрытый адрес, отклоняется при соединении
+	var requests atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer receiver.Close()
+	port := receiver.URL[strings.LastIndex(receiver.URL, ":")+1:]
+	hook, err := d.Register(Webhook{UserID: 1, URL: "http://localhost:" + port + "/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := &webhookDelivery{hook: hook, payload: WebhookPayload{Type: ChangeCreate}, body: []byte("{}")}
+	d.deliver(context.Background(), delivery)
+	dead, _ := d.DeadLetters(1)
+	if requests.Load() != 0 || len(dead) != 1 || !strings.Contains(dead[0].LastError, errWebhookAddress.Error()) {
+		t.Errorf("delivery to localhost: %d requests, dead letters %+v", requests.Load(), dead)
+	}
+
+	d.allowed, _ = parseNetworks("127.0.0.0/8,::1/128")
+	if err := d.checkURL("http://127.0.0.1/hook"); err != nil {
+		t.Errorf("checkURL with allowed loopback = %v", err)
+	}
+	delivery.attempts = 0
+	d.deliver(context.Background(), delivery)
+	if requests.Load() != 1 {
+		t.Errorf("delivery to allowed loopback: %d requests", requests.Load())
+	}
+}
+
+func TestFileRepositoryWebhooks(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewWebhookDispatcher(repo, 1, 1, time.Millisecond, realClock{}, Logger{Logger: log.New(io.Discard, "", 0)})
+	first, err := d.Register(Webhook{UserID: 1, URL: "https://example.com/first", Secret: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.bury(&webhookDelivery{hook: first, payload: WebhookPayload{DeliveryID: "d1", Type: ChangeCreate}, attempts: 5}, errors.New("timeout"))
+	if err := repo.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.Register(Webhook{UserID: 1, URL: "https://example.com/second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Update(Webhook{ID: first.ID, UserID: 1, URL: "https://example.com/updated", Events: []string{ChangeDelete}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(1, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	d.bury(&webhookDelivery{hook: first, payload: WebhookPayload{DeliveryID: "d2", Type: ChangeDelete}, attempts: 5}, errors.New("refused"))
+	_ = repo.wal.Close()
+
+	restored, err := NewFileRepository(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	hooks, _ := restored.Webhooks()
+	if len(hooks) != 1 || hooks[0].ID != first.ID || hooks[0].URL != "https://example.com/updated" ||
+		hooks[0].Secret != "s1" || !reflect.DeepEqual(hooks[0].Events, []string{ChangeDelete}) {
+		t.Errorf("restored webhooks = %+v", hooks)
+	}
+	dead, _ := restored.DeadLetters()
+	if len(dead) != 2 || dead[0].Payload.DeliveryID != "d1" || dead[1].LastError != "refused" {
+		t.Errorf("restored dead letters = %+v", dead)
+	}
+	// ID удаленного вебхука не выдается повторно
+	third, err := NewWebhookDispatcher(restored, 1, 1, time.Millisecond, realClock{}, d.logger).Register(Webhook{UserID: 1, URL: "https://example.com/third"})
+	if err != nil || third.ID != second.ID+1 {
+		t.Errorf("webhook after restart = %+v, %v, expected ID %d", third, err, second.ID+1)
+	}
+}
+
+func TestRPCAuth(t *testing.T) {
+	hash, err := hashPassword("wonderland", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewUserStore([]User{{ID: 1, Name: "alice", PasswordHash: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(users, []byte("secret"), time.Hour)
+	token, _, err := auth.Login("alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewCalendarService(NewMemoryRepository(), Logger{Logger: log.New(io.Discard, "", 0)})
+	server := NewRPCServer(svc)
+	server.auth = auth
+	// Вызовы без токена и вызовы пользователя ограничиваются отдельно, пользователю хватает на 6 вызовов
+	server.limiter = NewRateLimiter(0.001, 6)
+	session := &rpcSession{host: "127.0.0.1"}
+	call := func(method, params string) *RPCError {
+		t.Helper()
+		var res rpcResponse
+		line := server.handleLine(session, []byte(`{"jsonrpc": "2.0", "id": 1, "method": "`+method+`", "params": `+params+`}`))
+		if err := json.Unmarshal(line, &res); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return res.Error
+	}
+	create := `{"user_id": %d, "title": "standup", "description": "daily", "date": "2023-07-03"}`
+
+	tests := []struct {
+		name, method, params string
+		code                 int
+	}{
+		{"without token", "calendar.create_event", fmt.Sprintf(create, 1), rpcUnauthorized},
+		{"bad token", rpcAuthenticate, `{"token": "forged.token"}`, rpcUnauthorized},
+		{"login", rpcAuthenticate, `{"token": "` + token + `"}`, 0},
+		{"own data", "calendar.create_event", fmt.Sprintf(create, 1), 0},
+		{"another user's data", "calendar.create_event", fmt.Sprintf(create, 2), rpcForbidden},
+		{"another user's trash", "calendar.trash", `{"user_id": 2}`, rpcForbidden},
+		{"another user's day", "calendar.events_for_day", `{"user_id": 2, "date": "2023-07-03"}`, rpcForbidden},
+		{"batch with another user", "calendar.batch", `{"operations": [{"op": "delete", "user_id": 2, "id": 1}]}`, rpcForbidden},
+		{"own history", "calendar.history", `{"id": 1}`, 0},
+		{"rate limit", "calendar.trash", `{"user_id": 1}`, rpcRateLimited},
+	}
+	for _, test := range tests {
+		rerr := call(test.method, test.params)
+		if test.code == 0 && rerr != nil || test.code != 0 && (rerr == nil || rerr.Code != test.code) {
+			t.Errorf("%s = %+v, expected code %d", test.name, rerr, test.code)
+		}
+	}
+	if entries, _ := svc.EventRepository.History(1); len(entries) != 1 || entries[0].Actor != 1 {
+		t.Errorf("history = %+v", entries)
+	}
+	// Журнал чужого события отвечает так же, как журнал несуществующего
+	server.limiter = nil
+	if _, err := svc.CreateNewEvent(newTestEvent(2, 0, "2023-07-03", "retro"), WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if foreign, missing := call("calendar.history", `{"id": 2}`), call("calendar.history", `{"id": 99}`); foreign == nil || !reflect.DeepEqual(foreign, missing) {
+		t.Errorf("history of another user's event = %+v, of a missing event = %+v", foreign, missing)
+	}
+
+	// Без аутентификации сервер JSON-RPC открывается только на loopback
+	if ln, err := listenRPC(":0", false); err == nil {
+		ln.Close()
+		t.Error("listenRPC on all interfaces without auth succeeded")
+	}
+	ln, err := listenRPC("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestRPCServer(t *testing.T) {
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.routes()
+	handler := scope.Handler()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- NewRPCServer(scope.CalendarService).Serve(ctx, ln)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	call := func(line string) string {
+		t.Helper()
+		if _, err := io.WriteString(conn, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		res, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(res)
+	}
+	type response struct {
+		ID     json.RawMessage `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *RPCError       `json:"error"`
+	}
+	decode := func(line string) response {
+		t.Helper()
+		var res response
+		if err := json.Unmarshal([]byte(line), &res); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return res
+	}
+
+	res := decode(call(`{"jsonrpc": "2.0", "id": 1, "method": "calendar.create_event", "params": ` +
+		`{"user_id": 1, "title": "standup", "description": "daily", "date": "2023-07-03T09:00:00", "end": "2023-07-03T09:30:00"}}`))
+	var created Event
+	if res.Error != nil || string(res.ID) != "1" || json.Unmarshal(res.Result, &created) != nil || created.ID != 1 {
+		t.Fatalf("create = %+v %s", res.Error, res.Result)
+	}
+	// HTTP и JSON-RPC работают с одним сервисом
+	req := httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"title":"standup"`) {
+		t.Errorf("http day = %s", rec.Body.String())
+	}
+	if entries, _ := scope.EventRepository.History(1); len(entries) != 1 || entries[0].Actor != 1 {
+		t.Errorf("history = %+v", entries)
+	}
+
+	tests := []struct {
+		name, line string
+		code       int
+	}{
+		{"invalid params", `{"jsonrpc": "2.0", "id": 2, "method": "calendar.create_event", "params": {"user_id": 1, "date": "2023-07-03"}}`, rpcInvalidParams},
+		{"overlap", `{"jsonrpc": "2.0", "id": 3, "method": "calendar.create_event", "params": ` +
+			`{"user_id": 1, "title": "clash", "description": "x", "date": "2023-07-03T09:15:00", "end": "2023-07-03T10:00:00", "reject_overlaps": true}}`, rpcBusinessError},
+		{"missing event", `{"jsonrpc": "2.0", "id": 4, "method": "calendar.delete_event", "params": {"user_id": 1, "id": 9}}`, rpcNotFound},
+		{"unknown method", `{"jsonrpc": "2.0", "id": 5, "method": "calendar.drop"}`, rpcMethodNotFound},
+		{"positional params", `{"jsonrpc": "2.0", "id": 6, "method": "calendar.trash", "params": [1]}`, rpcInvalidParams},
+		{"wrong version", `{"jsonrpc": "1.0", "id": 7, "method": "calendar.trash"}`, rpcInvalidRequest},
+		{"parse error", `{"jsonrpc": "2.0", "id": 8`, rpcParseError},
+	}
+	for _, test := range tests {
+		if res := decode(call(test.line)); res.Error == nil || res.Error.Code != test.code {
+			t.Errorf("%s = %+v, expected code %d", test.name, res.Error, test.code)
+		}
+	}
+	if res := decode(call(tests[0].line)); res.Error.Data == nil || !strings.Contains(fmt.Sprint(res.Error.Data), "title") {
+		t.Errorf("validation data = %+v", res.Error)
+	}
+
+	// Уведомление выполняется без ответа, в пакете отвечают только запросы с id
+	line := call(`[{"jsonrpc": "2.0", "method": "calendar.delete_event", "params": {"user_id": 1, "id": 1}},` +
+		`{"jsonrpc": "2.0", "id": "trash", "method": "calendar.trash", "params": {"user_id": 1}},` +
+		`{"jsonrpc": "2.0", "id": "week", "method": "calendar.events_for_week", "params": {"user_id": 1, "date": "2023-07-05"}}]`)
+	var batch []response
+	if err := json.Unmarshal([]byte(line), &batch); err != nil || len(batch) != 2 {
+		t.Fatalf("batch = %s", line)
+	}
+	if string(batch[0].ID) != `"trash"` || !strings.Contains(string(batch[0].Result), `"deleted_by":1`) ||
+		string(batch[1].ID) != `"week"` || string(batch[1].Result) != "[]" {
+		t.Errorf("batch = %s", line)
+	}
+	res = decode(call(`{"jsonrpc": "2.0", "id": 9, "method": "calendar.batch", "params": {"operations": [` +
+		`{"op": "create", "user_id": 1, "title": "lunch", "description": "team", "date": "2023-07-04"},` +
+		`{"op": "delete", "user_id": 1, "id": 42}]}}`))
+	if res.Error == nil || res.Error.Code != rpcNotFound || !strings.Contains(fmt.Sprint(res.Error.Data), "lunch") {
+		t.Errorf("failed batch = %+v", res.Error)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("connection is still open")
+	}
+}
+
+// benchmarkRepository нагружает хранилище параллельно: каждый исполнитель работает со своим
+// пользователем, у которого уже есть events событий. На каждой итерации он читает событие по ID
+// и события недели вокруг него, на каждой четвертой - еще и изменяет событие
+func benchmarkRepository(b *testing.B, repo EventRepository, events int) {
+	workers := runtime.GOMAXPROCS(0)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for userID := 1; userID <= workers; userID++ {
+		for i := range events {
+			e := Event{UserID: userID, Date: Date{date: start.Add(time.Duration(i) * time.Hour)}, Title: "event", Description: "load"}
+			if _, err := repo.Create(e); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	var users atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		userID := int(users.Add(1))
+		for i := 0; pb.Next(); i++ {
+			// ID событий пользователя идут подряд
+			id := (userID-1)*events + i%events + 1
+			e, err := repo.Get(userID, id)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if i%4 == 0 {
+				if _, err := repo.Update(e, 0); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+			from := e.Date.date.Add(-72 * time.Hour)
+			if _, err := repo.Overlapping(userID, from, from.Add(7*24*time.Hour)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkRepositories(b *testing.B) {
+	for _, events := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("memory/events=%d", events), func(b *testing.B) {
+			benchmarkRepository(b, NewMemoryRepository(), events)
+		})
+		b.Run(fmt.Sprintf("sharded/events=%d", events), func(b *testing.B) {
+			benchmarkRepository(b, NewShardedRepository(64), events)
+		})
+	}
+}
+
+// schemaValidator проверяет значения JSON по схемам OpenAPI. Поддерживается подмножество
+// JSON Schema, которое используется в документе сервера
+type schemaValidator struct {
+	schemas map[string]interface{}
+}
+
+// validate возвращает описания несоответствий value схеме schema, path - путь к значению
+func (v schemaValidator) validate(path string, schema map[string]interface{}, value interface{}) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, ok := v.schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+		if !ok {
+			return []string{path + ": unresolved " + ref}
+		}
+		return v.validate(path, target, value)
+	}
+	var problems []string
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			problems = append(problems, v.validate(path, sub.(map[string]interface{}), value)...)
+		}
+	}
+	if value == nil {
+		if schema["nullable"] == true || schema["type"] == nil {
+			return problems
+		}
+		return append(problems, path+": must not be null")
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: %T is not an object", path, value))
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s: required", path, name))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, field := range obj {
+			if prop, ok := properties[name].(map[string]interface{}); ok {
+				problems = append(problems, v.validate(path+"."+name, prop, field)...)
+			} else if additional != nil {
+				problems = append(problems, v.validate(path+"."+name, additional, field)...)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: %T is not an array", path, value))
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for ind, item := range arr {
+			problems = append(problems, v.validate(fmt.Sprintf("%s[%d]", path, ind), items, item)...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return append(problems, fmt.Sprintf("%s: %T is not a string", path, value))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a date-time", path, s))
+			}
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: %q is not one of %v", path, s, enum))
+			}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			problems = append(problems, fmt.Sprintf("%s: %v is not an integer", path, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a number", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %v is not a boolean", path, value))
+		}
+	}
+	return problems
+}
+
+// collectRefs собирает все ссылки $ref документа
+func collectRefs(value interface{}, refs map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if ref, ok := field.(string); ok && key == "$ref" {
+				refs[ref] = true
+			}
+			collectRefs(field, refs)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectRefs(item, refs)
+		}
+	}
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	users, err := NewUserStore([]User{
+		{ID: 1, Name: "alice", PasswordHash: mustHash(t, "wonderland")},
+		{ID: 2, Name: "bob", PasswordHash: mustHash(t, "builder")},
+		{ID: 3, Name: "root", Role: RoleAdmin, PasswordHash: mustHash(t, "toor")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := CreateScope(NewMemoryRepository())
+	scope.logger.Logger = log.New(io.Discard, "", 0)
+	scope.auth = NewAuthenticator(users, []byte("secret"), time.Hour)
+	scope.maxBodyBytes = 4096
+	scope.routes()
+	handler := scope.Handler()
+	token := func(name, password string) string {
+		tok, _, err := scope.auth.Login(name, password)
+		if err != nil {
+			t.Fatalf("login %s: %v", name, err)
+		}
+		return tok
+	}
+	alice, bob, root := token("alice", "wonderland"), token("bob", "builder"), token("root", "toor")
+	standup := newTestEvent(1, 0, "2023-07-03", "standup")
+	standup.Date.date = standup.Date.date.Add(9 * time.Hour)
+	standup.End = Date{date: standup.Date.date.Add(time.Hour)}
+	if _, err := scope.CreateNewEvent(standup, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, target, tok, contentType, body string, ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body)).WithContext(ctx)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/openapi.json", "", "", "", context.Background())
+	var spec map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("openapi.json = %d %v", rec.Code, err)
+	}
+	components := spec["components"].(map[string]interface{})
+	v := schemaValidator{schemas: components["schemas"].(map[string]interface{})}
+	refs := map[string]bool{}
+	collectRefs(spec, refs)
+	for ref := range refs {
+		if _, ok := v.schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !ok {
+			t.Errorf("unresolved %s", ref)
+		}
+	}
+	paths := spec["paths"].(map[string]interface{})
+	operations := 0
+	for _, item := range paths {
+		operations += len(item.(map[string]interface{}))
+	}
+	if table := scope.routeTable(); operations != len(table) {
+		t.Errorf("document has %d operations, server has %d routes", operations, len(table))
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:imported@test\r\nDTSTART:20230710T090000Z\r\n" +
+		"DTEND:20230710T100000Z\r\nSUMMARY:Imported\r\nDESCRIPTION:from ics\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	const form, jsonType = "application/x-www-form-urlencoded", "application/json"
+	tests := []struct {
+		name                  string
+		method, target, token string
+		contentType, body     string
+		status                int
+	}{
+		{"login", http.MethodPost, "/login", "", form, "username=alice&password=wonderland", http.StatusOK},
+		{"login with wrong password", http.MethodPost, "/login", "", form, "username=alice&password=queen", http.StatusUnauthorized},
+		{"create", http.MethodPost, "/create_event", alice, jsonType,
+			`{"user_id": 1, "title": "retro", "description": "sprint", "date": "2023-07-03T11:00:00", "end": "2023-07-03T12:00:00", "tags": ["team"], "reminders": ["15m"]}`,
+			http.StatusCreated},
+		{"create without title", http.MethodPost, "/create_event", alice, form, "user_id=1&description=x&date=2023-07-03", http.StatusBadRequest},
+		{"create overlapping", http.MethodPost, "/create_event", alice, form,
+			"user_id=1&title=clash&description=x&date=2023-07-03T09:30:00&end=2023-07-03T10:30:00&reject_overlaps=true", http.StatusServiceUnavailable},
+		{"create for another user", http.MethodPost, "/create_event", alice, form, "user_id=2&title=a&description=b&date=2023-07-03", http.StatusForbidden},
+		{"create without token", http.MethodPost, "/create_event", "", form, "user_id=1&title=a&description=b&date=2023-07-03", http.StatusUnauthorized},
+		{"create too large", http.MethodPost, "/create_event", alice, form, "user_id=1&title=" + strings.Repeat("a", 5000), http.StatusRequestEntityTooLarge},
+		{"update", http.MethodPost, "/update_event", alice, form,
+			"user_id=1&id=2&title=retrospective&description=sprint&date=2023-07-03T11:00:00&end=2023-07-03T12:00:00&expected_version=1", http.StatusOK},
+		{"update missing event", http.MethodPost, "/update_event", alice, form, "user_id=1&id=99&title=a&description=b&date=2023-07-03", http.StatusInternalServerError},
+		{"update stale version", http.MethodPost, "/update_event", alice, form,
+			"user_id=1&id=2&title=a&description=b&date=2023-07-03&expected_version=1", http.StatusServiceUnavailable},
+		{"invite", http.MethodPost, "/invite", alice, jsonType, `{"user_id": 1, "id": 1, "attendees": [2]}`, http.StatusOK},
+		{"respond", http.MethodPost, "/respond", bob, form, "user_id=2&id=1&status=accept", http.StatusOK},
+		{"respond without invitation", http.MethodPost, "/respond", bob, form, "user_id=2&id=2&status=accept", http.StatusServiceUnavailable},
+		{"batch", http.MethodPost, "/batch", alice, jsonType,
+			`{"operations": [{"op": "create", "user_id": 1, "title": "lunch", "description": "team", "date": "2023-07-04"}]}`, http.StatusOK},
+		{"batch with stale version", http.MethodPost, "/batch", alice, jsonType,
+			`{"operations": [{"op": "delete", "user_id": 1, "id": 2, "expected_version": 1}]}`, http.StatusServiceUnavailable},
+		{"batch with missing event", http.MethodPost, "/batch", alice, jsonType,
+			`{"operations": [{"op": "delete", "user_id": 1, "id": 99}]}`, http.StatusInternalServerError},
+		{"invalid batch", http.MethodPost, "/batch", alice, jsonType, `{"operations": [{"op": "move"}]}`, http.StatusBadRequest},
+		{"day", http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03&sort=-start&limit=1", alice, "", "", http.StatusOK},
+		{"day with bad date", http.MethodGet, "/events_for_day?user_id=1&date=03.07.2023", alice, "", "", http.StatusBadRequest},
+		{"invited day", http.MethodGet, "/events_for_day?user_id=2&date=2023-07-03", bob, "", "", http.StatusOK},
+		{"week", http.MethodGet, "/events_for_week?user_id=1&date=2023-07-05&tz=Europe/Moscow", alice, "", "", http.StatusOK},
+		{"week as csv", http.MethodGet, "/events_for_week?user_id=1&date=2023-07-05&format=csv", alice, "", "", http.StatusOK},
+		{"month as calendar", http.MethodGet, "/events_for_month?user_id=1&date=2023-07-05&format=ics", alice, "", "", http.StatusOK},
+		{"month", http.MethodGet, "/events_for_month?user_id=1&date=2023-07-05", alice, "", "", http.StatusOK},
+		{"another user's month", http.MethodGet, "/events_for_month?user_id=1&date=2023-07-05", bob, "", "", http.StatusForbidden},
+		{"range", http.MethodGet, "/events?user_id=1&from=2023-07-01&to=2023-08-01", alice, "", "", http.StatusOK},
+		{"free/busy", http.MethodGet, "/free_busy?user_id=1&from=2023-07-03&to=2023-07-04", alice, "", "", http.StatusOK},
+		{"search", http.MethodGet, "/search?user_id=1&q=retrospective", alice, "", "", http.StatusOK},
+		{"export", http.MethodGet, "/export.ics?user_id=1", alice, "", "", http.StatusOK},
+		{"import", http.MethodPost, "/import_ics?user_id=1", alice, "text/calendar", ics, http.StatusOK},
+		{"subscribe", http.MethodGet, "/subscribe?user_id=1", alice, "", "", http.StatusOK},
+		{"metrics", http.MethodGet, "/metrics", root, "", "", http.StatusOK},
+		{"metrics without admin role", http.MethodGet, "/metrics", alice, "", "", http.StatusForbidden},
+		{"delete", http.MethodPost, "/delete_event", alice, form, "user_id=1&id=2", http.StatusOK},
+		{"delete missing event", http.MethodPost, "/delete_event", alice, form, "user_id=1&id=2", http.StatusInternalServerError},
+		{"trash", http.MethodGet, "/trash?user_id=1", alice, "", "", http.StatusOK},
+		{"history", http.MethodGet, "/event_history?id=2", alice, "", "", http.StatusOK},
+		{"another user's history", http.MethodGet, "/event_history?id=2", bob, "", "", http.StatusInternalServerError},
+		{"missing history", http.MethodGet, "/event_history?id=99", bob, "", "", http.StatusInternalServerError},
+		{"restore", http.MethodPost, "/restore_event", alice, jsonType, `{"user_id": 1, "id": 2}`, http.StatusOK},
+		{"restore missing event", http.MethodPost, "/restore_event", alice, form, "user_id=1&id=2", http.StatusInternalServerError},
+		{"webhook", http.MethodPost, "/webhooks", alice, jsonType,
+			`{"user_id": 1, "url": "https://hooks.example.com/calendar", "events": ["create"]}`, http.StatusCreated},
+		{"webhook with bad URL", http.MethodPost, "/webhooks", alice, form, "user_id=1&url=ftp://example.com", http.StatusBadRequest},
+		{"webhooks", http.MethodGet, "/webhooks?user_id=1", alice, "", "", http.StatusOK},
+		{"another user's webhooks", http.MethodGet, "/webhooks?user_id=1", bob, "", "", http.StatusForbidden},
+		{"update webhook", http.MethodPut, "/webhooks", alice, form, "user_id=1&id=1&url=https://hooks.example.com/calendar&events=create,delete", http.StatusOK},
+		{"update missing webhook", http.MethodPut, "/webhooks", alice, form, "user_id=1&id=9&url=https://hooks.example.com/calendar", http.StatusInternalServerError},
+		{"dead letters", http.MethodGet, "/webhooks/dead_letters?user_id=1", alice, "", "", http.StatusOK},
+		{"delete webhook", http.MethodDelete, "/webhooks?user_id=1&id=1", alice, "", "", http.StatusOK},
+		{"openapi", http.MethodGet, "/openapi.json", "", "", "", http.StatusOK},
+	}
+
+	covered := map[string]bool{}
+	statuses := map[int]bool{}
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.target == "/subscribe?user_id=1" {
+			// Поток событий завершается сразу после заголовков
+			ctx = cancelled
+		}
+		rec := do(test.method, test.target, test.token, test.contentType, test.body, ctx)
+		if rec.Code != test.status {
+			t.Errorf("%s = %d %s, expected %d", test.name, rec.Code, rec.Body.String(), test.status)
+			continue
+		}
+		path, _, _ := strings.Cut(test.target, "?")
+		covered[test.method+" "+path] = true
+		statuses[rec.Code] = true
+
+		item, _ := paths[path].(map[string]interface{})
+		op, _ := item[strings.ToLower(test.method)].(map[string]interface{})
+		if op == nil {
+			t.Errorf("%s: %s %s is not documented", test.name, test.method, path)
+			continue
+		}
+		response, _ := op["responses"].(map[string]interface{})[strconv.Itoa(rec.Code)].(map[string]interface{})
+		if response == nil {
+			t.Errorf("%s: status %d of %s is not documented", test.name, rec.Code, path)
+			continue
+		}
+		mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		content, _ := response["content"].(map[string]interface{})[mediaType].(map[string]interface{})
+		if content == nil {
+			t.Errorf("%s: content type %q of %s is not documented", test.name, mediaType, path)
+			continue
+		}
+		if mediaType != "application/json" {
+			continue
+		}
+		var body interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for _, problem := range v.validate("response", content["schema"].(map[string]interface{}), body) {
+			t.Errorf("%s: %s", test.name, problem)
+		}
+	}
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if !covered[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is not exercised", strings.ToUpper(method), path)
+			}
+		}
+	}
+	for _, status := range []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		if !statuses[status] {
+			t.Errorf("status %d is not exercised", status)
+		}
+	}
+
+	scope.limiter = NewRateLimiter(0.001, 1)
+	do(http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", alice, "", "", context.Background())
+	rec = do(http.MethodGet, "/events_for_day?user_id=1&date=2023-07-03", alice, "", "", context.Background())
+	response, _ := paths["/events_for_day"].(map[string]interface{})["get"].(map[string]interface{})["responses"].(map[string]interface{})["429"].(map[string]interface{})
+	if rec.Code != http.StatusTooManyRequests || response == nil {
+		t.Errorf("rate limited = %d, documented %v", rec.Code, response != nil)
+	}
+}
+
+// mustHash хеширует пароль с малым числом итераций, чтобы тесты шли быстро
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := hashPassword(password, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}